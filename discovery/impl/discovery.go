@@ -1,9 +1,57 @@
 package discoveryimpl
 
 import (
+	"github.com/ipfs/go-cid"
+
 	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 )
 
-func Multi(r discovery.PeerResolver) discovery.PeerResolver { // TODO: actually support multiple mechanisms
-	return r
+// Multi returns a peer resolver that returns the peers all the given
+// resolvers know of, without duplicates
+func Multi(resolvers ...discovery.PeerResolver) discovery.PeerResolver {
+	if len(resolvers) == 1 {
+		return resolvers[0]
+	}
+	return multi(resolvers)
+}
+
+type multi []discovery.PeerResolver
+
+func (m multi) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	var peers []retrievalmarket.RetrievalPeer
+	for _, resolver := range m {
+		found, err := resolver.GetPeers(payloadCID)
+		if err != nil {
+			return nil, err
+		}
+		for _, peer := range found {
+			if !containsPeer(peers, peer) {
+				peers = append(peers, peer)
+			}
+		}
+	}
+	return peers, nil
+}
+
+func containsPeer(peers []retrievalmarket.RetrievalPeer, peer retrievalmarket.RetrievalPeer) bool {
+	for _, p := range peers {
+		if samePeer(p, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// samePeer compares retrieval peers by the piece CID they point to, rather
+// than by the pointer to it
+func samePeer(a, b retrievalmarket.RetrievalPeer) bool {
+	return a.Address == b.Address && a.ID == b.ID && pieceCIDsEqual(a.PieceCID, b.PieceCID)
+}
+
+func pieceCIDsEqual(a, b *cid.Cid) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equals(*b)
 }
@@ -0,0 +1,338 @@
+package discoveryimpl
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// AnnouncementsTopic is the pubsub topic retrieval providers announce the
+// payloads they can serve on
+const AnnouncementsTopic = "/fil/retrieval/announcements/1.0.0"
+
+// MaxAnnouncementAge is how old a batch of announcements can be before peers
+// stop passing it on, so that old batches cannot be replayed indefinitely
+const MaxAnnouncementAge = 24 * time.Hour
+
+// DefaultAnnouncementTTL is how long a client uses an announced peer for by
+// default. Providers are expected to announce their payloads again before the
+// announcements expire.
+const DefaultAnnouncementTTL = 24 * time.Hour
+
+// MaxAnnouncementsPerMessage is the most announcements an Announcer publishes
+// in one pubsub message
+const MaxAnnouncementsPerMessage = 1000
+
+// SignAnnouncements signs a batch of announcements for a miner with the key of
+// the miner's worker
+type SignAnnouncements func(ctx context.Context, miner address.Address, data []byte) (*crypto.Signature, error)
+
+// VerifyAnnouncements checks a batch of announcements for a miner was signed
+// with the key of the miner's worker
+type VerifyAnnouncements func(ctx context.Context, miner address.Address, signature crypto.Signature, data []byte) (bool, error)
+
+// JoinAnnouncements joins the announcements topic, only passing on batches of
+// announcements that are recent and correctly signed
+func JoinAnnouncements(ps *pubsub.PubSub, verify VerifyAnnouncements) (*pubsub.Topic, error) {
+	err := ps.RegisterTopicValidator(AnnouncementsTopic, func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		var batch discovery.Announcements
+		if err := batch.UnmarshalCBOR(bytes.NewReader(msg.Data)); err != nil {
+			log.Debugf("rejecting announcements from %s: %s", from, err)
+			return false
+		}
+		if time.Since(time.Unix(batch.Time, 0)) > MaxAnnouncementAge {
+			log.Debugf("rejecting announcements from %s for miner %s: too old", from, batch.Miner)
+			return false
+		}
+		// from is the peer that forwarded the message, so the batch is checked
+		// against the peer that signed the message instead
+		if batch.Peer != msg.GetFrom() {
+			log.Debugf("rejecting announcements from %s for miner %s: published by %s rather than %s", from, batch.Miner, msg.GetFrom(), batch.Peer)
+			return false
+		}
+		if batch.Signature == nil {
+			log.Debugf("rejecting announcements from %s for miner %s: not signed", from, batch.Miner)
+			return false
+		}
+		data, err := signingBytes(batch)
+		if err != nil {
+			return false
+		}
+		ok, err := verify(ctx, batch.Miner, *batch.Signature, data)
+		if err != nil || !ok {
+			log.Debugf("rejecting announcements from %s for miner %s: bad signature", from, batch.Miner)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("registering announcements validator: %w", err)
+	}
+	return ps.Join(AnnouncementsTopic)
+}
+
+func signingBytes(batch discovery.Announcements) ([]byte, error) {
+	batch.Signature = nil
+	var buf bytes.Buffer
+	if err := batch.MarshalCBOR(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Announcer publishes the payloads a miner can serve to the announcements
+// topic
+type Announcer struct {
+	topic *pubsub.Topic
+	miner address.Address
+	self  peer.ID
+	sign  SignAnnouncements
+}
+
+// NewAnnouncer returns an announcer for the given miner, that publishes to a
+// topic returned by JoinAnnouncements from the given peer, which is the peer
+// clients are sent to for retrievals
+func NewAnnouncer(topic *pubsub.Topic, miner address.Address, self peer.ID, sign SignAnnouncements) *Announcer {
+	return &Announcer{topic: topic, miner: miner, self: self, sign: sign}
+}
+
+// Announce publishes the announcements, in as many signed batches as needed
+func (a *Announcer) Announce(ctx context.Context, announcements []discovery.Announcement) error {
+	return a.publish(ctx, announcements, false)
+}
+
+// Withdraw publishes that the miner no longer serves the announced payloads,
+// in as many signed batches as needed
+func (a *Announcer) Withdraw(ctx context.Context, announcements []discovery.Announcement) error {
+	return a.publish(ctx, announcements, true)
+}
+
+func (a *Announcer) publish(ctx context.Context, announcements []discovery.Announcement, withdraw bool) error {
+	for len(announcements) > 0 {
+		n := len(announcements)
+		if n > MaxAnnouncementsPerMessage {
+			n = MaxAnnouncementsPerMessage
+		}
+		batch := discovery.Announcements{
+			Miner:         a.miner,
+			Peer:          a.self,
+			Time:          time.Now().Unix(),
+			Announcements: announcements[:n],
+			Withdraw:      withdraw,
+		}
+		data, err := signingBytes(batch)
+		if err != nil {
+			return xerrors.Errorf("encoding announcements: %w", err)
+		}
+		batch.Signature, err = a.sign(ctx, a.miner, data)
+		if err != nil {
+			return xerrors.Errorf("signing announcements: %w", err)
+		}
+		var buf bytes.Buffer
+		if err := batch.MarshalCBOR(&buf); err != nil {
+			return xerrors.Errorf("encoding announcements: %w", err)
+		}
+		if err := a.topic.Publish(ctx, buf.Bytes()); err != nil {
+			return xerrors.Errorf("publishing announcements: %w", err)
+		}
+		announcements = announcements[n:]
+	}
+	return nil
+}
+
+// GossipOption configures a Gossip resolver
+type GossipOption func(*Gossip)
+
+// AnnouncementTTL sets how long an announced peer is used for
+func AnnouncementTTL(ttl time.Duration) GossipOption {
+	return func(g *Gossip) {
+		g.ttl = ttl
+	}
+}
+
+// GossipClock sets the function the resolver uses to get the current time
+func GossipClock(now func() time.Time) GossipOption {
+	return func(g *Gossip) {
+		g.now = now
+	}
+}
+
+// Gossip is a peer resolver that learns which peers can serve a payload from
+// the announcements providers publish over pubsub. Each announced peer is kept
+// until its announcement expires or is withdrawn.
+type Gossip struct {
+	topic *pubsub.Topic
+	ds    datastore.Batching
+	ttl   time.Duration
+	now   func() time.Time
+
+	sub    *pubsub.Subscription
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewGossip returns a resolver that reads announcements from a topic returned
+// by JoinAnnouncements, and stores announced peers in the given datastore
+func NewGossip(topic *pubsub.Topic, ds datastore.Batching, options ...GossipOption) *Gossip {
+	g := &Gossip{
+		topic: topic,
+		ds:    ds,
+		ttl:   DefaultAnnouncementTTL,
+		now:   time.Now,
+	}
+	for _, option := range options {
+		option(g)
+	}
+	return g
+}
+
+// Start subscribes to announcements
+func (g *Gossip) Start(ctx context.Context) error {
+	sub, err := g.topic.Subscribe()
+	if err != nil {
+		return xerrors.Errorf("subscribing to announcements: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	g.sub = sub
+	g.cancel = cancel
+	g.done = make(chan struct{})
+	go func() {
+		defer close(g.done)
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+			if err := g.record(msg); err != nil {
+				log.Errorf("recording announcements from %s: %s", msg.GetFrom(), err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop unsubscribes from announcements
+func (g *Gossip) Stop() {
+	if g.sub == nil {
+		return
+	}
+	g.sub.Cancel()
+	g.cancel()
+	<-g.done
+	g.sub = nil
+}
+
+func (g *Gossip) record(msg *pubsub.Message) error {
+	var batch discovery.Announcements
+	if err := batch.UnmarshalCBOR(bytes.NewReader(msg.Data)); err != nil {
+		return err
+	}
+	now := g.now()
+	announced := time.Unix(batch.Time, 0)
+	if announced.After(now) {
+		announced = now
+	}
+	expiry := announced.Add(g.ttl).Unix()
+
+	b, err := g.ds.Batch()
+	if err != nil {
+		return err
+	}
+	if batch.Withdraw {
+		for _, announcement := range batch.Announcements {
+			if err := g.withdraw(b, announcedPeerKey(announcement.PayloadCID, batch.Miner, announcement.PieceCID), expiry); err != nil {
+				return err
+			}
+		}
+		return b.Commit()
+	}
+	for _, announcement := range batch.Announcements {
+		pieceCID := announcement.PieceCID
+		ap := discovery.AnnouncedPeer{
+			Peer: retrievalmarket.RetrievalPeer{
+				Address:  batch.Miner,
+				ID:       batch.Peer,
+				PieceCID: &pieceCID,
+			},
+			Expiry: expiry,
+		}
+		var buf bytes.Buffer
+		if err := ap.MarshalCBOR(&buf); err != nil {
+			return err
+		}
+		if err := b.Put(announcedPeerKey(announcement.PayloadCID, batch.Miner, pieceCID), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+// withdraw deletes an announced peer, unless it was announced again after the
+// withdrawal was published
+func (g *Gossip) withdraw(b datastore.Batch, key datastore.Key, expiry int64) error {
+	data, err := g.ds.Get(key)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var ap discovery.AnnouncedPeer
+	if err := ap.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if ap.Expiry > expiry {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+func announcedPeerKey(payloadCID cid.Cid, miner address.Address, pieceCID cid.Cid) datastore.Key {
+	return dshelp.MultihashToDsKey(payloadCID.Hash()).ChildString(miner.String()).ChildString(pieceCID.String())
+}
+
+// GetPeers returns the peers announced for the payload whose announcements
+// have not expired
+func (g *Gossip) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	results, err := g.ds.Query(query.Query{Prefix: dshelp.MultihashToDsKey(payloadCID.Hash()).String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	now := g.now().Unix()
+	peers := []retrievalmarket.RetrievalPeer{}
+	for _, entry := range entries {
+		var ap discovery.AnnouncedPeer
+		if err := ap.UnmarshalCBOR(bytes.NewReader(entry.Value)); err != nil {
+			return nil, err
+		}
+		if ap.Expiry < now {
+			if err := g.ds.Delete(datastore.NewKey(entry.Key)); err != nil {
+				log.Warnf("deleting expired announcement %s: %s", entry.Key, err)
+			}
+			continue
+		}
+		peers = append(peers, ap.Peer)
+	}
+	return peers, nil
+}
+
+var _ discovery.PeerResolver = &Gossip{}
@@ -0,0 +1,144 @@
+package discoveryimpl_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/host"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+	specst "github.com/filecoin-project/specs-actors/support/testing"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	discoveryimpl "github.com/filecoin-project/go-fil-markets/discovery/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+// fakeSignature stands in for a signature by the miner's worker key
+func fakeSignature(miner address.Address, data []byte) crypto.Signature {
+	sum := sha256.Sum256(append(miner.Bytes(), data...))
+	return crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: sum[:]}
+}
+
+func sign(ctx context.Context, miner address.Address, data []byte) (*crypto.Signature, error) {
+	sig := fakeSignature(miner, data)
+	return &sig, nil
+}
+
+func verify(ctx context.Context, miner address.Address, signature crypto.Signature, data []byte) (bool, error) {
+	return bytes.Equal(fakeSignature(miner, data).Data, signature.Data), nil
+}
+
+func TestGossip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	joinTopic := func() (host.Host, *pubsub.Topic) {
+		h, err := mn.GenPeer()
+		require.NoError(t, err)
+		ps, err := pubsub.NewGossipSub(ctx, h)
+		require.NoError(t, err)
+		topic, err := discoveryimpl.JoinAnnouncements(ps, verify)
+		require.NoError(t, err)
+		return h, topic
+	}
+	providerHost, providerTopic := joinTopic()
+	_, clientTopic := joinTopic()
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	gossip := discoveryimpl.NewGossip(clientTopic, dss.MutexWrap(datastore.NewMapDatastore()), discoveryimpl.AnnouncementTTL(time.Hour), discoveryimpl.GossipClock(clock))
+	require.NoError(t, gossip.Start(ctx))
+	defer gossip.Stop()
+
+	// wait for the peers to see each other on the topic
+	require.Eventually(t, func() bool {
+		return len(providerTopic.ListPeers()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	miner := specst.NewIDAddr(t, 100)
+	payloadCIDs := shared_testutil.GenerateCids(discoveryimpl.MaxAnnouncementsPerMessage + 1)
+	pieceCID := shared_testutil.GenerateCids(1)[0]
+	announcements := make([]discovery.Announcement, 0, len(payloadCIDs))
+	for _, payloadCID := range payloadCIDs {
+		announcements = append(announcements, discovery.Announcement{PayloadCID: payloadCID, PieceCID: pieceCID})
+	}
+
+	// an announcement that is not signed by the miner is dropped
+	forgedCID := shared_testutil.GenerateCids(1)[0]
+	forger := discoveryimpl.NewAnnouncer(providerTopic, miner, providerHost.ID(), func(ctx context.Context, _ address.Address, data []byte) (*crypto.Signature, error) {
+		return sign(ctx, specst.NewIDAddr(t, 101), data)
+	})
+	require.NoError(t, forger.Announce(ctx, []discovery.Announcement{{PayloadCID: forgedCID, PieceCID: pieceCID}}))
+
+	// a correctly signed batch republished by another peer is dropped, so it
+	// cannot send clients to that peer
+	republishedCID := shared_testutil.GenerateCids(1)[0]
+	batch := discovery.Announcements{
+		Miner:         miner,
+		Peer:          providerHost.ID(),
+		Time:          now.Unix(),
+		Announcements: []discovery.Announcement{{PayloadCID: republishedCID, PieceCID: pieceCID}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, batch.MarshalCBOR(&buf))
+	var err error
+	batch.Signature, err = sign(ctx, miner, buf.Bytes())
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, batch.MarshalCBOR(&buf))
+	require.NoError(t, clientTopic.Publish(ctx, buf.Bytes()))
+
+	// announcements are published in batches, and all of them reach the client
+	announcer := discoveryimpl.NewAnnouncer(providerTopic, miner, providerHost.ID(), sign)
+	require.NoError(t, announcer.Announce(ctx, announcements))
+	expected := []retrievalmarket.RetrievalPeer{{Address: miner, ID: providerHost.ID(), PieceCID: &pieceCID}}
+	require.Eventually(t, func() bool {
+		first, err := gossip.GetPeers(payloadCIDs[0])
+		if err != nil {
+			return false
+		}
+		last, err := gossip.GetPeers(payloadCIDs[len(payloadCIDs)-1])
+		return err == nil && len(first) == 1 && len(last) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, payloadCID := range payloadCIDs {
+		peers, err := gossip.GetPeers(payloadCID)
+		require.NoError(t, err)
+		require.Equal(t, expected, peers)
+	}
+	peers, err := gossip.GetPeers(forgedCID)
+	require.NoError(t, err)
+	require.Empty(t, peers)
+	peers, err = gossip.GetPeers(republishedCID)
+	require.NoError(t, err)
+	require.Empty(t, peers)
+
+	// withdrawn announcements are removed, leaving the others
+	require.NoError(t, announcer.Withdraw(ctx, announcements[:1]))
+	require.Eventually(t, func() bool {
+		peers, err := gossip.GetPeers(payloadCIDs[0])
+		return err == nil && len(peers) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	peers, err = gossip.GetPeers(payloadCIDs[1])
+	require.NoError(t, err)
+	require.Equal(t, expected, peers)
+
+	// announced peers expire after the TTL
+	now = now.Add(2 * time.Hour)
+	peers, err = gossip.GetPeers(payloadCIDs[1])
+	require.NoError(t, err)
+	require.Empty(t, peers)
+}
@@ -3,16 +3,22 @@ package discoveryimpl
 import (
 	"bytes"
 	"context"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dshelp "github.com/ipfs/go-ipfs-ds-help"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
 
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	versionedds "github.com/filecoin-project/go-ds-versioning/pkg/datastore"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 
 	"github.com/filecoin-project/go-fil-markets/discovery"
 	"github.com/filecoin-project/go-fil-markets/discovery/migrations"
@@ -22,20 +28,41 @@ import (
 
 var log = logging.Logger("retrieval-discovery")
 
+// EpochFunc returns the current chain epoch
+type EpochFunc func(ctx context.Context) (abi.ChainEpoch, error)
+
+// LocalOption configures a Local peer store
+type LocalOption func(*Local)
+
+// CurrentEpoch lets the store tell when the storage deal behind a peer has
+// ended, so that it stops returning the peer. Without it, peers never expire.
+func CurrentEpoch(epoch EpochFunc) LocalOption {
+	return func(l *Local) {
+		l.epoch = epoch
+	}
+}
+
 type Local struct {
 	ds        datastore.Datastore
 	migrateDs func(context.Context) error
 	readySub  *pubsub.PubSub
+	epoch     EpochFunc
+
+	lk sync.Mutex
 }
 
-func NewLocal(ds datastore.Batching) (*Local, error) {
+func NewLocal(ds datastore.Batching, options ...LocalOption) (*Local, error) {
 	migrations, err := migrations.RetrievalPeersMigrations.Build()
 	if err != nil {
 		return nil, err
 	}
-	versionedDs, migrateDs := versionedds.NewVersionedDatastore(ds, migrations, versioning.VersionKey("1"))
+	versionedDs, migrateDs := versionedds.NewVersionedDatastore(ds, migrations, versioning.VersionKey("2"))
 	readySub := pubsub.New(shared.ReadyDispatcher)
-	return &Local{versionedDs, migrateDs, readySub}, nil
+	l := &Local{ds: versionedDs, migrateDs: migrateDs, readySub: readySub}
+	for _, option := range options {
+		option(l)
+	}
+	return l, nil
 }
 
 func (l *Local) Start(ctx context.Context) error {
@@ -57,65 +84,226 @@ func (l *Local) OnReady(ready shared.ReadyFunc) {
 	l.readySub.Subscribe(ready)
 }
 
+// AddPeer adds a peer that can serve the payload, which never expires
 func (l *Local) AddPeer(cid cid.Cid, peer retrievalmarket.RetrievalPeer) error {
+	return l.AddPeerWithExpiry(cid, peer, 0)
+}
+
+// AddPeerWithExpiry adds a peer that can serve the payload until the given
+// epoch, when the storage deal that placed the payload with it ends. Adding a
+// peer that is already known extends its expiry.
+func (l *Local) AddPeerWithExpiry(cid cid.Cid, peer retrievalmarket.RetrievalPeer, expiry abi.ChainEpoch) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
 	key := dshelp.MultihashToDsKey(cid.Hash())
-	exists, err := l.ds.Has(key)
+	records, err := l.getRecords(key)
 	if err != nil {
 		return err
 	}
+	for i, record := range records.Peers {
+		if !samePeer(record.Peer, peer) {
+			continue
+		}
+		// a peer with no expiry never expires
+		if record.Expiry == 0 || (expiry != 0 && expiry <= record.Expiry) {
+			return nil
+		}
+		records.Peers[i].Expiry = expiry
+		return l.putRecords(key, records)
+	}
+	records.Peers = append(records.Peers, discovery.PeerRecord{
+		Peer:             peer,
+		Expiry:           expiry,
+		LastPricePerByte: big.Zero(),
+	})
+	return l.putRecords(key, records)
+}
 
-	var newRecord bytes.Buffer
+// RemovePeer removes a peer for the payload
+func (l *Local) RemovePeer(cid cid.Cid, peer retrievalmarket.RetrievalPeer) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
 
-	if !exists {
-		peers := discovery.RetrievalPeers{Peers: []retrievalmarket.RetrievalPeer{peer}}
-		err = cborutil.WriteCborRPC(&newRecord, &peers)
-		if err != nil {
-			return err
+	key := dshelp.MultihashToDsKey(cid.Hash())
+	records, err := l.getRecords(key)
+	if err != nil {
+		return err
+	}
+	kept := records.Peers[:0]
+	for _, record := range records.Peers {
+		if !samePeer(record.Peer, peer) {
+			kept = append(kept, record)
 		}
-	} else {
-		entry, err := l.ds.Get(key)
+	}
+	if len(kept) == len(records.Peers) {
+		return nil
+	}
+	records.Peers = kept
+	return l.putRecords(key, records)
+}
+
+func (l *Local) getRecords(key datastore.Key) (discovery.PeerRecords, error) {
+	entry, err := l.ds.Get(key)
+	if err == datastore.ErrNotFound {
+		return discovery.PeerRecords{}, nil
+	}
+	if err != nil {
+		return discovery.PeerRecords{}, err
+	}
+	var records discovery.PeerRecords
+	if err := cborutil.ReadCborRPC(bytes.NewReader(entry), &records); err != nil {
+		return discovery.PeerRecords{}, err
+	}
+	return records, nil
+}
+
+func (l *Local) putRecords(key datastore.Key, records discovery.PeerRecords) error {
+	if len(records.Peers) == 0 {
+		return l.ds.Delete(key)
+	}
+	var newRecord bytes.Buffer
+	if err := cborutil.WriteCborRPC(&newRecord, &records); err != nil {
+		return err
+	}
+	return l.ds.Put(key, newRecord.Bytes())
+}
+
+// GetPeerRecords returns the peers that can serve the payload, with what the
+// client has learned from retrieving from them, best first. Peers whose
+// storage deal has ended are removed.
+func (l *Local) GetPeerRecords(payloadCID cid.Cid) ([]discovery.PeerRecord, error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	key := dshelp.MultihashToDsKey(payloadCID.Hash())
+	records, err := l.getRecords(key)
+	if err != nil {
+		return nil, err
+	}
+	if l.epoch != nil && len(records.Peers) > 0 {
+		epoch, err := l.epoch(context.TODO())
 		if err != nil {
-			return err
+			return nil, err
 		}
-		var peers discovery.RetrievalPeers
-		if err = cborutil.ReadCborRPC(bytes.NewReader(entry), &peers); err != nil {
-			return err
+		current := records.Peers[:0]
+		for _, record := range records.Peers {
+			if record.Expiry == 0 || record.Expiry > epoch {
+				current = append(current, record)
+			}
 		}
-		if hasPeer(peers, peer) {
-			return nil
-		}
-		peers.Peers = append(peers.Peers, peer)
-		err = cborutil.WriteCborRPC(&newRecord, &peers)
-		if err != nil {
-			return err
+		if len(current) < len(records.Peers) {
+			records.Peers = current
+			if err := l.putRecords(key, records); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return l.ds.Put(key, newRecord.Bytes())
+	peers := append([]discovery.PeerRecord{}, records.Peers...)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return betterPeer(peers[i], peers[j])
+	})
+	return peers, nil
 }
 
-func hasPeer(peerList discovery.RetrievalPeers, peer retrievalmarket.RetrievalPeer) bool {
-	for _, p := range peerList.Peers {
-		if p == peer {
-			return true
+// betterPeer orders peers whose last retrieval succeeded first, most recent
+// success first, then peers the client has not retrieved from, then peers
+// whose last retrieval failed, least recent failure first. Peers that are
+// otherwise equal are ordered by the last price they agreed to.
+func betterPeer(a, b discovery.PeerRecord) bool {
+	ra, rb := peerRank(a), peerRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	switch ra {
+	case 0:
+		if a.LastSuccess != b.LastSuccess {
+			return a.LastSuccess > b.LastSuccess
+		}
+	case 2:
+		if a.LastFailure != b.LastFailure {
+			return a.LastFailure < b.LastFailure
 		}
 	}
-	return false
+	return a.LastPricePerByte.LessThan(b.LastPricePerByte)
 }
 
-func (l *Local) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
-	entry, err := l.ds.Get(dshelp.MultihashToDsKey(payloadCID.Hash()))
-	if err == datastore.ErrNotFound {
-		return []retrievalmarket.RetrievalPeer{}, nil
+func peerRank(record discovery.PeerRecord) int {
+	switch {
+	case record.LastSuccess == 0 && record.LastFailure == 0:
+		return 1
+	case record.LastSuccess >= record.LastFailure:
+		return 0
+	default:
+		return 2
 	}
+}
+
+// GetPeers returns the peers that can serve the payload, best first
+func (l *Local) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	records, err := l.GetPeerRecords(payloadCID)
 	if err != nil {
 		return nil, err
 	}
-	var peers discovery.RetrievalPeers
-	if err := cborutil.ReadCborRPC(bytes.NewReader(entry), &peers); err != nil {
-		return nil, err
+	peers := make([]retrievalmarket.RetrievalPeer, 0, len(records))
+	for _, record := range records {
+		peers = append(peers, record.Peer)
+	}
+	return peers, nil
+}
+
+// TrackRetrievals records the outcome and price of the client's retrievals
+// against the peers they were made from
+func (l *Local) TrackRetrievals(client retrievalmarket.RetrievalClient) retrievalmarket.Unsubscribe {
+	return client.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+		var update func(*discovery.PeerRecord)
+		now := time.Now().Unix()
+		switch {
+		case event == retrievalmarket.ClientEventDealAccepted && !state.PricePerByte.Nil():
+			update = func(record *discovery.PeerRecord) {
+				record.LastPricePerByte = state.PricePerByte
+			}
+		case state.Status == retrievalmarket.DealStatusCompleted:
+			update = func(record *discovery.PeerRecord) {
+				record.LastSuccess = now
+			}
+		case state.Status == retrievalmarket.DealStatusErrored ||
+			state.Status == retrievalmarket.DealStatusRejected ||
+			state.Status == retrievalmarket.DealStatusDealNotFound:
+			update = func(record *discovery.PeerRecord) {
+				record.LastFailure = now
+				record.LastFailureReason = state.Message
+			}
+		default:
+			return
+		}
+		if err := l.updateRecords(state.PayloadCID, state.Sender, update); err != nil {
+			log.Errorf("recording retrieval of %s from %s: %s", state.PayloadCID, state.Sender, err)
+		}
+	})
+}
+
+func (l *Local) updateRecords(payloadCID cid.Cid, sender peer.ID, update func(*discovery.PeerRecord)) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	key := dshelp.MultihashToDsKey(payloadCID.Hash())
+	records, err := l.getRecords(key)
+	if err != nil {
+		return err
+	}
+	updated := false
+	for i := range records.Peers {
+		if records.Peers[i].Peer.ID == sender {
+			update(&records.Peers[i])
+			updated = true
+		}
+	}
+	if !updated {
+		return nil
 	}
-	return peers.Peers, nil
+	return l.putRecords(key, records)
 }
 
 var _ discovery.PeerResolver = &Local{}
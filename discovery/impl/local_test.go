@@ -13,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
 	specst "github.com/filecoin-project/specs-actors/support/testing"
 
 	discoveryimpl "github.com/filecoin-project/go-fil-markets/discovery/impl"
@@ -125,3 +126,108 @@ func TestLocalMigrations(t *testing.T) {
 		require.Equal(t, expectedPeers, peers)
 	}
 }
+
+func TestLocal_RemovePeerAndExpiry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	epoch := abi.ChainEpoch(100)
+	l, err := discoveryimpl.NewLocal(datastore.NewMapDatastore(), discoveryimpl.CurrentEpoch(func(context.Context) (abi.ChainEpoch, error) {
+		return epoch, nil
+	}))
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, l)
+
+	pieceCids := shared_testutil.GenerateCids(3)
+	peerIDs := shared_testutil.GeneratePeers(3)
+	peers := make([]retrievalmarket.RetrievalPeer, 0, 3)
+	for i := range pieceCids {
+		peers = append(peers, retrievalmarket.RetrievalPeer{Address: specst.NewIDAddr(t, uint64(i)), ID: peerIDs[i], PieceCID: &pieceCids[i]})
+	}
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	require.NoError(t, l.AddPeerWithExpiry(payloadCID, peers[0], 150))
+	require.NoError(t, l.AddPeerWithExpiry(payloadCID, peers[1], 200))
+	require.NoError(t, l.AddPeer(payloadCID, peers[2]))
+
+	// a peer is the same peer when its piece CID is, wherever it is stored
+	pieceCid := pieceCids[0]
+	samePeer := peers[0]
+	samePeer.PieceCID = &pieceCid
+	require.NoError(t, l.AddPeerWithExpiry(payloadCID, samePeer, 120))
+	actualPeers, err := l.GetPeers(payloadCID)
+	require.NoError(t, err)
+	require.Equal(t, peers, actualPeers)
+
+	// peers are dropped once their storage deal ends
+	epoch = 160
+	actualPeers, err = l.GetPeers(payloadCID)
+	require.NoError(t, err)
+	require.Equal(t, peers[1:], actualPeers)
+
+	require.NoError(t, l.RemovePeer(payloadCID, peers[2]))
+	actualPeers, err = l.GetPeers(payloadCID)
+	require.NoError(t, err)
+	require.Equal(t, peers[1:2], actualPeers)
+
+	epoch = 300
+	actualPeers, err = l.GetPeers(payloadCID)
+	require.NoError(t, err)
+	require.Empty(t, actualPeers)
+}
+
+type fakeRetrievalClient struct {
+	retrievalmarket.RetrievalClient
+	subscriber retrievalmarket.ClientSubscriber
+}
+
+func (c *fakeRetrievalClient) SubscribeToEvents(subscriber retrievalmarket.ClientSubscriber) retrievalmarket.Unsubscribe {
+	c.subscriber = subscriber
+	return func() {}
+}
+
+func TestLocal_TrackRetrievals(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := discoveryimpl.NewLocal(datastore.NewMapDatastore())
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, l)
+	client := &fakeRetrievalClient{}
+	l.TrackRetrievals(client)
+
+	pieceCid := shared_testutil.GenerateCids(1)[0]
+	peerIDs := shared_testutil.GeneratePeers(3)
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	for i, id := range peerIDs {
+		require.NoError(t, l.AddPeer(payloadCID, retrievalmarket.RetrievalPeer{Address: specst.NewIDAddr(t, uint64(i)), ID: id, PieceCID: &pieceCid}))
+	}
+
+	deal := func(sender peer.ID, status retrievalmarket.DealStatus) retrievalmarket.ClientDealState {
+		return retrievalmarket.ClientDealState{
+			DealProposal: retrievalmarket.DealProposal{
+				PayloadCID: payloadCID,
+				Params:     retrievalmarket.Params{PricePerByte: abi.NewTokenAmount(2)},
+			},
+			Sender:  sender,
+			Status:  status,
+			Message: "something went wrong",
+		}
+	}
+	// the first peer fails, and the last succeeds
+	client.subscriber(retrievalmarket.ClientEventDealAccepted, deal(peerIDs[0], retrievalmarket.DealStatusAccepted))
+	client.subscriber(retrievalmarket.ClientEventProviderCancelled, deal(peerIDs[0], retrievalmarket.DealStatusErrored))
+	client.subscriber(retrievalmarket.ClientEventDealAccepted, deal(peerIDs[2], retrievalmarket.DealStatusAccepted))
+	client.subscriber(retrievalmarket.ClientEventCompleteVerified, deal(peerIDs[2], retrievalmarket.DealStatusCompleted))
+
+	records, err := l.GetPeerRecords(payloadCID)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, peerIDs[2], records[0].Peer.ID)
+	require.NotZero(t, records[0].LastSuccess)
+	require.Equal(t, abi.NewTokenAmount(2), records[0].LastPricePerByte)
+	require.Equal(t, peerIDs[1], records[1].Peer.ID)
+	require.Zero(t, records[1].LastSuccess)
+	require.Equal(t, peerIDs[0], records[2].Peer.ID)
+	require.NotZero(t, records[2].LastFailure)
+	require.Equal(t, "something went wrong", records[2].LastFailureReason)
+}
@@ -3,6 +3,7 @@ package migrations
 import (
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+	"github.com/filecoin-project/go-state-types/big"
 
 	"github.com/filecoin-project/go-fil-markets/discovery"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -31,7 +32,23 @@ func MigrateRetrievalPeers0To1(oldRps *RetrievalPeers0) (*discovery.RetrievalPee
 	}, nil
 }
 
+// MigrateRetrievalPeers1To2 migrates a list of retrieval peers to a list of
+// peer records, which have no expiry or retrieval history yet
+func MigrateRetrievalPeers1To2(oldRps *discovery.RetrievalPeers) (*discovery.PeerRecords, error) {
+	records := make([]discovery.PeerRecord, 0, len(oldRps.Peers))
+	for _, peer := range oldRps.Peers {
+		records = append(records, discovery.PeerRecord{
+			Peer:             peer,
+			LastPricePerByte: big.Zero(),
+		})
+	}
+	return &discovery.PeerRecords{
+		Peers: records,
+	}, nil
+}
+
 // RetrievalPeersMigrations are migrations for the store local discovery list of peers we can retrieve from
 var RetrievalPeersMigrations = versioned.BuilderList{
 	versioned.NewVersionedBuilder(MigrateRetrievalPeers0To1, versioning.VersionKey("1")),
+	versioned.NewVersionedBuilder(MigrateRetrievalPeers1To2, versioning.VersionKey("2")).OldVersion("1"),
 }
@@ -2,18 +2,79 @@ package discovery
 
 import (
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 )
 
-//go:generate cbor-gen-for --map-encoding RetrievalPeers
+//go:generate cbor-gen-for --map-encoding RetrievalPeers PeerRecord PeerRecords Announcement Announcements AnnouncedPeer
 
 // RetrievalPeers is a convenience struct for encoding slices of RetrievalPeer
 type RetrievalPeers struct {
 	Peers []retrievalmarket.RetrievalPeer
 }
 
+// PeerRecord is a peer the local store knows can serve a payload, with what
+// the client has learned from retrieving from it
+type PeerRecord struct {
+	Peer retrievalmarket.RetrievalPeer
+	// Expiry is the epoch at which the storage deal that placed the payload
+	// with the peer ends, or zero if it is not known
+	Expiry abi.ChainEpoch
+	// LastSuccess is the Unix time in seconds at which a retrieval from the
+	// peer last completed, or zero if none has
+	LastSuccess int64
+	// LastFailure is the Unix time in seconds at which a retrieval from the
+	// peer last failed, or zero if none has, and LastFailureReason says why
+	LastFailure       int64
+	LastFailureReason string
+	// LastPricePerByte is the price per byte the peer last agreed to retrieve
+	// the payload for, or zero if the client has not retrieved from it
+	LastPricePerByte abi.TokenAmount
+}
+
+// PeerRecords is the list of peers the local store knows can serve a payload
+type PeerRecords struct {
+	Peers []PeerRecord
+}
+
 // PeerResolver is an interface for looking up providers that may have a piece
 type PeerResolver interface {
 	GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) // TODO: channel
 }
+
+// Announcement is a provider's claim that it can serve a payload from a piece
+type Announcement struct {
+	PayloadCID cid.Cid
+	PieceCID   cid.Cid
+}
+
+// Announcements is a batch of announcements a provider publishes for a
+// miner, signed by the miner's worker key
+type Announcements struct {
+	Miner address.Address
+	// Peer is the libp2p peer that serves retrievals for the miner. It is
+	// signed with the rest of the batch, so that a batch republished by
+	// another peer cannot redirect clients to it.
+	Peer peer.ID
+	// Time is the Unix time in seconds at which the batch was published
+	Time          int64
+	Announcements []Announcement
+	// Withdraw is set when the provider no longer serves the payloads, so
+	// peers should stop using it for them
+	Withdraw bool
+	// Signature is over the batch with no signature set
+	Signature *crypto.Signature
+}
+
+// AnnouncedPeer is a retrieval peer learned from an announcement, which is
+// only used until it expires
+type AnnouncedPeer struct {
+	Peer retrievalmarket.RetrievalPeer
+	// Expiry is the Unix time in seconds after which the peer is not used
+	Expiry int64
+}
@@ -8,7 +8,10 @@ import (
 	"sort"
 
 	retrievalmarket "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	abi "github.com/filecoin-project/go-state-types/abi"
+	crypto "github.com/filecoin-project/go-state-types/crypto"
 	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 	cbg "github.com/whyrusleeping/cbor-gen"
 	xerrors "golang.org/x/xerrors"
 )
@@ -126,3 +129,930 @@ func (t *RetrievalPeers) UnmarshalCBOR(r io.Reader) error {
 
 	return nil
 }
+func (t *PeerRecord) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{166}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Peer (retrievalmarket.RetrievalPeer) (struct)
+	if len("Peer") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Peer\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Peer"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Peer")); err != nil {
+		return err
+	}
+
+	if err := t.Peer.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Expiry (abi.ChainEpoch) (int64)
+	if len("Expiry") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Expiry\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Expiry"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Expiry")); err != nil {
+		return err
+	}
+
+	if t.Expiry >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Expiry)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Expiry-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.LastSuccess (int64) (int64)
+	if len("LastSuccess") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"LastSuccess\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("LastSuccess"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("LastSuccess")); err != nil {
+		return err
+	}
+
+	if t.LastSuccess >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.LastSuccess)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.LastSuccess-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.LastFailure (int64) (int64)
+	if len("LastFailure") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"LastFailure\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("LastFailure"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("LastFailure")); err != nil {
+		return err
+	}
+
+	if t.LastFailure >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.LastFailure)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.LastFailure-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.LastFailureReason (string) (string)
+	if len("LastFailureReason") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"LastFailureReason\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("LastFailureReason"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("LastFailureReason")); err != nil {
+		return err
+	}
+
+	if len(t.LastFailureReason) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.LastFailureReason was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.LastFailureReason))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.LastFailureReason)); err != nil {
+		return err
+	}
+
+	// t.LastPricePerByte (big.Int) (struct)
+	if len("LastPricePerByte") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"LastPricePerByte\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("LastPricePerByte"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("LastPricePerByte")); err != nil {
+		return err
+	}
+
+	if err := t.LastPricePerByte.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *PeerRecord) UnmarshalCBOR(r io.Reader) error {
+	*t = PeerRecord{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("PeerRecord: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Peer (retrievalmarket.RetrievalPeer) (struct)
+		case "Peer":
+
+			{
+
+				if err := t.Peer.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.Peer: %w", err)
+				}
+
+			}
+			// t.Expiry (abi.ChainEpoch) (int64)
+		case "Expiry":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.Expiry = abi.ChainEpoch(extraI)
+			}
+			// t.LastSuccess (int64) (int64)
+		case "LastSuccess":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.LastSuccess = int64(extraI)
+			}
+			// t.LastFailure (int64) (int64)
+		case "LastFailure":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.LastFailure = int64(extraI)
+			}
+			// t.LastFailureReason (string) (string)
+		case "LastFailureReason":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.LastFailureReason = string(sval)
+			}
+			// t.LastPricePerByte (big.Int) (struct)
+		case "LastPricePerByte":
+
+			{
+
+				if err := t.LastPricePerByte.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.LastPricePerByte: %w", err)
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *PeerRecords) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{161}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Peers ([]discovery.PeerRecord) (slice)
+	if len("Peers") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Peers\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Peers"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Peers")); err != nil {
+		return err
+	}
+
+	if len(t.Peers) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Peers was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, uint64(len(t.Peers))); err != nil {
+		return err
+	}
+	for _, v := range t.Peers {
+		if err := v.MarshalCBOR(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *PeerRecords) UnmarshalCBOR(r io.Reader) error {
+	*t = PeerRecords{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("PeerRecords: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Peers ([]discovery.PeerRecord) (slice)
+		case "Peers":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.Peers: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.Peers = make([]PeerRecord, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				var v PeerRecord
+				if err := v.UnmarshalCBOR(br); err != nil {
+					return err
+				}
+
+				t.Peers[i] = v
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *Announcement) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{162}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.PayloadCID (cid.Cid) (struct)
+	if len("PayloadCID") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"PayloadCID\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("PayloadCID"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("PayloadCID")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteCidBuf(scratch, w, t.PayloadCID); err != nil {
+		return xerrors.Errorf("failed to write cid field t.PayloadCID: %w", err)
+	}
+
+	// t.PieceCID (cid.Cid) (struct)
+	if len("PieceCID") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"PieceCID\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("PieceCID"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("PieceCID")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteCidBuf(scratch, w, t.PieceCID); err != nil {
+		return xerrors.Errorf("failed to write cid field t.PieceCID: %w", err)
+	}
+
+	return nil
+}
+
+func (t *Announcement) UnmarshalCBOR(r io.Reader) error {
+	*t = Announcement{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("Announcement: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.PayloadCID (cid.Cid) (struct)
+		case "PayloadCID":
+
+			{
+
+				c, err := cbg.ReadCid(br)
+				if err != nil {
+					return xerrors.Errorf("failed to read cid field t.PayloadCID: %w", err)
+				}
+
+				t.PayloadCID = c
+
+			}
+			// t.PieceCID (cid.Cid) (struct)
+		case "PieceCID":
+
+			{
+
+				c, err := cbg.ReadCid(br)
+				if err != nil {
+					return xerrors.Errorf("failed to read cid field t.PieceCID: %w", err)
+				}
+
+				t.PieceCID = c
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *Announcements) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{166}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Miner (address.Address) (struct)
+	if len("Miner") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Miner\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Miner"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Miner")); err != nil {
+		return err
+	}
+
+	if err := t.Miner.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Peer (peer.ID) (string)
+	if len("Peer") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Peer\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Peer"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Peer")); err != nil {
+		return err
+	}
+
+	if len(t.Peer) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Peer was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Peer))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Peer)); err != nil {
+		return err
+	}
+
+	// t.Time (int64) (int64)
+	if len("Time") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Time\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Time"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Time")); err != nil {
+		return err
+	}
+
+	if t.Time >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Time)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Time-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.Announcements ([]discovery.Announcement) (slice)
+	if len("Announcements") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Announcements\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Announcements"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Announcements")); err != nil {
+		return err
+	}
+
+	if len(t.Announcements) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Announcements was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, uint64(len(t.Announcements))); err != nil {
+		return err
+	}
+	for _, v := range t.Announcements {
+		if err := v.MarshalCBOR(w); err != nil {
+			return err
+		}
+	}
+
+	// t.Withdraw (bool) (bool)
+	if len("Withdraw") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Withdraw\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Withdraw"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Withdraw")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.Withdraw); err != nil {
+		return err
+	}
+
+	// t.Signature (crypto.Signature) (struct)
+	if len("Signature") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Signature\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Signature"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Signature")); err != nil {
+		return err
+	}
+
+	if err := t.Signature.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *Announcements) UnmarshalCBOR(r io.Reader) error {
+	*t = Announcements{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("Announcements: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Miner (address.Address) (struct)
+		case "Miner":
+
+			{
+
+				if err := t.Miner.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.Miner: %w", err)
+				}
+
+			}
+			// t.Peer (peer.ID) (string)
+		case "Peer":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.Peer = peer.ID(sval)
+			}
+			// t.Time (int64) (int64)
+		case "Time":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.Time = int64(extraI)
+			}
+			// t.Announcements ([]discovery.Announcement) (slice)
+		case "Announcements":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.Announcements: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.Announcements = make([]Announcement, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				var v Announcement
+				if err := v.UnmarshalCBOR(br); err != nil {
+					return err
+				}
+
+				t.Announcements[i] = v
+			}
+			// t.Withdraw (bool) (bool)
+		case "Withdraw":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.Withdraw = false
+			case 21:
+				t.Withdraw = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
+			// t.Signature (crypto.Signature) (struct)
+		case "Signature":
+
+			{
+
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := br.UnreadByte(); err != nil {
+						return err
+					}
+					t.Signature = new(crypto.Signature)
+					if err := t.Signature.UnmarshalCBOR(br); err != nil {
+						return xerrors.Errorf("unmarshaling t.Signature pointer: %w", err)
+					}
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *AnnouncedPeer) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{162}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Peer (retrievalmarket.RetrievalPeer) (struct)
+	if len("Peer") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Peer\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Peer"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Peer")); err != nil {
+		return err
+	}
+
+	if err := t.Peer.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Expiry (int64) (int64)
+	if len("Expiry") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Expiry\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Expiry"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Expiry")); err != nil {
+		return err
+	}
+
+	if t.Expiry >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Expiry)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Expiry-1)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *AnnouncedPeer) UnmarshalCBOR(r io.Reader) error {
+	*t = AnnouncedPeer{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("AnnouncedPeer: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Peer (retrievalmarket.RetrievalPeer) (struct)
+		case "Peer":
+
+			{
+
+				if err := t.Peer.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.Peer: %w", err)
+				}
+
+			}
+			// t.Expiry (int64) (int64)
+		case "Expiry":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.Expiry = int64(extraI)
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
@@ -2,15 +2,19 @@ package piecestoreimpl
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
 	logging "github.com/ipfs/go-log/v2"
 
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	versioned "github.com/filecoin-project/go-ds-versioning/pkg/statestore"
+	"github.com/filecoin-project/go-state-types/abi"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/piecestore/migrations"
@@ -25,6 +29,17 @@ var DSPiecePrefix = "/pieces"
 // DSCIDPrefix is the name space for storing CID infos
 var DSCIDPrefix = "/cid-infos"
 
+// DSSectorPiecePrefix is the name space for the index of the pieces in each
+// sector
+var DSSectorPiecePrefix = "/sector-pieces"
+
+// DSPieceCIDPrefix is the name space for the index of the CIDs in each piece
+var DSPieceCIDPrefix = "/piece-cids"
+
+// pieceCIDsIndexedKey is set in the piece CID index once it has been built
+// from the CID infos stored before it existed
+var pieceCIDsIndexedKey = datastore.NewKey("/indexed")
+
 // NewPieceStore returns a new piecestore based on the given datastore
 func NewPieceStore(ds datastore.Batching) (piecestore.PieceStore, error) {
 	pieceInfoMigrations, err := migrations.PieceInfoMigrations.Build()
@@ -43,15 +58,30 @@ func NewPieceStore(ds datastore.Batching) (piecestore.PieceStore, error) {
 		migratePieces:   migratePieces,
 		cidInfos:        cidInfos,
 		migrateCidInfos: migrateCidInfos,
+		sectorPieces:    namespace.Wrap(ds, datastore.NewKey(DSSectorPiecePrefix)),
+		pieceCids:       namespace.Wrap(ds, datastore.NewKey(DSPieceCIDPrefix)),
+		pieceLocks:      newKeyLocks(),
+		cidLocks:        newKeyLocks(),
 	}, nil
 }
 
+// pieceStore serializes changes to each piece info and CID info with a lock
+// per key, so that concurrent changes to the same key are not lost.
+// Changes to a piece info take the piece's lock before any CID info locks.
 type pieceStore struct {
 	readySub        *pubsub.PubSub
 	migratePieces   func(ctx context.Context) error
 	pieces          versioned.StateStore
 	migrateCidInfos func(ctx context.Context) error
 	cidInfos        versioned.StateStore
+	// sectorPieces has a key for each sector and piece in it
+	sectorPieces datastore.Batching
+	// pieceCids has a key for each piece and CID with a block location in it.
+	// Keys are added before block locations and removed after them, so every
+	// block location is indexed.
+	pieceCids  datastore.Batching
+	pieceLocks *keyLocks
+	cidLocks   *keyLocks
 }
 
 func (ps *pieceStore) Start(ctx context.Context) error {
@@ -71,6 +101,21 @@ func (ps *pieceStore) Start(ctx context.Context) error {
 		err = ps.migrateCidInfos(ctx)
 		if err != nil {
 			log.Errorf("Migrating cidInfos: %s", err.Error())
+			return
+		}
+		err = ps.indexSectors()
+		if err != nil {
+			log.Errorf("Indexing pieces by sector: %s", err.Error())
+			return
+		}
+		err = ps.indexPieceCIDs()
+		if err != nil {
+			log.Errorf("Indexing CIDs by piece: %s", err.Error())
+			return
+		}
+		err = ps.removeEmptyPieces()
+		if err != nil {
+			log.Errorf("Removing pieces with no deals: %s", err.Error())
 		}
 	}()
 	return nil
@@ -82,7 +127,21 @@ func (ps *pieceStore) OnReady(ready shared.ReadyFunc) {
 
 // Store `dealInfo` in the PieceStore with key `pieceCID`.
 func (ps *pieceStore) AddDealForPiece(pieceCID cid.Cid, dealInfo piecestore.DealInfo) error {
-	return ps.mutatePieceInfo(pieceCID, func(pi *piecestore.PieceInfo) error {
+	defer ps.pieceLocks.lock(pieceCID)()
+
+	if err := ps.sectorPieces.Put(sectorPieceKey(dealInfo.SectorID, pieceCID), []byte{}); err != nil {
+		return err
+	}
+	has, err := ps.pieces.Has(pieceCID)
+	if err != nil {
+		return err
+	}
+	if !has {
+		// the piece is stored with its first deal, so a piece with no deals is
+		// only ever one whose removal was interrupted
+		return ps.pieces.Begin(pieceCID, &piecestore.PieceInfo{PieceCID: pieceCID, Deals: []piecestore.DealInfo{dealInfo}})
+	}
+	return ps.pieces.Get(pieceCID).Mutate(func(pi *piecestore.PieceInfo) error {
 		for _, di := range pi.Deals {
 			if di == dealInfo {
 				return nil
@@ -95,7 +154,25 @@ func (ps *pieceStore) AddDealForPiece(pieceCID cid.Cid, dealInfo piecestore.Deal
 
 // Store the map of blockLocations in the PieceStore's CIDInfo store, with key `pieceCID`
 func (ps *pieceStore) AddPieceBlockLocations(pieceCID cid.Cid, blockLocations map[cid.Cid]piecestore.BlockLocation) error {
+	// hold the piece's lock so the piece can't be removed between indexing
+	// the CIDs and adding their locations
+	defer ps.pieceLocks.lock(pieceCID)()
+
+	b, err := ps.pieceCids.Batch()
+	if err != nil {
+		return err
+	}
+	for c := range blockLocations {
+		if err := b.Put(pieceCIDKey(pieceCID, c), []byte{}); err != nil {
+			return err
+		}
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+
 	for c, blockLocation := range blockLocations {
+		unlock := ps.cidLocks.lock(c)
 		err := ps.mutateCIDInfo(c, func(ci *piecestore.CIDInfo) error {
 			for _, pbl := range ci.PieceBlockLocations {
 				if pbl.PieceCID.Equals(pieceCID) && pbl.BlockLocation == blockLocation {
@@ -105,6 +182,7 @@ func (ps *pieceStore) AddPieceBlockLocations(pieceCID cid.Cid, blockLocations ma
 			ci.PieceBlockLocations = append(ci.PieceBlockLocations, piecestore.PieceBlockLocation{BlockLocation: blockLocation, PieceCID: pieceCID})
 			return nil
 		})
+		unlock()
 		if err != nil {
 			return err
 		}
@@ -112,6 +190,174 @@ func (ps *pieceStore) AddPieceBlockLocations(pieceCID cid.Cid, blockLocations ma
 	return nil
 }
 
+// Remove the deal with `dealID` from the PieceInfo with key `pieceCID`, and
+// remove the piece once it has no deals.
+func (ps *pieceStore) RemoveDealForPiece(pieceCID cid.Cid, dealID abi.DealID) error {
+	defer ps.pieceLocks.lock(pieceCID)()
+
+	has, err := ps.pieces.Has(pieceCID)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+
+	var removed, remaining []piecestore.DealInfo
+	err = ps.pieces.Get(pieceCID).Mutate(func(pi *piecestore.PieceInfo) error {
+		for _, di := range pi.Deals {
+			if di.DealID == dealID {
+				removed = append(removed, di)
+			} else {
+				remaining = append(remaining, di)
+			}
+		}
+		pi.Deals = remaining
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the piece stays in the index for sectors its other deals are in
+	for _, di := range removed {
+		inSector := false
+		for _, other := range remaining {
+			if other.SectorID == di.SectorID {
+				inSector = true
+				break
+			}
+		}
+		if inSector {
+			continue
+		}
+		if err := ps.sectorPieces.Delete(sectorPieceKey(di.SectorID, pieceCID)); err != nil {
+			return err
+		}
+	}
+	if len(remaining) == 0 {
+		return ps.removePiece(pieceCID)
+	}
+	return nil
+}
+
+// Remove the PieceInfo with key `pieceCID`, and the block locations in the piece
+// from the CID info store.
+func (ps *pieceStore) RemovePiece(pieceCID cid.Cid) error {
+	defer ps.pieceLocks.lock(pieceCID)()
+
+	return ps.removePiece(pieceCID)
+}
+
+// removePiece removes a piece, with the piece's lock held
+func (ps *pieceStore) removePiece(pieceCID cid.Cid) error {
+	// block locations are removed first, so that if removing them fails the
+	// piece is still there to be removed again
+	cids, err := ps.listPieceCIDs(pieceCID)
+	if err != nil {
+		return err
+	}
+	for _, c := range cids {
+		if err := ps.removePieceBlockLocations(c, pieceCID); err != nil {
+			return err
+		}
+		if err := ps.pieceCids.Delete(pieceCIDKey(pieceCID, c)); err != nil {
+			return err
+		}
+	}
+
+	has, err := ps.pieces.Has(pieceCID)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+	var pi piecestore.PieceInfo
+	if err := ps.pieces.Get(pieceCID).Get(&pi); err != nil {
+		return err
+	}
+	for _, di := range pi.Deals {
+		if err := ps.sectorPieces.Delete(sectorPieceKey(di.SectorID, pieceCID)); err != nil {
+			return err
+		}
+	}
+	return ps.pieces.Get(pieceCID).End()
+}
+
+// listPieceCIDs lists the CIDs with a block location in the piece
+func (ps *pieceStore) listPieceCIDs(pieceCID cid.Cid) ([]cid.Cid, error) {
+	prefix := datastore.NewKey(pieceCID.String())
+	results, err := ps.pieceCids.Query(query.Query{Prefix: prefix.String() + "/", KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]cid.Cid, 0, len(entries))
+	for _, entry := range entries {
+		key := datastore.RawKey(entry.Key)
+		if !key.Parent().Equal(prefix) {
+			continue
+		}
+		c, err := cid.Decode(key.BaseNamespace())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// removePieceBlockLocations removes the locations of a CID in a piece, and the
+// CID info if it has no locations left
+func (ps *pieceStore) removePieceBlockLocations(c cid.Cid, pieceCID cid.Cid) error {
+	defer ps.cidLocks.lock(c)()
+
+	has, err := ps.cidInfos.Has(c)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+	remaining := 0
+	err = ps.cidInfos.Get(c).Mutate(func(ci *piecestore.CIDInfo) error {
+		pbls := ci.PieceBlockLocations[:0]
+		for _, pbl := range ci.PieceBlockLocations {
+			if !pbl.PieceCID.Equals(pieceCID) {
+				pbls = append(pbls, pbl)
+			}
+		}
+		ci.PieceBlockLocations = pbls
+		remaining = len(pbls)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+	return ps.cidInfos.Get(c).End()
+}
+
+// Remove the CIDInfo with key `payloadCID` from the CID info store.
+func (ps *pieceStore) RemoveCIDInfo(payloadCID cid.Cid) error {
+	defer ps.cidLocks.lock(payloadCID)()
+
+	has, err := ps.cidInfos.Has(payloadCID)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+	return ps.cidInfos.Get(payloadCID).End()
+}
+
 func (ps *pieceStore) ListPieceInfoKeys() ([]cid.Cid, error) {
 	var pis []piecestore.PieceInfo
 	if err := ps.pieces.List(&pis); err != nil {
@@ -140,6 +386,50 @@ func (ps *pieceStore) ListCidInfoKeys() ([]cid.Cid, error) {
 	return out, nil
 }
 
+// List the CIDs of the pieces with a deal in sector `sectorID`.
+func (ps *pieceStore) ListPiecesInSector(sectorID abi.SectorNumber) ([]cid.Cid, error) {
+	prefix := sectorKey(sectorID)
+	results, err := ps.sectorPieces.Query(query.Query{Prefix: prefix.String() + "/", KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]cid.Cid, 0, len(entries))
+	for _, entry := range entries {
+		key := datastore.RawKey(entry.Key)
+		if !key.Parent().Equal(prefix) {
+			continue
+		}
+		pieceCID, err := cid.Decode(key.BaseNamespace())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pieceCID)
+	}
+	return out, nil
+}
+
+// List the deals for the piece `pieceCID`, which are empty if the piece is not
+// in the piece info store.
+func (ps *pieceStore) ListDealsForPiece(pieceCID cid.Cid) ([]piecestore.DealInfo, error) {
+	has, err := ps.pieces.Has(pieceCID)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, nil
+	}
+	pi, err := ps.GetPieceInfo(pieceCID)
+	if err != nil {
+		return nil, err
+	}
+	return pi.Deals, nil
+}
+
 // Retrieve the PieceInfo associated with `pieceCID` from the piece info store.
 func (ps *pieceStore) GetPieceInfo(pieceCID cid.Cid) (piecestore.PieceInfo, error) {
 	var out piecestore.PieceInfo
@@ -158,49 +448,191 @@ func (ps *pieceStore) GetCIDInfo(payloadCID cid.Cid) (piecestore.CIDInfo, error)
 	return out, nil
 }
 
-func (ps *pieceStore) ensurePieceInfo(pieceCID cid.Cid) error {
-	has, err := ps.pieces.Has(pieceCID)
+func (ps *pieceStore) ensureCIDInfo(c cid.Cid) error {
+	has, err := ps.cidInfos.Has(c)
 
 	if err != nil {
 		return err
 	}
+
 	if has {
 		return nil
 	}
 
-	pieceInfo := piecestore.PieceInfo{PieceCID: pieceCID}
-	return ps.pieces.Begin(pieceCID, &pieceInfo)
+	cidInfo := piecestore.CIDInfo{CID: c}
+	return ps.cidInfos.Begin(c, &cidInfo)
 }
 
-func (ps *pieceStore) ensureCIDInfo(c cid.Cid) error {
-	has, err := ps.cidInfos.Has(c)
-
+func (ps *pieceStore) mutateCIDInfo(c cid.Cid, mutator interface{}) error {
+	err := ps.ensureCIDInfo(c)
 	if err != nil {
 		return err
 	}
 
-	if has {
-		return nil
+	return ps.cidInfos.Get(c).Mutate(mutator)
+}
+
+// indexSectors brings the index of the pieces in each sector in line with the
+// piece infos, indexing piece infos stored before the index existed and
+// dropping entries left by interrupted changes
+func (ps *pieceStore) indexSectors() error {
+	var pis []piecestore.PieceInfo
+	if err := ps.pieces.List(&pis); err != nil {
+		return err
+	}
+	indexed := make(map[datastore.Key]struct{})
+	for _, pi := range pis {
+		for _, di := range pi.Deals {
+			indexed[sectorPieceKey(di.SectorID, pi.PieceCID)] = struct{}{}
+		}
 	}
 
-	cidInfo := piecestore.CIDInfo{CID: c}
-	return ps.cidInfos.Begin(c, &cidInfo)
+	results, err := ps.sectorPieces.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+	b, err := ps.sectorPieces.Batch()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		key := datastore.RawKey(entry.Key)
+		if _, ok := indexed[key]; ok {
+			delete(indexed, key)
+			continue
+		}
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+	}
+	for key := range indexed {
+		if err := b.Put(key, []byte{}); err != nil {
+			return err
+		}
+	}
+	return b.Commit()
 }
 
-func (ps *pieceStore) mutatePieceInfo(pieceCID cid.Cid, mutator interface{}) error {
-	err := ps.ensurePieceInfo(pieceCID)
+// indexPieceCIDs indexes the CID infos stored before the piece CID index
+// existed. It only runs once, as the index is kept up to date from then on.
+func (ps *pieceStore) indexPieceCIDs() error {
+	indexed, err := ps.pieceCids.Has(pieceCIDsIndexedKey)
 	if err != nil {
 		return err
 	}
+	if indexed {
+		return nil
+	}
 
-	return ps.pieces.Get(pieceCID).Mutate(mutator)
+	var cis []piecestore.CIDInfo
+	if err := ps.cidInfos.List(&cis); err != nil {
+		return err
+	}
+	b, err := ps.pieceCids.Batch()
+	if err != nil {
+		return err
+	}
+	for _, ci := range cis {
+		for _, pbl := range ci.PieceBlockLocations {
+			if err := b.Put(pieceCIDKey(pbl.PieceCID, ci.CID), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := b.Put(pieceCIDsIndexedKey, []byte{}); err != nil {
+		return err
+	}
+	return b.Commit()
 }
 
-func (ps *pieceStore) mutateCIDInfo(c cid.Cid, mutator interface{}) error {
-	err := ps.ensureCIDInfo(c)
-	if err != nil {
+// removeEmptyPieces finishes removing pieces whose removal was interrupted
+// after their last deal was removed
+func (ps *pieceStore) removeEmptyPieces() error {
+	var pis []piecestore.PieceInfo
+	if err := ps.pieces.List(&pis); err != nil {
 		return err
 	}
+	for _, pi := range pis {
+		if len(pi.Deals) > 0 {
+			continue
+		}
+		if err := ps.removePieceIfEmpty(pi.PieceCID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return ps.cidInfos.Get(c).Mutate(mutator)
+// removePieceIfEmpty removes the piece if it still has no deals once its lock
+// is held, so that a deal added in the meantime is kept
+func (ps *pieceStore) removePieceIfEmpty(pieceCID cid.Cid) error {
+	defer ps.pieceLocks.lock(pieceCID)()
+
+	has, err := ps.pieces.Has(pieceCID)
+	if err != nil || !has {
+		return err
+	}
+	var pi piecestore.PieceInfo
+	if err := ps.pieces.Get(pieceCID).Get(&pi); err != nil {
+		return err
+	}
+	if len(pi.Deals) > 0 {
+		return nil
+	}
+	return ps.removePiece(pieceCID)
+}
+
+func pieceCIDKey(pieceCID cid.Cid, c cid.Cid) datastore.Key {
+	return datastore.NewKey(pieceCID.String()).ChildString(c.String())
+}
+
+func sectorKey(sectorID abi.SectorNumber) datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%d", sectorID))
+}
+
+func sectorPieceKey(sectorID abi.SectorNumber, pieceCID cid.Cid) datastore.Key {
+	return sectorKey(sectorID).ChildString(pieceCID.String())
+}
+
+// keyLocks serializes changes to the same key, while letting changes to
+// different keys go ahead concurrently
+type keyLocks struct {
+	lk    sync.Mutex
+	locks map[cid.Cid]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[cid.Cid]*keyLock)}
+}
+
+// lock locks the key, and returns a function that unlocks it
+func (kl *keyLocks) lock(key cid.Cid) func() {
+	kl.lk.Lock()
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &keyLock{}
+		kl.locks[key] = l
+	}
+	l.refs++
+	kl.lk.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		kl.lk.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(kl.locks, key)
+		}
+		kl.lk.Unlock()
+	}
 }
@@ -3,12 +3,15 @@ package piecestoreimpl_test
 import (
 	"context"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	dss "github.com/ipfs/go-datastore/sync"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -195,6 +198,312 @@ func TestStoreCIDInfo(t *testing.T) {
 	})
 }
 
+func TestRemove(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pieceCids := shared_testutil.GenerateCids(2)
+	testCIDs := shared_testutil.GenerateCids(3)
+	dealInfos := make([]piecestore.DealInfo, 0, 2)
+	for i := 0; i < 2; i++ {
+		dealInfos = append(dealInfos, piecestore.DealInfo{
+			DealID:   abi.DealID(i),
+			SectorID: abi.SectorNumber(rand.Uint64()),
+			Offset:   abi.PaddedPieceSize(rand.Uint64()),
+			Length:   abi.PaddedPieceSize(rand.Uint64()),
+		})
+	}
+	blockLocation := piecestore.BlockLocation{RelOffset: rand.Uint64(), BlockSize: rand.Uint64()}
+
+	initializePieceStore := func(t *testing.T) piecestore.PieceStore {
+		ps, err := piecestoreimpl.NewPieceStore(datastore.NewMapDatastore())
+		require.NoError(t, err)
+		shared_testutil.StartAndWaitForReady(ctx, t, ps)
+		// the first piece has both deals and the first two CIDs, the second
+		// piece has the last two CIDs
+		require.NoError(t, ps.AddDealForPiece(pieceCids[0], dealInfos[0]))
+		require.NoError(t, ps.AddDealForPiece(pieceCids[0], dealInfos[1]))
+		require.NoError(t, ps.AddDealForPiece(pieceCids[1], dealInfos[1]))
+		require.NoError(t, ps.AddPieceBlockLocations(pieceCids[0], map[cid.Cid]piecestore.BlockLocation{
+			testCIDs[0]: blockLocation,
+			testCIDs[1]: blockLocation,
+		}))
+		require.NoError(t, ps.AddPieceBlockLocations(pieceCids[1], map[cid.Cid]piecestore.BlockLocation{
+			testCIDs[1]: blockLocation,
+			testCIDs[2]: blockLocation,
+		}))
+		return ps
+	}
+
+	t.Run("removing a deal keeps a piece other deals have", func(t *testing.T) {
+		ps := initializePieceStore(t)
+		require.NoError(t, ps.RemoveDealForPiece(pieceCids[0], dealInfos[0].DealID))
+
+		pi, err := ps.GetPieceInfo(pieceCids[0])
+		require.NoError(t, err)
+		require.Equal(t, []piecestore.DealInfo{dealInfos[1]}, pi.Deals)
+		ci, err := ps.GetCIDInfo(testCIDs[0])
+		require.NoError(t, err)
+		require.Len(t, ci.PieceBlockLocations, 1)
+	})
+
+	t.Run("removing the last deal removes the piece", func(t *testing.T) {
+		ps := initializePieceStore(t)
+		require.NoError(t, ps.RemoveDealForPiece(pieceCids[1], dealInfos[1].DealID))
+
+		_, err := ps.GetPieceInfo(pieceCids[1])
+		require.Error(t, err)
+		_, err = ps.GetCIDInfo(testCIDs[2])
+		require.Error(t, err)
+		ci, err := ps.GetCIDInfo(testCIDs[1])
+		require.NoError(t, err)
+		require.Equal(t, []piecestore.PieceBlockLocation{{BlockLocation: blockLocation, PieceCID: pieceCids[0]}}, ci.PieceBlockLocations)
+
+		pieces, err := ps.ListPieceInfoKeys()
+		require.NoError(t, err)
+		require.Equal(t, []cid.Cid{pieceCids[0]}, pieces)
+	})
+
+	t.Run("removing what is not there does nothing", func(t *testing.T) {
+		ps := initializePieceStore(t)
+		missing := shared_testutil.GenerateCids(1)[0]
+		require.NoError(t, ps.RemoveDealForPiece(missing, dealInfos[0].DealID))
+		require.NoError(t, ps.RemovePiece(missing))
+		require.NoError(t, ps.RemoveCIDInfo(missing))
+
+		pieces, err := ps.ListPieceInfoKeys()
+		require.NoError(t, err)
+		require.Len(t, pieces, 2)
+	})
+
+	t.Run("can remove CID infos", func(t *testing.T) {
+		ps := initializePieceStore(t)
+		require.NoError(t, ps.RemoveCIDInfo(testCIDs[1]))
+
+		_, err := ps.GetCIDInfo(testCIDs[1])
+		require.Error(t, err)
+		cids, err := ps.ListCidInfoKeys()
+		require.NoError(t, err)
+		require.Len(t, cids, 2)
+	})
+}
+
+func TestConcurrentAdds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ps, err := piecestoreimpl.NewPieceStore(dss.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+
+	pieceCids := shared_testutil.GenerateCids(20)
+	payloadCid := shared_testutil.GenerateCids(1)[0]
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(pieceCids))
+	for i, pieceCid := range pieceCids {
+		wg.Add(1)
+		go func(i int, pieceCid cid.Cid) {
+			defer wg.Done()
+			// every handoff adds a deal to the same piece and a block
+			// location to the same CID
+			errs <- ps.AddDealForPiece(pieceCids[0], piecestore.DealInfo{DealID: abi.DealID(i)})
+			errs <- ps.AddPieceBlockLocations(pieceCid, map[cid.Cid]piecestore.BlockLocation{payloadCid: {}})
+		}(i, pieceCid)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	deals, err := ps.ListDealsForPiece(pieceCids[0])
+	require.NoError(t, err)
+	require.Len(t, deals, len(pieceCids))
+	ci, err := ps.GetCIDInfo(payloadCid)
+	require.NoError(t, err)
+	require.Len(t, ci.PieceBlockLocations, len(pieceCids))
+}
+
+func TestConcurrentAddAndRemove(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pieceCid := shared_testutil.GenerateCids(1)[0]
+	payloadCids := shared_testutil.GenerateCids(20)
+	blockLocations := make(map[cid.Cid]piecestore.BlockLocation, len(payloadCids))
+	for _, c := range payloadCids {
+		blockLocations[c] = piecestore.BlockLocation{}
+	}
+	oldDeal := piecestore.DealInfo{DealID: 1}
+	newDeal := piecestore.DealInfo{DealID: 2}
+
+	for i := 0; i < 20; i++ {
+		ps, err := piecestoreimpl.NewPieceStore(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, err)
+		shared_testutil.StartAndWaitForReady(ctx, t, ps)
+		require.NoError(t, ps.AddDealForPiece(pieceCid, oldDeal))
+		require.NoError(t, ps.AddPieceBlockLocations(pieceCid, blockLocations))
+
+		// a handoff of the piece races the removal of its last old deal
+		var wg sync.WaitGroup
+		errs := make(chan error, 3)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- ps.AddDealForPiece(pieceCid, newDeal)
+			errs <- ps.AddPieceBlockLocations(pieceCid, blockLocations)
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- ps.RemoveDealForPiece(pieceCid, oldDeal.DealID)
+		}()
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		deals, err := ps.ListDealsForPiece(pieceCid)
+		require.NoError(t, err)
+		require.Equal(t, []piecestore.DealInfo{newDeal}, deals)
+		for _, c := range payloadCids {
+			ci, err := ps.GetCIDInfo(c)
+			require.NoError(t, err)
+			require.Len(t, ci.PieceBlockLocations, 1)
+		}
+
+		// adding block locations while the piece is removed leaves no block
+		// locations behind once the piece is removed again
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = ps.AddPieceBlockLocations(pieceCid, blockLocations)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = ps.RemovePiece(pieceCid)
+		}()
+		wg.Wait()
+		require.NoError(t, ps.RemovePiece(pieceCid))
+		cids, err := ps.ListCidInfoKeys()
+		require.NoError(t, err)
+		require.Empty(t, cids)
+	}
+}
+
+func TestListPiecesInSector(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ds := datastore.NewMapDatastore()
+	ps, err := piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+
+	pieceCids := shared_testutil.GenerateCids(3)
+	require.NoError(t, ps.AddDealForPiece(pieceCids[0], piecestore.DealInfo{DealID: 1, SectorID: 1}))
+	require.NoError(t, ps.AddDealForPiece(pieceCids[0], piecestore.DealInfo{DealID: 2, SectorID: 10}))
+	require.NoError(t, ps.AddDealForPiece(pieceCids[1], piecestore.DealInfo{DealID: 3, SectorID: 1}))
+	require.NoError(t, ps.AddDealForPiece(pieceCids[2], piecestore.DealInfo{DealID: 4, SectorID: 10}))
+
+	listPieces := func(t *testing.T, ps piecestore.PieceStore, sectorID abi.SectorNumber) []cid.Cid {
+		pieces, err := ps.ListPiecesInSector(sectorID)
+		require.NoError(t, err)
+		return pieces
+	}
+	require.ElementsMatch(t, []cid.Cid{pieceCids[0], pieceCids[1]}, listPieces(t, ps, 1))
+	require.ElementsMatch(t, []cid.Cid{pieceCids[0], pieceCids[2]}, listPieces(t, ps, 10))
+	require.Empty(t, listPieces(t, ps, 2))
+
+	deals, err := ps.ListDealsForPiece(pieceCids[0])
+	require.NoError(t, err)
+	require.Len(t, deals, 2)
+	deals, err = ps.ListDealsForPiece(shared_testutil.GenerateCids(1)[0])
+	require.NoError(t, err)
+	require.Empty(t, deals)
+
+	// removing deals removes the piece from their sectors
+	require.NoError(t, ps.RemoveDealForPiece(pieceCids[0], 2))
+	require.Equal(t, []cid.Cid{pieceCids[2]}, listPieces(t, ps, 10))
+	require.NoError(t, ps.RemoveDealForPiece(pieceCids[1], 3))
+	require.Equal(t, []cid.Cid{pieceCids[0]}, listPieces(t, ps, 1))
+
+	// the index is rebuilt from the piece infos on start
+	index := namespace.Wrap(ds, datastore.NewKey(piecestoreimpl.DSSectorPiecePrefix))
+	results, err := index.Query(query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NoError(t, index.Delete(datastore.NewKey(entry.Key)))
+	}
+	require.NoError(t, index.Put(datastore.NewKey("/2").ChildString(pieceCids[1].String()), []byte{}))
+
+	ps, err = piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+	require.Equal(t, []cid.Cid{pieceCids[0]}, listPieces(t, ps, 1))
+	require.Equal(t, []cid.Cid{pieceCids[2]}, listPieces(t, ps, 10))
+	require.Empty(t, listPieces(t, ps, 2))
+}
+
+func TestPieceCIDIndex(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pieceCids := shared_testutil.GenerateCids(2)
+	testCIDs := shared_testutil.GenerateCids(3)
+
+	// a store from before the index, where the second piece lost its last
+	// deal but was not removed
+	ds := datastore.NewMapDatastore()
+	oldPieces := statestore.New(namespace.Wrap(ds, datastore.NewKey(piecestoreimpl.DSPiecePrefix)))
+	require.NoError(t, oldPieces.Begin(pieceCids[0], &migrations.PieceInfo0{
+		PieceCID: pieceCids[0],
+		Deals:    []migrations.DealInfo0{{DealID: 1}},
+	}))
+	require.NoError(t, oldPieces.Begin(pieceCids[1], &migrations.PieceInfo0{
+		PieceCID: pieceCids[1],
+	}))
+	oldCidInfos := statestore.New(namespace.Wrap(ds, datastore.NewKey(piecestoreimpl.DSCIDPrefix)))
+	addCIDInfo := func(c cid.Cid, pieceCids ...cid.Cid) {
+		ci := &migrations.CIDInfo0{CID: c}
+		for _, pieceCid := range pieceCids {
+			ci.PieceBlockLocations = append(ci.PieceBlockLocations, migrations.PieceBlockLocation0{PieceCID: pieceCid})
+		}
+		require.NoError(t, oldCidInfos.Begin(c, ci))
+	}
+	addCIDInfo(testCIDs[0], pieceCids[0])
+	addCIDInfo(testCIDs[1], pieceCids[0], pieceCids[1])
+	addCIDInfo(testCIDs[2], pieceCids[1])
+
+	ps, err := piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+
+	t.Run("removes pieces with no deals on start", func(t *testing.T) {
+		pieces, err := ps.ListPieceInfoKeys()
+		require.NoError(t, err)
+		require.Equal(t, []cid.Cid{pieceCids[0]}, pieces)
+		cids, err := ps.ListCidInfoKeys()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []cid.Cid{testCIDs[0], testCIDs[1]}, cids)
+		ci, err := ps.GetCIDInfo(testCIDs[1])
+		require.NoError(t, err)
+		require.Equal(t, []piecestore.PieceBlockLocation{{PieceCID: pieceCids[0]}}, ci.PieceBlockLocations)
+	})
+
+	t.Run("removes block locations of existing pieces", func(t *testing.T) {
+		require.NoError(t, ps.RemoveDealForPiece(pieceCids[0], 1))
+		cids, err := ps.ListCidInfoKeys()
+		require.NoError(t, err)
+		require.Empty(t, cids)
+
+		// nothing but the marker that the index was built is left
+		index := namespace.Wrap(ds, datastore.NewKey(piecestoreimpl.DSPieceCIDPrefix))
+		results, err := index.Query(query.Query{KeysOnly: true})
+		require.NoError(t, err)
+		entries, err := results.Rest()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+}
+
 func TestMigrations(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
@@ -59,8 +59,20 @@ type PieceStore interface {
 	OnReady(ready shared.ReadyFunc)
 	AddDealForPiece(pieceCID cid.Cid, dealInfo DealInfo) error
 	AddPieceBlockLocations(pieceCID cid.Cid, blockLocations map[cid.Cid]BlockLocation) error
+	// RemoveDealForPiece removes a deal from a piece. When the piece has no
+	// deals left, the piece is removed.
+	RemoveDealForPiece(pieceCID cid.Cid, dealID abi.DealID) error
+	// RemovePiece removes a piece and the locations of all the blocks in it.
+	// CID infos left with no block locations are removed.
+	RemovePiece(pieceCID cid.Cid) error
+	// RemoveCIDInfo removes the locations of a payload CID in every piece
+	RemoveCIDInfo(payloadCID cid.Cid) error
 	GetPieceInfo(pieceCID cid.Cid) (PieceInfo, error)
 	GetCIDInfo(payloadCID cid.Cid) (CIDInfo, error)
 	ListCidInfoKeys() ([]cid.Cid, error)
 	ListPieceInfoKeys() ([]cid.Cid, error)
+	// ListPiecesInSector lists the pieces with a deal in the sector
+	ListPiecesInSector(sectorID abi.SectorNumber) ([]cid.Cid, error)
+	// ListDealsForPiece lists the deals for the piece
+	ListDealsForPiece(pieceCID cid.Cid) ([]DealInfo, error)
 }
@@ -47,15 +47,38 @@ type RetrievalClient interface {
 		storeID *multistore.StoreID,
 	) (DealID, error)
 
+	// RetrieveWithFailover retrieves a whole payload from the best provider
+	// the peer resolver knows of, moving on to the next best provider when a
+	// deal fails. Blocks already received are kept, and are not retrieved
+	// again from the next provider. If storeID is nil a new store is used.
+	RetrieveWithFailover(
+		ctx context.Context,
+		payloadCID cid.Cid,
+		params FailoverParams,
+		clientWallet address.Address,
+		storeID *multistore.StoreID,
+	) (FailoverResult, error)
+
+	// ExportDeal writes the DAG a deal retrieved to disk. A deal that is
+	// still in progress can be exported to a CAR file, which holds the blocks
+	// received so far.
+	ExportDeal(ctx context.Context, dealID DealID, params ExportParams) error
+
 	// SubscribeToEvents listens for events that happen related to client retrievals
 	SubscribeToEvents(subscriber ClientSubscriber) Unsubscribe
 
 	// V1
 
 	// TryRestartInsufficientFunds attempts to restart any deals stuck in the insufficient funds state
-	// after funds are added to a given payment channel
+	// after funds are added to a given payment channel. A fundsmonitor.Monitor calls it
+	// automatically once a channel has the funds.
 	TryRestartInsufficientFunds(paymentChannel address.Address) error
 
+	// TryRestartBudgetExceeded attempts to restart any deals paused because
+	// they would exceed a spending budget, after the budget has been raised or
+	// a new budget period has begun
+	TryRestartBudgetExceeded() error
+
 	// CancelDeal attempts to cancel an inprogress deal
 	CancelDeal(id DealID) error
 
@@ -120,6 +120,15 @@ const (
 	// exists from an earlier deal between client and provider, but we need
 	// to add funds to the channel for this particular deal
 	DealStatusPaymentChannelAddingInitialFunds
+
+	// DealStatusQueued means the provider has accepted the deal and it is
+	// waiting for the provider to have capacity to unseal and send the data
+	DealStatusQueued
+
+	// DealStatusBudgetExceeded means paying the provider would exceed one of
+	// the client's spending budgets, so the deal is paused until the budget
+	// allows it to continue
+	DealStatusBudgetExceeded
 )
 
 // DealStatuses maps deal status to a human readable representation
@@ -155,6 +164,8 @@ var DealStatuses = map[DealStatus]string{
 	DealStatusWaitForAcceptanceLegacy:          "DealStatusWaitForAcceptanceLegacy",
 	DealStatusClientWaitingForLastBlocks:       "DealStatusWaitingForLastBlocks",
 	DealStatusPaymentChannelAddingInitialFunds: "DealStatusPaymentChannelAddingInitialFunds",
+	DealStatusQueued:                           "DealStatusQueued",
+	DealStatusBudgetExceeded:                   "DealStatusBudgetExceeded",
 }
 
 func (s DealStatus) String() string {
@@ -130,6 +130,18 @@ const (
 	// ClientEventPaymentNotSent indicates that payment was requested, but no
 	// payment was actually due, so a voucher was not sent to the provider
 	ClientEventPaymentNotSent
+
+	// ClientEventBudgetExceeded means paying the provider would exceed one of
+	// the client's spending budgets
+	ClientEventBudgetExceeded
+
+	// ClientEventRecheckBudget runs when an external caller indicates a
+	// spending budget may now allow a paused deal to continue
+	ClientEventRecheckBudget
+
+	// ClientEventDealQueued means the provider has accepted the deal but it
+	// is waiting for the provider to have capacity to serve it
+	ClientEventDealQueued
 )
 
 // ClientEvents is a human readable map of client event name -> event description
@@ -171,6 +183,9 @@ var ClientEvents = map[ClientEvent]string{
 	ClientEventWaitForLastBlocks:             "ClientEventWaitForLastBlocks",
 	ClientEventPaymentChannelSkip:            "ClientEventPaymentChannelSkip",
 	ClientEventPaymentNotSent:                "ClientEventPaymentNotSent",
+	ClientEventBudgetExceeded:                "ClientEventBudgetExceeded",
+	ClientEventRecheckBudget:                 "ClientEventRecheckBudget",
+	ClientEventDealQueued:                    "ClientEventDealQueued",
 }
 
 func (e ClientEvent) String() string {
@@ -246,6 +261,12 @@ const (
 
 	// ProviderEventClientCancelled happens when the provider gets a cancel message from the client's data transfer
 	ProviderEventClientCancelled
+
+	// ProviderEventDequeued happens when a queued deal is given capacity to unseal and send data
+	ProviderEventDequeued
+
+	// ProviderEventProviderCancelled happens when the provider cancels a deal
+	ProviderEventProviderCancelled
 )
 
 // ProviderEvents is a human readable map of provider event name -> event description
@@ -268,4 +289,6 @@ var ProviderEvents = map[ProviderEvent]string{
 	ProviderEventCleanupComplete:        "ProviderEventCleanupComplete",
 	ProviderEventMultiStoreError:        "ProviderEventMultiStoreError",
 	ProviderEventClientCancelled:        "ProviderEventClientCancelled",
+	ProviderEventDequeued:               "ProviderEventDequeued",
+	ProviderEventProviderCancelled:      "ProviderEventProviderCancelled",
 }
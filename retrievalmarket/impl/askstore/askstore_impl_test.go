@@ -10,6 +10,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/askstore"
@@ -36,6 +37,7 @@ func TestAskStoreImpl(t *testing.T) {
 		UnsealPrice:             abi.NewTokenAmount(456),
 		PaymentInterval:         789,
 		PaymentIntervalIncrease: 789,
+		PriorityPricePerByte:    abi.NewTokenAmount(1000),
 	}
 	err = store.SetAsk(newAsk)
 	require.NoError(t, err)
@@ -70,6 +72,7 @@ func TestMigrations(t *testing.T) {
 		UnsealPrice:             oldAsk.UnsealPrice,
 		PaymentInterval:         oldAsk.PaymentInterval,
 		PaymentIntervalIncrease: oldAsk.PaymentIntervalIncrease,
+		PriorityPricePerByte:    big.Zero(),
 	}
 	require.Equal(t, expectedAsk, ask)
 }
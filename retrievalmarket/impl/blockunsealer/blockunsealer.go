@@ -0,0 +1,349 @@
+/*
+Package blockunsealer unseals only the parts of a piece needed to serve a
+selector retrieval.
+
+Rather than unsealing a whole piece, the unsealer walks the requested DAG,
+using the block locations recorded in the piece store to unseal just the byte
+range holding each block the selector reaches.
+*/
+package blockunsealer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime"
+	dagpb "github.com/ipld/go-ipld-prime-proto"
+	// to register multicodec
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+var log = logging.Logger("blockunsealer")
+
+// ErrNoBlockLocation is returned when the location of a block within the
+// piece has not been recorded in the piece store
+var ErrNoBlockLocation = xerrors.New("block location not recorded for piece")
+
+// ErrNoUnsealedCopy is returned when measuring a selection of a piece that
+// has no unsealed copy
+var ErrNoUnsealedCopy = xerrors.New("no unsealed copy of piece")
+
+// ErrSelectionTooLarge is returned when a selection reaches more blocks than
+// it may be measured by
+var ErrSelectionTooLarge = xerrors.New("selection reaches too many blocks to measure")
+
+// Unsealer unseals individual blocks from a piece
+type Unsealer struct {
+	node       rm.RetrievalProviderNode
+	pieceStore piecestore.PieceStore
+	pieceInfo  piecestore.PieceInfo
+
+	// deals in the order they should be tried, preferring sectors that
+	// already have an unsealed copy
+	deals         []piecestore.DealInfo
+	unsealedDeals int
+	unsealedBytes uint64
+}
+
+// NewUnsealer returns an unsealer for blocks of the given piece
+func NewUnsealer(ctx context.Context, node rm.RetrievalProviderNode, pieceStore piecestore.PieceStore, pieceInfo piecestore.PieceInfo) *Unsealer {
+	var unsealed, sealed []piecestore.DealInfo
+	for _, deal := range pieceInfo.Deals {
+		isUnsealed, err := node.IsUnsealed(ctx, deal.SectorID, deal.Offset.Unpadded(), deal.Length.Unpadded())
+		if err == nil && isUnsealed {
+			unsealed = append(unsealed, deal)
+		} else {
+			sealed = append(sealed, deal)
+		}
+	}
+	return &Unsealer{
+		node:          node,
+		pieceStore:    pieceStore,
+		pieceInfo:     pieceInfo,
+		deals:         append(unsealed, sealed...),
+		unsealedDeals: len(unsealed),
+	}
+}
+
+// UnsealedBytes returns the total number of bytes unsealed so far
+func (u *Unsealer) UnsealedBytes() uint64 {
+	return u.unsealedBytes
+}
+
+// UnsealSelected walks the DAG under root with the given selector, unsealing
+// each block the selector reaches and putting it in the given blockstore
+func (u *Unsealer) UnsealSelected(ctx context.Context, root cid.Cid, sel ipld.Node, bs blockstore.Blockstore) error {
+	err := walk(ctx, root, sel, func(c cid.Cid) (blocks.Block, error) {
+		return u.unsealBlock(ctx, c, bs)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("unsealed %d bytes of piece %s for payload %s", u.unsealedBytes, u.pieceInfo.PieceCID, root)
+	return nil
+}
+
+// SelectedSize walks the DAG under root with the given selector and returns
+// the total size of the blocks the selector reaches. Blocks are only read from
+// sectors that already have an unsealed copy of the piece, so that measuring
+// a selection never unseals a sector. It returns ErrNoUnsealedCopy if there is
+// no such sector.
+func (u *Unsealer) SelectedSize(ctx context.Context, root cid.Cid, sel ipld.Node, maxBlocks int) (uint64, error) {
+	if u.unsealedDeals == 0 {
+		return 0, ErrNoUnsealedCopy
+	}
+	var size uint64
+	var walkErr error
+	seen := make(map[cid.Cid]struct{})
+	err := walk(ctx, root, sel, func(c cid.Cid) (blocks.Block, error) {
+		if _, ok := seen[c]; !ok && len(seen) >= maxBlocks {
+			walkErr = ErrSelectionTooLarge
+			return nil, walkErr
+		}
+		blk, err := u.readBlock(ctx, u.deals[:u.unsealedDeals], c)
+		if err != nil {
+			// the traversal does not wrap loader errors, so hold on to the
+			// error that shows a block is missing from the piece
+			if xerrors.Is(err, ErrNoBlockLocation) {
+				walkErr = err
+			}
+			return nil, err
+		}
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			size += uint64(len(blk.RawData()))
+		}
+		return blk, nil
+	})
+	if walkErr != nil {
+		return 0, walkErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// walk traverses the DAG under root with the given selector, loading each
+// block it reaches with loadBlock
+func walk(ctx context.Context, root cid.Cid, sel ipld.Node, loadBlock func(cid.Cid) (blocks.Block, error)) error {
+	parsed, err := selector.ParseSelector(sel)
+	if err != nil {
+		return xerrors.Errorf("parsing selector: %w", err)
+	}
+
+	loader := func(lnk ipld.Link, _ ipld.LinkContext) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, xerrors.Errorf("unsupported link type %T", lnk)
+		}
+		blk, err := loadBlock(cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	chooser := dagpb.AddDagPBSupportToChooser(func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+		return basicnode.Prototype.Any, nil
+	})
+
+	rootLnk := cidlink.Link{Cid: root}
+	proto, err := chooser(rootLnk, ipld.LinkContext{})
+	if err != nil {
+		return err
+	}
+	nb := proto.NewBuilder()
+	if err := rootLnk.Load(ctx, ipld.LinkContext{}, nb, loader); err != nil {
+		return xerrors.Errorf("loading root block %s: %w", root, err)
+	}
+
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkLoader:                     loader,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}
+	err = progress.WalkAdv(nb.Build(), parsed, func(traversal.Progress, ipld.Node, traversal.VisitReason) error {
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("walking selector: %w", err)
+	}
+	return nil
+}
+
+// unsealBlock returns the given block from the blockstore, unsealing it from
+// the piece and adding it to the blockstore if it isn't already there
+func (u *Unsealer) unsealBlock(ctx context.Context, c cid.Cid, bs blockstore.Blockstore) (blocks.Block, error) {
+	blk, err := bs.Get(c)
+	if err == nil {
+		return blk, nil
+	}
+	if err != blockstore.ErrNotFound {
+		return nil, err
+	}
+
+	blk, err = u.readBlock(ctx, u.deals, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := bs.Put(blk); err != nil {
+		return nil, xerrors.Errorf("storing block %s: %w", c, err)
+	}
+	return blk, nil
+}
+
+// ReadBlock unseals the given block from the piece, without walking the DAG
+func (u *Unsealer) ReadBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return u.readBlock(ctx, u.deals, c)
+}
+
+// readBlock reads the given block from the piece in the first of the given
+// deals' sectors able to unseal it
+func (u *Unsealer) readBlock(ctx context.Context, deals []piecestore.DealInfo, c cid.Cid) (blocks.Block, error) {
+	loc, err := BlockLocation(u.pieceStore, u.pieceInfo.PieceCID, c)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := u.readRange(ctx, deals, loc)
+	if err != nil {
+		return nil, xerrors.Errorf("unsealing block %s: %w", c, err)
+	}
+
+	// check the unsealed data before trusting the recorded location
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, xerrors.Errorf("unsealed data for block %s does not match its CID", c)
+	}
+
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// readRange unseals the given range of the piece from the first of the given
+// deals' sectors able to unseal it
+func (u *Unsealer) readRange(ctx context.Context, deals []piecestore.DealInfo, loc piecestore.BlockLocation) ([]byte, error) {
+	lastErr := xerrors.New("no sectors found to unseal from")
+	for _, deal := range deals {
+		start, size, err := unsealWindow(loc, deal.Length.Unpadded())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reader, err := u.node.UnsealSector(ctx, deal.SectorID, deal.Offset.Unpadded()+start, size)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		window, err := ioutil.ReadAll(io.LimitReader(reader, int64(size)))
+		closeErr := reader.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if uint64(len(window)) != uint64(size) {
+			lastErr = xerrors.Errorf("unsealed %d bytes, expected %d", len(window), size)
+			continue
+		}
+		u.unsealedBytes += uint64(size)
+		blockStart := loc.RelOffset - uint64(start)
+		return window[blockStart : blockStart+loc.BlockSize], nil
+	}
+	return nil, lastErr
+}
+
+// unsealWindow returns the range of a piece of the given length to unseal to
+// read the block at the given location. Sectors are unsealed from fr32 padded
+// data, so the range must start at a multiple of 127 bytes and be a valid
+// unpadded piece size long. The smallest such range holding the block is
+// used, moved back to end at the end of the piece if it would run past it.
+func unsealWindow(loc piecestore.BlockLocation, pieceLength abi.UnpaddedPieceSize) (abi.UnpaddedPieceSize, abi.UnpaddedPieceSize, error) {
+	end := loc.RelOffset + loc.BlockSize
+	if end > uint64(pieceLength) {
+		return 0, 0, xerrors.Errorf("block at %d-%d lies outside the piece of %d bytes", loc.RelOffset, end, pieceLength)
+	}
+	start := loc.RelOffset - loc.RelOffset%127
+	size := uint64(127)
+	for start+size < end {
+		size *= 2
+	}
+	if start+size > uint64(pieceLength) {
+		start = uint64(pieceLength) - size
+	}
+	return abi.UnpaddedPieceSize(start), abi.UnpaddedPieceSize(size), nil
+}
+
+// BlockLocation returns the location of the given block within the given piece
+func BlockLocation(pieceStore piecestore.PieceStore, pieceCID cid.Cid, c cid.Cid) (piecestore.BlockLocation, error) {
+	cidInfo, err := pieceStore.GetCIDInfo(c)
+	if err != nil {
+		return piecestore.BlockLocation{}, xerrors.Errorf("looking up location of block %s: %w", c, err)
+	}
+	for _, pbl := range cidInfo.PieceBlockLocations {
+		if pbl.PieceCID.Equals(pieceCID) {
+			return pbl.BlockLocation, nil
+		}
+	}
+	return piecestore.BlockLocation{}, xerrors.Errorf("block %s: %w", c, ErrNoBlockLocation)
+}
+
+// EstimateUnsealSize estimates how many bytes of the piece must be unsealed to
+// serve a retrieval of the blocks the given selector reaches under root. The
+// unsealer unseals just those blocks, so when a sector has an unsealed copy of
+// the piece the selection is walked, through at most maxBlocks blocks, and the
+// estimate is the total size of the blocks it reaches. Otherwise the blocks
+// can't be read without unsealing them, and the estimate is RangeFromRoot.
+// The second return value is false if the root's location in the piece is
+// unknown, in which case the whole piece would be unsealed.
+func (u *Unsealer) EstimateUnsealSize(ctx context.Context, root cid.Cid, sel ipld.Node, maxBlocks int) (abi.UnpaddedPieceSize, bool) {
+	rangeSize, ok := RangeFromRoot(u.pieceStore, u.pieceInfo, root)
+	if !ok {
+		return rangeSize, false
+	}
+	size, err := u.SelectedSize(ctx, root, sel, maxBlocks)
+	if err == nil && size <= uint64(rangeSize) {
+		return abi.UnpaddedPieceSize(size), true
+	}
+	return rangeSize, true
+}
+
+// RangeFromRoot returns the size of the range of the piece from the given
+// root block to the end of the piece. Blocks are written to a piece in
+// traversal order, so every block a selector can reach from the root lies in
+// this range. The second return value is false if the root's location in the
+// piece is unknown, in which case the size of the whole piece is returned.
+func RangeFromRoot(pieceStore piecestore.PieceStore, pieceInfo piecestore.PieceInfo, root cid.Cid) (abi.UnpaddedPieceSize, bool) {
+	if len(pieceInfo.Deals) == 0 {
+		return 0, false
+	}
+	pieceSize := pieceInfo.Deals[0].Length.Unpadded()
+	loc, err := BlockLocation(pieceStore, pieceInfo.PieceCID, root)
+	if err != nil || loc.RelOffset >= uint64(pieceSize) {
+		return pieceSize, false
+	}
+	return pieceSize - abi.UnpaddedPieceSize(loc.RelOffset), true
+}
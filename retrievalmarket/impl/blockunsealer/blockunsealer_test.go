@@ -0,0 +1,196 @@
+package blockunsealer_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockunsealer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/blockrecorder"
+)
+
+func TestUnsealSelected(t *testing.T) {
+	ctx := context.Background()
+	tree := tut.NewTestIPLDTree()
+
+	carBuf := new(bytes.Buffer)
+	locationsBuf := new(bytes.Buffer)
+	require.NoError(t, tree.DumpToCar(carBuf, blockrecorder.RecordEachBlockTo(locationsBuf)))
+	metadata, err := blockrecorder.ReadBlockMetadata(locationsBuf)
+	require.NoError(t, err)
+
+	pieceCid := tut.GenerateCids(1)[0]
+	deal := piecestore.DealInfo{
+		DealID:   abi.DealID(10),
+		SectorID: abi.SectorNumber(1),
+		Offset:   abi.PaddedPieceSize(1024),
+		Length:   abi.PaddedPieceSize(1024),
+	}
+	pieceInfo := piecestore.PieceInfo{PieceCID: pieceCid, Deals: []piecestore.DealInfo{deal}}
+
+	pieceStore := tut.NewTestPieceStore()
+	locations := make(map[cid.Cid]piecestore.BlockLocation)
+	for _, md := range metadata {
+		loc := piecestore.BlockLocation{RelOffset: md.Offset, BlockSize: md.Size}
+		locations[md.CID] = loc
+		pieceStore.StubCID(md.CID, piecestore.CIDInfo{
+			CID:                 md.CID,
+			PieceBlockLocations: []piecestore.PieceBlockLocation{{BlockLocation: loc, PieceCID: pieceCid}},
+		})
+	}
+	// the piece is the CAR file padded out to the piece size
+	pieceData := make([]byte, deal.Length.Unpadded())
+	require.LessOrEqual(t, carBuf.Len(), len(pieceData))
+	copy(pieceData, carBuf.Bytes())
+
+	// blocks are unsealed in fr32 aligned windows around them: starting at a
+	// multiple of 127 bytes and a valid unpadded piece size long
+	window := func(c cid.Cid) (uint64, uint64) {
+		loc := locations[c]
+		start := loc.RelOffset - loc.RelOffset%127
+		size := uint64(127)
+		for start+size < loc.RelOffset+loc.BlockSize {
+			size *= 2
+		}
+		if start+size > uint64(len(pieceData)) {
+			start = uint64(len(pieceData)) - size
+		}
+		return start, size
+	}
+	expectBlock := func(node *testnodes.TestRetrievalProviderNode, c cid.Cid) {
+		start, size := window(c)
+		node.ExpectUnseal(deal.SectorID, deal.Offset.Unpadded()+abi.UnpaddedPieceSize(start),
+			abi.UnpaddedPieceSize(size), pieceData[start:start+size])
+	}
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+
+	t.Run("unseals only the selected blocks", func(t *testing.T) {
+		// the blocks are not aligned themselves
+		require.NotZero(t, locations[tree.RootBlock.Cid()].RelOffset%127)
+
+		node := testnodes.NewTestRetrievalProviderNode()
+		expectBlock(node, tree.RootBlock.Cid())
+		expectBlock(node, tree.MiddleMapBlock.Cid())
+
+		sel := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("linkedMap", ssb.Matcher())
+		}).Node()
+
+		bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		unsealer := blockunsealer.NewUnsealer(ctx, node, pieceStore, pieceInfo)
+		require.NoError(t, unsealer.UnsealSelected(ctx, tree.RootBlock.Cid(), sel, bs))
+		node.VerifyExpectations(t)
+
+		for _, blk := range []cid.Cid{tree.RootBlock.Cid(), tree.MiddleMapBlock.Cid()} {
+			has, err := bs.Has(blk)
+			require.NoError(t, err)
+			require.True(t, has)
+		}
+		has, err := bs.Has(tree.MiddleListBlock.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+
+		_, rootSize := window(tree.RootBlock.Cid())
+		_, middleSize := window(tree.MiddleMapBlock.Cid())
+		expectedBytes := rootSize + middleSize
+		require.Equal(t, expectedBytes, unsealer.UnsealedBytes())
+	})
+
+	t.Run("errors if a block's location is unknown", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		otherPiece := piecestore.PieceInfo{PieceCID: tut.GenerateCids(1)[0], Deals: []piecestore.DealInfo{deal}}
+
+		bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		unsealer := blockunsealer.NewUnsealer(ctx, node, pieceStore, otherPiece)
+		err := unsealer.UnsealSelected(ctx, tree.RootBlock.Cid(), ssb.Matcher().Node(), bs)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), blockunsealer.ErrNoBlockLocation.Error())
+	})
+
+	t.Run("measures the selected blocks of an unsealed piece", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.MarkUnsealed(ctx, deal.SectorID, deal.Offset.Unpadded(), deal.Length.Unpadded())
+		expectBlock(node, tree.RootBlock.Cid())
+		expectBlock(node, tree.MiddleMapBlock.Cid())
+
+		sel := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("linkedMap", ssb.Matcher())
+		}).Node()
+
+		unsealer := blockunsealer.NewUnsealer(ctx, node, pieceStore, pieceInfo)
+		size, err := unsealer.SelectedSize(ctx, tree.RootBlock.Cid(), sel, 2)
+		require.NoError(t, err)
+		node.VerifyExpectations(t)
+		expectedSize := locations[tree.RootBlock.Cid()].BlockSize + locations[tree.MiddleMapBlock.Cid()].BlockSize
+		require.Equal(t, expectedSize, size)
+	})
+
+	t.Run("stops measuring a selection that reaches too many blocks", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.MarkUnsealed(ctx, deal.SectorID, deal.Offset.Unpadded(), deal.Length.Unpadded())
+		expectBlock(node, tree.RootBlock.Cid())
+
+		sel := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("linkedMap", ssb.Matcher())
+		}).Node()
+
+		unsealer := blockunsealer.NewUnsealer(ctx, node, pieceStore, pieceInfo)
+		_, err := unsealer.SelectedSize(ctx, tree.RootBlock.Cid(), sel, 1)
+		require.True(t, xerrors.Is(err, blockunsealer.ErrSelectionTooLarge))
+		node.VerifyExpectations(t)
+	})
+
+	t.Run("does not measure a piece without an unsealed copy", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		unsealer := blockunsealer.NewUnsealer(ctx, node, pieceStore, pieceInfo)
+		_, err := unsealer.SelectedSize(ctx, tree.RootBlock.Cid(), ssb.Matcher().Node(), 1)
+		require.True(t, xerrors.Is(err, blockunsealer.ErrNoUnsealedCopy))
+		node.VerifyExpectations(t)
+	})
+
+	t.Run("estimates the unseal size of a sealed piece from the payload location", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		unsealer := blockunsealer.NewUnsealer(ctx, node, pieceStore, pieceInfo)
+		size, ok := unsealer.EstimateUnsealSize(ctx, tree.MiddleListBlock.Cid(), ssb.Matcher().Node(), 1)
+		require.True(t, ok)
+		expected := deal.Length.Unpadded() - abi.UnpaddedPieceSize(locations[tree.MiddleListBlock.Cid()].RelOffset)
+		require.Equal(t, expected, size)
+		node.VerifyExpectations(t)
+
+		_, ok = unsealer.EstimateUnsealSize(ctx, tut.GenerateCids(1)[0], ssb.Matcher().Node(), 1)
+		require.False(t, ok)
+	})
+
+	t.Run("estimates the unseal size of an unsealed piece from the selected blocks", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.MarkUnsealed(ctx, deal.SectorID, deal.Offset.Unpadded(), deal.Length.Unpadded())
+		expectBlock(node, tree.RootBlock.Cid())
+		expectBlock(node, tree.MiddleMapBlock.Cid())
+
+		sel := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("linkedMap", ssb.Matcher())
+		}).Node()
+
+		unsealer := blockunsealer.NewUnsealer(ctx, node, pieceStore, pieceInfo)
+		size, ok := unsealer.EstimateUnsealSize(ctx, tree.RootBlock.Cid(), sel, 2)
+		require.True(t, ok)
+		node.VerifyExpectations(t)
+		expectedSize := locations[tree.RootBlock.Cid()].BlockSize + locations[tree.MiddleMapBlock.Cid()].BlockSize
+		require.Equal(t, abi.UnpaddedPieceSize(expectedSize), size)
+	})
+}
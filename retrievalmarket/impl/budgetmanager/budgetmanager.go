@@ -0,0 +1,299 @@
+/*
+Package budgetmanager caps what a retrieval client spends on retrievals.
+
+A deal's TotalFunds only limits that one deal, so nothing stops many deals
+made at once from draining a wallet. The manager holds budgets for client
+wallets and miners, each a cap on what may be spent in a period, such as a
+day, and budgets that cap what each deal made from a wallet may pay.
+
+Wallet budgets count the funds that leave the wallet: the client reserves the
+funds it moves into a payment channel against the wallet's budget before
+creating or adding funds to the channel, and fails the deal if the budget would
+be exceeded. Miner and deal budgets count payments: the client reserves every
+payment against them before it sends a voucher, and pauses the deal when a
+budget would be exceeded. Budgets and what has been spent in the current period
+are persisted, so restarting the client does not reset them.
+
+Spending is only counted against budgets that exist when it happens.
+*/
+package budgetmanager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-statestore"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// Clock sets the function the manager uses to get the current time
+func Clock(now func() time.Time) Option {
+	return func(m *Manager) {
+		m.now = now
+	}
+}
+
+// Manager tracks retrieval spending against budgets
+type Manager struct {
+	budgets *statestore.StateStore
+	now     func() time.Time
+
+	lk sync.Mutex
+}
+
+// NewManager returns a budget manager that persists budgets to the given
+// datastore
+func NewManager(ds datastore.Batching, options ...Option) *Manager {
+	m := &Manager{
+		budgets: statestore.New(ds),
+		now:     time.Now,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// SetBudget sets the cap and period of a budget, creating it if it does not
+// exist. Changing the period of a budget starts a new period.
+func (m *Manager) SetBudget(scope Scope, addr address.Address, cap abi.TokenAmount, period time.Duration) error {
+	if _, ok := Scopes[scope]; !ok {
+		return xerrors.Errorf("unknown budget scope %d", scope)
+	}
+	if cap.Nil() || cap.LessThan(big.Zero()) {
+		return xerrors.Errorf("budget cap must not be negative")
+	}
+	if period < 0 || (scope == ScopeDeal && period != 0) {
+		return xerrors.Errorf("invalid period %s for a %s budget", period, scope)
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	key := budgetKey(scope, addr)
+	has, err := m.budgets.Has(key)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return m.budgets.Begin(key, &Budget{
+			Scope:       scope,
+			Address:     addr,
+			Cap:         cap,
+			Period:      period,
+			PeriodStart: m.now().Unix(),
+			Spent:       big.Zero(),
+		})
+	}
+	return m.budgets.Get(key).Mutate(func(b *Budget) error {
+		if b.Period != period {
+			b.PeriodStart = m.now().Unix()
+			b.Spent = big.Zero()
+		}
+		b.Cap = cap
+		b.Period = period
+		return nil
+	})
+}
+
+// RemoveBudget removes a budget
+func (m *Manager) RemoveBudget(scope Scope, addr address.Address) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	key := budgetKey(scope, addr)
+	has, err := m.budgets.Has(key)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return xerrors.Errorf("no %s budget for %s", scope, addr)
+	}
+	return m.budgets.Get(key).End()
+}
+
+// Budgets lists all budgets, with what has been spent in their current
+// period
+func (m *Manager) Budgets() ([]Budget, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var budgets []Budget
+	if err := m.budgets.List(&budgets); err != nil {
+		return nil, err
+	}
+	now := m.now()
+	for i := range budgets {
+		m.roll(&budgets[i], now)
+	}
+	return budgets, nil
+}
+
+// Check returns an error wrapping retrievalmarket.ErrBudgetExceeded if paying
+// amount for a deal between the client wallet and miner would exceed a miner
+// or deal budget. dealSpent is what the deal has paid so far.
+func (m *Manager) Check(clientWallet address.Address, miner address.Address, dealSpent abi.TokenAmount, amount abi.TokenAmount) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	_, err := m.check(clientWallet, miner, dealSpent, amount)
+	return err
+}
+
+// Reserve counts a payment of amount for a deal between the client wallet
+// and miner against the miner and deal budgets that apply to it. If the
+// payment would exceed a budget nothing is counted, and the error wraps
+// retrievalmarket.ErrBudgetExceeded.
+func (m *Manager) Reserve(clientWallet address.Address, miner address.Address, dealSpent abi.TokenAmount, amount abi.TokenAmount) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	keys, err := m.check(clientWallet, miner, dealSpent, amount)
+	if err != nil {
+		return err
+	}
+	now := m.now()
+	for _, key := range keys {
+		err := m.budgets.Get(key).Mutate(func(b *Budget) error {
+			m.roll(b, now)
+			b.Spent = big.Add(b.Spent, amount)
+			return nil
+		})
+		if err != nil {
+			return xerrors.Errorf("recording spending: %w", err)
+		}
+	}
+	return nil
+}
+
+// Release returns a reserved amount that was not paid after all to the
+// budget of the miner
+func (m *Manager) Release(clientWallet address.Address, miner address.Address, amount abi.TokenAmount) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.release(budgetKey(ScopeMiner, miner), amount)
+}
+
+// ReserveFunding counts amount moved from the client wallet into a payment
+// channel against the wallet's budget. If it would exceed the budget nothing
+// is counted, and the error wraps retrievalmarket.ErrBudgetExceeded.
+func (m *Manager) ReserveFunding(clientWallet address.Address, amount abi.TokenAmount) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	key := budgetKey(ScopeWallet, clientWallet)
+	has, err := m.budgets.Has(key)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+	now := m.now()
+	err = m.budgets.Get(key).Mutate(func(b *Budget) error {
+		m.roll(b, now)
+		if big.Add(b.Spent, amount).GreaterThan(b.Cap) {
+			return xerrors.Errorf("moving %s into a payment channel would exceed the %s budget for %s: %s of %s spent: %w",
+				amount, ScopeWallet, clientWallet, b.Spent, b.Cap, rm.ErrBudgetExceeded)
+		}
+		b.Spent = big.Add(b.Spent, amount)
+		return nil
+	})
+	return err
+}
+
+// ReleaseFunding returns a reserved amount that was not moved into a payment
+// channel after all to the budget of the client wallet
+func (m *Manager) ReleaseFunding(clientWallet address.Address, amount abi.TokenAmount) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.release(budgetKey(ScopeWallet, clientWallet), amount)
+}
+
+func (m *Manager) release(key string, amount abi.TokenAmount) error {
+	has, err := m.budgets.Has(key)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+	now := m.now()
+	err = m.budgets.Get(key).Mutate(func(b *Budget) error {
+		m.roll(b, now)
+		b.Spent = big.Max(big.Zero(), big.Sub(b.Spent, amount))
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("releasing spending: %w", err)
+	}
+	return nil
+}
+
+// check checks a payment against the miner and deal budgets that apply to it,
+// and returns the keys of the budgets it should be counted against
+func (m *Manager) check(clientWallet address.Address, miner address.Address, dealSpent abi.TokenAmount, amount abi.TokenAmount) ([]string, error) {
+	now := m.now()
+	var keys []string
+	for _, scope := range []Scope{ScopeMiner, ScopeDeal} {
+		addr := clientWallet
+		if scope == ScopeMiner {
+			addr = miner
+		}
+		key := budgetKey(scope, addr)
+		has, err := m.budgets.Has(key)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			continue
+		}
+		var b Budget
+		if err := m.budgets.Get(key).Get(&b); err != nil {
+			return nil, xerrors.Errorf("loading %s budget for %s: %w", scope, addr, err)
+		}
+
+		spent := dealSpent
+		if scope != ScopeDeal {
+			m.roll(&b, now)
+			spent = b.Spent
+			keys = append(keys, key)
+		}
+		if big.Add(spent, amount).GreaterThan(b.Cap) {
+			return nil, xerrors.Errorf("paying %s would exceed the %s budget for %s: %s of %s spent: %w",
+				amount, scope, addr, spent, b.Cap, rm.ErrBudgetExceeded)
+		}
+	}
+	return keys, nil
+}
+
+// roll starts a new period for the budget if its current period is over
+func (m *Manager) roll(b *Budget, now time.Time) {
+	if b.Period <= 0 {
+		return
+	}
+	start := time.Unix(b.PeriodStart, 0)
+	elapsed := now.Sub(start)
+	if elapsed < b.Period {
+		return
+	}
+	b.PeriodStart = start.Add(elapsed - elapsed%b.Period).Unix()
+	b.Spent = big.Zero()
+}
+
+func budgetKey(scope Scope, addr address.Address) string {
+	return fmt.Sprintf("%s-%s", scope, addr)
+}
@@ -0,0 +1,117 @@
+package budgetmanager_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	spect "github.com/filecoin-project/specs-actors/support/testing"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/budgetmanager"
+)
+
+func TestManager(t *testing.T) {
+	wallet := spect.NewIDAddr(t, 100)
+	otherWallet := spect.NewIDAddr(t, 101)
+	miner := spect.NewIDAddr(t, 200)
+	otherMiner := spect.NewIDAddr(t, 201)
+	amt := abi.NewTokenAmount
+	zero := big.Zero()
+
+	t.Run("caps what a wallet moves into payment channels", func(t *testing.T) {
+		m := budgetmanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, m.SetBudget(budgetmanager.ScopeWallet, wallet, amt(100), 0))
+
+		require.NoError(t, m.ReserveFunding(wallet, amt(60)))
+		require.NoError(t, m.ReserveFunding(wallet, amt(40)))
+		require.True(t, xerrors.Is(m.ReserveFunding(wallet, amt(1)), rm.ErrBudgetExceeded))
+
+		// payments from the funded channels are not counted again
+		require.NoError(t, m.Reserve(wallet, miner, zero, amt(100)))
+
+		// other wallets have no budget
+		require.NoError(t, m.ReserveFunding(otherWallet, amt(1000)))
+
+		// released funds can be moved again
+		require.NoError(t, m.ReleaseFunding(wallet, amt(10)))
+		require.NoError(t, m.ReserveFunding(wallet, amt(10)))
+	})
+
+	t.Run("caps what is paid to a miner", func(t *testing.T) {
+		m := budgetmanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, m.SetBudget(budgetmanager.ScopeMiner, miner, amt(100), 0))
+
+		require.NoError(t, m.Reserve(wallet, miner, zero, amt(50)))
+		require.NoError(t, m.Reserve(otherWallet, miner, zero, amt(50)))
+		require.True(t, xerrors.Is(m.Reserve(wallet, miner, amt(50), amt(1)), rm.ErrBudgetExceeded))
+		require.True(t, xerrors.Is(m.Check(wallet, miner, amt(50), amt(1)), rm.ErrBudgetExceeded))
+		require.NoError(t, m.Reserve(wallet, otherMiner, zero, amt(1)))
+
+		// released payments can be made again
+		require.NoError(t, m.Release(wallet, miner, amt(10)))
+		require.NoError(t, m.Reserve(wallet, miner, amt(50), amt(10)))
+	})
+
+	t.Run("caps what each deal pays", func(t *testing.T) {
+		m := budgetmanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, m.SetBudget(budgetmanager.ScopeDeal, wallet, amt(100), 0))
+		require.Error(t, m.SetBudget(budgetmanager.ScopeDeal, wallet, amt(100), time.Hour))
+
+		require.NoError(t, m.Reserve(wallet, miner, amt(90), amt(10)))
+		require.True(t, xerrors.Is(m.Reserve(wallet, miner, amt(90), amt(11)), rm.ErrBudgetExceeded))
+		// a second deal has its own allowance
+		require.NoError(t, m.Reserve(wallet, miner, zero, amt(100)))
+	})
+
+	t.Run("starts a new period", func(t *testing.T) {
+		now := time.Unix(1000000, 0)
+		m := budgetmanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()), budgetmanager.Clock(func() time.Time { return now }))
+		require.NoError(t, m.SetBudget(budgetmanager.ScopeWallet, wallet, amt(100), time.Hour))
+
+		require.NoError(t, m.ReserveFunding(wallet, amt(100)))
+		require.True(t, xerrors.Is(m.ReserveFunding(wallet, amt(1)), rm.ErrBudgetExceeded))
+
+		now = now.Add(90 * time.Minute)
+		require.NoError(t, m.ReserveFunding(wallet, amt(70)))
+		budgets, err := m.Budgets()
+		require.NoError(t, err)
+		require.Len(t, budgets, 1)
+		require.Equal(t, amt(70), budgets[0].Spent)
+		require.Equal(t, int64(1000000+3600), budgets[0].PeriodStart)
+
+		now = now.Add(3 * time.Hour)
+		budgets, err = m.Budgets()
+		require.NoError(t, err)
+		require.Equal(t, zero, budgets[0].Spent)
+	})
+
+	t.Run("persists budgets and spending", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		m := budgetmanager.NewManager(ds)
+		require.NoError(t, m.SetBudget(budgetmanager.ScopeWallet, wallet, amt(100), 24*time.Hour))
+		require.NoError(t, m.SetBudget(budgetmanager.ScopeMiner, miner, amt(50), 0))
+		require.NoError(t, m.ReserveFunding(wallet, amt(30)))
+		require.NoError(t, m.Reserve(wallet, miner, zero, amt(30)))
+
+		m = budgetmanager.NewManager(ds)
+		budgets, err := m.Budgets()
+		require.NoError(t, err)
+		require.Len(t, budgets, 2)
+		for _, b := range budgets {
+			require.Equal(t, amt(30), b.Spent)
+		}
+		require.True(t, xerrors.Is(m.Reserve(wallet, miner, amt(30), amt(21)), rm.ErrBudgetExceeded))
+		require.True(t, xerrors.Is(m.ReserveFunding(wallet, amt(71)), rm.ErrBudgetExceeded))
+
+		require.NoError(t, m.RemoveBudget(budgetmanager.ScopeMiner, miner))
+		require.NoError(t, m.Reserve(wallet, miner, amt(30), amt(21)))
+		require.Error(t, m.RemoveBudget(budgetmanager.ScopeMiner, miner))
+	})
+}
@@ -0,0 +1,60 @@
+package budgetmanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+//go:generate cbor-gen-for --map-encoding Budget
+
+// Scope is what a budget applies to
+type Scope uint64
+
+const (
+	// ScopeWallet budgets cap the total moved from a client wallet into
+	// payment channels
+	ScopeWallet Scope = iota
+
+	// ScopeMiner budgets cap the total paid to a miner
+	ScopeMiner
+
+	// ScopeDeal budgets cap what each deal made from a client wallet may
+	// pay. They have no period.
+	ScopeDeal
+)
+
+// Scopes maps a scope to a human readable representation
+var Scopes = map[Scope]string{
+	ScopeWallet: "wallet",
+	ScopeMiner:  "miner",
+	ScopeDeal:   "deal",
+}
+
+// Budget caps what retrieval deals may pay in each period
+type Budget struct {
+	Scope Scope
+	// Address is the client wallet for wallet and deal budgets, and the
+	// miner's payment address for miner budgets
+	Address address.Address
+	// Cap is the most that may be paid in a period
+	Cap abi.TokenAmount
+	// Period is the length of a budget period. If it is zero the cap applies
+	// to everything paid since the budget was set.
+	Period time.Duration
+
+	// PeriodStart is the Unix time in seconds at which the current period
+	// began, and Spent is what has been paid in it
+	PeriodStart int64
+	Spent       abi.TokenAmount
+}
+
+func (s Scope) String() string {
+	str, ok := Scopes[s]
+	if ok {
+		return str
+	}
+	return fmt.Sprintf("ScopeUnknown - %d", s)
+}
@@ -20,11 +20,14 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/discovery"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/budgetmanager"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dtutils"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/lanemanager"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -45,11 +48,25 @@ type Client struct {
 	resolver             discovery.PeerResolver
 	stateMachines        fsm.Group
 	migrateStateMachines func(context.Context) error
+	budgetManager        *budgetmanager.Manager
+	laneManager          *lanemanager.Manager
 
 	// Guards concurrent access to Retrieve method
 	retrieveLk sync.Mutex
 }
 
+// RetrievalClientOption is a function that configures a retrieval client
+type RetrievalClientOption func(c *Client)
+
+// BudgetManager has the client count every payment it makes against the
+// budgets of the given manager, and pause deals whose payments would exceed
+// them
+func BudgetManager(manager *budgetmanager.Manager) RetrievalClientOption {
+	return func(c *Client) {
+		c.budgetManager = manager
+	}
+}
+
 type internalEvent struct {
 	evt   retrievalmarket.ClientEvent
 	state retrievalmarket.ClientDealState
@@ -70,8 +87,17 @@ func dispatcher(evt pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
 
 var _ retrievalmarket.RetrievalClient = &Client{}
 
+// ShareLanes has deals between the same client wallet and miner take turns to
+// use the lanes of their payment channel, through the given manager, instead
+// of each allocating a lane of its own
+func ShareLanes(manager *lanemanager.Manager) RetrievalClientOption {
+	return func(c *Client) {
+		c.laneManager = manager
+	}
+}
+
 // NewClient creates a new retrieval client
-func NewClient(network rmnet.RetrievalMarketNetwork, multiStore *multistore.MultiStore, dataTransfer datatransfer.Manager, node retrievalmarket.RetrievalClientNode, resolver discovery.PeerResolver, ds datastore.Batching) (retrievalmarket.RetrievalClient, error) {
+func NewClient(network rmnet.RetrievalMarketNetwork, multiStore *multistore.MultiStore, dataTransfer datatransfer.Manager, node retrievalmarket.RetrievalClientNode, resolver discovery.PeerResolver, ds datastore.Batching, opts ...RetrievalClientOption) (retrievalmarket.RetrievalClient, error) {
 	c := &Client{
 		network:      network,
 		multiStore:   multiStore,
@@ -82,6 +108,9 @@ func NewClient(network rmnet.RetrievalMarketNetwork, multiStore *multistore.Mult
 		subscribers:  pubsub.New(dispatcher),
 		readySub:     pubsub.New(shared.ReadyDispatcher),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
 	retrievalMigrations, err := migrations.ClientMigrations.Build()
 	if err != nil {
 		return nil, err
@@ -142,6 +171,9 @@ func (c *Client) Start(ctx context.Context) error {
 		if err != nil {
 			log.Errorf("Migrating retrieval client state machines: %s", err.Error())
 		}
+		if err == nil && c.laneManager != nil {
+			c.releaseEndedLanes()
+		}
 		err = c.readySub.Publish(err)
 		if err != nil {
 			log.Warnf("Publish retrieval client ready event: %s", err.Error())
@@ -224,6 +256,9 @@ When called, the client takes the following actions:
 From then on, the statemachine controls the deal flow in the client. Other components may listen for events in this flow by calling
 `SubscribeToEvents` on the Client. The Client handles consuming blocks it receives from the provider, via `ConsumeBlocks` function
 
+If the params have a zero price per byte and a zero unseal price, the deal is free: no payment channel is
+created and the deal completes as soon as the last block is received.
+
 Documentation of the client state machine can be found at https://godoc.org/github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates
 */
 func (c *Client) Retrieve(ctx context.Context, payloadCID cid.Cid, params retrievalmarket.Params, totalFunds abi.TokenAmount, p retrievalmarket.RetrievalPeer, clientWallet address.Address, minerWallet address.Address, storeID *multistore.StoreID) (retrievalmarket.DealID, error) {
@@ -314,9 +349,37 @@ func (c *Client) checkForActiveDeal(payloadCID cid.Cid, pid peer.ID) error {
 func (c *Client) notifySubscribers(eventName fsm.EventName, state fsm.StateType) {
 	evt := eventName.(retrievalmarket.ClientEvent)
 	ds := state.(retrievalmarket.ClientDealState)
+	if c.laneManager != nil && clientstates.IsFinalityState(ds.Status) {
+		if err := c.laneManager.Release(ds.ID, ds.FundsSpent); err != nil {
+			log.Errorf("releasing payment channel lane of deal %d: %s", ds.ID, err)
+		}
+	}
 	_ = c.subscribers.Publish(internalEvent{evt, ds})
 }
 
+// releaseEndedLanes releases the shared lanes of deals that ended while the
+// client was not running to release them
+func (c *Client) releaseEndedLanes() {
+	dealIDs, err := c.laneManager.Deals()
+	if err != nil {
+		log.Errorf("listing deals using shared lanes: %s", err)
+		return
+	}
+	for _, dealID := range dealIDs {
+		deal, err := c.GetDeal(dealID)
+		if err != nil {
+			log.Warnf("deal %d using a shared lane was not found, keeping its lane: %s", dealID, err)
+			continue
+		}
+		if !clientstates.IsFinalityState(deal.Status) {
+			continue
+		}
+		if err := c.laneManager.Release(dealID, deal.FundsSpent); err != nil {
+			log.Errorf("releasing payment channel lane of deal %d: %s", dealID, err)
+		}
+	}
+}
+
 func (c *Client) addMultiaddrs(ctx context.Context, p retrievalmarket.RetrievalPeer) error {
 	tok, _, err := c.node.GetChainHead(ctx)
 	if err != nil {
@@ -358,6 +421,25 @@ func (c *Client) TryRestartInsufficientFunds(paymentChannel address.Address) err
 	return nil
 }
 
+// TryRestartBudgetExceeded attempts to restart any deals paused because
+// paying for them would exceed a spending budget. Deals that still exceed a
+// budget are paused again.
+func (c *Client) TryRestartBudgetExceeded() error {
+	var deals []retrievalmarket.ClientDealState
+	err := c.stateMachines.List(&deals)
+	if err != nil {
+		return err
+	}
+	for _, deal := range deals {
+		if deal.Status == retrievalmarket.DealStatusBudgetExceeded {
+			if err := c.stateMachines.Send(deal.ID, retrievalmarket.ClientEventRecheckBudget); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // CancelDeal attempts to cancel an in progress deal
 func (c *Client) CancelDeal(dealID retrievalmarket.DealID) error {
 	return c.stateMachines.Send(dealID, retrievalmarket.ClientEventCancel)
@@ -452,6 +534,75 @@ func (c *clientDealEnvironment) CloseDataTransfer(ctx context.Context, channelID
 	return err
 }
 
+// AllocateLane allocates a payment channel lane for a deal, or gives it a
+// shared lane if the client shares lanes
+func (c *clientDealEnvironment) AllocateLane(ctx context.Context, deal retrievalmarket.ClientDealState, paymentChannel address.Address) (uint64, error) {
+	if c.c.laneManager == nil {
+		return c.c.node.AllocateLane(ctx, paymentChannel)
+	}
+	return c.c.laneManager.Acquire(deal.ID, paymentChannel, func() (uint64, error) {
+		return c.c.node.AllocateLane(ctx, paymentChannel)
+	})
+}
+
+// CreatePaymentVoucher creates a voucher paying amount in total for a deal.
+// On a shared lane the voucher includes what earlier deals paid on the lane.
+func (c *clientDealEnvironment) CreatePaymentVoucher(ctx context.Context, deal retrievalmarket.ClientDealState, amount abi.TokenAmount, tok shared.TipSetToken) (*paych.SignedVoucher, error) {
+	if c.c.laneManager != nil {
+		var err error
+		amount, err = c.c.laneManager.VoucherAmount(deal.ID, amount)
+		if err != nil {
+			return nil, xerrors.Errorf("getting voucher amount on shared lane: %w", err)
+		}
+	}
+	return c.c.node.CreatePaymentVoucher(ctx, deal.PaymentInfo.PayCh, amount, deal.PaymentInfo.Lane, tok)
+}
+
+// ReserveFunds counts a payment for a deal against the client's spending
+// budgets, if it has any
+func (c *clientDealEnvironment) ReserveFunds(deal retrievalmarket.ClientDealState, amount abi.TokenAmount) error {
+	if c.c.budgetManager == nil {
+		return nil
+	}
+	return c.c.budgetManager.Reserve(deal.ClientWallet, deal.MinerWallet, deal.FundsSpent, amount)
+}
+
+// ReleaseFunds returns a reserved payment that was not sent to the client's
+// spending budgets
+func (c *clientDealEnvironment) ReleaseFunds(deal retrievalmarket.ClientDealState, amount abi.TokenAmount) error {
+	if c.c.budgetManager == nil {
+		return nil
+	}
+	return c.c.budgetManager.Release(deal.ClientWallet, deal.MinerWallet, amount)
+}
+
+// CheckBudget checks a payment for a deal against the client's spending
+// budgets, if it has any
+func (c *clientDealEnvironment) CheckBudget(deal retrievalmarket.ClientDealState, amount abi.TokenAmount) error {
+	if c.c.budgetManager == nil {
+		return nil
+	}
+	return c.c.budgetManager.Check(deal.ClientWallet, deal.MinerWallet, deal.FundsSpent, amount)
+}
+
+// ReserveFunding counts funds moved into a payment channel for a deal against
+// the client's spending budgets, if it has any
+func (c *clientDealEnvironment) ReserveFunding(deal retrievalmarket.ClientDealState, amount abi.TokenAmount) error {
+	if c.c.budgetManager == nil {
+		return nil
+	}
+	return c.c.budgetManager.ReserveFunding(deal.ClientWallet, amount)
+}
+
+// ReleaseFunding returns reserved funds that were not moved into a payment
+// channel to the client's spending budgets
+func (c *clientDealEnvironment) ReleaseFunding(deal retrievalmarket.ClientDealState, amount abi.TokenAmount) error {
+	if c.c.budgetManager == nil {
+		return nil
+	}
+	return c.c.budgetManager.ReleaseFunding(deal.ClientWallet, amount)
+}
+
 type clientStoreGetter struct {
 	c *Client
 }
@@ -0,0 +1,129 @@
+package retrievalimpl
+
+import (
+	"bufio"
+	"context"
+	"os"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	files "github.com/ipfs/go-ipfs-files"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientutils"
+)
+
+/*
+ExportDeal writes the DAG a deal retrieved to a CAR file, or reconstructs the
+UnixFS file or directory it encodes, at the given path.
+
+A CAR export holds the blocks of the DAG that are in the deal's store, in
+depth first order, so a deal that is still in progress can be exported to see
+what has been received so far. A UnixFS export needs the whole DAG, so the
+deal must have completed.
+
+If params.DeleteStore is set the deal's store is deleted once the export has
+succeeded, which is only allowed once the deal has ended. Deals that were
+retrieved into the same store, such as the deals of a retrieval with failover,
+lose their data too.
+*/
+func (c *Client) ExportDeal(ctx context.Context, dealID retrievalmarket.DealID, params retrievalmarket.ExportParams) error {
+	deal, err := c.GetDeal(dealID)
+	if err != nil {
+		return xerrors.Errorf("getting deal %d: %w", dealID, err)
+	}
+	if deal.StoreID == nil {
+		return xerrors.Errorf("deal %d was retrieved into the default blockstore, not a store of its own", dealID)
+	}
+	if params.DeleteStore && !dealEnded(deal.Status) {
+		return xerrors.Errorf("cannot delete the store of deal %d: deal is still in progress (%s)", dealID, deal.Status)
+	}
+	if _, err := os.Stat(params.Path); err == nil {
+		return xerrors.Errorf("export path %s already exists", params.Path)
+	}
+	store, err := c.multiStore.Get(*deal.StoreID)
+	if err != nil {
+		return xerrors.Errorf("loading store %d: %w", *deal.StoreID, err)
+	}
+
+	switch params.Format {
+	case retrievalmarket.ExportCAR:
+		err = exportCAR(ctx, store.Bstore, deal.PayloadCID, params.Path)
+	case retrievalmarket.ExportUnixFS:
+		if deal.Status != retrievalmarket.DealStatusCompleted {
+			return xerrors.Errorf("cannot export deal %d as UnixFS: deal has not completed (%s)", dealID, deal.Status)
+		}
+		err = exportUnixFS(ctx, store.DAG, deal.PayloadCID, params.Path)
+	default:
+		return xerrors.Errorf("unknown export format %q", params.Format)
+	}
+	if err != nil {
+		return xerrors.Errorf("exporting deal %d: %w", dealID, err)
+	}
+
+	if params.DeleteStore {
+		if err := c.multiStore.Delete(*deal.StoreID); err != nil {
+			return xerrors.Errorf("deleting store %d: %w", *deal.StoreID, err)
+		}
+	}
+	return nil
+}
+
+// dealEnded returns true if a client deal will make no more progress
+func dealEnded(status retrievalmarket.DealStatus) bool {
+	return retrievalmarket.IsTerminalStatus(status) ||
+		status == retrievalmarket.DealStatusErrored ||
+		status == retrievalmarket.DealStatusCancelled
+}
+
+func exportCAR(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, path string) (err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return xerrors.Errorf("writing CAR header: %w", err)
+	}
+	err = clientutils.WalkStoredDAG(ctx, bs, root, func(c cid.Cid, blk blocks.Block) error {
+		if blk == nil {
+			return nil
+		}
+		return carutil.LdWrite(w, c.Bytes(), blk.RawData())
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func exportUnixFS(ctx context.Context, dag ipldformat.DAGService, root cid.Cid, path string) error {
+	nd, err := dag.Get(ctx, root)
+	if err != nil {
+		return xerrors.Errorf("loading root %s: %w", root, err)
+	}
+	file, err := unixfile.NewUnixfsFile(ctx, dag, nd)
+	if err != nil {
+		return xerrors.Errorf("reading UnixFS root %s: %w", root, err)
+	}
+	if err := files.WriteTo(file, path); err != nil {
+		_ = os.RemoveAll(path)
+		return xerrors.Errorf("writing UnixFS files: %w", err)
+	}
+	return nil
+}
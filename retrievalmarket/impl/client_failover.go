@@ -0,0 +1,121 @@
+package retrievalimpl
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-multistore"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientutils"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+/*
+RetrieveWithFailover retrieves a whole payload, trying providers in turn until
+one of them succeeds.
+
+The client queries every provider the peer resolver knows of for the payload,
+and ranks the ones that have it by the price of the retrieval. It starts a deal
+with the best of them, and when the deal fails, is rejected or stalls, moves
+on to the next. All deals write to the same store. Before each new provider is
+tried the client walks the DAG in the store, and retrieves only the subtrees
+that are missing, each in its own deal, so blocks already received are not
+paid for twice.
+*/
+func (c *Client) RetrieveWithFailover(ctx context.Context, payloadCID cid.Cid, params retrievalmarket.FailoverParams, clientWallet address.Address, storeID *multistore.StoreID) (retrievalmarket.FailoverResult, error) {
+	if storeID == nil {
+		next := c.multiStore.Next()
+		storeID = &next
+	}
+	store, err := c.multiStore.Get(*storeID)
+	if err != nil {
+		return retrievalmarket.FailoverResult{}, xerrors.Errorf("loading store %d: %w", *storeID, err)
+	}
+	result := retrievalmarket.FailoverResult{StoreID: *storeID}
+
+	candidates := clientutils.RankProviders(ctx, c, payloadCID, c.FindProviders(payloadCID), params.QueryParams)
+	if len(candidates) == 0 {
+		return result, xerrors.Errorf("retrieving %s: %w", payloadCID, retrievalmarket.ErrNoProviders)
+	}
+
+	waiter := clientutils.NewDealWaiter(c, *storeID)
+	unsubscribe := c.SubscribeToEvents(waiter.Update)
+	defer unsubscribe()
+
+	var lastErr error
+	for _, candidate := range candidates {
+		err := c.retrieveMissing(ctx, store.Bstore, payloadCID, candidate, params, clientWallet, *storeID, waiter, &result)
+		if err == nil {
+			result.Provider = candidate.Peer.ID
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		log.Warnf("retrieving %s from %s, trying the next provider: %s", payloadCID, candidate.Peer.ID, err)
+		lastErr = err
+	}
+	return result, xerrors.Errorf("retrieving %s: all %d providers failed, the last with: %w", payloadCID, len(candidates), lastErr)
+}
+
+// retrieveMissing retrieves the subtrees of the payload that are not yet in
+// the store from a single provider
+func (c *Client) retrieveMissing(ctx context.Context, bs blockstore.Blockstore, payloadCID cid.Cid, candidate clientutils.Candidate, params retrievalmarket.FailoverParams, clientWallet address.Address, storeID multistore.StoreID, waiter *clientutils.DealWaiter, result *retrievalmarket.FailoverResult) error {
+	missing, err := missingSubtrees(ctx, bs, payloadCID)
+	if err != nil {
+		return err
+	}
+	for _, root := range missing {
+		resp := candidate.Response
+		if root != payloadCID {
+			resp, err = c.Query(ctx, candidate.Peer, root, clientutils.WithAllSelector(root, params.QueryParams))
+			if err != nil {
+				return xerrors.Errorf("querying provider for %s: %w", root, err)
+			}
+			if resp.Status != retrievalmarket.QueryResponseAvailable {
+				return xerrors.Errorf("provider cannot serve %s: %s", root, resp.Message)
+			}
+		}
+		dealParams, err := retrievalmarket.NewParamsV1(resp.MinPricePerByte, resp.MaxPaymentInterval, resp.MaxPaymentIntervalIncrease,
+			shared.AllSelector(), params.PieceCID, resp.UnsealPrice)
+		if err != nil {
+			return err
+		}
+		dealID, err := c.Retrieve(ctx, root, dealParams, clientutils.RetrievalPrice(resp), candidate.Peer, clientWallet, resp.PaymentAddress, &storeID)
+		if err != nil {
+			return xerrors.Errorf("starting deal for %s: %w", root, err)
+		}
+		attempt := retrievalmarket.FailoverAttempt{Provider: candidate.Peer.ID, DealID: dealID, PayloadCID: root}
+		err = waiter.Wait(ctx, dealID, params.StallTimeout, nil)
+		if err != nil {
+			attempt.Err = err.Error()
+		}
+		result.Attempts = append(result.Attempts, attempt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingSubtrees walks the DAG under root in the blockstore, and returns the
+// roots of the largest subtrees whose root block is missing
+func missingSubtrees(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) ([]cid.Cid, error) {
+	var missing []cid.Cid
+	err := clientutils.WalkStoredDAG(ctx, bs, root, func(c cid.Cid, blk blocks.Block) error {
+		if blk == nil {
+			missing = append(missing, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
@@ -5,14 +5,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
 	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-car"
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/assert"
@@ -520,3 +526,174 @@ func TestMigrations(t *testing.T) {
 		require.Equal(t, expectedDeal, deal)
 	}
 }
+
+func TestClient_RetrieveWithFailover(t *testing.T) {
+	ctx := context.Background()
+	tree := tut.NewTestIPLDTree()
+	payloadCID := tree.RootBlock.Cid()
+	peers := tut.RequireGenerateRetrievalPeers(t, 3)
+	responses := map[peer.ID]retrievalmarket.QueryResponse{
+		peers[0].ID: {
+			Status:              retrievalmarket.QueryResponseAvailable,
+			ExpectedPayloadSize: 100,
+			PaymentAddress:      address.TestAddress2,
+			MinPricePerByte:     abi.NewTokenAmount(2),
+			MaxPaymentInterval:  100,
+			UnsealPrice:         big.Zero(),
+		},
+		peers[1].ID: {
+			Status:              retrievalmarket.QueryResponseAvailable,
+			ExpectedPayloadSize: 100,
+			PaymentAddress:      address.TestAddress2,
+			MinPricePerByte:     abi.NewTokenAmount(1),
+			MaxPaymentInterval:  100,
+			UnsealPrice:         big.Zero(),
+		},
+		peers[2].ID: {
+			Status: retrievalmarket.QueryResponseUnavailable,
+		},
+	}
+
+	setup := func(t *testing.T, available []retrievalmarket.RetrievalPeer) (retrievalmarket.RetrievalClient, *multistore.MultiStore) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		multiStore, err := multistore.NewMultiDstore(ds)
+		require.NoError(t, err)
+		var qsb tut.QueryStreamBuilder = func(p peer.ID) (rmnet.RetrievalQueryStream, error) {
+			return tut.NewTestRetrievalQueryStream(tut.TestQueryStreamParams{
+				Writer:     tut.TrivialQueryWriter,
+				RespReader: tut.StubbedQueryResponseReader(responses[p]),
+			}), nil
+		}
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{QueryStreamBuilder: qsb})
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		for _, p := range peers {
+			node.ExpectKnownAddresses(p, nil)
+		}
+		client, err := retrievalimpl.NewClient(net, multiStore, tut.NewTestDataTransfer(), node, &tut.TestPeerResolver{Peers: available}, ds)
+		require.NoError(t, err)
+		tut.StartAndWaitForReady(ctx, t, client)
+		return client, multiStore
+	}
+
+	newStore := func(t *testing.T, multiStore *multistore.MultiStore, blks ...blocks.Block) multistore.StoreID {
+		storeID := multiStore.Next()
+		store, err := multiStore.Get(storeID)
+		require.NoError(t, err)
+		require.NoError(t, store.Bstore.PutMany(blks))
+		return storeID
+	}
+
+	t.Run("fails over to the next provider, keeping received blocks", func(t *testing.T) {
+		client, multiStore := setup(t, peers)
+		// the store has everything but the linked list and one of its leaves
+		storeID := newStore(t, multiStore, tree.RootBlock, tree.LeafAlphaBlock, tree.MiddleMapBlock)
+
+		// the test data transfer never sends any data, so no deal completes
+		params := retrievalmarket.FailoverParams{StallTimeout: 50 * time.Millisecond}
+		result, err := client.RetrieveWithFailover(ctx, payloadCID, params, address.TestAddress, &storeID)
+		require.Error(t, err)
+		require.Equal(t, storeID, result.StoreID)
+		require.Len(t, result.Attempts, 2)
+		// the cheapest provider is tried first, and only the missing subtree
+		// is retrieved
+		for i, p := range []peer.ID{peers[1].ID, peers[0].ID} {
+			require.Equal(t, p, result.Attempts[i].Provider)
+			require.Equal(t, tree.MiddleListBlock.Cid(), result.Attempts[i].PayloadCID)
+			require.NotEmpty(t, result.Attempts[i].Err)
+		}
+	})
+
+	t.Run("succeeds without deals when the payload is already in the store", func(t *testing.T) {
+		client, multiStore := setup(t, peers)
+		storeID := newStore(t, multiStore, tree.RootBlock, tree.LeafAlphaBlock, tree.LeafBetaBlock, tree.MiddleMapBlock, tree.MiddleListBlock)
+		result, err := client.RetrieveWithFailover(ctx, payloadCID, retrievalmarket.FailoverParams{}, address.TestAddress, &storeID)
+		require.NoError(t, err)
+		require.Equal(t, peers[1].ID, result.Provider)
+		require.Empty(t, result.Attempts)
+	})
+
+	t.Run("no providers have the payload", func(t *testing.T) {
+		client, _ := setup(t, peers[2:])
+		_, err := client.RetrieveWithFailover(ctx, payloadCID, retrievalmarket.FailoverParams{}, address.TestAddress, nil)
+		require.True(t, errors.Is(err, retrievalmarket.ErrNoProviders))
+	})
+}
+
+func TestClient_ExportDeal(t *testing.T) {
+	ctx := context.Background()
+	tree := tut.NewTestIPLDTree()
+	payloadCID := tree.RootBlock.Cid()
+	rpeer := tut.RequireGenerateRetrievalPeers(t, 1)[0]
+
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	multiStore, err := multistore.NewMultiDstore(ds)
+	require.NoError(t, err)
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+	node.ExpectKnownAddresses(rpeer, nil)
+	client, err := retrievalimpl.NewClient(tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{}), multiStore, tut.NewTestDataTransfer(), node, &tut.TestPeerResolver{}, ds)
+	require.NoError(t, err)
+	tut.StartAndWaitForReady(ctx, t, client)
+
+	storeID := multiStore.Next()
+	store, err := multiStore.Get(storeID)
+	require.NoError(t, err)
+	params, err := retrievalmarket.NewParamsV1(abi.NewTokenAmount(1), 100, 0, shared.AllSelector(), nil, big.Zero())
+	require.NoError(t, err)
+	dealID, err := client.Retrieve(ctx, payloadCID, params, abi.NewTokenAmount(1000), rpeer, address.TestAddress, address.TestAddress2, &storeID)
+	require.NoError(t, err)
+
+	// the deal has received everything but one leaf
+	require.NoError(t, store.Bstore.PutMany([]blocks.Block{tree.RootBlock, tree.LeafAlphaBlock, tree.MiddleMapBlock, tree.MiddleListBlock}))
+
+	dir, err := ioutil.TempDir("", "export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("exports an in progress deal to a CAR file", func(t *testing.T) {
+		path := filepath.Join(dir, "partial.car")
+		err := client.ExportDeal(ctx, dealID, retrievalmarket.ExportParams{Format: retrievalmarket.ExportCAR, Path: path})
+		require.NoError(t, err)
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		cr, err := car.NewCarReader(f)
+		require.NoError(t, err)
+		require.Equal(t, []cid.Cid{payloadCID}, cr.Header.Roots)
+		var exported []cid.Cid
+		for {
+			blk, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			exported = append(exported, blk.Cid())
+		}
+		require.ElementsMatch(t, []cid.Cid{payloadCID, tree.LeafAlphaBlock.Cid(), tree.MiddleMapBlock.Cid(), tree.MiddleListBlock.Cid()}, exported)
+
+		err = client.ExportDeal(ctx, dealID, retrievalmarket.ExportParams{Format: retrievalmarket.ExportCAR, Path: path})
+		require.Error(t, err, "export path already exists")
+	})
+
+	t.Run("needs a completed deal for UnixFS", func(t *testing.T) {
+		err := client.ExportDeal(ctx, dealID, retrievalmarket.ExportParams{Format: retrievalmarket.ExportUnixFS, Path: filepath.Join(dir, "file")})
+		require.Error(t, err)
+	})
+
+	t.Run("deletes the store once the deal has ended", func(t *testing.T) {
+		path := filepath.Join(dir, "deleted.car")
+		err := client.ExportDeal(ctx, dealID, retrievalmarket.ExportParams{Format: retrievalmarket.ExportCAR, Path: path, DeleteStore: true})
+		require.Error(t, err)
+		require.Contains(t, multiStore.List(), storeID)
+
+		require.NoError(t, client.CancelDeal(dealID))
+		require.Eventually(t, func() bool {
+			deal, err := client.GetDeal(dealID)
+			return err == nil && deal.Status == retrievalmarket.DealStatusCancelled
+		}, time.Second, 10*time.Millisecond)
+
+		err = client.ExportDeal(ctx, dealID, retrievalmarket.ExportParams{Format: retrievalmarket.ExportCAR, Path: path, DeleteStore: true})
+		require.NoError(t, err)
+		require.NotContains(t, multiStore.List(), storeID)
+	})
+}
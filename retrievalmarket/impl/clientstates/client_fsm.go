@@ -68,6 +68,15 @@ var ClientEvents = fsm.Events{
 		}),
 	fsm.Event(rm.ClientEventDealAccepted).
 		FromMany(rm.DealStatusWaitForAcceptance, rm.DealStatusWaitForAcceptanceLegacy).To(rm.DealStatusAccepted),
+	// a queued deal has been accepted, and a deal that has paid to unseal
+	// carries on waiting for the provider
+	fsm.Event(rm.ClientEventDealQueued).
+		FromMany(rm.DealStatusWaitForAcceptance, rm.DealStatusWaitForAcceptanceLegacy).To(rm.DealStatusAccepted).
+		FromAny().ToJustRecord().
+		Action(func(deal *rm.ClientDealState) error {
+			deal.Message = "Provider queued the deal until it has capacity to serve it"
+			return nil
+		}),
 	fsm.Event(rm.ClientEventUnknownResponseReceived).
 		FromAny().To(rm.DealStatusFailing).
 		Action(func(deal *rm.ClientDealState, status rm.DealStatus) error {
@@ -172,6 +181,7 @@ var ClientEvents = fsm.Events{
 		From(rm.DealStatusBlocksComplete).To(rm.DealStatusSendFundsLastPayment).
 		FromMany(
 			paymentChannelCreationStates...).ToJustRecord().
+		From(rm.DealStatusBudgetExceeded).ToJustRecord().
 		Action(func(deal *rm.ClientDealState, paymentOwed abi.TokenAmount) error {
 			deal.PaymentRequested = big.Add(deal.PaymentRequested, paymentOwed)
 			deal.LastPaymentRequested = true
@@ -187,6 +197,7 @@ var ClientEvents = fsm.Events{
 		From(rm.DealStatusCheckComplete).ToNoChange().
 		FromMany(
 			paymentChannelCreationStates...).ToJustRecord().
+		From(rm.DealStatusBudgetExceeded).ToJustRecord().
 		Action(func(deal *rm.ClientDealState, paymentOwed abi.TokenAmount) error {
 			deal.PaymentRequested = big.Add(deal.PaymentRequested, paymentOwed)
 			return nil
@@ -211,6 +222,7 @@ var ClientEvents = fsm.Events{
 		From(rm.DealStatusFundsNeededLastPayment).To(rm.DealStatusSendFundsLastPayment).
 		From(rm.DealStatusClientWaitingForLastBlocks).To(rm.DealStatusCompleted).
 		From(rm.DealStatusCheckComplete).To(rm.DealStatusCompleted).
+		From(rm.DealStatusBudgetExceeded).ToJustRecord().
 		Action(func(deal *rm.ClientDealState) error {
 			deal.AllBlocksReceived = true
 			return nil
@@ -223,6 +235,7 @@ var ClientEvents = fsm.Events{
 			rm.DealStatusClientWaitingForLastBlocks).ToNoChange().
 		FromMany(rm.DealStatusSendFunds, rm.DealStatusSendFundsLastPayment).To(rm.DealStatusOngoing).
 		FromMany(paymentChannelCreationStates...).ToJustRecord().
+		From(rm.DealStatusBudgetExceeded).ToJustRecord().
 		Action(recordReceived),
 
 	fsm.Event(rm.ClientEventSendFunds).
@@ -249,6 +262,12 @@ var ClientEvents = fsm.Events{
 			deal.Message = xerrors.Errorf("creating payment voucher: %w", err).Error()
 			return nil
 		}),
+	fsm.Event(rm.ClientEventBudgetExceeded).
+		FromMany(rm.DealStatusSendFunds, rm.DealStatusSendFundsLastPayment, rm.DealStatusCheckFunds).To(rm.DealStatusBudgetExceeded).
+		Action(func(deal *rm.ClientDealState, err error) error {
+			deal.Message = xerrors.Errorf("pausing deal: %w", err).Error()
+			return nil
+		}),
 	fsm.Event(rm.ClientEventVoucherShortfall).
 		FromMany(rm.DealStatusSendFunds, rm.DealStatusSendFundsLastPayment).To(rm.DealStatusCheckFunds).
 		Action(func(deal *rm.ClientDealState, shortfall abi.TokenAmount) error {
@@ -325,7 +344,10 @@ var ClientEvents = fsm.Events{
 			rm.DealStatusFundsNeededLastPayment).To(rm.DealStatusCheckComplete).
 		From(rm.DealStatusOngoing).To(rm.DealStatusCheckComplete).
 		From(rm.DealStatusBlocksComplete).To(rm.DealStatusCheckComplete).
-		From(rm.DealStatusFinalizing).To(rm.DealStatusCompleted),
+		From(rm.DealStatusFinalizing).To(rm.DealStatusCompleted).
+		// a free deal completes when all blocks are received, before the
+		// provider sends its complete message
+		From(rm.DealStatusCompleted).ToJustRecord(),
 	fsm.Event(rm.ClientEventCompleteVerified).
 		From(rm.DealStatusCheckComplete).To(rm.DealStatusCompleted),
 	fsm.Event(rm.ClientEventEarlyTermination).
@@ -353,9 +375,12 @@ var ClientEvents = fsm.Events{
 		From(rm.DealStatusFailing).ToJustRecord().
 		From(rm.DealStatusCancelling).ToJustRecord().
 		FromAny().To(rm.DealStatusCancelling).Action(
-		func(deal *rm.ClientDealState) error {
+		func(deal *rm.ClientDealState, reason string) error {
 			if deal.Status != rm.DealStatusFailing && deal.Status != rm.DealStatusCancelling {
 				deal.Message = "Provider cancelled retrieval"
+				if reason != "" {
+					deal.Message += ": " + reason
+				}
 			}
 			return nil
 		},
@@ -369,6 +394,14 @@ var ClientEvents = fsm.Events{
 
 	// payment channel receives more money, we believe there may be reason to recheck the funds for this channel
 	fsm.Event(rm.ClientEventRecheckFunds).From(rm.DealStatusInsufficientFunds).To(rm.DealStatusCheckFunds),
+
+	// a spending budget was raised or a new budget period began, so go back to
+	// the ongoing state, which requests the payment that is still owed
+	fsm.Event(rm.ClientEventRecheckBudget).From(rm.DealStatusBudgetExceeded).To(rm.DealStatusOngoing).
+		Action(func(deal *rm.ClientDealState) error {
+			deal.Message = ""
+			return nil
+		}),
 }
 
 // ClientFinalityStates are terminal states after which no further events are received
@@ -398,6 +431,7 @@ var ClientStateEntryFuncs = fsm.StateEntryFuncs{
 	rm.DealStatusPaymentChannelAddingInitialFunds: WaitPaymentChannelReady,
 	rm.DealStatusPaymentChannelAllocatingLane:     AllocateLane,
 	rm.DealStatusOngoing:                          Ongoing,
+	rm.DealStatusBlocksComplete:                   BlocksComplete,
 	rm.DealStatusFundsNeeded:                      ProcessPaymentRequested,
 	rm.DealStatusFundsNeededLastPayment:           ProcessPaymentRequested,
 	rm.DealStatusSendFunds:                        SendFunds,
@@ -5,14 +5,17 @@ import (
 
 	logging "github.com/ipfs/go-log/v2"
 	peer "github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
 )
 
 var log = logging.Logger("markets-rtvl")
@@ -25,6 +28,27 @@ type ClientDealEnvironment interface {
 	OpenDataTransfer(ctx context.Context, to peer.ID, proposal *rm.DealProposal, legacy bool) (datatransfer.ChannelID, error)
 	SendDataTransferVoucher(context.Context, datatransfer.ChannelID, *rm.DealPayment, bool) error
 	CloseDataTransfer(context.Context, datatransfer.ChannelID) error
+	// AllocateLane allocates a lane of the payment channel for the deal
+	AllocateLane(ctx context.Context, deal rm.ClientDealState, paymentChannel address.Address) (uint64, error)
+	// CreatePaymentVoucher creates a voucher on the deal's lane that pays the
+	// provider amount in total for the deal
+	CreatePaymentVoucher(ctx context.Context, deal rm.ClientDealState, amount abi.TokenAmount, tok shared.TipSetToken) (*paych.SignedVoucher, error)
+	// ReserveFunds counts a payment for the deal against the client's
+	// spending budgets, returning an error that wraps rm.ErrBudgetExceeded
+	// if the payment would exceed one of them
+	ReserveFunds(deal rm.ClientDealState, amount abi.TokenAmount) error
+	// ReleaseFunds returns a reserved payment that was not sent
+	ReleaseFunds(deal rm.ClientDealState, amount abi.TokenAmount) error
+	// CheckBudget checks whether a payment for the deal would exceed one of
+	// the client's spending budgets, without counting it
+	CheckBudget(deal rm.ClientDealState, amount abi.TokenAmount) error
+	// ReserveFunding counts funds moved from the deal's wallet into a payment
+	// channel against the client's spending budgets, returning an error that
+	// wraps rm.ErrBudgetExceeded if they would exceed one of them
+	ReserveFunding(deal rm.ClientDealState, amount abi.TokenAmount) error
+	// ReleaseFunding returns reserved funds that were not moved into a
+	// payment channel
+	ReleaseFunding(deal rm.ClientDealState, amount abi.TokenAmount) error
 }
 
 // ProposeDeal sends the proposal to the other party
@@ -39,8 +63,9 @@ func ProposeDeal(ctx fsm.Context, environment ClientDealEnvironment, deal rm.Cli
 
 // SetupPaymentChannelStart initiates setting up a payment channel for a deal
 func SetupPaymentChannelStart(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
-	// If the total funds required for the deal are zero, skip creating the payment channel
-	if deal.TotalFunds.IsZero() {
+	// If the total funds required for the deal are zero, or the deal is free,
+	// skip creating the payment channel
+	if deal.TotalFunds.IsZero() || deal.IsFree() {
 		return ctx.Trigger(rm.ClientEventPaymentChannelSkip)
 	}
 
@@ -49,8 +74,15 @@ func SetupPaymentChannelStart(ctx fsm.Context, environment ClientDealEnvironment
 		return ctx.Trigger(rm.ClientEventPaymentChannelErrored, err)
 	}
 
+	// The deal's total funds are the most that can be moved into the channel
+	if err := environment.ReserveFunding(deal, deal.TotalFunds); err != nil {
+		return ctx.Trigger(rm.ClientEventPaymentChannelErrored, err)
+	}
 	paych, msgCID, err := environment.Node().GetOrCreatePaymentChannel(ctx.Context(), deal.ClientWallet, deal.MinerWallet, deal.TotalFunds, tok)
 	if err != nil {
+		if releaseErr := environment.ReleaseFunding(deal, deal.TotalFunds); releaseErr != nil {
+			log.Errorf("releasing funding reserved for deal %d: %s", deal.ID, releaseErr)
+		}
 		return ctx.Trigger(rm.ClientEventPaymentChannelErrored, err)
 	}
 
@@ -72,7 +104,7 @@ func WaitPaymentChannelReady(ctx fsm.Context, environment ClientDealEnvironment,
 
 // AllocateLane allocates a lane for this retrieval operation
 func AllocateLane(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
-	lane, err := environment.Node().AllocateLane(ctx.Context(), deal.PaymentInfo.PayCh)
+	lane, err := environment.AllocateLane(ctx.Context(), deal, deal.PaymentInfo.PayCh)
 	if err != nil {
 		return ctx.Trigger(rm.ClientEventAllocateLaneErrored, err)
 	}
@@ -81,6 +113,10 @@ func AllocateLane(ctx fsm.Context, environment ClientDealEnvironment, deal rm.Cl
 
 // Ongoing just double checks that we may need to move out of the ongoing state cause a payment was previously requested
 func Ongoing(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
+	// A free deal is complete as soon as all blocks are received
+	if deal.IsFree() && deal.AllBlocksReceived {
+		return ctx.Trigger(rm.ClientEventComplete)
+	}
 	if deal.PaymentRequested.GreaterThan(big.Zero()) {
 		if deal.LastPaymentRequested {
 			return ctx.Trigger(rm.ClientEventLastPaymentRequested, big.Zero())
@@ -90,6 +126,15 @@ func Ongoing(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientD
 	return nil
 }
 
+// BlocksComplete completes a free deal once all blocks are received, without
+// waiting for the provider to request a last payment
+func BlocksComplete(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
+	if deal.IsFree() {
+		return ctx.Trigger(rm.ClientEventComplete)
+	}
+	return nil
+}
+
 // ProcessPaymentRequested processes a request for payment from the provider
 func ProcessPaymentRequested(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
 	// If the unseal payment hasn't been made, we need to send funds
@@ -165,9 +210,20 @@ func SendFunds(ctx fsm.Context, environment ClientDealEnvironment, deal rm.Clien
 	log.Debugf("client: sending voucher for %d = transfer price %d + unseal price %d (payment requested %d)",
 		totalPrice, transferPrice, deal.UnsealPrice, deal.PaymentRequested)
 
+	// Count the payment against the client's spending budgets
+	payment := big.Sub(totalPrice, deal.FundsSpent)
+	err = environment.ReserveFunds(deal, payment)
+	if err != nil {
+		if xerrors.Is(err, rm.ErrBudgetExceeded) {
+			return ctx.Trigger(rm.ClientEventBudgetExceeded, err)
+		}
+		return ctx.Trigger(rm.ClientEventCreateVoucherFailed, err)
+	}
+
 	// Create a payment voucher
-	voucher, err := environment.Node().CreatePaymentVoucher(ctx.Context(), deal.PaymentInfo.PayCh, totalPrice, deal.PaymentInfo.Lane, tok)
+	voucher, err := environment.CreatePaymentVoucher(ctx.Context(), deal, totalPrice, tok)
 	if err != nil {
+		releaseFunds(environment, deal, payment)
 		shortfallErr, ok := err.(rm.ShortfallError)
 		if ok {
 			// There were not enough funds in the payment channel to create a
@@ -187,16 +243,32 @@ func SendFunds(ctx fsm.Context, environment ClientDealEnvironment, deal rm.Clien
 		PaymentVoucher: voucher,
 	}, deal.LegacyProtocol)
 	if err != nil {
+		releaseFunds(environment, deal, payment)
 		return ctx.Trigger(rm.ClientEventWriteDealPaymentErrored, err)
 	}
 
 	return ctx.Trigger(rm.ClientEventPaymentSent, totalPrice)
 }
 
+func releaseFunds(environment ClientDealEnvironment, deal rm.ClientDealState, amount abi.TokenAmount) {
+	if err := environment.ReleaseFunds(deal, amount); err != nil {
+		log.Warnf("client: releasing reserved funds for deal %d: %s", deal.ID, err)
+	}
+}
+
 // CheckFunds examines current available funds in a payment channel after a voucher shortfall to determine
 // a course of action -- whether it's a good time to try again, wait for pending operations, or
 // we've truly expended all funds and we need to wait for a manual readd
 func CheckFunds(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
+	// there's no point waiting for more funds if paying what is owed would
+	// exceed a spending budget
+	err := environment.CheckBudget(deal, deal.PaymentRequested)
+	if err != nil {
+		if xerrors.Is(err, rm.ErrBudgetExceeded) {
+			return ctx.Trigger(rm.ClientEventBudgetExceeded, err)
+		}
+		return ctx.Trigger(rm.ClientEventPaymentChannelErrored, err)
+	}
 	// if we already have an outstanding operation, let's wait for that to complete
 	if deal.WaitMsgCID != nil {
 		return ctx.Trigger(rm.ClientEventPaymentChannelAddingFunds, *deal.WaitMsgCID, deal.PaymentInfo.PayCh)
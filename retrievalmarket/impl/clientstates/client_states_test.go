@@ -9,6 +9,7 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -22,6 +23,7 @@ import (
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	"github.com/filecoin-project/go-fil-markets/shared"
 	testnet "github.com/filecoin-project/go-fil-markets/shared_testutil"
 )
 
@@ -36,6 +38,7 @@ type fakeEnvironment struct {
 	OpenDataTransferError        error
 	SendDataTransferVoucherError error
 	CloseDataTransferError       error
+	BudgetError                  error
 }
 
 func (e *fakeEnvironment) Node() retrievalmarket.RetrievalClientNode {
@@ -54,13 +57,41 @@ func (e *fakeEnvironment) CloseDataTransfer(_ context.Context, _ datatransfer.Ch
 	return e.CloseDataTransferError
 }
 
+func (e *fakeEnvironment) AllocateLane(ctx context.Context, _ rm.ClientDealState, paymentChannel address.Address) (uint64, error) {
+	return e.node.AllocateLane(ctx, paymentChannel)
+}
+
+func (e *fakeEnvironment) CreatePaymentVoucher(ctx context.Context, deal rm.ClientDealState, amount abi.TokenAmount, tok shared.TipSetToken) (*paych.SignedVoucher, error) {
+	return e.node.CreatePaymentVoucher(ctx, deal.PaymentInfo.PayCh, amount, deal.PaymentInfo.Lane, tok)
+}
+
+func (e *fakeEnvironment) ReserveFunds(_ rm.ClientDealState, _ abi.TokenAmount) error {
+	return e.BudgetError
+}
+
+func (e *fakeEnvironment) ReleaseFunds(_ rm.ClientDealState, _ abi.TokenAmount) error {
+	return nil
+}
+
+func (e *fakeEnvironment) CheckBudget(_ rm.ClientDealState, _ abi.TokenAmount) error {
+	return e.BudgetError
+}
+
+func (e *fakeEnvironment) ReserveFunding(_ rm.ClientDealState, _ abi.TokenAmount) error {
+	return e.BudgetError
+}
+
+func (e *fakeEnvironment) ReleaseFunding(_ rm.ClientDealState, _ abi.TokenAmount) error {
+	return nil
+}
+
 func TestProposeDeal(t *testing.T) {
 	ctx := context.Background()
 	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
 	eventMachine, err := fsm.NewEventProcessor(retrievalmarket.ClientDealState{}, "Status", clientstates.ClientEvents)
 	require.NoError(t, err)
 	runProposeDeal := func(t *testing.T, openError error, dealState *retrievalmarket.ClientDealState) {
-		environment := &fakeEnvironment{node, openError, nil, nil}
+		environment := &fakeEnvironment{node, openError, nil, nil, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.ProposeDeal(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -101,9 +132,13 @@ func TestSetupPaymentChannel(t *testing.T) {
 	require.NoError(t, err)
 	runSetupPaymentChannel := func(t *testing.T,
 		params testnodes.TestRetrievalClientNodeParams,
-		dealState *retrievalmarket.ClientDealState) {
+		dealState *retrievalmarket.ClientDealState,
+		budgetErr ...error) {
 		node := testnodes.NewTestRetrievalClientNode(params)
-		environment := &fakeEnvironment{node, nil, nil, nil}
+		environment := &fakeEnvironment{node, nil, nil, nil, nil}
+		if len(budgetErr) > 0 {
+			environment.BudgetError = budgetErr[0]
+		}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.SetupPaymentChannelStart(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -147,6 +182,18 @@ func TestSetupPaymentChannel(t *testing.T) {
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailing)
 	})
 
+	t.Run("when funding the channel would exceed the wallet budget", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		envParams := testnodes.TestRetrievalClientNodeParams{
+			PayCh:          address.Undef,
+			CreatePaychCID: testnet.GenerateCids(1)[0],
+		}
+		runSetupPaymentChannel(t, envParams, dealState, xerrors.Errorf("wallet budget: %w", rm.ErrBudgetExceeded))
+		require.Contains(t, dealState.Message, rm.ErrBudgetExceeded.Error())
+		require.Equal(t, retrievalmarket.DealStatusFailing, dealState.Status)
+		require.Nil(t, dealState.WaitMsgCID)
+	})
+
 	t.Run("payment channel skip if total funds is zero", func(t *testing.T) {
 		envParams := testnodes.TestRetrievalClientNodeParams{}
 		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
@@ -155,6 +202,20 @@ func TestSetupPaymentChannel(t *testing.T) {
 		assert.Empty(t, dealState.Message)
 		assert.Equal(t, dealState.Status, retrievalmarket.DealStatusOngoing)
 	})
+
+	t.Run("payment channel skip if deal is free", func(t *testing.T) {
+		envParams := testnodes.TestRetrievalClientNodeParams{
+			PayCh:          address.Undef,
+			CreatePaychCID: testnet.GenerateCids(1)[0],
+		}
+		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		dealState.PricePerByte = big.Zero()
+		dealState.UnsealPrice = big.Zero()
+		runSetupPaymentChannel(t, envParams, dealState)
+		assert.Empty(t, dealState.Message)
+		assert.Nil(t, dealState.WaitMsgCID)
+		assert.Equal(t, dealState.Status, retrievalmarket.DealStatusOngoing)
+	})
 }
 
 func TestWaitForPaymentReady(t *testing.T) {
@@ -166,7 +227,7 @@ func TestWaitForPaymentReady(t *testing.T) {
 		params testnodes.TestRetrievalClientNodeParams,
 		dealState *retrievalmarket.ClientDealState) {
 		node := testnodes.NewTestRetrievalClientNode(params)
-		environment := &fakeEnvironment{node, nil, nil, nil}
+		environment := &fakeEnvironment{node, nil, nil, nil, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.WaitPaymentChannelReady(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -221,7 +282,7 @@ func TestAllocateLane(t *testing.T) {
 		params testnodes.TestRetrievalClientNodeParams,
 		dealState *retrievalmarket.ClientDealState) {
 		node := testnodes.NewTestRetrievalClientNode(params)
-		environment := &fakeEnvironment{node, nil, nil, nil}
+		environment := &fakeEnvironment{node, nil, nil, nil, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.AllocateLane(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -256,7 +317,7 @@ func TestOngoing(t *testing.T) {
 	runOngoing := func(t *testing.T,
 		dealState *retrievalmarket.ClientDealState) {
 		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
-		environment := &fakeEnvironment{node, nil, nil, nil}
+		environment := &fakeEnvironment{node, nil, nil, nil, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.Ongoing(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -282,6 +343,43 @@ func TestOngoing(t *testing.T) {
 		runOngoing(t, dealState)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeededLastPayment)
 	})
+
+	t.Run("it works - free deal with all blocks received", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusOngoing)
+		dealState.PricePerByte = big.Zero()
+		dealState.PaymentRequested = big.Zero()
+		dealState.AllBlocksReceived = true
+		runOngoing(t, dealState)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusCheckComplete)
+	})
+}
+
+func TestBlocksComplete(t *testing.T) {
+	ctx := context.Background()
+	eventMachine, err := fsm.NewEventProcessor(retrievalmarket.ClientDealState{}, "Status", clientstates.ClientEvents)
+	require.NoError(t, err)
+	runBlocksComplete := func(t *testing.T,
+		dealState *retrievalmarket.ClientDealState) {
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		environment := &fakeEnvironment{node, nil, nil, nil, nil}
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		err := clientstates.BlocksComplete(fsmCtx, environment, *dealState)
+		require.NoError(t, err)
+		fsmCtx.ReplayEvents(t, dealState)
+	}
+
+	t.Run("waits for the provider when the deal has a price", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusBlocksComplete)
+		runBlocksComplete(t, dealState)
+		require.Equal(t, retrievalmarket.DealStatusBlocksComplete, dealState.Status)
+	})
+
+	t.Run("completes a free deal", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusBlocksComplete)
+		dealState.PricePerByte = big.Zero()
+		runBlocksComplete(t, dealState)
+		require.Equal(t, retrievalmarket.DealStatusCheckComplete, dealState.Status)
+	})
 }
 
 func TestProcessPaymentRequested(t *testing.T) {
@@ -291,7 +389,7 @@ func TestProcessPaymentRequested(t *testing.T) {
 	runProcessPaymentRequested := func(t *testing.T,
 		dealState *retrievalmarket.ClientDealState) {
 		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
-		environment := &fakeEnvironment{node, nil, nil, nil}
+		environment := &fakeEnvironment{node, nil, nil, nil, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.ProcessPaymentRequested(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -361,7 +459,7 @@ func TestSendFunds(t *testing.T) {
 		nodeParams testnodes.TestRetrievalClientNodeParams,
 		dealState *retrievalmarket.ClientDealState) {
 		node := testnodes.NewTestRetrievalClientNode(nodeParams)
-		environment := &fakeEnvironment{node, nil, sendDataTransferVoucherError, nil}
+		environment := &fakeEnvironment{node, nil, sendDataTransferVoucherError, nil, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		dealState.ChannelID = &datatransfer.ChannelID{
 			Initiator: "initiator",
@@ -615,6 +713,28 @@ func TestSendFunds(t *testing.T) {
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusErrored)
 	})
+
+	t.Run("budget exceeded", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusSendFunds)
+		dealState.PricePerByte = abi.NewTokenAmount(1)
+		dealState.UnsealPrice = abi.NewTokenAmount(0)
+		dealState.UnsealFundsPaid = abi.NewTokenAmount(0)
+		dealState.BytesPaidFor = 0
+		dealState.FundsSpent = abi.NewTokenAmount(0)
+		dealState.PaymentRequested = abi.NewTokenAmount(1000)
+		dealState.CurrentInterval = 1000
+		dealState.TotalReceived = 1000
+		dealState.ChannelID = &datatransfer.ChannelID{Initiator: "initiator", Responder: dealState.Sender, ID: 1}
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{Voucher: testVoucher})
+		environment := &fakeEnvironment{node, nil, nil, nil, xerrors.Errorf("wallet budget: %w", rm.ErrBudgetExceeded)}
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		err := clientstates.SendFunds(fsmCtx, environment, *dealState)
+		require.NoError(t, err)
+		fsmCtx.ReplayEvents(t, dealState)
+		require.Contains(t, dealState.Message, rm.ErrBudgetExceeded.Error())
+		require.Equal(t, retrievalmarket.DealStatusBudgetExceeded, dealState.Status)
+		require.Equal(t, abi.NewTokenAmount(0), dealState.FundsSpent)
+	})
 }
 
 func TestCheckFunds(t *testing.T) {
@@ -625,7 +745,7 @@ func TestCheckFunds(t *testing.T) {
 		params testnodes.TestRetrievalClientNodeParams,
 		dealState *retrievalmarket.ClientDealState) {
 		node := testnodes.NewTestRetrievalClientNode(params)
-		environment := &fakeEnvironment{node, nil, nil, nil}
+		environment := &fakeEnvironment{node, nil, nil, nil, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.CheckFunds(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -680,6 +800,18 @@ func TestCheckFunds(t *testing.T) {
 		runCheckFunds(t, nodeParams, dealState)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusInsufficientFunds)
 	})
+
+	t.Run("budget exceeded", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusCheckFunds)
+		dealState.PaymentRequested = abi.NewTokenAmount(10000)
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		environment := &fakeEnvironment{node, nil, nil, nil, xerrors.Errorf("miner budget: %w", rm.ErrBudgetExceeded)}
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		err := clientstates.CheckFunds(fsmCtx, environment, *dealState)
+		require.NoError(t, err)
+		fsmCtx.ReplayEvents(t, dealState)
+		require.Equal(t, retrievalmarket.DealStatusBudgetExceeded, dealState.Status)
+	})
 }
 
 func TestCancelDeal(t *testing.T) {
@@ -690,7 +822,7 @@ func TestCancelDeal(t *testing.T) {
 		closeError error,
 		dealState *retrievalmarket.ClientDealState) {
 		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
-		environment := &fakeEnvironment{node, nil, nil, closeError}
+		environment := &fakeEnvironment{node, nil, nil, closeError, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		dealState.ChannelID = &datatransfer.ChannelID{
 			Initiator: "initiator",
@@ -734,7 +866,7 @@ func TestCheckComplete(t *testing.T) {
 	require.NoError(t, err)
 	runCheckComplete := func(t *testing.T, dealState *retrievalmarket.ClientDealState) {
 		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
-		environment := &fakeEnvironment{node, nil, nil, nil}
+		environment := &fakeEnvironment{node, nil, nil, nil, nil}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.CheckComplete(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -0,0 +1,78 @@
+// Package clientutils provides utility functions for retrieval clients that
+// spread a retrieval over several deals
+package clientutils
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("retrieval_clientutils")
+
+// Candidate is a provider that can serve a retrieval, with its answer to the
+// query
+type Candidate struct {
+	Peer     rm.RetrievalPeer
+	Response rm.QueryResponse
+}
+
+// RankProviders queries the given peers at once about the whole DAG under the
+// payload, and returns the ones that can serve it, cheapest first
+func RankProviders(ctx context.Context, client rm.RetrievalClient, payloadCID cid.Cid, peers []rm.RetrievalPeer, params rm.QueryParams) []Candidate {
+	params = WithAllSelector(payloadCID, params)
+	responses := make([]rm.QueryResponse, len(peers))
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p rm.RetrievalPeer) {
+			defer wg.Done()
+			responses[i], errs[i] = client.Query(ctx, p, payloadCID, params)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var candidates []Candidate
+	for i, p := range peers {
+		if errs[i] != nil {
+			log.Warnf("querying provider %s for %s: %s", p.ID, payloadCID, errs[i])
+			continue
+		}
+		if responses[i].Status != rm.QueryResponseAvailable {
+			continue
+		}
+		candidates = append(candidates, Candidate{p, responses[i]})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return RetrievalPrice(candidates[i].Response).LessThan(RetrievalPrice(candidates[j].Response))
+	})
+	return candidates
+}
+
+// WithAllSelector returns query params that ask about the whole DAG under the
+// payload, so that providers can give its expected size
+func WithAllSelector(payloadCID cid.Cid, params rm.QueryParams) rm.QueryParams {
+	query, err := rm.NewQueryV1WithSelector(payloadCID, params.PieceCID, shared.AllSelector())
+	if err != nil {
+		return params
+	}
+	params.Selector = query.Selector
+	return params
+}
+
+// RetrievalPrice is the expected total price of a retrieval
+func RetrievalPrice(resp rm.QueryResponse) abi.TokenAmount {
+	if resp.ExpectedPayloadSize > 0 {
+		return resp.PayloadRetrievalPrice()
+	}
+	return resp.PieceRetrievalPrice()
+}
@@ -0,0 +1,133 @@
+package clientutils
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-ipld-prime"
+	dagpb "github.com/ipld/go-ipld-prime-proto"
+	// to register multicodec
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"golang.org/x/xerrors"
+)
+
+// WalkStoredDAG walks the DAG under root in a blockstore depth first, calling
+// visit once for each block it reaches. Blocks missing from the blockstore are
+// visited with a nil block, and the walk does not go below them.
+func WalkStoredDAG(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, visit func(c cid.Cid, blk blocks.Block) error) error {
+	seen := make(map[cid.Cid]struct{})
+	var walk func(c cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if _, ok := seen[c]; ok {
+			return nil
+		}
+		seen[c] = struct{}{}
+
+		blk, err := bs.Get(c)
+		if err == blockstore.ErrNotFound {
+			return visit(c, nil)
+		}
+		if err != nil {
+			return err
+		}
+		if err := visit(c, blk); err != nil {
+			return err
+		}
+		links, err := BlockLinks(ctx, blk)
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if err := walk(l); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return xerrors.Errorf("walking %s: %w", root, err)
+	}
+	return nil
+}
+
+// BlockLinks decodes a block and returns the CIDs it links to, in order and
+// without duplicates
+func BlockLinks(ctx context.Context, blk blocks.Block) ([]cid.Cid, error) {
+	c := blk.Cid()
+	if c.Prefix().Codec == cid.Raw {
+		return nil, nil
+	}
+
+	chooser := dagpb.AddDagPBSupportToChooser(func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+		return basicnode.Prototype.Any, nil
+	})
+	loader := func(ipld.Link, ipld.LinkContext) (io.Reader, error) {
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	lnk := cidlink.Link{Cid: c}
+	proto, err := chooser(lnk, ipld.LinkContext{})
+	if err != nil {
+		return nil, err
+	}
+	nb := proto.NewBuilder()
+	if err := lnk.Load(ctx, ipld.LinkContext{}, nb, loader); err != nil {
+		return nil, xerrors.Errorf("loading block %s: %w", c, err)
+	}
+
+	var links []cid.Cid
+	seen := make(map[cid.Cid]struct{})
+	err = forEachLink(nb.Build(), func(l cid.Cid) error {
+		if _, ok := seen[l]; !ok {
+			seen[l] = struct{}{}
+			links = append(links, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("reading links of block %s: %w", c, err)
+	}
+	return links, nil
+}
+
+// forEachLink calls fn with every link in a node, without following them
+func forEachLink(n ipld.Node, fn func(cid.Cid) error) error {
+	switch n.ReprKind() {
+	case ipld.ReprKind_Link:
+		lnk, err := n.AsLink()
+		if err != nil {
+			return err
+		}
+		if cl, ok := lnk.(cidlink.Link); ok {
+			return fn(cl.Cid)
+		}
+	case ipld.ReprKind_Map:
+		it := n.MapIterator()
+		for !it.Done() {
+			_, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if err := forEachLink(v, fn); err != nil {
+				return err
+			}
+		}
+	case ipld.ReprKind_List:
+		it := n.ListIterator()
+		for !it.Done() {
+			_, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if err := forEachLink(v, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
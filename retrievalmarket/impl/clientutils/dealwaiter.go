@@ -0,0 +1,154 @@
+package clientutils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-multistore"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// DealWaiter follows the deals a client makes into a single store, so that a
+// retrieval spread over several deals can wait for each of them to end.
+// Update must be subscribed to the client's events before the first deal is
+// started.
+type DealWaiter struct {
+	client  rm.RetrievalClient
+	storeID multistore.StoreID
+
+	lk         sync.Mutex
+	changed    chan struct{}
+	states     map[rm.DealID]rm.ClientDealState
+	progressed map[rm.DealID]time.Time
+	// queued are the deals the provider has queued until it has capacity
+	queued map[rm.DealID]bool
+}
+
+// NewDealWaiter returns a waiter for the deals the client makes into the
+// given store
+func NewDealWaiter(client rm.RetrievalClient, storeID multistore.StoreID) *DealWaiter {
+	return &DealWaiter{
+		client:     client,
+		storeID:    storeID,
+		changed:    make(chan struct{}),
+		states:     make(map[rm.DealID]rm.ClientDealState),
+		progressed: make(map[rm.DealID]time.Time),
+		queued:     make(map[rm.DealID]bool),
+	}
+}
+
+// Update is the client subscriber that tracks the deals
+func (w *DealWaiter) Update(event rm.ClientEvent, state rm.ClientDealState) {
+	if state.StoreID == nil || *state.StoreID != w.storeID {
+		return
+	}
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	prev, ok := w.states[state.ID]
+	if !ok || state.TotalReceived > prev.TotalReceived || state.Status != prev.Status {
+		w.progressed[state.ID] = time.Now()
+		delete(w.queued, state.ID)
+	}
+	if event == rm.ClientEventDealQueued {
+		w.progressed[state.ID] = time.Now()
+		w.queued[state.ID] = true
+	}
+	w.states[state.ID] = state
+	w.notifyLocked()
+}
+
+// State returns the last known state of a deal
+func (w *DealWaiter) State(dealID rm.DealID) (rm.ClientDealState, bool) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	state, ok := w.states[dealID]
+	return state, ok
+}
+
+// Notify wakes every call to Wait, so that they check their done function
+// again
+func (w *DealWaiter) Notify() {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	w.notifyLocked()
+}
+
+func (w *DealWaiter) notifyLocked() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// Wait waits for a deal to end, and returns an error unless it completed. If
+// done is not nil, Wait also returns without error as soon as it returns true.
+//
+// A deal that receives no data for stallTimeout is cancelled, unless
+// stallTimeout is zero. A deal the provider has queued is not stalled, and
+// neither is a deal paused by the client's spending budgets, since any other
+// provider would be paused just the same. Both are waited on until they
+// carry on.
+func (w *DealWaiter) Wait(ctx context.Context, dealID rm.DealID, stallTimeout time.Duration, done func() bool) error {
+	w.lk.Lock()
+	if _, ok := w.progressed[dealID]; !ok {
+		w.progressed[dealID] = time.Now()
+	}
+	w.lk.Unlock()
+
+	for {
+		if done != nil && done() {
+			return nil
+		}
+
+		w.lk.Lock()
+		state := w.states[dealID]
+		stalledFor := time.Since(w.progressed[dealID])
+		queued := w.queued[dealID]
+		changed := w.changed
+		w.lk.Unlock()
+
+		switch state.Status {
+		case rm.DealStatusCompleted:
+			return nil
+		case rm.DealStatusErrored, rm.DealStatusCancelled, rm.DealStatusRejected,
+			rm.DealStatusDealNotFound:
+			return xerrors.Errorf("deal %d ended with status %s: %s", dealID, state.Status, state.Message)
+		case rm.DealStatusInsufficientFunds:
+			w.cancel(dealID)
+			return xerrors.Errorf("deal %d ran out of funds", dealID)
+		}
+		paused := queued || state.Status == rm.DealStatusBudgetExceeded
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if stallTimeout > 0 && !paused {
+			if stalledFor >= stallTimeout {
+				w.cancel(dealID)
+				return xerrors.Errorf("deal %d received no data for %s", dealID, stalledFor.Round(time.Millisecond))
+			}
+			timer = time.NewTimer(stallTimeout - stalledFor)
+			timeout = timer.C
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			w.cancel(dealID)
+			return ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (w *DealWaiter) cancel(dealID rm.DealID) {
+	if err := w.client.CancelDeal(dealID); err != nil {
+		log.Warnf("cancelling deal %d: %s", dealID, err)
+	}
+}
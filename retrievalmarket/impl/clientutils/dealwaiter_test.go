@@ -0,0 +1,127 @@
+package clientutils_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-multistore"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientutils"
+)
+
+func TestDealWaiter(t *testing.T) {
+	ctx := context.Background()
+	storeID := multistore.StoreID(1)
+	stallTimeout := 50 * time.Millisecond
+
+	state := func(status rm.DealStatus, received uint64) rm.ClientDealState {
+		return rm.ClientDealState{
+			DealProposal:  rm.DealProposal{ID: 1},
+			Status:        status,
+			StoreID:       &storeID,
+			TotalReceived: received,
+		}
+	}
+	// wait waits for deal 1 in the background, and returns a channel that
+	// gets its result
+	wait := func(w *clientutils.DealWaiter, done func() bool) chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- w.Wait(ctx, 1, stallTimeout, done)
+		}()
+		return result
+	}
+
+	t.Run("completes", func(t *testing.T) {
+		client := &fakeClient{}
+		w := clientutils.NewDealWaiter(client, storeID)
+		w.Update(rm.ClientEventOpen, state(rm.DealStatusNew, 0))
+		result := wait(w, nil)
+		w.Update(rm.ClientEventAllBlocksReceived, state(rm.DealStatusCompleted, 100))
+		require.NoError(t, <-result)
+		require.Empty(t, client.cancelled())
+	})
+
+	t.Run("fails", func(t *testing.T) {
+		client := &fakeClient{}
+		w := clientutils.NewDealWaiter(client, storeID)
+		w.Update(rm.ClientEventDealRejected, state(rm.DealStatusRejected, 0))
+		require.Error(t, <-wait(w, nil))
+	})
+
+	t.Run("cancels stalled deals", func(t *testing.T) {
+		client := &fakeClient{}
+		w := clientutils.NewDealWaiter(client, storeID)
+		w.Update(rm.ClientEventDealAccepted, state(rm.DealStatusAccepted, 0))
+		require.Error(t, <-wait(w, nil))
+		require.Equal(t, []rm.DealID{1}, client.cancelled())
+	})
+
+	t.Run("does not cancel queued deals", func(t *testing.T) {
+		client := &fakeClient{}
+		w := clientutils.NewDealWaiter(client, storeID)
+		w.Update(rm.ClientEventDealQueued, state(rm.DealStatusAccepted, 0))
+		result := wait(w, nil)
+		time.Sleep(3 * stallTimeout)
+		require.Empty(t, client.cancelled())
+
+		// once the deal carries on it can stall again
+		w.Update(rm.ClientEventBlocksReceived, state(rm.DealStatusOngoing, 10))
+		require.Error(t, <-result)
+		require.Equal(t, []rm.DealID{1}, client.cancelled())
+	})
+
+	t.Run("does not cancel deals paused by budgets", func(t *testing.T) {
+		client := &fakeClient{}
+		w := clientutils.NewDealWaiter(client, storeID)
+		w.Update(rm.ClientEventBudgetExceeded, state(rm.DealStatusBudgetExceeded, 10))
+		result := wait(w, nil)
+		time.Sleep(3 * stallTimeout)
+		require.Empty(t, client.cancelled())
+		w.Update(rm.ClientEventAllBlocksReceived, state(rm.DealStatusCompleted, 100))
+		require.NoError(t, <-result)
+	})
+
+	t.Run("ends when done", func(t *testing.T) {
+		client := &fakeClient{}
+		w := clientutils.NewDealWaiter(client, storeID)
+		w.Update(rm.ClientEventDealQueued, state(rm.DealStatusAccepted, 0))
+		var lk sync.Mutex
+		done := false
+		result := wait(w, func() bool {
+			lk.Lock()
+			defer lk.Unlock()
+			return done
+		})
+		lk.Lock()
+		done = true
+		lk.Unlock()
+		w.Notify()
+		require.NoError(t, <-result)
+	})
+}
+
+type fakeClient struct {
+	rm.RetrievalClient
+
+	lk    sync.Mutex
+	deals []rm.DealID
+}
+
+func (fc *fakeClient) CancelDeal(id rm.DealID) error {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	fc.deals = append(fc.deals, id)
+	return nil
+}
+
+func (fc *fakeClient) cancelled() []rm.DealID {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return fc.deals
+}
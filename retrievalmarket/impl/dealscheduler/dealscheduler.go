@@ -0,0 +1,262 @@
+/*
+Package dealscheduler limits how many retrieval deals a provider works on at once.
+
+Accepted deals wait in a FIFO queue until there is capacity to serve them. A
+deal is started once an unseal slot, a transfer slot and a slot for its
+client are all free. The unseal slot is released when unsealing finishes,
+and the transfer and client slots are released when the deal ends. Deals that
+are served outside the provider's state machines, such as HTTP retrievals,
+wait for their turn with Acquire.
+*/
+package dealscheduler
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+var log = logging.Logger("dealscheduler")
+
+// Limits are the limits on concurrent deal processing. A limit of zero
+// means there is no limit.
+type Limits struct {
+	// MaxConcurrentUnseals is the maximum number of deals unsealing at once
+	MaxConcurrentUnseals int
+	// MaxConcurrentTransfers is the maximum number of deals that have
+	// started and not yet finished
+	MaxConcurrentTransfers int
+	// MaxDealsPerClient is the maximum number of started deals for a
+	// single client
+	MaxDealsPerClient int
+}
+
+// StartFunc is called when a queued deal can be started
+type StartFunc func(dealID rm.ProviderDealIdentifier) error
+
+type queuedDeal struct {
+	dealID   rm.ProviderDealIdentifier
+	queuedAt time.Time
+}
+
+// Scheduler queues deals and starts them as capacity becomes available
+type Scheduler struct {
+	start StartFunc
+	now   func() time.Time
+
+	lk        sync.Mutex
+	limits    Limits
+	queue     *list.List
+	queued    map[rm.ProviderDealIdentifier]*list.Element
+	unsealing map[rm.ProviderDealIdentifier]struct{}
+	active    map[rm.ProviderDealIdentifier]struct{}
+	perClient map[peer.ID]int
+	// acquiring holds the deals waiting in Acquire, which are started by
+	// closing their channel rather than by calling start
+	acquiring map[rm.ProviderDealIdentifier]chan struct{}
+
+	totalStarted  uint64
+	totalWaitTime time.Duration
+}
+
+// NewScheduler returns a scheduler with the given limits, which calls start
+// when a deal can begin unsealing
+func NewScheduler(limits Limits, start StartFunc) *Scheduler {
+	return &Scheduler{
+		start:     start,
+		now:       time.Now,
+		limits:    limits,
+		queue:     list.New(),
+		queued:    make(map[rm.ProviderDealIdentifier]*list.Element),
+		unsealing: make(map[rm.ProviderDealIdentifier]struct{}),
+		active:    make(map[rm.ProviderDealIdentifier]struct{}),
+		perClient: make(map[peer.ID]int),
+		acquiring: make(map[rm.ProviderDealIdentifier]chan struct{}),
+	}
+}
+
+// SetLimits changes the scheduler limits. Raising a limit may start queued deals.
+func (s *Scheduler) SetLimits(limits Limits) {
+	s.lk.Lock()
+	s.limits = limits
+	ready := s.dequeueReady()
+	s.lk.Unlock()
+
+	s.startDeals(ready)
+}
+
+// Enqueue adds a deal to the back of the queue, starting it immediately if
+// there is capacity. Enqueuing a deal that is already queued or started has
+// no effect.
+func (s *Scheduler) Enqueue(dealID rm.ProviderDealIdentifier) {
+	s.lk.Lock()
+	_, isQueued := s.queued[dealID]
+	_, isActive := s.active[dealID]
+	if !isQueued && !isActive {
+		s.queued[dealID] = s.queue.PushBack(&queuedDeal{dealID: dealID, queuedAt: s.now()})
+	}
+	ready := s.dequeueReady()
+	s.lk.Unlock()
+
+	s.startDeals(ready)
+}
+
+// Acquire queues a deal and blocks until it starts or the context is done.
+// Once Acquire returns without an error, the caller must release the deal's
+// slots with UnsealFinished and Finished.
+func (s *Scheduler) Acquire(ctx context.Context, dealID rm.ProviderDealIdentifier) error {
+	started := make(chan struct{})
+	s.lk.Lock()
+	s.acquiring[dealID] = started
+	s.lk.Unlock()
+
+	s.Enqueue(dealID)
+	select {
+	case <-started:
+		return nil
+	case <-ctx.Done():
+		s.lk.Lock()
+		delete(s.acquiring, dealID)
+		s.lk.Unlock()
+		s.Finished(dealID)
+		return ctx.Err()
+	}
+}
+
+// WouldQueue returns true if a deal for the given client would have to wait
+// in the queue rather than start straight away. Deals left in the queue are
+// only waiting for capacity, so a new deal waits if there is no capacity for
+// it or its client already has deals waiting.
+func (s *Scheduler) WouldQueue(client peer.ID) bool {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if atLimit(len(s.unsealing), s.limits.MaxConcurrentUnseals) ||
+		atLimit(len(s.active), s.limits.MaxConcurrentTransfers) ||
+		atLimit(s.perClient[client], s.limits.MaxDealsPerClient) {
+		return true
+	}
+	for e := s.queue.Front(); e != nil; e = e.Next() {
+		if e.Value.(*queuedDeal).dealID.Receiver == client {
+			return true
+		}
+	}
+	return false
+}
+
+// UnsealFinished releases the unseal slot held by a deal
+func (s *Scheduler) UnsealFinished(dealID rm.ProviderDealIdentifier) {
+	s.lk.Lock()
+	if _, ok := s.unsealing[dealID]; !ok {
+		s.lk.Unlock()
+		return
+	}
+	delete(s.unsealing, dealID)
+	ready := s.dequeueReady()
+	s.lk.Unlock()
+
+	s.startDeals(ready)
+}
+
+// Finished removes a deal from the queue, or releases all the slots it holds
+// if it has started
+func (s *Scheduler) Finished(dealID rm.ProviderDealIdentifier) {
+	s.lk.Lock()
+	if elem, ok := s.queued[dealID]; ok {
+		s.queue.Remove(elem)
+		delete(s.queued, dealID)
+	}
+	if _, ok := s.active[dealID]; ok {
+		delete(s.active, dealID)
+		delete(s.unsealing, dealID)
+		s.perClient[dealID.Receiver]--
+		if s.perClient[dealID.Receiver] <= 0 {
+			delete(s.perClient, dealID.Receiver)
+		}
+	}
+	ready := s.dequeueReady()
+	s.lk.Unlock()
+
+	s.startDeals(ready)
+}
+
+// Stats returns a snapshot of the scheduler's queue metrics
+func (s *Scheduler) Stats() rm.ProviderQueueStats {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	stats := rm.ProviderQueueStats{
+		Queued:          s.queue.Len(),
+		Unsealing:       len(s.unsealing),
+		Active:          len(s.active),
+		TotalStarted:    s.totalStarted,
+		TotalWaitTime:   s.totalWaitTime,
+		QueuedPerClient: make(map[peer.ID]int),
+		ActivePerClient: make(map[peer.ID]int, len(s.perClient)),
+	}
+	if front := s.queue.Front(); front != nil {
+		stats.LongestWait = s.now().Sub(front.Value.(*queuedDeal).queuedAt)
+	}
+	for e := s.queue.Front(); e != nil; e = e.Next() {
+		stats.QueuedPerClient[e.Value.(*queuedDeal).dealID.Receiver]++
+	}
+	for client, count := range s.perClient {
+		stats.ActivePerClient[client] = count
+	}
+	return stats
+}
+
+// dequeueReady removes deals that can start from the queue, in queue order,
+// and reserves their slots. Deals from clients at their limit are skipped so
+// they don't hold up other clients' deals.
+func (s *Scheduler) dequeueReady() []rm.ProviderDealIdentifier {
+	var ready []rm.ProviderDealIdentifier
+	now := s.now()
+	for e := s.queue.Front(); e != nil; {
+		if atLimit(len(s.unsealing), s.limits.MaxConcurrentUnseals) ||
+			atLimit(len(s.active), s.limits.MaxConcurrentTransfers) {
+			break
+		}
+
+		next := e.Next()
+		qd := e.Value.(*queuedDeal)
+		if !atLimit(s.perClient[qd.dealID.Receiver], s.limits.MaxDealsPerClient) {
+			s.queue.Remove(e)
+			delete(s.queued, qd.dealID)
+			s.unsealing[qd.dealID] = struct{}{}
+			s.active[qd.dealID] = struct{}{}
+			s.perClient[qd.dealID.Receiver]++
+			s.totalStarted++
+			s.totalWaitTime += now.Sub(qd.queuedAt)
+			ready = append(ready, qd.dealID)
+		}
+		e = next
+	}
+	return ready
+}
+
+func (s *Scheduler) startDeals(ready []rm.ProviderDealIdentifier) {
+	for _, dealID := range ready {
+		s.lk.Lock()
+		started, ok := s.acquiring[dealID]
+		delete(s.acquiring, dealID)
+		s.lk.Unlock()
+		if ok {
+			close(started)
+			continue
+		}
+		if err := s.start(dealID); err != nil {
+			log.Errorf("starting queued deal %s: %s", dealID, err)
+			s.Finished(dealID)
+		}
+	}
+}
+
+func atLimit(count int, limit int) bool {
+	return limit > 0 && count >= limit
+}
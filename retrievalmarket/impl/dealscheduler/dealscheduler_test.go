@@ -0,0 +1,185 @@
+package dealscheduler_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dealscheduler"
+)
+
+type startRecorder struct {
+	started []rm.ProviderDealIdentifier
+	failFor map[rm.ProviderDealIdentifier]struct{}
+}
+
+func (sr *startRecorder) start(dealID rm.ProviderDealIdentifier) error {
+	if _, ok := sr.failFor[dealID]; ok {
+		return xerrors.New("something went wrong")
+	}
+	sr.started = append(sr.started, dealID)
+	return nil
+}
+
+func dealIDs(client peer.ID, n int) []rm.ProviderDealIdentifier {
+	ids := make([]rm.ProviderDealIdentifier, 0, n)
+	for i := 0; i < n; i++ {
+		ids = append(ids, rm.ProviderDealIdentifier{Receiver: client, DealID: rm.DealID(i)})
+	}
+	return ids
+}
+
+func TestScheduler(t *testing.T) {
+	client1 := peer.ID("client1")
+	client2 := peer.ID("client2")
+
+	t.Run("starts deals immediately with no limits", func(t *testing.T) {
+		sr := &startRecorder{}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{}, sr.start)
+		deals := dealIDs(client1, 3)
+		for _, d := range deals {
+			s.Enqueue(d)
+		}
+		require.Equal(t, deals, sr.started)
+		stats := s.Stats()
+		require.Equal(t, 0, stats.Queued)
+		require.Equal(t, 3, stats.Active)
+		require.Equal(t, uint64(3), stats.TotalStarted)
+	})
+
+	t.Run("limits concurrent unseals", func(t *testing.T) {
+		sr := &startRecorder{}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{MaxConcurrentUnseals: 2}, sr.start)
+		deals := dealIDs(client1, 3)
+		for _, d := range deals {
+			s.Enqueue(d)
+		}
+		require.Equal(t, deals[:2], sr.started)
+		require.True(t, s.WouldQueue(client2))
+		stats := s.Stats()
+		require.Equal(t, 1, stats.Queued)
+		require.Equal(t, 2, stats.Unsealing)
+		require.Equal(t, map[peer.ID]int{client1: 1}, stats.QueuedPerClient)
+
+		s.UnsealFinished(deals[0])
+		require.Equal(t, deals, sr.started)
+		stats = s.Stats()
+		require.Equal(t, 0, stats.Queued)
+		require.Equal(t, 2, stats.Unsealing)
+		require.Equal(t, 3, stats.Active)
+	})
+
+	t.Run("limits concurrent transfers", func(t *testing.T) {
+		sr := &startRecorder{}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{MaxConcurrentTransfers: 1}, sr.start)
+		deals := dealIDs(client1, 2)
+		for _, d := range deals {
+			s.Enqueue(d)
+		}
+		require.Equal(t, deals[:1], sr.started)
+
+		// finishing unsealing does not free a transfer slot
+		s.UnsealFinished(deals[0])
+		require.Equal(t, deals[:1], sr.started)
+
+		s.Finished(deals[0])
+		require.Equal(t, deals, sr.started)
+	})
+
+	t.Run("limits deals per client without blocking other clients", func(t *testing.T) {
+		sr := &startRecorder{}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{MaxDealsPerClient: 1}, sr.start)
+		client1Deals := dealIDs(client1, 2)
+		client2Deals := dealIDs(client2, 1)
+		s.Enqueue(client1Deals[0])
+		s.Enqueue(client1Deals[1])
+		s.Enqueue(client2Deals[0])
+		require.Equal(t, []rm.ProviderDealIdentifier{client1Deals[0], client2Deals[0]}, sr.started)
+		require.Equal(t, map[peer.ID]int{client1: 1, client2: 1}, s.Stats().ActivePerClient)
+
+		require.True(t, s.WouldQueue(client1))
+		require.True(t, s.WouldQueue(client2))
+		require.False(t, s.WouldQueue(peer.ID("client3")))
+
+		s.Finished(client1Deals[0])
+		require.Equal(t, []rm.ProviderDealIdentifier{client1Deals[0], client2Deals[0], client1Deals[1]}, sr.started)
+	})
+
+	t.Run("removes finished deals from the queue", func(t *testing.T) {
+		sr := &startRecorder{}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{MaxConcurrentUnseals: 1}, sr.start)
+		deals := dealIDs(client1, 3)
+		for _, d := range deals {
+			s.Enqueue(d)
+		}
+		s.Finished(deals[1])
+		require.Equal(t, 1, s.Stats().Queued)
+
+		s.UnsealFinished(deals[0])
+		require.Equal(t, []rm.ProviderDealIdentifier{deals[0], deals[2]}, sr.started)
+	})
+
+	t.Run("raising limits starts queued deals", func(t *testing.T) {
+		sr := &startRecorder{}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{MaxConcurrentUnseals: 1}, sr.start)
+		deals := dealIDs(client1, 3)
+		for _, d := range deals {
+			s.Enqueue(d)
+		}
+		require.Equal(t, deals[:1], sr.started)
+		s.SetLimits(dealscheduler.Limits{})
+		require.Equal(t, deals, sr.started)
+	})
+
+	t.Run("releases capacity if a deal fails to start", func(t *testing.T) {
+		deals := dealIDs(client1, 2)
+		sr := &startRecorder{failFor: map[rm.ProviderDealIdentifier]struct{}{deals[0]: {}}}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{MaxConcurrentUnseals: 1}, sr.start)
+		for _, d := range deals {
+			s.Enqueue(d)
+		}
+		require.Equal(t, deals[1:], sr.started)
+		require.Equal(t, 1, s.Stats().Active)
+	})
+	t.Run("acquire waits for capacity", func(t *testing.T) {
+		deals := dealIDs(client1, 2)
+		sr := &startRecorder{}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{MaxConcurrentTransfers: 1}, sr.start)
+		s.Enqueue(deals[0])
+
+		acquired := make(chan error, 1)
+		go func() {
+			acquired <- s.Acquire(context.Background(), deals[1])
+		}()
+		select {
+		case <-acquired:
+			t.Fatal("acquired a slot while at the transfer limit")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		s.Finished(deals[0])
+		require.NoError(t, <-acquired)
+		require.Equal(t, deals[:1], sr.started)
+		require.Equal(t, 1, s.Stats().Active)
+	})
+
+	t.Run("acquire leaves the queue when the context is done", func(t *testing.T) {
+		deals := dealIDs(client1, 2)
+		sr := &startRecorder{}
+		s := dealscheduler.NewScheduler(dealscheduler.Limits{MaxConcurrentTransfers: 1}, sr.start)
+		s.Enqueue(deals[0])
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		require.Equal(t, context.DeadlineExceeded, s.Acquire(ctx, deals[1]))
+		require.Equal(t, 0, s.Stats().Queued)
+
+		s.Finished(deals[0])
+		require.Equal(t, 0, s.Stats().Active)
+	})
+}
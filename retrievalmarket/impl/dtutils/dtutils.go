@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"math"
 
+	"github.com/ipfs/go-graphsync/storeutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
 	peer "github.com/libp2p/go-libp2p-core/peer"
@@ -16,6 +18,7 @@ import (
 
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
 )
 
 var log = logging.Logger("retrievalmarket_impl")
@@ -83,6 +86,10 @@ func clientEventForResponse(response *rm.DealResponse) (rm.ClientEvent, []interf
 		return rm.ClientEventDealNotFound, []interface{}{response.Message}
 	case rm.DealStatusAccepted:
 		return rm.ClientEventDealAccepted, nil
+	case rm.DealStatusQueued:
+		return rm.ClientEventDealQueued, nil
+	case rm.DealStatusCancelled:
+		return rm.ClientEventProviderCancelled, []interface{}{response.Message}
 	case rm.DealStatusFundsNeededUnseal:
 		return rm.ClientEventUnsealPaymentRequested, []interface{}{response.PaymentOwed}
 	case rm.DealStatusFundsNeededLastPayment:
@@ -105,7 +112,7 @@ func clientEvent(event datatransfer.Event, channelState datatransfer.ChannelStat
 	case datatransfer.FinishTransfer:
 		return rm.ClientEventAllBlocksReceived, nil
 	case datatransfer.Cancel:
-		return rm.ClientEventProviderCancelled, nil
+		return rm.ClientEventProviderCancelled, []interface{}{""}
 	case datatransfer.NewVoucherResult:
 		response, ok := dealResponseFromVoucherResult(channelState.LastVoucherResult())
 		if !ok {
@@ -159,13 +166,29 @@ type StoreGetter interface {
 	Get(otherPeer peer.ID, dealID rm.DealID) (*multistore.Store, error)
 }
 
+// BlockstoreGetter retrieves a read-only blockstore to serve a deal's data from,
+// in place of the deal's multistore. It returns a nil blockstore if the deal
+// should be served from its multistore.
+type BlockstoreGetter interface {
+	GetBlockstore(otherPeer peer.ID, dealID rm.DealID) (blockstore.Blockstore, error)
+}
+
 // StoreConfigurableTransport defines the methods needed to
 // configure a data transfer transport use a unique store for a given request
 type StoreConfigurableTransport interface {
 	UseStore(datatransfer.ChannelID, ipld.Loader, ipld.Storer) error
 }
 
-// TransportConfigurer configurers the graphsync transport to use a custom blockstore per deal
+// TransferThrottler returns the bandwidth limits for sending a deal's data.
+// It returns a nil transfer if the deal's data should not be limited.
+type TransferThrottler interface {
+	Throttle(otherPeer peer.ID, dealID rm.DealID) (*bandwidth.Transfer, error)
+}
+
+// TransportConfigurer configurers the graphsync transport to use a custom blockstore per deal.
+// If the store getter is also a BlockstoreGetter and returns a blockstore for the deal,
+// that blockstore is used in place of the deal's multistore. If the store getter is
+// also a TransferThrottler, blocks are loaded at the rate it allows.
 func TransportConfigurer(thisPeer peer.ID, storeGetter StoreGetter) datatransfer.TransportConfigurer {
 	return func(channelID datatransfer.ChannelID, voucher datatransfer.Voucher, transport datatransfer.Transport) {
 		dealProposal, ok := dealProposalFromVoucher(voucher)
@@ -177,21 +200,53 @@ func TransportConfigurer(thisPeer peer.ID, storeGetter StoreGetter) datatransfer
 			return
 		}
 		otherPeer := channelID.OtherParty(thisPeer)
-		store, err := storeGetter.Get(otherPeer, dealProposal.ID)
+		loader, storer, hasStore, err := dealLoaderAndStorer(otherPeer, dealProposal.ID, storeGetter)
 		if err != nil {
 			log.Errorf("attempting to configure data store: %s", err)
 			return
 		}
-		if store == nil {
+		if !hasStore {
 			return
 		}
-		err = gsTransport.UseStore(channelID, store.Loader, store.Storer)
+		if throttler, ok := storeGetter.(TransferThrottler); ok {
+			transfer, err := throttler.Throttle(otherPeer, dealProposal.ID)
+			if err != nil {
+				log.Errorf("attempting to configure bandwidth limits: %s", err)
+				return
+			}
+			if transfer != nil {
+				loader = transfer.Loader(loader)
+			}
+		}
+		err = gsTransport.UseStore(channelID, loader, storer)
 		if err != nil {
 			log.Errorf("attempting to configure data store: %s", err)
 		}
 	}
 }
 
+// dealLoaderAndStorer returns the loader and storer for a deal's data. The
+// third return value is false if the deal has no store.
+func dealLoaderAndStorer(otherPeer peer.ID, dealID rm.DealID, storeGetter StoreGetter) (ipld.Loader, ipld.Storer, bool, error) {
+	if bsGetter, ok := storeGetter.(BlockstoreGetter); ok {
+		bs, err := bsGetter.GetBlockstore(otherPeer, dealID)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if bs != nil {
+			return storeutil.LoaderForBlockstore(bs), storeutil.StorerForBlockstore(bs), true, nil
+		}
+	}
+	store, err := storeGetter.Get(otherPeer, dealID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if store == nil {
+		return nil, nil, false, nil
+	}
+	return store.Loader, store.Storer, true, nil
+}
+
 func dealProposalFromVoucher(voucher datatransfer.Voucher) (*rm.DealProposal, bool) {
 	dealProposal, ok := voucher.(*rm.DealProposal)
 	// if this event is for a transfer not related to storage, ignore
@@ -1,8 +1,11 @@
 package dtutils_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
@@ -19,6 +22,7 @@ import (
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dtutils"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 )
 
@@ -198,6 +202,21 @@ func TestClientDataTransferSubscriber(t *testing.T) {
 				Status:   datatransfer.Ongoing},
 			expectedID:    dealProposal.ID,
 			expectedEvent: rm.ClientEventProviderCancelled,
+			expectedArgs:  []interface{}{""},
+		},
+		"new voucher result - cancelled": {
+			code: datatransfer.NewVoucherResult,
+			state: shared_testutil.TestChannelParams{
+				Vouchers: []datatransfer.Voucher{&dealProposal},
+				VoucherResults: []datatransfer.VoucherResult{&retrievalmarket.DealResponse{
+					Status:  retrievalmarket.DealStatusCancelled,
+					ID:      dealProposal.ID,
+					Message: "shutting down",
+				}},
+				Status: datatransfer.Ongoing},
+			expectedID:    dealProposal.ID,
+			expectedEvent: rm.ClientEventProviderCancelled,
+			expectedArgs:  []interface{}{"shutting down"},
 		},
 		"new voucher result - rejected": {
 			code: datatransfer.NewVoucherResult,
@@ -239,6 +258,18 @@ func TestClientDataTransferSubscriber(t *testing.T) {
 			expectedID:    dealProposal.ID,
 			expectedEvent: rm.ClientEventDealAccepted,
 		},
+		"new voucher result - queued": {
+			code: datatransfer.NewVoucherResult,
+			state: shared_testutil.TestChannelParams{
+				Vouchers: []datatransfer.Voucher{&dealProposal},
+				VoucherResults: []datatransfer.VoucherResult{&retrievalmarket.DealResponse{
+					Status: retrievalmarket.DealStatusQueued,
+					ID:     dealProposal.ID,
+				}},
+				Status: datatransfer.Ongoing},
+			expectedID:    dealProposal.ID,
+			expectedEvent: rm.ClientEventDealQueued,
+		},
 		"new voucher result - accepted, legacy": {
 			code: datatransfer.NewVoucherResult,
 			state: shared_testutil.TestChannelParams{
@@ -454,6 +485,58 @@ func TestTransportConfigurer(t *testing.T) {
 	}
 }
 
+func TestTransportConfigurerThrottle(t *testing.T) {
+	channelID := shared_testutil.MakeTestChannelID()
+	dealID := rm.DealID(rand.Uint64())
+	voucher := &rm.DealProposal{PayloadCID: shared_testutil.GenerateCids(1)[0], ID: dealID}
+	data := []byte("block data")
+	store := &multistore.Store{
+		Loader: func(ipld.Link, ipld.LinkContext) (io.Reader, error) {
+			return bytes.NewReader(data), nil
+		},
+	}
+
+	t.Run("wraps the loader with the deal's limits", func(t *testing.T) {
+		limiter := bandwidth.NewLimiter(bandwidth.Limits{PerDeal: 1 << 20}, bandwidth.Limits{})
+		storeGetter := &fakeThrottlingStoreGetter{
+			fakeStoreGetter:  fakeStoreGetter{returnedStore: store},
+			returnedTransfer: limiter.NewTransfer(context.Background(), channelID.Responder, false),
+		}
+		transport := &fakeGsTransport{Transport: &fakeTransport{}}
+		dtutils.TransportConfigurer(channelID.Initiator, storeGetter)(channelID, voucher, transport)
+		require.True(t, storeGetter.throttleCalled)
+		require.True(t, transport.called)
+		r, err := transport.lastLoader(nil, ipld.LinkContext{})
+		require.NoError(t, err)
+		read, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+	})
+
+	t.Run("does not configure the store if the throttler errors", func(t *testing.T) {
+		storeGetter := &fakeThrottlingStoreGetter{
+			fakeStoreGetter: fakeStoreGetter{returnedStore: store},
+			throttleErr:     errors.New("something went wrong"),
+		}
+		transport := &fakeGsTransport{Transport: &fakeTransport{}}
+		dtutils.TransportConfigurer(channelID.Initiator, storeGetter)(channelID, voucher, transport)
+		require.True(t, storeGetter.throttleCalled)
+		require.False(t, transport.called)
+	})
+}
+
+type fakeThrottlingStoreGetter struct {
+	fakeStoreGetter
+	returnedTransfer *bandwidth.Transfer
+	throttleErr      error
+	throttleCalled   bool
+}
+
+func (ftsg *fakeThrottlingStoreGetter) Throttle(otherPeer peer.ID, dealID rm.DealID) (*bandwidth.Transfer, error) {
+	ftsg.throttleCalled = true
+	return ftsg.returnedTransfer, ftsg.throttleErr
+}
+
 type fakeStoreGetter struct {
 	lastDealID    rm.DealID
 	lastOtherPeer peer.ID
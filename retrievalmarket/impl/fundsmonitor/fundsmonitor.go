@@ -0,0 +1,312 @@
+/*
+Package fundsmonitor restarts retrieval deals that ran out of funds in their
+payment channel, once the channel has the funds to pay for them.
+
+A retrieval deal whose payment channel cannot cover a payment request stops in
+DealStatusInsufficientFunds, until TryRestartInsufficientFunds is called for its
+channel. The monitor does this automatically: it checks the funds of the
+channels of stuck deals regularly, and whenever a deal goes into
+DealStatusInsufficientFunds. Once a channel's confirmed funds, or the funds it
+is waiting for, cover what one of its deals owes, it restarts the channel's
+deals.
+
+The monitor can also top up channels from the client's wallet, up to a limit
+per channel. What it has added to each channel is persisted, so the limit holds
+across restarts. Given the client's budget manager, the monitor also counts
+top ups against the wallet's budget, and does not top up beyond it.
+*/
+package fundsmonitor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-statestore"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/budgetmanager"
+)
+
+var log = logging.Logger("fundsmonitor")
+
+// DefaultCheckInterval is how often channels are checked by default
+const DefaultCheckInterval = time.Minute
+
+// Option configures a Monitor
+type Option func(*Monitor)
+
+// CheckInterval sets how often the monitor checks the funds of channels with
+// deals that ran out of funds
+func CheckInterval(interval time.Duration) Option {
+	return func(m *Monitor) {
+		m.checkInterval = interval
+	}
+}
+
+// TopUpFromWallet has the monitor add the funds that deals are short of to
+// their payment channel from the client's wallet, adding no more than limit to
+// any one channel in total
+func TopUpFromWallet(limit abi.TokenAmount) Option {
+	return func(m *Monitor) {
+		m.topUpLimit = limit
+	}
+}
+
+// BudgetManager has the monitor count top ups against the wallet budgets of
+// the given budget manager, which should be the client's
+func BudgetManager(manager *budgetmanager.Manager) Option {
+	return func(m *Monitor) {
+		m.budgetManager = manager
+	}
+}
+
+// Monitor restarts retrieval deals once their payment channel has the funds
+// to pay for them
+type Monitor struct {
+	node          rm.RetrievalClientNode
+	client        rm.RetrievalClient
+	topUps        *statestore.StateStore
+	checkInterval time.Duration
+	topUpLimit    abi.TokenAmount
+	budgetManager *budgetmanager.Manager
+
+	lk sync.Mutex
+
+	unsubscribe rm.Unsubscribe
+	wake        chan struct{}
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+// NewMonitor returns a monitor for the deals of the given client, that
+// persists what it tops channels up with to the given datastore
+func NewMonitor(ds datastore.Batching, node rm.RetrievalClientNode, client rm.RetrievalClient, options ...Option) *Monitor {
+	m := &Monitor{
+		node:          node,
+		client:        client,
+		topUps:        statestore.New(ds),
+		checkInterval: DefaultCheckInterval,
+		topUpLimit:    big.Zero(),
+		wake:          make(chan struct{}, 1),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Start checks channels regularly, and whenever a deal runs out of funds,
+// until Stop is called
+func (m *Monitor) Start(ctx context.Context) {
+	m.unsubscribe = m.client.SubscribeToEvents(m.onDealEvent)
+	m.stop = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go func() {
+		defer close(m.stopped)
+		ticker := time.NewTicker(m.checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-m.wake:
+			case <-m.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+			if err := m.Check(ctx); err != nil {
+				log.Errorf("checking funds of payment channels: %s", err)
+			}
+		}
+	}()
+}
+
+// Stop stops checking channels
+func (m *Monitor) Stop() {
+	if m.stop == nil {
+		return
+	}
+	m.unsubscribe()
+	close(m.stop)
+	<-m.stopped
+	m.stop = nil
+}
+
+func (m *Monitor) onDealEvent(event rm.ClientEvent, state rm.ClientDealState) {
+	if event != rm.ClientEventFundsExpended {
+		return
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Check restarts the deals that ran out of funds in channels that now have
+// funds to pay for them, topping channels up first if the monitor is allowed to
+func (m *Monitor) Check(ctx context.Context) error {
+	deals, err := m.client.ListDeals()
+	if err != nil {
+		return xerrors.Errorf("listing deals: %w", err)
+	}
+	stuck := make(map[address.Address][]rm.ClientDealState)
+	for _, deal := range deals {
+		if deal.Status == rm.DealStatusInsufficientFunds && deal.PaymentInfo != nil {
+			stuck[deal.PaymentInfo.PayCh] = append(stuck[deal.PaymentInfo.PayCh], deal)
+		}
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for paymentChannel, deals := range stuck {
+		if err := m.checkChannel(ctx, paymentChannel, deals); err != nil {
+			log.Errorf("checking funds of payment channel %s: %s", paymentChannel, err)
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) checkChannel(ctx context.Context, paymentChannel address.Address, deals []rm.ClientDealState) error {
+	funds, err := m.node.CheckAvailableFunds(ctx, paymentChannel)
+	if err != nil {
+		return xerrors.Errorf("checking available funds: %w", err)
+	}
+	unredeemed := big.Sub(funds.ConfirmedAmt, funds.VoucherReedeemedAmt)
+	available := unredeemed
+	// Deals only wait for funds being added if there is a message to wait on
+	if funds.PendingWaitSentinel != nil {
+		available = big.Add(available, big.Add(funds.PendingAmt, funds.QueuedAmt))
+	}
+
+	// Restart as soon as any deal can go on, the others go back to waiting
+	needed := big.Zero()
+	for _, deal := range deals {
+		needed = big.Add(needed, deal.PaymentRequested)
+		if deal.PaymentRequested.LessThanEqual(available) {
+			return m.restart(paymentChannel)
+		}
+	}
+
+	added, err := m.topUp(ctx, paymentChannel, deals[0], big.Sub(needed, big.Add(unredeemed, big.Add(funds.PendingAmt, funds.QueuedAmt))))
+	if err != nil {
+		return err
+	}
+	if added.IsZero() {
+		return nil
+	}
+	return m.restart(paymentChannel)
+}
+
+func (m *Monitor) restart(paymentChannel address.Address) error {
+	log.Infof("restarting deals waiting for funds in payment channel %s", paymentChannel)
+	if err := m.client.TryRestartInsufficientFunds(paymentChannel); err != nil {
+		return xerrors.Errorf("restarting deals: %w", err)
+	}
+	return nil
+}
+
+// topUp adds up to shortfall to the payment channel from the wallet of the
+// given deal, within the limit and the wallet's budget, and returns what it
+// added. If the node adds the funds to a different channel between the same
+// wallet and miner, they are recorded against that channel and nothing is
+// returned, since they do not help the deals in this one.
+func (m *Monitor) topUp(ctx context.Context, paymentChannel address.Address, deal rm.ClientDealState, shortfall abi.TokenAmount) (abi.TokenAmount, error) {
+	if m.topUpLimit.IsZero() {
+		return big.Zero(), nil
+	}
+	has, err := m.topUps.Has(paymentChannel)
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+	topUp := TopUp{PaymentChannel: paymentChannel, Total: big.Zero()}
+	if has {
+		if err := m.topUps.Get(paymentChannel).Get(&topUp); err != nil {
+			return abi.TokenAmount{}, err
+		}
+	}
+	amount := big.Min(shortfall, big.Sub(m.topUpLimit, topUp.Total))
+	if amount.LessThanEqual(big.Zero()) {
+		log.Debugf("not topping up payment channel %s, already added %s of a limit of %s", paymentChannel, topUp.Total, m.topUpLimit)
+		return big.Zero(), nil
+	}
+
+	tok, _, err := m.node.GetChainHead(ctx)
+	if err != nil {
+		return abi.TokenAmount{}, xerrors.Errorf("getting chain head: %w", err)
+	}
+	if m.budgetManager != nil {
+		if err := m.budgetManager.ReserveFunding(deal.ClientWallet, amount); err != nil {
+			if xerrors.Is(err, rm.ErrBudgetExceeded) {
+				log.Debugf("not topping up payment channel %s: %s", paymentChannel, err)
+				return big.Zero(), nil
+			}
+			return abi.TokenAmount{}, xerrors.Errorf("checking wallet budget: %w", err)
+		}
+	}
+	funded, msg, err := m.node.GetOrCreatePaymentChannel(ctx, deal.ClientWallet, deal.MinerWallet, amount, tok)
+	if err != nil {
+		if m.budgetManager != nil {
+			if releaseErr := m.budgetManager.ReleaseFunding(deal.ClientWallet, amount); releaseErr != nil {
+				log.Errorf("releasing wallet budget reserved for top up: %s", releaseErr)
+			}
+		}
+		return abi.TokenAmount{}, xerrors.Errorf("adding funds: %w", err)
+	}
+	if funded != paymentChannel {
+		log.Warnf("topping up payment channel %s from wallet %s added %s to channel %s instead, in message %s", paymentChannel, deal.ClientWallet, amount, funded, msg)
+		if funded == address.Undef {
+			// a new channel is being created, and its address is not known yet
+			return big.Zero(), nil
+		}
+		if err := m.recordTopUp(funded, amount); err != nil {
+			return abi.TokenAmount{}, err
+		}
+		return big.Zero(), nil
+	}
+	log.Infof("topping up payment channel %s with %s from wallet %s, in message %s", paymentChannel, amount, deal.ClientWallet, msg)
+	if err := m.recordTopUp(paymentChannel, amount); err != nil {
+		return abi.TokenAmount{}, err
+	}
+	return amount, nil
+}
+
+// recordTopUp adds amount to what the monitor has added to the channel
+func (m *Monitor) recordTopUp(paymentChannel address.Address, amount abi.TokenAmount) error {
+	has, err := m.topUps.Has(paymentChannel)
+	if err != nil {
+		return err
+	}
+	if !has {
+		err = m.topUps.Begin(paymentChannel, &TopUp{PaymentChannel: paymentChannel, Total: amount})
+	} else {
+		err = m.topUps.Get(paymentChannel).Mutate(func(t *TopUp) error {
+			t.Total = big.Add(t.Total, amount)
+			return nil
+		})
+	}
+	if err != nil {
+		return xerrors.Errorf("recording top up: %w", err)
+	}
+	return nil
+}
+
+// TopUps lists what the monitor has added to each payment channel
+func (m *Monitor) TopUps() ([]TopUp, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var topUps []TopUp
+	if err := m.topUps.List(&topUps); err != nil {
+		return nil, xerrors.Errorf("listing top ups: %w", err)
+	}
+	return topUps, nil
+}
@@ -0,0 +1,178 @@
+package fundsmonitor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	spect "github.com/filecoin-project/specs-actors/support/testing"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/budgetmanager"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/fundsmonitor"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+type fakeClient struct {
+	rm.RetrievalClient
+	deals     map[rm.DealID]rm.ClientDealState
+	restarted []address.Address
+}
+
+func (c *fakeClient) ListDeals() (map[rm.DealID]rm.ClientDealState, error) {
+	return c.deals, nil
+}
+
+func (c *fakeClient) TryRestartInsufficientFunds(paymentChannel address.Address) error {
+	c.restarted = append(c.restarted, paymentChannel)
+	return nil
+}
+
+func TestMonitor(t *testing.T) {
+	ctx := context.Background()
+	ch := spect.NewIDAddr(t, 100)
+	clientWallet := spect.NewIDAddr(t, 101)
+	minerWallet := spect.NewIDAddr(t, 102)
+
+	client := &fakeClient{deals: map[rm.DealID]rm.ClientDealState{
+		1: {
+			DealProposal:     rm.DealProposal{ID: 1},
+			Status:           rm.DealStatusInsufficientFunds,
+			PaymentInfo:      &rm.PaymentInfo{PayCh: ch},
+			PaymentRequested: abi.NewTokenAmount(300),
+			ClientWallet:     clientWallet,
+			MinerWallet:      minerWallet,
+		},
+		2: {
+			DealProposal:     rm.DealProposal{ID: 2},
+			Status:           rm.DealStatusOngoing,
+			PaymentInfo:      &rm.PaymentInfo{PayCh: ch},
+			PaymentRequested: abi.NewTokenAmount(1000),
+		},
+	}}
+
+	t.Run("restarts deals once funds cover them", func(t *testing.T) {
+		client.restarted = nil
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+			ChannelAvailableFunds: rm.ChannelAvailableFunds{
+				ConfirmedAmt:        abi.NewTokenAmount(500),
+				VoucherReedeemedAmt: abi.NewTokenAmount(400),
+			},
+		})
+		m := fundsmonitor.NewMonitor(dss.MutexWrap(datastore.NewMapDatastore()), node, client)
+		require.NoError(t, m.Check(ctx))
+		require.Empty(t, client.restarted)
+
+		// funds being added without a message to wait on are not enough
+		node.ResetChannelAvailableFunds(rm.ChannelAvailableFunds{
+			ConfirmedAmt:        abi.NewTokenAmount(500),
+			PendingAmt:          abi.NewTokenAmount(300),
+			VoucherReedeemedAmt: abi.NewTokenAmount(400),
+		})
+		require.NoError(t, m.Check(ctx))
+		require.Empty(t, client.restarted)
+
+		sentinel := shared_testutil.GenerateCids(1)[0]
+		node.ResetChannelAvailableFunds(rm.ChannelAvailableFunds{
+			ConfirmedAmt:        abi.NewTokenAmount(500),
+			PendingAmt:          abi.NewTokenAmount(300),
+			PendingWaitSentinel: &sentinel,
+			VoucherReedeemedAmt: abi.NewTokenAmount(400),
+		})
+		require.NoError(t, m.Check(ctx))
+		require.Equal(t, []address.Address{ch}, client.restarted)
+	})
+
+	t.Run("tops up channels within the limit", func(t *testing.T) {
+		client.restarted = nil
+		var added []abi.TokenAmount
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+			AddFundsOnly: true,
+			PayCh:        ch,
+			AddFundsCID:  shared_testutil.GenerateCids(1)[0],
+			PaymentChannelRecorder: func(client address.Address, miner address.Address, amount abi.TokenAmount) {
+				require.Equal(t, clientWallet, client)
+				require.Equal(t, minerWallet, miner)
+				added = append(added, amount)
+			},
+			ChannelAvailableFunds: rm.ChannelAvailableFunds{
+				ConfirmedAmt:        abi.NewTokenAmount(500),
+				VoucherReedeemedAmt: abi.NewTokenAmount(400),
+			},
+		})
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		m := fundsmonitor.NewMonitor(ds, node, client, fundsmonitor.TopUpFromWallet(abi.NewTokenAmount(250)))
+		require.NoError(t, m.Check(ctx))
+		require.Equal(t, []abi.TokenAmount{abi.NewTokenAmount(200)}, added)
+		require.Equal(t, []address.Address{ch}, client.restarted)
+
+		// the limit holds across restarts
+		m = fundsmonitor.NewMonitor(ds, node, client, fundsmonitor.TopUpFromWallet(abi.NewTokenAmount(250)))
+		require.NoError(t, m.Check(ctx))
+		require.Equal(t, []abi.TokenAmount{abi.NewTokenAmount(200), abi.NewTokenAmount(50)}, added)
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, added, 2)
+		require.Len(t, client.restarted, 2)
+
+		topUps, err := m.TopUps()
+		require.NoError(t, err)
+		require.Equal(t, []fundsmonitor.TopUp{{PaymentChannel: ch, Total: abi.NewTokenAmount(250)}}, topUps)
+	})
+	topUpNode := func(payCh address.Address, added *[]abi.TokenAmount) *testnodes.TestRetrievalClientNode {
+		return testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+			AddFundsOnly: true,
+			PayCh:        payCh,
+			AddFundsCID:  shared_testutil.GenerateCids(1)[0],
+			PaymentChannelRecorder: func(client address.Address, miner address.Address, amount abi.TokenAmount) {
+				*added = append(*added, amount)
+			},
+			ChannelAvailableFunds: rm.ChannelAvailableFunds{
+				ConfirmedAmt:        abi.NewTokenAmount(500),
+				VoucherReedeemedAmt: abi.NewTokenAmount(400),
+			},
+		})
+	}
+
+	t.Run("does not top up beyond the wallet budget", func(t *testing.T) {
+		client.restarted = nil
+		var added []abi.TokenAmount
+		node := topUpNode(ch, &added)
+		budgets := budgetmanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, budgets.SetBudget(budgetmanager.ScopeWallet, clientWallet, abi.NewTokenAmount(100), 24*time.Hour))
+		m := fundsmonitor.NewMonitor(dss.MutexWrap(datastore.NewMapDatastore()), node, client,
+			fundsmonitor.TopUpFromWallet(abi.NewTokenAmount(250)), fundsmonitor.BudgetManager(budgets))
+		require.NoError(t, m.Check(ctx))
+		require.Empty(t, added)
+		require.Empty(t, client.restarted)
+
+		require.NoError(t, budgets.SetBudget(budgetmanager.ScopeWallet, clientWallet, abi.NewTokenAmount(200), 24*time.Hour))
+		require.NoError(t, m.Check(ctx))
+		require.Equal(t, []abi.TokenAmount{abi.NewTokenAmount(200)}, added)
+		require.Equal(t, []address.Address{ch}, client.restarted)
+		all, err := budgets.Budgets()
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(200), all[0].Spent)
+	})
+
+	t.Run("records top ups against the channel that was funded", func(t *testing.T) {
+		client.restarted = nil
+		var added []abi.TokenAmount
+		otherCh := spect.NewIDAddr(t, 103)
+		node := topUpNode(otherCh, &added)
+		m := fundsmonitor.NewMonitor(dss.MutexWrap(datastore.NewMapDatastore()), node, client, fundsmonitor.TopUpFromWallet(abi.NewTokenAmount(250)))
+		require.NoError(t, m.Check(ctx))
+		require.Equal(t, []abi.TokenAmount{abi.NewTokenAmount(200)}, added)
+		require.Empty(t, client.restarted)
+
+		topUps, err := m.TopUps()
+		require.NoError(t, err)
+		require.Equal(t, []fundsmonitor.TopUp{{PaymentChannel: otherCh, Total: abi.NewTokenAmount(200)}}, topUps)
+	})
+}
@@ -0,0 +1,15 @@
+package fundsmonitor
+
+import (
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+//go:generate cbor-gen-for --map-encoding TopUp
+
+// TopUp is what the monitor has added to a payment channel from the client's
+// wallet
+type TopUp struct {
+	PaymentChannel address.Address
+	Total          abi.TokenAmount
+}
@@ -3,6 +3,8 @@ package retrievalimpl_test
 import (
 	"bytes"
 	"context"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -524,7 +526,7 @@ CurrentInterval: %d
 				clientStoreID = &id
 			}
 			// *** Retrieve the piece
-			_, err = client.Retrieve(bgCtx, payloadCID, rmParams, expectedTotal, retrievalPeer, clientPaymentChannel, retrievalPeer.Address, clientStoreID)
+			clientDealID, err := client.Retrieve(bgCtx, payloadCID, rmParams, expectedTotal, retrievalPeer, clientPaymentChannel, retrievalPeer.Address, clientStoreID)
 			require.NoError(t, err)
 
 			// verify that client subscribers will be notified of state changes
@@ -581,6 +583,26 @@ CurrentInterval: %d
 					testData.VerifyFileTransferred(t, pieceLink, false, testCase.filesize)
 				} else {
 					testData.VerifyFileTransferredIntoStore(t, pieceLink, *clientStoreID, false, testCase.filesize)
+
+					// export the whole retrieved file, and check it matches the original
+					if testCase.selector == nil {
+						exportDir, err := ioutil.TempDir("", "export")
+						require.NoError(t, err)
+						defer os.RemoveAll(exportDir)
+						exportPath := filepath.Join(exportDir, testCase.filename)
+						err = client.ExportDeal(bgCtx, clientDealID, retrievalmarket.ExportParams{
+							Format:      retrievalmarket.ExportUnixFS,
+							Path:        exportPath,
+							DeleteStore: true,
+						})
+						require.NoError(t, err)
+						exported, err := ioutil.ReadFile(exportPath)
+						require.NoError(t, err)
+						original, err := ioutil.ReadFile(filepath.Join("fixtures", testCase.filename))
+						require.NoError(t, err)
+						require.Equal(t, original, exported)
+						require.NotContains(t, testData.MultiStore1.List(), *clientStoreID)
+					}
 				}
 			}
 		})
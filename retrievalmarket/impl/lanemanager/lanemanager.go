@@ -0,0 +1,199 @@
+/*
+Package lanemanager lets retrieval deals between the same client and miner
+share payment channel lanes.
+
+By default each retrieval deal allocates a lane of its own, and the miner must
+redeem every lane separately on chain. With a lane manager, a deal is given a
+lane of the payment channel that no other deal is using, and a new lane is only
+allocated when all of them are busy, so deals made one after another use the
+same lane. Vouchers on a lane are cumulative: a deal's vouchers are for the
+total of the lane when the deal started using it plus what the deal has paid.
+A provider counts the payment in a voucher as the increase over the best
+voucher it has on the lane, so it sees the same payments as it would on a lane
+of the deal's own.
+
+Which deal uses which lane, and the total of each lane, are persisted, so lanes
+are shared safely across restarts.
+*/
+package lanemanager
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-statestore"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// Manager assigns shared payment channel lanes to retrieval deals
+type Manager struct {
+	lanes *statestore.StateStore
+	deals *statestore.StateStore
+
+	lk sync.Mutex
+}
+
+// NewManager returns a lane manager that persists lane assignments to the
+// given datastore
+func NewManager(ds datastore.Batching) *Manager {
+	return &Manager{
+		lanes: statestore.New(namespace.Wrap(ds, datastore.NewKey("/lanes"))),
+		deals: statestore.New(namespace.Wrap(ds, datastore.NewKey("/deals"))),
+	}
+}
+
+// Acquire gives the deal a lane of the payment channel that no other deal is
+// using. If every lane is in use, allocate is called to allocate a new one.
+// Acquiring a lane again for the same deal returns the lane it already has.
+func (m *Manager) Acquire(dealID rm.DealID, paymentChannel address.Address, allocate func() (uint64, error)) (uint64, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	has, err := m.deals.Has(dealID)
+	if err != nil {
+		return 0, err
+	}
+	if has {
+		var dl DealLane
+		if err := m.deals.Get(dealID).Get(&dl); err != nil {
+			return 0, err
+		}
+		return dl.Lane, nil
+	}
+
+	var lanes []SharedLane
+	if err := m.lanes.List(&lanes); err != nil {
+		return 0, xerrors.Errorf("listing lanes: %w", err)
+	}
+	sort.Slice(lanes, func(i, j int) bool {
+		return lanes[i].Lane < lanes[j].Lane
+	})
+	var lane *SharedLane
+	for i := range lanes {
+		if lanes[i].PaymentChannel == paymentChannel && !lanes[i].InUse {
+			lane = &lanes[i]
+			break
+		}
+	}
+	if lane == nil {
+		number, err := allocate()
+		if err != nil {
+			return 0, err
+		}
+		lane = &SharedLane{PaymentChannel: paymentChannel, Lane: number, Total: big.Zero()}
+		if err := m.lanes.Begin(laneKey(paymentChannel, number), lane); err != nil {
+			return 0, xerrors.Errorf("recording lane %d of %s: %w", number, paymentChannel, err)
+		}
+	}
+
+	err = m.lanes.Get(laneKey(paymentChannel, lane.Lane)).Mutate(func(l *SharedLane) error {
+		l.InUse = true
+		l.Deal = dealID
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = m.deals.Begin(dealID, &DealLane{
+		DealID:         dealID,
+		PaymentChannel: paymentChannel,
+		Lane:           lane.Lane,
+		Base:           lane.Total,
+	})
+	if err != nil {
+		return 0, xerrors.Errorf("recording lane for deal %d: %w", dealID, err)
+	}
+	return lane.Lane, nil
+}
+
+// VoucherAmount returns the amount of a voucher on the deal's lane that pays
+// dealAmount in total for the deal. Deals without a shared lane pay
+// dealAmount.
+func (m *Manager) VoucherAmount(dealID rm.DealID, dealAmount abi.TokenAmount) (abi.TokenAmount, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	has, err := m.deals.Has(dealID)
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+	if !has {
+		return dealAmount, nil
+	}
+	var dl DealLane
+	if err := m.deals.Get(dealID).Get(&dl); err != nil {
+		return abi.TokenAmount{}, err
+	}
+	return big.Add(dl.Base, dealAmount), nil
+}
+
+// Release hands the deal's lane on to the next deal, once the deal has paid
+// spent in total and will make no more vouchers
+func (m *Manager) Release(dealID rm.DealID, spent abi.TokenAmount) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	has, err := m.deals.Has(dealID)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+	var dl DealLane
+	if err := m.deals.Get(dealID).Get(&dl); err != nil {
+		return err
+	}
+	err = m.lanes.Get(laneKey(dl.PaymentChannel, dl.Lane)).Mutate(func(l *SharedLane) error {
+		l.Total = big.Max(l.Total, big.Add(dl.Base, spent))
+		if l.InUse && l.Deal == dealID {
+			l.InUse = false
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("releasing lane %d of %s: %w", dl.Lane, dl.PaymentChannel, err)
+	}
+	return m.deals.Get(dealID).End()
+}
+
+// Deals returns the IDs of the deals using a shared lane
+func (m *Manager) Deals() ([]rm.DealID, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var deals []DealLane
+	if err := m.deals.List(&deals); err != nil {
+		return nil, err
+	}
+	ids := make([]rm.DealID, 0, len(deals))
+	for _, dl := range deals {
+		ids = append(ids, dl.DealID)
+	}
+	return ids, nil
+}
+
+// Lanes lists the shared lanes
+func (m *Manager) Lanes() ([]SharedLane, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var lanes []SharedLane
+	if err := m.lanes.List(&lanes); err != nil {
+		return nil, err
+	}
+	return lanes, nil
+}
+
+func laneKey(paymentChannel address.Address, lane uint64) string {
+	return fmt.Sprintf("%s-%d", paymentChannel, lane)
+}
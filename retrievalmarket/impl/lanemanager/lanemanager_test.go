@@ -0,0 +1,84 @@
+package lanemanager_test
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	spect "github.com/filecoin-project/specs-actors/support/testing"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/lanemanager"
+)
+
+func TestManager(t *testing.T) {
+	ch1 := spect.NewIDAddr(t, 100)
+	ch2 := spect.NewIDAddr(t, 101)
+
+	var allocated uint64
+	allocate := func() (uint64, error) {
+		allocated++
+		return allocated, nil
+	}
+
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	m := lanemanager.NewManager(ds)
+
+	// the first deal allocates a lane, and acquiring again returns it
+	lane, err := m.Acquire(rm.DealID(1), ch1, allocate)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lane)
+	lane, err = m.Acquire(rm.DealID(1), ch1, allocate)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lane)
+
+	// a deal running at the same time gets a lane of its own, and so does a
+	// deal on another channel
+	lane, err = m.Acquire(rm.DealID(2), ch1, allocate)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lane)
+	lane, err = m.Acquire(rm.DealID(3), ch2, allocate)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lane)
+
+	amount, err := m.VoucherAmount(rm.DealID(1), abi.NewTokenAmount(100))
+	require.NoError(t, err)
+	require.Equal(t, abi.NewTokenAmount(100), amount)
+
+	// once the first deal ends, the next deal uses its lane and its vouchers
+	// include what the first deal paid
+	require.NoError(t, m.Release(rm.DealID(1), abi.NewTokenAmount(150)))
+	lane, err = m.Acquire(rm.DealID(4), ch1, allocate)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lane)
+	amount, err = m.VoucherAmount(rm.DealID(4), abi.NewTokenAmount(100))
+	require.NoError(t, err)
+	require.Equal(t, abi.NewTokenAmount(250), amount)
+
+	// deals without a shared lane pay the amount they are asked to
+	amount, err = m.VoucherAmount(rm.DealID(1), abi.NewTokenAmount(100))
+	require.NoError(t, err)
+	require.Equal(t, abi.NewTokenAmount(100), amount)
+
+	// lanes survive a restart
+	require.NoError(t, m.Release(rm.DealID(4), abi.NewTokenAmount(50)))
+	m = lanemanager.NewManager(ds)
+	deals, err := m.Deals()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []rm.DealID{2, 3}, deals)
+
+	lane, err = m.Acquire(rm.DealID(5), ch1, allocate)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lane)
+	amount, err = m.VoucherAmount(rm.DealID(5), abi.NewTokenAmount(10))
+	require.NoError(t, err)
+	require.Equal(t, abi.NewTokenAmount(210), amount)
+
+	lanes, err := m.Lanes()
+	require.NoError(t, err)
+	require.Len(t, lanes, 3)
+	require.Equal(t, uint64(3), allocated)
+}
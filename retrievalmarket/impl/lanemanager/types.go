@@ -0,0 +1,35 @@
+package lanemanager
+
+import (
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+//go:generate cbor-gen-for --map-encoding SharedLane DealLane
+
+// SharedLane is a lane of a payment channel that deals take turns to use
+type SharedLane struct {
+	PaymentChannel address.Address
+	Lane           uint64
+
+	// Total is what the deals that have finished with the lane paid on it,
+	// which is the amount of the last voucher they created
+	Total abi.TokenAmount
+
+	// InUse is set while Deal is using the lane
+	InUse bool
+	Deal  retrievalmarket.DealID
+}
+
+// DealLane is the shared lane a deal is using
+type DealLane struct {
+	DealID         retrievalmarket.DealID
+	PaymentChannel address.Address
+	Lane           uint64
+
+	// Base is the total of the lane when the deal started using it. The
+	// deal's vouchers are for Base plus what the deal has paid.
+	Base abi.TokenAmount
+}
@@ -0,0 +1,547 @@
+/*
+Package parallelretrieval retrieves a DAG from several providers at once.
+
+The orchestrator first retrieves the root block of the DAG, then splits the
+rest of it into the subtrees under the root's links. While there are fewer
+subtrees than providers, it retrieves the root blocks of the subtrees as well
+and splits them in turn, so that every provider has work. Each subtree is retrieved
+in its own deal from whichever provider is free, and every deal writes to the
+same store. A provider whose deal fails, or stops making progress, is dropped
+and its subtree goes back in the queue for the others. Once the queue is
+empty, idle providers also take on subtrees that are still in progress with
+another provider, and whichever deal finishes first wins.
+*/
+package parallelretrieval
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-multistore"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientutils"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("parallelretrieval")
+
+const (
+	// DefaultStallTimeout is how long a deal may go without receiving any
+	// data before it is cancelled, by default
+	DefaultStallTimeout = 2 * time.Minute
+	// DefaultMaxProviders is the number of providers retrieved from at once,
+	// by default
+	DefaultMaxProviders = 5
+	// DefaultMaxAttempts is the number of times a subtree is tried before the
+	// retrieval fails, by default
+	DefaultMaxAttempts = 3
+)
+
+// ErrNoProviders is returned when no provider can serve the retrieval
+var ErrNoProviders = xerrors.New("no providers available for retrieval")
+
+// Option configures an Orchestrator
+type Option func(*Orchestrator)
+
+// StallTimeout sets how long a deal may go without receiving any data before
+// it is cancelled and its provider dropped
+func StallTimeout(timeout time.Duration) Option {
+	return func(o *Orchestrator) {
+		o.stallTimeout = timeout
+	}
+}
+
+// MaxProviders sets the number of providers retrieved from at once. The
+// cheapest providers are chosen.
+func MaxProviders(n int) Option {
+	return func(o *Orchestrator) {
+		o.maxProviders = n
+	}
+}
+
+// MaxAttempts sets the number of times a subtree is tried before the
+// retrieval fails
+func MaxAttempts(n int) Option {
+	return func(o *Orchestrator) {
+		o.maxAttempts = n
+	}
+}
+
+// ProviderProgress is the progress of the deals with a single provider
+type ProviderProgress struct {
+	BytesReceived     uint64
+	FundsSpent        abi.TokenAmount
+	SubtreesRetrieved int
+	// Dropped is true once the provider has failed a deal or stalled
+	Dropped bool
+}
+
+// Progress is the aggregate progress of a parallel retrieval
+type Progress struct {
+	// Subtrees is the number of subtrees the DAG was split into, which is
+	// zero until it has been split
+	Subtrees          int
+	SubtreesRetrieved int
+	BytesReceived     uint64
+	FundsSpent        abi.TokenAmount
+	Providers         map[peer.ID]ProviderProgress
+}
+
+// ProgressFunc is called whenever the progress of a retrieval changes
+type ProgressFunc func(Progress)
+
+// Orchestrator splits retrievals across providers
+type Orchestrator struct {
+	client       rm.RetrievalClient
+	multiStore   *multistore.MultiStore
+	stallTimeout time.Duration
+	maxProviders int
+	maxAttempts  int
+}
+
+// NewOrchestrator returns an orchestrator that makes deals with the given
+// client, which must write to the given multistore
+func NewOrchestrator(client rm.RetrievalClient, multiStore *multistore.MultiStore, options ...Option) *Orchestrator {
+	o := &Orchestrator{
+		client:       client,
+		multiStore:   multiStore,
+		stallTimeout: DefaultStallTimeout,
+		maxProviders: DefaultMaxProviders,
+		maxAttempts:  DefaultMaxAttempts,
+	}
+	for _, option := range options {
+		option(o)
+	}
+	return o
+}
+
+// Retrieve retrieves the whole DAG under payloadCID into the given store,
+// paying from clientWallet, and returns the final progress. If no peers are
+// given, providers are found with the client's FindProviders. onProgress may
+// be nil.
+func (o *Orchestrator) Retrieve(ctx context.Context, payloadCID cid.Cid, peers []rm.RetrievalPeer, clientWallet address.Address, storeID multistore.StoreID, onProgress ProgressFunc) (Progress, error) {
+	if _, err := o.multiStore.Get(storeID); err != nil {
+		return Progress{}, xerrors.Errorf("loading store %d: %w", storeID, err)
+	}
+	if len(peers) == 0 {
+		peers = o.client.FindProviders(payloadCID)
+	}
+	candidates := clientutils.RankProviders(ctx, o.client, payloadCID, peers, rm.QueryParams{})
+	if len(candidates) == 0 {
+		return Progress{}, ErrNoProviders
+	}
+	if o.maxProviders > 0 && len(candidates) > o.maxProviders {
+		candidates = candidates[:o.maxProviders]
+	}
+	providers := make([]rm.RetrievalPeer, 0, len(candidates))
+	for _, candidate := range candidates {
+		providers = append(providers, candidate.Peer)
+	}
+
+	r := &retrieval{
+		o:            o,
+		payloadCID:   payloadCID,
+		clientWallet: clientWallet,
+		storeID:      storeID,
+		onProgress:   onProgress,
+		waiter:       clientutils.NewDealWaiter(o.client, storeID),
+		changed:      make(chan struct{}),
+		deals:        make(map[rm.DealID]*deal),
+		providers:    make(map[peer.ID]*ProviderProgress),
+	}
+	for _, p := range providers {
+		r.providers[p.ID] = &ProviderProgress{FundsSpent: big.Zero()}
+	}
+	unsubscribe := o.client.SubscribeToEvents(r.update)
+	defer unsubscribe()
+
+	err := r.run(ctx, providers)
+	return r.progress(), err
+}
+
+type subtree struct {
+	root     cid.Cid
+	done     bool
+	attempts int
+	// active are the deals in progress for the subtree, by provider
+	active map[peer.ID]rm.DealID
+}
+
+type deal struct {
+	provider peer.ID
+	subtree  *subtree
+}
+
+// retrieval is the state of a single call to Retrieve
+type retrieval struct {
+	o            *Orchestrator
+	payloadCID   cid.Cid
+	clientWallet address.Address
+	storeID      multistore.StoreID
+	onProgress   ProgressFunc
+	waiter       *clientutils.DealWaiter
+
+	lk        sync.Mutex
+	changed   chan struct{}
+	deals     map[rm.DealID]*deal
+	providers map[peer.ID]*ProviderProgress
+	subtrees  []*subtree
+	remaining int
+	err       error
+	// abort cancels the deals in progress once the retrieval has failed
+	abort context.CancelFunc
+}
+
+func (r *retrieval) run(ctx context.Context, providers []rm.RetrievalPeer) error {
+	ctx, r.abort = context.WithCancel(ctx)
+	defer r.abort()
+
+	roots, live, err := r.split(ctx, providers)
+	if err != nil {
+		return err
+	}
+	r.lk.Lock()
+	for _, c := range roots {
+		r.subtrees = append(r.subtrees, &subtree{root: c, active: make(map[peer.ID]rm.DealID)})
+	}
+	r.remaining = len(r.subtrees)
+	r.lk.Unlock()
+	r.notify()
+
+	var wg sync.WaitGroup
+	for _, p := range live {
+		wg.Add(1)
+		go func(p rm.RetrievalPeer) {
+			defer wg.Done()
+			r.work(ctx, p)
+		}(p)
+	}
+	wg.Wait()
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.remaining > 0 {
+		if r.err != nil {
+			return r.err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return xerrors.Errorf("%d subtrees of %s not retrieved: %w", r.remaining, r.payloadCID, ErrNoProviders)
+	}
+	return nil
+}
+
+// split retrieves the root block of the DAG and returns the roots of the
+// subtrees under it, along with the providers that have not failed. While there
+// are fewer subtrees than providers, it retrieves the root blocks of the
+// subtrees too, and replaces them with the subtrees under them.
+func (r *retrieval) split(ctx context.Context, providers []rm.RetrievalPeer) ([]cid.Cid, []rm.RetrievalPeer, error) {
+	seen := make(map[cid.Cid]struct{})
+	var roots []cid.Cid
+	expand := func(c cid.Cid) error {
+		var err error
+		providers, err = r.retrieveBlock(ctx, providers, c)
+		if err != nil {
+			return err
+		}
+		links, err := r.links(ctx, c)
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if _, ok := seen[l]; !ok {
+				seen[l] = struct{}{}
+				roots = append(roots, l)
+			}
+		}
+		return nil
+	}
+
+	seen[r.payloadCID] = struct{}{}
+	if err := expand(r.payloadCID); err != nil {
+		return nil, nil, err
+	}
+	for len(roots) > 0 && len(roots) < len(providers) {
+		parents := roots
+		roots = nil
+		for _, c := range parents {
+			if err := expand(c); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return roots, providers, nil
+}
+
+// retrieveBlock retrieves a single block from the first of the providers that
+// serves it, and returns the providers that have not failed
+func (r *retrieval) retrieveBlock(ctx context.Context, providers []rm.RetrievalPeer, c cid.Cid) ([]rm.RetrievalPeer, error) {
+	matchRoot := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any).Matcher().Node()
+	for i, p := range providers {
+		err := r.retrieveFrom(ctx, p, c, matchRoot, nil)
+		if err == nil {
+			return providers[i:], nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Warnf("retrieving block %s from %s: %s", c, p.ID, err)
+		r.drop(p.ID)
+	}
+	return nil, xerrors.Errorf("retrieving block %s: %w", c, ErrNoProviders)
+}
+
+// links returns the CIDs a retrieved block links to
+func (r *retrieval) links(ctx context.Context, c cid.Cid) ([]cid.Cid, error) {
+	store, err := r.o.multiStore.Get(r.storeID)
+	if err != nil {
+		return nil, xerrors.Errorf("loading store %d: %w", r.storeID, err)
+	}
+	blk, err := store.Bstore.Get(c)
+	if err != nil {
+		return nil, xerrors.Errorf("loading block %s: %w", c, err)
+	}
+	return clientutils.BlockLinks(ctx, blk)
+}
+
+// work retrieves subtrees from a single provider until there are none left,
+// or the provider fails
+func (r *retrieval) work(ctx context.Context, p rm.RetrievalPeer) {
+	for {
+		st := r.next(ctx, p.ID)
+		if st == nil {
+			return
+		}
+		err := r.retrieveFrom(ctx, p, st.root, shared.AllSelector(), st)
+		if err == nil {
+			continue
+		}
+		log.Warnf("retrieving subtree %s from %s, dropping provider: %s", st.root, p.ID, err)
+		r.lk.Lock()
+		delete(st.active, p.ID)
+		st.attempts++
+		failed := !st.done && st.attempts >= r.o.maxAttempts && r.err == nil
+		if failed {
+			r.err = xerrors.Errorf("retrieving subtree %s: giving up after %d attempts: %w", st.root, st.attempts, err)
+		}
+		r.lk.Unlock()
+		if failed {
+			r.abort()
+		}
+		r.drop(p.ID)
+		return
+	}
+}
+
+// next waits for a subtree the given provider can work on. It returns nil
+// when the retrieval is over.
+func (r *retrieval) next(ctx context.Context, provider peer.ID) *subtree {
+	for {
+		r.lk.Lock()
+		if r.remaining == 0 || r.err != nil {
+			r.lk.Unlock()
+			return nil
+		}
+		// prefer subtrees no one is working on, then help with subtrees that
+		// only one other provider is working on
+		var found *subtree
+		for _, st := range r.subtrees {
+			if !st.done && len(st.active) == 0 {
+				found = st
+				break
+			}
+		}
+		if found == nil {
+			for _, st := range r.subtrees {
+				if _, ok := st.active[provider]; !st.done && !ok && len(st.active) == 1 {
+					found = st
+					break
+				}
+			}
+		}
+		if found != nil {
+			found.active[provider] = 0
+			r.lk.Unlock()
+			return found
+		}
+		changed := r.changed
+		r.lk.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// retrieveFrom retrieves the given selection from a provider and waits for the
+// deal to end
+func (r *retrieval) retrieveFrom(ctx context.Context, p rm.RetrievalPeer, root cid.Cid, sel ipld.Node, st *subtree) error {
+	query, err := rm.NewQueryV1WithSelector(root, nil, sel)
+	if err != nil {
+		return err
+	}
+	resp, err := r.o.client.Query(ctx, p, root, query.QueryParams)
+	if err != nil {
+		return xerrors.Errorf("querying provider: %w", err)
+	}
+	if resp.Status != rm.QueryResponseAvailable {
+		return xerrors.Errorf("provider cannot serve retrieval: %s", resp.Message)
+	}
+	totalFunds := clientutils.RetrievalPrice(resp)
+	params, err := rm.NewParamsV1(resp.MinPricePerByte, resp.MaxPaymentInterval, resp.MaxPaymentIntervalIncrease, sel, nil, resp.UnsealPrice)
+	if err != nil {
+		return err
+	}
+
+	storeID := r.storeID
+	dealID, err := r.o.client.Retrieve(ctx, root, params, totalFunds, p, r.clientWallet, resp.PaymentAddress, &storeID)
+	if err != nil {
+		return xerrors.Errorf("starting deal: %w", err)
+	}
+
+	r.lk.Lock()
+	d := &deal{provider: p.ID, subtree: st}
+	r.deals[dealID] = d
+	if st != nil && st.done {
+		// another provider finished the subtree while the deal was starting
+		r.lk.Unlock()
+		r.cancel(dealID)
+		return nil
+	}
+	if st != nil {
+		st.active[p.ID] = dealID
+	}
+	r.lk.Unlock()
+
+	// a deal for a subtree that another provider has finished ends
+	// successfully as soon as that happens
+	err = r.waiter.Wait(ctx, dealID, r.o.stallTimeout, func() bool {
+		r.lk.Lock()
+		defer r.lk.Unlock()
+		return st != nil && st.done
+	})
+	if err != nil {
+		return err
+	}
+
+	r.lk.Lock()
+	var others []rm.DealID
+	if st != nil && !st.done {
+		others = r.complete(d)
+	}
+	r.lk.Unlock()
+	r.notify()
+	for _, id := range others {
+		if err := r.o.client.CancelDeal(id); err != nil {
+			log.Warnf("cancelling duplicate deal %d: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// complete records a successful deal and returns the other deals in progress
+// for the same subtree. It must be called with the lock held.
+func (r *retrieval) complete(d *deal) []rm.DealID {
+	st := d.subtree
+	if st == nil {
+		return nil
+	}
+	r.providers[d.provider].SubtreesRetrieved++
+	st.done = true
+	r.remaining--
+	var others []rm.DealID
+	for provider, id := range st.active {
+		if provider != d.provider && id != 0 {
+			others = append(others, id)
+		}
+	}
+	st.active = make(map[peer.ID]rm.DealID)
+	return others
+}
+
+func (r *retrieval) cancel(dealID rm.DealID) {
+	if err := r.o.client.CancelDeal(dealID); err != nil {
+		log.Warnf("cancelling deal %d: %s", dealID, err)
+	}
+}
+
+func (r *retrieval) drop(provider peer.ID) {
+	r.lk.Lock()
+	r.providers[provider].Dropped = true
+	r.lk.Unlock()
+	r.notify()
+}
+
+// update is the client subscriber that tracks the deals of the retrieval
+func (r *retrieval) update(event rm.ClientEvent, state rm.ClientDealState) {
+	if state.StoreID == nil || *state.StoreID != r.storeID {
+		return
+	}
+	r.waiter.Update(event, state)
+	r.notify()
+}
+
+// notify wakes everything waiting for a change and reports progress
+func (r *retrieval) notify() {
+	r.lk.Lock()
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.lk.Unlock()
+	r.waiter.Notify()
+
+	if r.onProgress != nil {
+		r.onProgress(r.progress())
+	}
+}
+
+func (r *retrieval) progress() Progress {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	progress := Progress{
+		Subtrees:          len(r.subtrees),
+		SubtreesRetrieved: len(r.subtrees) - r.remaining,
+		FundsSpent:        big.Zero(),
+		Providers:         make(map[peer.ID]ProviderProgress, len(r.providers)),
+	}
+	for id, pp := range r.providers {
+		progress.Providers[id] = ProviderProgress{
+			FundsSpent:        big.Zero(),
+			SubtreesRetrieved: pp.SubtreesRetrieved,
+			Dropped:           pp.Dropped,
+		}
+	}
+	for id, d := range r.deals {
+		state, ok := r.waiter.State(id)
+		if !ok {
+			continue
+		}
+		pp := progress.Providers[d.provider]
+		pp.BytesReceived += state.TotalReceived
+		if !state.FundsSpent.Nil() {
+			pp.FundsSpent = big.Add(pp.FundsSpent, state.FundsSpent)
+		}
+		progress.Providers[d.provider] = pp
+	}
+	for _, pp := range progress.Providers {
+		progress.BytesReceived += pp.BytesReceived
+		progress.FundsSpent = big.Add(progress.FundsSpent, pp.FundsSpent)
+	}
+	return progress
+}
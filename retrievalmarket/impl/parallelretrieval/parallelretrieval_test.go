@@ -0,0 +1,385 @@
+package parallelretrieval_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-multistore"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/parallelretrieval"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestOrchestratorRetrieve(t *testing.T) {
+	ctx := context.Background()
+	tree := tut.NewTestIPLDTree()
+	payloadCID := tree.RootBlock.Cid()
+	allBlocks := []blocks.Block{tree.RootBlock, tree.LeafAlphaBlock, tree.LeafBetaBlock, tree.MiddleMapBlock, tree.MiddleListBlock}
+	clientWallet := address.TestAddress
+
+	setup := func(t *testing.T, behaviors ...behavior) (*fakeClient, *multistore.MultiStore, multistore.StoreID, []rm.RetrievalPeer) {
+		ms, err := multistore.NewMultiDstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, err)
+		storeID := ms.Next()
+		_, err = ms.Get(storeID)
+		require.NoError(t, err)
+
+		fc := newFakeClient(t, tree, ms)
+		peers := make([]rm.RetrievalPeer, 0, len(behaviors))
+		for i, b := range behaviors {
+			p := tut.GeneratePeers(1)[0]
+			fc.providers[p] = fakeProvider{behavior: b, price: abi.NewTokenAmount(int64(i + 1))}
+			peers = append(peers, rm.RetrievalPeer{ID: p})
+		}
+		return fc, ms, storeID, peers
+	}
+
+	requireAllBlocks := func(t *testing.T, ms *multistore.MultiStore, storeID multistore.StoreID) {
+		store, err := ms.Get(storeID)
+		require.NoError(t, err)
+		for _, blk := range allBlocks {
+			has, err := store.Bstore.Has(blk.Cid())
+			require.NoError(t, err)
+			require.True(t, has, "missing block %s", blk.Cid())
+		}
+	}
+
+	t.Run("splits the DAG across providers", func(t *testing.T) {
+		fc, ms, storeID, peers := setup(t, serve, serve, serve)
+		var lk sync.Mutex
+		var updates []parallelretrieval.Progress
+		o := parallelretrieval.NewOrchestrator(fc, ms)
+		progress, err := o.Retrieve(ctx, payloadCID, peers, clientWallet, storeID, func(p parallelretrieval.Progress) {
+			lk.Lock()
+			updates = append(updates, p)
+			lk.Unlock()
+		})
+		require.NoError(t, err)
+		requireAllBlocks(t, ms, storeID)
+
+		require.Equal(t, 3, progress.Subtrees)
+		require.Equal(t, 3, progress.SubtreesRetrieved)
+		bytesReceived, fundsSpent := fc.totals()
+		require.Equal(t, bytesReceived, progress.BytesReceived)
+		require.True(t, fundsSpent.Equals(progress.FundsSpent))
+		require.NotEmpty(t, updates)
+
+		// the root block comes from the cheapest provider, and every subtree
+		// is retrieved in its own deal
+		require.Equal(t, []cid.Cid{payloadCID}, fc.retrieved[peers[0].ID][:1])
+		var subtrees []cid.Cid
+		for _, p := range peers {
+			for _, c := range fc.retrieved[p.ID] {
+				if c != payloadCID {
+					subtrees = append(subtrees, c)
+				}
+			}
+		}
+		require.ElementsMatch(t, []cid.Cid{tree.LeafAlphaBlock.Cid(), tree.MiddleMapBlock.Cid(), tree.MiddleListBlock.Cid()}, subtrees)
+	})
+
+	t.Run("splits subtrees further when there are more providers", func(t *testing.T) {
+		fc, ms, storeID, peers := setup(t, serve, serve, serve, serve, serve)
+		o := parallelretrieval.NewOrchestrator(fc, ms)
+		_, err := o.Retrieve(ctx, payloadCID, peers, clientWallet, storeID, nil)
+		require.NoError(t, err)
+		requireAllBlocks(t, ms, storeID)
+
+		// the three subtrees under the root are split into the single leaf
+		// below them that is not linked from the root, so every block ends
+		// up retrieved on its own, and only once
+		var retrieved []cid.Cid
+		for _, p := range peers {
+			retrieved = append(retrieved, fc.retrieved[p.ID]...)
+		}
+		require.ElementsMatch(t, []cid.Cid{payloadCID, tree.LeafAlphaBlock.Cid(), tree.LeafBetaBlock.Cid(), tree.MiddleMapBlock.Cid(), tree.MiddleListBlock.Cid()}, retrieved)
+	})
+
+	t.Run("finds providers when none are given", func(t *testing.T) {
+		fc, ms, storeID, peers := setup(t, serve, serve)
+		fc.found = peers
+		o := parallelretrieval.NewOrchestrator(fc, ms)
+		_, err := o.Retrieve(ctx, payloadCID, nil, clientWallet, storeID, nil)
+		require.NoError(t, err)
+		requireAllBlocks(t, ms, storeID)
+	})
+
+	t.Run("drops failing providers", func(t *testing.T) {
+		fc, ms, storeID, peers := setup(t, serve, fail, serve)
+		o := parallelretrieval.NewOrchestrator(fc, ms)
+		progress, err := o.Retrieve(ctx, payloadCID, peers, clientWallet, storeID, nil)
+		require.NoError(t, err)
+		requireAllBlocks(t, ms, storeID)
+		require.False(t, progress.Providers[peers[0].ID].Dropped)
+		require.True(t, progress.Providers[peers[1].ID].Dropped)
+		require.Equal(t, 3, progress.SubtreesRetrieved)
+	})
+
+	t.Run("duplicates slow subtrees", func(t *testing.T) {
+		fc, ms, storeID, peers := setup(t, serve, stallSubtrees)
+		o := parallelretrieval.NewOrchestrator(fc, ms)
+		progress, err := o.Retrieve(ctx, payloadCID, peers, clientWallet, storeID, nil)
+		require.NoError(t, err)
+		requireAllBlocks(t, ms, storeID)
+		require.Equal(t, 3, progress.Providers[peers[0].ID].SubtreesRetrieved)
+		require.Equal(t, 0, progress.Providers[peers[1].ID].SubtreesRetrieved)
+		// every stalled subtree deal was cancelled once the other provider
+		// finished it
+		require.Len(t, fc.cancelled, len(fc.retrieved[peers[1].ID])-1)
+	})
+
+	t.Run("cancels stalled deals", func(t *testing.T) {
+		fc, ms, storeID, peers := setup(t, stallSubtrees)
+		o := parallelretrieval.NewOrchestrator(fc, ms, parallelretrieval.StallTimeout(50*time.Millisecond))
+		progress, err := o.Retrieve(ctx, payloadCID, peers, clientWallet, storeID, nil)
+		require.Error(t, err)
+		require.True(t, progress.Providers[peers[0].ID].Dropped)
+		require.Len(t, fc.cancelled, 1)
+	})
+
+	t.Run("no providers", func(t *testing.T) {
+		fc, ms, storeID, peers := setup(t, unavailable, unavailable)
+		o := parallelretrieval.NewOrchestrator(fc, ms)
+		_, err := o.Retrieve(ctx, payloadCID, peers, clientWallet, storeID, nil)
+		require.True(t, xerrors.Is(err, parallelretrieval.ErrNoProviders))
+	})
+
+	t.Run("all providers fail", func(t *testing.T) {
+		fc, ms, storeID, peers := setup(t, fail, fail)
+		o := parallelretrieval.NewOrchestrator(fc, ms)
+		_, err := o.Retrieve(ctx, payloadCID, peers, clientWallet, storeID, nil)
+		require.True(t, xerrors.Is(err, parallelretrieval.ErrNoProviders))
+	})
+}
+
+type behavior int
+
+const (
+	serve behavior = iota
+	fail
+	// stallSubtrees serves the root block, then stops sending data
+	stallSubtrees
+	unavailable
+)
+
+type fakeProvider struct {
+	behavior behavior
+	price    abi.TokenAmount
+}
+
+// fakeClient is a retrieval client that serves deals straight from a test
+// IPLD tree
+type fakeClient struct {
+	rm.RetrievalClient
+	t          *testing.T
+	multiStore *multistore.MultiStore
+	blocks     map[cid.Cid]blocks.Block
+	subtrees   map[cid.Cid][]cid.Cid
+	matchRoot  []byte
+	providers  map[peer.ID]fakeProvider
+	found      []rm.RetrievalPeer
+
+	lk          sync.Mutex
+	nextID      rm.DealID
+	subscribers map[int]rm.ClientSubscriber
+	nextSub     int
+	deals       map[rm.DealID]*fakeDeal
+	retrieved   map[peer.ID][]cid.Cid
+	cancelled   []rm.DealID
+}
+
+type fakeDeal struct {
+	state     rm.ClientDealState
+	cancel    chan struct{}
+	cancelled bool
+}
+
+func newFakeClient(t *testing.T, tree tut.TestIPLDTree, ms *multistore.MultiStore) *fakeClient {
+	var matchRoot bytes.Buffer
+	err := dagcbor.Encoder(builder.NewSelectorSpecBuilder(basicnode.Prototype.Any).Matcher().Node(), &matchRoot)
+	require.NoError(t, err)
+	alpha := tree.LeafAlphaBlock.Cid()
+	beta := tree.LeafBetaBlock.Cid()
+	middleMap := tree.MiddleMapBlock.Cid()
+	middleList := tree.MiddleListBlock.Cid()
+	root := tree.RootNodeLnk.(cidlink.Link).Cid
+	return &fakeClient{
+		t:          t,
+		multiStore: ms,
+		blocks: map[cid.Cid]blocks.Block{
+			root:       tree.RootBlock,
+			alpha:      tree.LeafAlphaBlock,
+			beta:       tree.LeafBetaBlock,
+			middleMap:  tree.MiddleMapBlock,
+			middleList: tree.MiddleListBlock,
+		},
+		subtrees: map[cid.Cid][]cid.Cid{
+			root:       {root, alpha, middleMap, middleList, beta},
+			alpha:      {alpha},
+			beta:       {beta},
+			middleMap:  {middleMap, alpha},
+			middleList: {middleList, alpha, beta},
+		},
+		matchRoot:   matchRoot.Bytes(),
+		providers:   make(map[peer.ID]fakeProvider),
+		nextID:      1,
+		subscribers: make(map[int]rm.ClientSubscriber),
+		deals:       make(map[rm.DealID]*fakeDeal),
+		retrieved:   make(map[peer.ID][]cid.Cid),
+	}
+}
+
+func (fc *fakeClient) FindProviders(payloadCID cid.Cid) []rm.RetrievalPeer {
+	return fc.found
+}
+
+func (fc *fakeClient) Query(ctx context.Context, p rm.RetrievalPeer, payloadCID cid.Cid, params rm.QueryParams) (rm.QueryResponse, error) {
+	provider := fc.providers[p.ID]
+	if provider.behavior == unavailable {
+		return rm.QueryResponse{Status: rm.QueryResponseUnavailable}, nil
+	}
+	return rm.QueryResponse{
+		Status:                     rm.QueryResponseAvailable,
+		Size:                       1000,
+		ExpectedPayloadSize:        100,
+		PaymentAddress:             address.TestAddress2,
+		MinPricePerByte:            provider.price,
+		MaxPaymentInterval:         1000,
+		MaxPaymentIntervalIncrease: 100,
+		UnsealPrice:                big.Zero(),
+	}, nil
+}
+
+func (fc *fakeClient) Retrieve(ctx context.Context, payloadCID cid.Cid, params rm.Params, totalFunds abi.TokenAmount, p rm.RetrievalPeer, clientWallet address.Address, minerWallet address.Address, storeID *multistore.StoreID) (rm.DealID, error) {
+	fc.lk.Lock()
+	id := fc.nextID
+	fc.nextID++
+	d := &fakeDeal{
+		state: rm.ClientDealState{
+			DealProposal: rm.DealProposal{PayloadCID: payloadCID, ID: id, Params: params},
+			Status:       rm.DealStatusOngoing,
+			Sender:       p.ID,
+			StoreID:      storeID,
+			FundsSpent:   big.Zero(),
+		},
+		cancel: make(chan struct{}),
+	}
+	fc.deals[id] = d
+	fc.retrieved[p.ID] = append(fc.retrieved[p.ID], payloadCID)
+	fc.lk.Unlock()
+
+	onlyRoot := bytes.Equal(params.Selector.Raw, fc.matchRoot)
+	go fc.run(d, fc.providers[p.ID], *storeID, onlyRoot)
+	return id, nil
+}
+
+func (fc *fakeClient) run(d *fakeDeal, provider fakeProvider, storeID multistore.StoreID, onlyRoot bool) {
+	fc.publish(d, func(*rm.ClientDealState) {})
+
+	switch {
+	case provider.behavior == fail:
+		fc.publish(d, func(state *rm.ClientDealState) {
+			state.Status = rm.DealStatusErrored
+			state.Message = "provider failed"
+		})
+		return
+	case provider.behavior == stallSubtrees && !onlyRoot:
+		<-d.cancel
+		fc.publish(d, func(state *rm.ClientDealState) {
+			state.Status = rm.DealStatusCancelled
+		})
+		return
+	}
+
+	store, err := fc.multiStore.Get(storeID)
+	require.NoError(fc.t, err)
+	cids := fc.subtrees[d.state.PayloadCID]
+	if onlyRoot {
+		cids = cids[:1]
+	}
+	var received uint64
+	for _, c := range cids {
+		blk := fc.blocks[c]
+		require.NoError(fc.t, store.Bstore.Put(blk))
+		received += uint64(len(blk.RawData()))
+	}
+	fc.publish(d, func(state *rm.ClientDealState) {
+		state.Status = rm.DealStatusCompleted
+		state.TotalReceived = received
+		state.FundsSpent = big.Mul(provider.price, abi.NewTokenAmount(int64(received)))
+	})
+}
+
+func (fc *fakeClient) publish(d *fakeDeal, update func(*rm.ClientDealState)) {
+	fc.lk.Lock()
+	update(&d.state)
+	state := d.state
+	subscribers := make([]rm.ClientSubscriber, 0, len(fc.subscribers))
+	for _, sub := range fc.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	fc.lk.Unlock()
+	for _, sub := range subscribers {
+		sub(rm.ClientEventDataTransferComplete, state)
+	}
+}
+
+func (fc *fakeClient) SubscribeToEvents(subscriber rm.ClientSubscriber) rm.Unsubscribe {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	id := fc.nextSub
+	fc.nextSub++
+	fc.subscribers[id] = subscriber
+	return func() {
+		fc.lk.Lock()
+		defer fc.lk.Unlock()
+		delete(fc.subscribers, id)
+	}
+}
+
+func (fc *fakeClient) CancelDeal(id rm.DealID) error {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	d, ok := fc.deals[id]
+	if !ok {
+		return xerrors.Errorf("no deal %d", id)
+	}
+	fc.cancelled = append(fc.cancelled, id)
+	if !d.cancelled {
+		d.cancelled = true
+		close(d.cancel)
+	}
+	return nil
+}
+
+// totals returns the bytes received and funds spent across all deals
+func (fc *fakeClient) totals() (uint64, abi.TokenAmount) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	var received uint64
+	spent := big.Zero()
+	for _, d := range fc.deals {
+		received += d.state.TotalReceived
+		spent = big.Add(spent, d.state.FundsSpent)
+	}
+	return received, spent
+}
@@ -0,0 +1,371 @@
+/*
+Package paychmanager settles and collects the payment channels a retrieval
+client has finished with.
+
+The client creates payment channels as it needs them, and the funds it puts in
+a channel stay locked there until the channel is settled and collected. The
+manager follows the deals of a retrieval client to learn which channels they
+use. On a regular check, it starts settling each channel that no deal in
+progress uses and that has been idle for longer than a threshold, and once the
+channel has settled, collects it, which returns the funds the client did not
+pay out to the client. Funds only count as reclaimed once the collect message
+is confirmed. A deal that picks up a channel the manager has settled is
+cancelled, as providers could not redeem its vouchers. All bookkeeping is
+persisted, so that the manager can report what it has reclaimed.
+*/
+package paychmanager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-statestore"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("paychmanager")
+
+// DefaultCheckInterval is how often channels are checked by default
+const DefaultCheckInterval = 10 * time.Minute
+
+// DefaultIdleTimeout is how long a channel must go unused by default before
+// it is settled
+const DefaultIdleTimeout = 24 * time.Hour
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// CheckInterval sets how often the manager checks whether channels should be
+// settled or collected
+func CheckInterval(interval time.Duration) Option {
+	return func(m *Manager) {
+		m.checkInterval = interval
+	}
+}
+
+// IdleTimeout sets how long a channel must go unused before it is settled
+func IdleTimeout(timeout time.Duration) Option {
+	return func(m *Manager) {
+		m.idleTimeout = timeout
+	}
+}
+
+// Clock sets the function the manager uses to get the current time
+func Clock(now func() time.Time) Option {
+	return func(m *Manager) {
+		m.now = now
+	}
+}
+
+// Manager settles and collects the payment channels of a retrieval client
+type Manager struct {
+	node          rm.RetrievalClientNode
+	client        rm.RetrievalClient
+	channels      *statestore.StateStore
+	checkInterval time.Duration
+	idleTimeout   time.Duration
+	now           func() time.Time
+
+	lk sync.Mutex
+
+	unsubscribe rm.Unsubscribe
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+// NewManager returns a manager for the payment channels used by the deals
+// of the given client, that persists its bookkeeping to the given datastore
+func NewManager(ds datastore.Batching, node rm.RetrievalClientNode, client rm.RetrievalClient, options ...Option) *Manager {
+	m := &Manager{
+		node:          node,
+		client:        client,
+		channels:      statestore.New(ds),
+		checkInterval: DefaultCheckInterval,
+		idleTimeout:   DefaultIdleTimeout,
+		now:           time.Now,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Start follows the client's deals, and checks channels regularly until
+// Stop is called
+func (m *Manager) Start(ctx context.Context) error {
+	m.unsubscribe = m.client.SubscribeToEvents(m.onDealEvent)
+	deals, err := m.client.ListDeals()
+	if err != nil {
+		m.unsubscribe()
+		return xerrors.Errorf("listing deals: %w", err)
+	}
+	for _, deal := range deals {
+		if deal.PaymentInfo != nil {
+			if _, err := m.track(deal.PaymentInfo.PayCh, false); err != nil {
+				log.Errorf("tracking payment channel %s: %s", deal.PaymentInfo.PayCh, err)
+			}
+		}
+	}
+
+	m.stop = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go func() {
+		defer close(m.stopped)
+		ticker := time.NewTicker(m.checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.Check(ctx); err != nil {
+					log.Errorf("checking payment channels: %s", err)
+				}
+			case <-m.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops following deals and checking channels
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	m.unsubscribe()
+	close(m.stop)
+	<-m.stopped
+	m.stop = nil
+}
+
+func (m *Manager) onDealEvent(event rm.ClientEvent, state rm.ClientDealState) {
+	if state.PaymentInfo == nil {
+		return
+	}
+	status, err := m.track(state.PaymentInfo.PayCh, true)
+	if err != nil {
+		log.Errorf("tracking payment channel %s: %s", state.PaymentInfo.PayCh, err)
+		return
+	}
+	// a deal that picked up a channel the manager has settled would pay into a
+	// channel that providers can no longer redeem from, so it is cancelled
+	if status == ChannelStatusActive || clientstates.IsFinalityState(state.Status) || state.Status == rm.DealStatusCancelling {
+		return
+	}
+	log.Errorf("cancelling deal %d: it uses payment channel %s, which is %s", state.ID, state.PaymentInfo.PayCh, status)
+	if err := m.client.CancelDeal(state.ID); err != nil {
+		log.Errorf("cancelling deal %d: %s", state.ID, err)
+	}
+}
+
+// track records that a deal uses the payment channel, and returns the
+// channel's status. If active is set the deal has just made progress, so the
+// channel's idle time starts again.
+func (m *Manager) track(paymentChannel address.Address, active bool) (ChannelStatus, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := m.now().Unix()
+	has, err := m.channels.Has(paymentChannel)
+	if err != nil {
+		return 0, err
+	}
+	if !has {
+		return ChannelStatusActive, m.channels.Begin(paymentChannel, &Channel{
+			PaymentChannel: paymentChannel,
+			Status:         ChannelStatusActive,
+			LastActive:     now,
+			Reclaimed:      big.Zero(),
+		})
+	}
+	var channel Channel
+	if err := m.channels.Get(paymentChannel).Get(&channel); err != nil {
+		return 0, err
+	}
+	if !active || channel.Status != ChannelStatusActive {
+		return channel.Status, nil
+	}
+	return channel.Status, m.channels.Get(paymentChannel).Mutate(func(c *Channel) error {
+		c.LastActive = now
+		return nil
+	})
+}
+
+// Check settles the channels that have been idle for too long, and collects
+// the channels that have settled
+func (m *Manager) Check(ctx context.Context) error {
+	tok, epoch, err := m.node.GetChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+	deals, err := m.client.ListDeals()
+	if err != nil {
+		return xerrors.Errorf("listing deals: %w", err)
+	}
+	inUse := make(map[address.Address]bool)
+	for _, deal := range deals {
+		if deal.PaymentInfo != nil && !clientstates.IsFinalityState(deal.Status) {
+			inUse[deal.PaymentInfo.PayCh] = true
+		}
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var channels []Channel
+	if err := m.channels.List(&channels); err != nil {
+		return xerrors.Errorf("listing payment channels: %w", err)
+	}
+	for _, channel := range channels {
+		var err error
+		switch channel.Status {
+		case ChannelStatusActive:
+			if inUse[channel.PaymentChannel] {
+				continue
+			}
+			err = m.settle(ctx, channel)
+		case ChannelStatusSettling:
+			err = m.collect(ctx, tok, epoch, channel)
+		case ChannelStatusCollecting:
+			err = m.checkCollected(ctx, channel)
+		}
+		if err != nil {
+			log.Errorf("checking payment channel %s: %s", channel.PaymentChannel, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) settle(ctx context.Context, channel Channel) error {
+	idle := m.now().Sub(time.Unix(channel.LastActive, 0))
+	if idle < m.idleTimeout {
+		return nil
+	}
+	funds, err := m.node.CheckAvailableFunds(ctx, channel.PaymentChannel)
+	if err != nil {
+		return xerrors.Errorf("checking available funds: %w", err)
+	}
+	// Funds are still being added to the channel, so someone means to use it
+	if funds.PendingAmt.GreaterThan(big.Zero()) || funds.QueuedAmt.GreaterThan(big.Zero()) {
+		return nil
+	}
+
+	msg, err := m.node.SettlePaymentChannel(ctx, channel.PaymentChannel)
+	if err != nil {
+		return xerrors.Errorf("settling: %w", err)
+	}
+	log.Infof("settling payment channel %s, idle for %s, in message %s", channel.PaymentChannel, idle.Round(time.Second), msg)
+	return m.channels.Get(channel.PaymentChannel).Mutate(func(c *Channel) error {
+		c.Status = ChannelStatusSettling
+		c.SettleMessage = &msg
+		return nil
+	})
+}
+
+func (m *Manager) collect(ctx context.Context, tok shared.TipSetToken, epoch abi.ChainEpoch, channel Channel) error {
+	settlingAt, err := m.node.GetPaymentChannelSettlingAt(ctx, channel.PaymentChannel, tok)
+	if err != nil {
+		return xerrors.Errorf("getting settlement epoch: %w", err)
+	}
+	if settlingAt != channel.SettlingAt {
+		err := m.channels.Get(channel.PaymentChannel).Mutate(func(c *Channel) error {
+			c.SettlingAt = settlingAt
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// The settle message has not landed yet, or the channel has not settled
+	if settlingAt == 0 || epoch < settlingAt {
+		return nil
+	}
+
+	// providers can redeem vouchers until the channel settles, so what is
+	// left to reclaim is only known now
+	funds, err := m.node.CheckAvailableFunds(ctx, channel.PaymentChannel)
+	if err != nil {
+		return xerrors.Errorf("checking available funds: %w", err)
+	}
+	reclaimed := big.Max(big.Zero(), big.Sub(funds.ConfirmedAmt, funds.VoucherReedeemedAmt))
+
+	msg, err := m.node.CollectPaymentChannel(ctx, channel.PaymentChannel)
+	if err != nil {
+		return xerrors.Errorf("collecting: %w", err)
+	}
+	log.Infof("collecting payment channel %s, reclaiming %s, in message %s", channel.PaymentChannel, reclaimed, msg)
+	return m.channels.Get(channel.PaymentChannel).Mutate(func(c *Channel) error {
+		c.Status = ChannelStatusCollecting
+		c.CollectMessage = &msg
+		c.Reclaimed = reclaimed
+		return nil
+	})
+}
+
+// checkCollected records the channel as collected once its collect message
+// is confirmed, or sets it back to settling so that it is collected again if
+// the message failed
+func (m *Manager) checkCollected(ctx context.Context, channel Channel) error {
+	found, code, err := m.node.SearchMessage(ctx, *channel.CollectMessage)
+	if err != nil {
+		return xerrors.Errorf("looking up collect message: %w", err)
+	}
+	if !found {
+		return nil
+	}
+	if code != exitcode.Ok {
+		log.Warnf("collect message %s for payment channel %s failed with exit code %d", *channel.CollectMessage, channel.PaymentChannel, code)
+		return m.channels.Get(channel.PaymentChannel).Mutate(func(c *Channel) error {
+			c.Status = ChannelStatusSettling
+			c.CollectMessage = nil
+			c.Reclaimed = big.Zero()
+			return nil
+		})
+	}
+	log.Infof("collected payment channel %s, reclaiming %s", channel.PaymentChannel, channel.Reclaimed)
+	return m.channels.Get(channel.PaymentChannel).Mutate(func(c *Channel) error {
+		c.Status = ChannelStatusCollected
+		return nil
+	})
+}
+
+// Channels lists the payment channels the manager knows of
+func (m *Manager) Channels() ([]Channel, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var channels []Channel
+	if err := m.channels.List(&channels); err != nil {
+		return nil, xerrors.Errorf("listing payment channels: %w", err)
+	}
+	return channels, nil
+}
+
+// Reclaimed returns the total of the funds reclaimed from collected channels
+func (m *Manager) Reclaimed() (abi.TokenAmount, error) {
+	channels, err := m.Channels()
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+	total := big.Zero()
+	for _, channel := range channels {
+		if channel.Status == ChannelStatusCollected {
+			total = big.Add(total, channel.Reclaimed)
+		}
+	}
+	return total, nil
+}
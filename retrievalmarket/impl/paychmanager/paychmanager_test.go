@@ -0,0 +1,151 @@
+package paychmanager_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	spect "github.com/filecoin-project/specs-actors/support/testing"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/paychmanager"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+)
+
+type fakeClient struct {
+	rm.RetrievalClient
+	deals      map[rm.DealID]rm.ClientDealState
+	subscriber rm.ClientSubscriber
+	cancelled  []rm.DealID
+}
+
+func (c *fakeClient) CancelDeal(id rm.DealID) error {
+	c.cancelled = append(c.cancelled, id)
+	return nil
+}
+
+func (c *fakeClient) ListDeals() (map[rm.DealID]rm.ClientDealState, error) {
+	return c.deals, nil
+}
+
+func (c *fakeClient) SubscribeToEvents(subscriber rm.ClientSubscriber) rm.Unsubscribe {
+	c.subscriber = subscriber
+	return func() { c.subscriber = nil }
+}
+
+func (c *fakeClient) setDeal(id rm.DealID, paymentChannel address.Address, status rm.DealStatus) {
+	c.deals[id] = rm.ClientDealState{
+		DealProposal: rm.DealProposal{ID: id},
+		Status:       status,
+		PaymentInfo:  &rm.PaymentInfo{PayCh: paymentChannel},
+	}
+	if c.subscriber != nil {
+		c.subscriber(rm.ClientEventBlocksReceived, c.deals[id])
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	ch1 := spect.NewIDAddr(t, 100)
+	ch2 := spect.NewIDAddr(t, 101)
+
+	now := time.Unix(1000000, 0)
+	clock := func() time.Time { return now }
+
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{
+		ChannelAvailableFunds: rm.ChannelAvailableFunds{
+			ConfirmedAmt:        abi.NewTokenAmount(1000),
+			PendingAmt:          abi.NewTokenAmount(0),
+			QueuedAmt:           abi.NewTokenAmount(0),
+			VoucherReedeemedAmt: abi.NewTokenAmount(400),
+		},
+	})
+	client := &fakeClient{deals: make(map[rm.DealID]rm.ClientDealState)}
+	client.setDeal(1, ch1, rm.DealStatusCompleted)
+
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	m := paychmanager.NewManager(ds, node, client, paychmanager.IdleTimeout(time.Hour), paychmanager.Clock(clock))
+	require.NoError(t, m.Start(ctx))
+	defer func() { m.Stop() }()
+
+	// a deal starts on the second channel
+	client.setDeal(2, ch2, rm.DealStatusOngoing)
+	channels, err := m.Channels()
+	require.NoError(t, err)
+	require.Len(t, channels, 2)
+
+	// channels are not settled until they have been idle long enough
+	require.NoError(t, m.Check(ctx))
+	require.Empty(t, node.SettledPaymentChannels())
+
+	// only the channel no deal is using is settled
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, m.Check(ctx))
+	require.Equal(t, []address.Address{ch1}, node.SettledPaymentChannels())
+
+	// the channel is collected once it has settled
+	require.NoError(t, m.Check(ctx))
+	require.Empty(t, node.CollectedPaymentChannels())
+	node.StubPaymentChannelSettlingAt(ch1, 50)
+	node.SetChainHeadEpoch(49)
+	require.NoError(t, m.Check(ctx))
+	require.Empty(t, node.CollectedPaymentChannels())
+	node.SetChainHeadEpoch(50)
+	node.StubMessageResult(true, exitcode.Ok)
+	require.NoError(t, m.Check(ctx))
+	require.Equal(t, []address.Address{ch1}, node.CollectedPaymentChannels())
+
+	// funds only count as reclaimed once the collect message is confirmed,
+	// and a failed collect is sent again
+	require.NoError(t, m.Check(ctx))
+	reclaimed, err := m.Reclaimed()
+	require.NoError(t, err)
+	require.Equal(t, big.Zero(), reclaimed)
+	node.StubMessageResult(false, exitcode.ErrIllegalState)
+	require.NoError(t, m.Check(ctx))
+	require.NoError(t, m.Check(ctx))
+	require.Equal(t, []address.Address{ch1, ch1}, node.CollectedPaymentChannels())
+	node.StubMessageResult(false, exitcode.Ok)
+	require.NoError(t, m.Check(ctx))
+
+	reclaimed, err = m.Reclaimed()
+	require.NoError(t, err)
+	require.Equal(t, abi.NewTokenAmount(600), reclaimed)
+
+	// a new deal on a channel that has been settled is cancelled
+	client.setDeal(3, ch1, rm.DealStatusOngoing)
+	require.Equal(t, []rm.DealID{3}, client.cancelled)
+	delete(client.deals, 3)
+
+	// progress on a deal keeps its channel active after the deal finishes,
+	// until the channel has been idle long enough
+	now = now.Add(2 * time.Hour)
+	client.setDeal(2, ch2, rm.DealStatusCompleted)
+	require.NoError(t, m.Check(ctx))
+	require.Len(t, node.SettledPaymentChannels(), 1)
+
+	// the bookkeeping survives a restart
+	m.Stop()
+	m = paychmanager.NewManager(ds, node, client, paychmanager.IdleTimeout(time.Hour), paychmanager.Clock(clock))
+	require.NoError(t, m.Start(ctx))
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, m.Check(ctx))
+	require.Equal(t, []address.Address{ch1, ch2}, node.SettledPaymentChannels())
+	channels, err = m.Channels()
+	require.NoError(t, err)
+	for _, channel := range channels {
+		if channel.PaymentChannel == ch1 {
+			require.Equal(t, paychmanager.ChannelStatusCollected, channel.Status)
+		} else {
+			require.Equal(t, paychmanager.ChannelStatusSettling, channel.Status)
+		}
+	}
+}
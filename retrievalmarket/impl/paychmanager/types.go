@@ -0,0 +1,70 @@
+package paychmanager
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+//go:generate cbor-gen-for --map-encoding Channel
+
+// ChannelStatus is where a payment channel is in its lifecycle
+type ChannelStatus uint64
+
+const (
+	// ChannelStatusActive means the channel may still be used by retrievals
+	ChannelStatusActive ChannelStatus = iota
+
+	// ChannelStatusSettling means the client has started settling the channel
+	ChannelStatusSettling
+
+	// ChannelStatusCollecting means the client has sent the message collecting
+	// the channel's funds, and is waiting for it to be confirmed
+	ChannelStatusCollecting
+
+	// ChannelStatusCollected means the message collecting the channel's funds
+	// has been confirmed
+	ChannelStatusCollected
+)
+
+// ChannelStatuses maps a channel status to a human readable representation
+var ChannelStatuses = map[ChannelStatus]string{
+	ChannelStatusActive:     "ChannelStatusActive",
+	ChannelStatusSettling:   "ChannelStatusSettling",
+	ChannelStatusCollecting: "ChannelStatusCollecting",
+	ChannelStatusCollected:  "ChannelStatusCollected",
+}
+
+func (s ChannelStatus) String() string {
+	str, ok := ChannelStatuses[s]
+	if ok {
+		return str
+	}
+	return fmt.Sprintf("ChannelStatusUnknown - %d", s)
+}
+
+// Channel is the bookkeeping for a payment channel used by retrieval deals
+type Channel struct {
+	PaymentChannel address.Address
+	Status         ChannelStatus
+
+	// LastActive is the Unix time in seconds at which a deal using the
+	// channel last made progress
+	LastActive int64
+
+	// SettleMessage is the message that started settling the channel, and
+	// SettlingAt is the epoch at which it settles, once the message has landed
+	SettleMessage *cid.Cid
+	SettlingAt    abi.ChainEpoch
+
+	// CollectMessage is the message that collects the channel's funds
+	CollectMessage *cid.Cid
+
+	// Reclaimed is the amount in the channel that providers had not redeemed
+	// once it settled, which collecting the channel returns to the client. It
+	// only counts once the collect message is confirmed.
+	Reclaimed abi.TokenAmount
+}
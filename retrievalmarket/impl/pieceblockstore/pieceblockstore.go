@@ -0,0 +1,260 @@
+/*
+Package pieceblockstore provides a read-only blockstore that serves blocks
+directly from the unsealed data of a piece.
+
+Blocks are found at the locations recorded in the piece store when the piece
+was added, and read from the unsealed piece data as it is unsealed, so the
+transfer can start as soon as the first blocks arrive and the piece is never
+copied to disk or loaded into a multistore. Blocks are normally requested in
+the order they were written to the piece, so the piece data is read in a
+single pass, skipping the parts no block is requested from. A block that lies
+behind the data already read is read from the piece on its own instead.
+*/
+package pieceblockstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockunsealer"
+)
+
+var log = logging.Logger("pieceblockstore")
+
+// ErrReadOnly is returned when attempting to modify a piece blockstore
+var ErrReadOnly = xerrors.New("piece blockstore is read-only")
+
+// ErrClosed is returned when requesting a block from a closed piece blockstore
+var ErrClosed = xerrors.New("piece blockstore is closed")
+
+// ReadBlockFunc reads a single block from the piece, for blocks that lie
+// behind the piece data already read
+type ReadBlockFunc func(c cid.Cid) (blocks.Block, error)
+
+// Blockstore is a read-only blockstore backed by the unsealed data for a
+// piece. Requests for blocks wait until the piece data is loaded, and then
+// until the piece data has been read up to the block.
+type Blockstore struct {
+	pieceStore piecestore.PieceStore
+	pieceCID   cid.Cid
+	readBlock  ReadBlockFunc
+
+	lk     sync.Mutex
+	cond   *sync.Cond
+	reader io.ReadCloser
+	closed bool
+
+	// readLk serialises reads of the piece data, and guards pos and readErr
+	readLk  sync.Mutex
+	pos     uint64
+	readErr error
+}
+
+var _ blockstore.Blockstore = (*Blockstore)(nil)
+
+// NewBlockstore returns a new blockstore for the given piece, finding blocks
+// with the given piece store and reading blocks behind the piece data already
+// read with readBlock. Blocks can be requested immediately, but will not be
+// returned until Load is called.
+func NewBlockstore(pieceStore piecestore.PieceStore, pieceCID cid.Cid, readBlock ReadBlockFunc) *Blockstore {
+	bs := &Blockstore{
+		pieceStore: pieceStore,
+		pieceCID:   pieceCID,
+		readBlock:  readBlock,
+	}
+	bs.cond = sync.NewCond(&bs.lk)
+	return bs
+}
+
+// Load sets the unsealed piece data to serve blocks from, starting at the
+// beginning of the piece. The reader is drained and closed when the
+// blockstore is closed.
+func (bs *Blockstore) Load(pieceData io.ReadCloser) error {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+
+	if bs.closed {
+		_ = pieceData.Close()
+		return ErrClosed
+	}
+	if bs.reader != nil {
+		_ = pieceData.Close()
+		return xerrors.New("piece blockstore is already loaded")
+	}
+
+	bs.reader = pieceData
+	bs.cond.Broadcast()
+	return nil
+}
+
+// Close stops serving blocks. The piece data is drained and closed in the
+// background, so the unsealing subsystem can clean up.
+func (bs *Blockstore) Close() error {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+
+	if bs.closed {
+		return nil
+	}
+	bs.closed = true
+	bs.cond.Broadcast()
+
+	if bs.reader != nil {
+		go bs.drain(bs.reader)
+	}
+	return nil
+}
+
+// Has returns true if the piece contains a block with the given CID
+func (bs *Blockstore) Has(c cid.Cid) (bool, error) {
+	_, err := bs.location(c)
+	if err == blockstore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Get returns the block with the given CID, waiting for it to be read from
+// the piece if necessary
+func (bs *Blockstore) Get(c cid.Cid) (blocks.Block, error) {
+	loc, err := bs.location(c)
+	if err != nil {
+		return nil, err
+	}
+
+	bs.readLk.Lock()
+	reader, err := bs.awaitReader()
+	if err != nil {
+		bs.readLk.Unlock()
+		return nil, err
+	}
+	if bs.readErr != nil || loc.RelOffset < bs.pos {
+		bs.readLk.Unlock()
+		return bs.readBlock(c)
+	}
+	data, err := bs.readAt(reader, loc)
+	bs.readLk.Unlock()
+	if err != nil {
+		return nil, xerrors.Errorf("reading block %s from piece: %w", c, err)
+	}
+
+	// check the piece data before trusting the recorded location
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, xerrors.Errorf("piece data for block %s does not match its CID", c)
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// GetSize returns the size of the block with the given CID
+func (bs *Blockstore) GetSize(c cid.Cid) (int, error) {
+	loc, err := bs.location(c)
+	if err != nil {
+		return -1, err
+	}
+	return int(loc.BlockSize), nil
+}
+
+// AllKeysChan is not supported, as the piece store does not index blocks by
+// piece
+func (bs *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	return nil, xerrors.New("piece blockstore does not list its blocks")
+}
+
+// DeleteBlock is not supported
+func (bs *Blockstore) DeleteBlock(cid.Cid) error {
+	return ErrReadOnly
+}
+
+// Put is not supported
+func (bs *Blockstore) Put(blocks.Block) error {
+	return ErrReadOnly
+}
+
+// PutMany is not supported
+func (bs *Blockstore) PutMany([]blocks.Block) error {
+	return ErrReadOnly
+}
+
+// HashOnRead is a no-op -- blocks are always verified when read
+func (bs *Blockstore) HashOnRead(enabled bool) {}
+
+// location returns the location of the given block in the piece, or
+// blockstore.ErrNotFound if the piece store has no location for it
+func (bs *Blockstore) location(c cid.Cid) (piecestore.BlockLocation, error) {
+	loc, err := blockunsealer.BlockLocation(bs.pieceStore, bs.pieceCID, c)
+	if err == nil {
+		return loc, nil
+	}
+	if xerrors.Is(err, blockunsealer.ErrNoBlockLocation) || xerrors.Is(err, rm.ErrNotFound) ||
+		xerrors.Is(err, datastore.ErrNotFound) {
+		return piecestore.BlockLocation{}, blockstore.ErrNotFound
+	}
+	return piecestore.BlockLocation{}, err
+}
+
+// awaitReader waits for the piece data to be loaded
+func (bs *Blockstore) awaitReader() (io.Reader, error) {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+
+	for bs.reader == nil && !bs.closed {
+		bs.cond.Wait()
+	}
+	if bs.closed {
+		return nil, ErrClosed
+	}
+	return bs.reader, nil
+}
+
+// readAt skips ahead in the piece data to the given location and reads the
+// block there. It must be called with readLk held.
+func (bs *Blockstore) readAt(reader io.Reader, loc piecestore.BlockLocation) ([]byte, error) {
+	skipped, err := io.CopyN(ioutil.Discard, reader, int64(loc.RelOffset-bs.pos))
+	bs.pos += uint64(skipped)
+	if err != nil {
+		bs.readErr = err
+		return nil, err
+	}
+
+	data := make([]byte, loc.BlockSize)
+	n, err := io.ReadFull(reader, data)
+	bs.pos += uint64(n)
+	if err != nil {
+		bs.readErr = err
+		return nil, err
+	}
+	return data, nil
+}
+
+// drain reads the piece data to the end and closes it, once any read in
+// progress is done
+func (bs *Blockstore) drain(reader io.ReadCloser) {
+	bs.readLk.Lock()
+	defer bs.readLk.Unlock()
+
+	var err error
+	if bs.readErr == nil {
+		_, err = io.Copy(ioutil.Discard, reader)
+	}
+	if closeErr := reader.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Warnf("draining unsealed data for piece %s: %s", bs.pieceCID, err)
+	}
+}
@@ -0,0 +1,213 @@
+package pieceblockstore_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/pieceblockstore"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestPieceBlockstore(t *testing.T) {
+	pieceCID := tut.GenerateCids(1)[0]
+	tree := tut.NewTestIPLDTree()
+	treeBlocks := []blocks.Block{
+		tree.RootBlock,
+		tree.MiddleMapBlock,
+		tree.MiddleListBlock,
+		tree.LeafAlphaBlock,
+		tree.LeafBetaBlock,
+	}
+
+	// lay the blocks out in a piece with some other data between them, and
+	// record their locations in the piece store
+	var piece bytes.Buffer
+	pieceStore := tut.NewTestPieceStore()
+	for _, blk := range treeBlocks {
+		piece.Write(tut.RandomBytes(16))
+		pieceStore.StubCID(blk.Cid(), piecestore.CIDInfo{
+			CID: blk.Cid(),
+			PieceBlockLocations: []piecestore.PieceBlockLocation{{
+				BlockLocation: piecestore.BlockLocation{
+					RelOffset: uint64(piece.Len()),
+					BlockSize: uint64(len(blk.RawData())),
+				},
+				PieceCID: pieceCID,
+			}},
+		})
+		piece.Write(blk.RawData())
+	}
+	piece.Write(make([]byte, 128))
+	pieceData := piece.Bytes()
+
+	// readBlock is the fallback for blocks behind the piece data already read
+	var readBlockLk sync.Mutex
+	var readBlocks []cid.Cid
+	readBlock := func(c cid.Cid) (blocks.Block, error) {
+		readBlockLk.Lock()
+		defer readBlockLk.Unlock()
+		readBlocks = append(readBlocks, c)
+		for _, blk := range treeBlocks {
+			if blk.Cid().Equals(c) {
+				return blk, nil
+			}
+		}
+		return nil, blockstore.ErrNotFound
+	}
+	newBlockstore := func() *pieceblockstore.Blockstore {
+		readBlockLk.Lock()
+		readBlocks = nil
+		readBlockLk.Unlock()
+		return pieceblockstore.NewBlockstore(pieceStore, pieceCID, readBlock)
+	}
+
+	t.Run("serves blocks from the piece", func(t *testing.T) {
+		bs := newBlockstore()
+		defer bs.Close()
+		require.NoError(t, bs.Load(ioutil.NopCloser(bytes.NewReader(pieceData))))
+
+		for _, blk := range treeBlocks {
+			has, err := bs.Has(blk.Cid())
+			require.NoError(t, err)
+			require.True(t, has)
+
+			size, err := bs.GetSize(blk.Cid())
+			require.NoError(t, err)
+			require.Equal(t, len(blk.RawData()), size)
+
+			got, err := bs.Get(blk.Cid())
+			require.NoError(t, err)
+			require.Equal(t, blk.RawData(), got.RawData())
+		}
+		require.Empty(t, readBlocks)
+	})
+
+	t.Run("does not find blocks missing from the piece", func(t *testing.T) {
+		bs := newBlockstore()
+		defer bs.Close()
+		require.NoError(t, bs.Load(ioutil.NopCloser(bytes.NewReader(pieceData))))
+
+		missing := tut.GenerateCids(1)[0]
+		pieceStore.ExpectMissingCID(missing)
+		has, err := bs.Has(missing)
+		require.NoError(t, err)
+		require.False(t, has)
+		_, err = bs.Get(missing)
+		require.Equal(t, blockstore.ErrNotFound, err)
+
+		// in another piece
+		otherPiece := tut.GenerateCids(1)[0]
+		other := pieceblockstore.NewBlockstore(pieceStore, otherPiece, readBlock)
+		defer other.Close()
+		_, err = other.Get(tree.RootBlock.Cid())
+		require.Equal(t, blockstore.ErrNotFound, err)
+	})
+
+	t.Run("reads blocks behind the piece data already read on their own", func(t *testing.T) {
+		bs := newBlockstore()
+		defer bs.Close()
+		require.NoError(t, bs.Load(ioutil.NopCloser(bytes.NewReader(pieceData))))
+
+		got, err := bs.Get(tree.LeafAlphaBlock.Cid())
+		require.NoError(t, err)
+		require.Equal(t, tree.LeafAlphaBlock.RawData(), got.RawData())
+
+		got, err = bs.Get(tree.RootBlock.Cid())
+		require.NoError(t, err)
+		require.Equal(t, tree.RootBlock.RawData(), got.RawData())
+		require.Equal(t, []cid.Cid{tree.RootBlock.Cid()}, readBlocks)
+
+		got, err = bs.Get(tree.LeafBetaBlock.Cid())
+		require.NoError(t, err)
+		require.Equal(t, tree.LeafBetaBlock.RawData(), got.RawData())
+		require.Len(t, readBlocks, 1)
+	})
+
+	t.Run("waits for the piece data", func(t *testing.T) {
+		bs := newBlockstore()
+		defer bs.Close()
+
+		result := make(chan blocks.Block, 1)
+		go func() {
+			blk, err := bs.Get(tree.LeafBetaBlock.Cid())
+			if err == nil {
+				result <- blk
+			}
+			close(result)
+		}()
+
+		pr, pw := io.Pipe()
+		require.NoError(t, bs.Load(pr))
+		go func() {
+			_, _ = pw.Write(pieceData)
+			_ = pw.Close()
+		}()
+
+		blk, ok := <-result
+		require.True(t, ok)
+		require.Equal(t, tree.LeafBetaBlock.RawData(), blk.RawData())
+	})
+
+	t.Run("errors on bad piece data", func(t *testing.T) {
+		bs := newBlockstore()
+		defer bs.Close()
+		require.NoError(t, bs.Load(ioutil.NopCloser(bytes.NewReader(tut.RandomBytes(len(pieceData))))))
+		_, err := bs.Get(tree.RootBlock.Cid())
+		require.Error(t, err)
+		require.NotEqual(t, blockstore.ErrNotFound, err)
+	})
+
+	t.Run("is read only", func(t *testing.T) {
+		bs := newBlockstore()
+		defer bs.Close()
+		require.Equal(t, pieceblockstore.ErrReadOnly, bs.Put(tree.RootBlock))
+		require.Equal(t, pieceblockstore.ErrReadOnly, bs.PutMany(treeBlocks))
+		require.Equal(t, pieceblockstore.ErrReadOnly, bs.DeleteBlock(tree.RootBlock.Cid()))
+	})
+
+	t.Run("drains and closes the piece data once closed", func(t *testing.T) {
+		bs := newBlockstore()
+		reader := &trackingReader{Reader: bytes.NewReader(pieceData)}
+		require.NoError(t, bs.Load(reader))
+		_, err := bs.Get(tree.RootBlock.Cid())
+		require.NoError(t, err)
+
+		require.NoError(t, bs.Close())
+		require.Eventually(t, reader.isClosed, time.Second, 10*time.Millisecond)
+		require.Equal(t, 0, reader.Len())
+
+		_, err = bs.Get(tree.LeafBetaBlock.Cid())
+		require.Equal(t, pieceblockstore.ErrClosed, err)
+		require.Error(t, bs.Load(ioutil.NopCloser(bytes.NewReader(pieceData))))
+	})
+}
+
+type trackingReader struct {
+	*bytes.Reader
+
+	lk     sync.Mutex
+	closed bool
+}
+
+func (tr *trackingReader) Close() error {
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+	tr.closed = true
+	return nil
+}
+
+func (tr *trackingReader) isClosed() bool {
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+	return tr.closed
+}
@@ -0,0 +1,312 @@
+// Package piececache provides a disk-backed cache of unsealed pieces, so that
+// popular pieces can be served to retrieval clients without unsealing them again
+package piececache
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+)
+
+var log = logging.Logger("piececache")
+
+const pieceFileExt = ".piece"
+
+type entry struct {
+	pieceCID cid.Cid
+	size     uint64
+}
+
+// PieceCache is a disk-backed cache of unsealed piece data keyed by PieceCID.
+// The total size of cached pieces is kept within a byte budget by evicting the
+// least recently used pieces that are not pinned.
+type PieceCache struct {
+	dir      string
+	maxBytes uint64
+
+	lk         sync.Mutex
+	usedBytes  uint64
+	lru        *list.List
+	entries    map[cid.Cid]*list.Element
+	inProgress map[cid.Cid]struct{}
+	// pins counts the pins held on each piece
+	pins map[cid.Cid]int
+}
+
+// NewPieceCache returns a new PieceCache that stores pieces in the given
+// directory, using at most maxBytes of disk space. Pieces left in the
+// directory by a previous instance are loaded into the cache, in order of
+// their last modification time.
+func NewPieceCache(dir string, maxBytes uint64) (*PieceCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, xerrors.Errorf("creating piece cache directory: %w", err)
+	}
+
+	pc := &PieceCache{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    make(map[cid.Cid]*list.Element),
+		inProgress: make(map[cid.Cid]struct{}),
+		pins:       make(map[cid.Cid]int),
+	}
+
+	if err := pc.loadEntries(); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// Has returns true if the piece with the given PieceCID is in the cache
+func (pc *PieceCache) Has(pieceCID cid.Cid) bool {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+	_, ok := pc.entries[pieceCID]
+	return ok
+}
+
+// Get opens the cached data for the piece with the given PieceCID and marks
+// the piece as recently used. It returns false if the piece is not cached.
+func (pc *PieceCache) Get(pieceCID cid.Cid) (io.ReadCloser, bool) {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+
+	elem, ok := pc.entries[pieceCID]
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(pc.piecePath(pieceCID))
+	if err != nil {
+		log.Warnf("failed to open cached piece %s, removing from cache: %s", pieceCID, err)
+		pc.removeElement(elem)
+		return nil, false
+	}
+
+	// touch the file so usage order is preserved across restarts
+	now := time.Now()
+	_ = os.Chtimes(pc.piecePath(pieceCID), now, now)
+
+	pc.lru.MoveToFront(elem)
+	return f, true
+}
+
+// Pin keeps the piece with the given PieceCID in the cache until Unpin is
+// called, so that a retrieval priced as unsealed can still be served from the
+// cache. It returns false, and does not pin, if the piece is not cached. While
+// every other piece is pinned, new pieces are not kept.
+func (pc *PieceCache) Pin(pieceCID cid.Cid) bool {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+
+	if _, ok := pc.entries[pieceCID]; !ok {
+		return false
+	}
+	pc.pins[pieceCID]++
+	return true
+}
+
+// Unpin releases a pin taken with Pin
+func (pc *PieceCache) Unpin(pieceCID cid.Cid) {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+
+	if pc.pins[pieceCID] <= 1 {
+		delete(pc.pins, pieceCID)
+	} else {
+		pc.pins[pieceCID]--
+	}
+}
+
+// Remove deletes the piece with the given PieceCID from the cache
+func (pc *PieceCache) Remove(pieceCID cid.Cid) {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+
+	if elem, ok := pc.entries[pieceCID]; ok {
+		pc.removeElement(elem)
+	}
+}
+
+// Size returns the total number of bytes of piece data held in the cache
+func (pc *PieceCache) Size() uint64 {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+	return pc.usedBytes
+}
+
+// TeeReader wraps a reader for unsealed piece data, so that the data is written
+// into the cache as it is read. The piece is only added to the cache if the
+// reader is read to the end before it is closed. If the piece is already
+// cached, larger than the cache or already being written, the reader is
+// returned unchanged.
+func (pc *PieceCache) TeeReader(pieceCID cid.Cid, pieceSize uint64, pieceData io.ReadCloser) io.ReadCloser {
+	if pieceSize > pc.maxBytes {
+		return pieceData
+	}
+
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+
+	if _, ok := pc.entries[pieceCID]; ok {
+		return pieceData
+	}
+	if _, ok := pc.inProgress[pieceCID]; ok {
+		return pieceData
+	}
+
+	tmp, err := ioutil.TempFile(pc.dir, "tmp-")
+	if err != nil {
+		log.Warnf("failed to create temp file to cache piece %s: %s", pieceCID, err)
+		return pieceData
+	}
+
+	pc.inProgress[pieceCID] = struct{}{}
+	return &teeReader{
+		pc:       pc,
+		pieceCID: pieceCID,
+		src:      pieceData,
+		tmp:      tmp,
+	}
+}
+
+func (pc *PieceCache) loadEntries() error {
+	files, err := ioutil.ReadDir(pc.dir)
+	if err != nil {
+		return xerrors.Errorf("reading piece cache directory: %w", err)
+	}
+
+	// ReadDir sorts by name, so order by modification time to approximate
+	// the previous usage order
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(name, pieceFileExt) {
+			// left over from an incomplete write
+			_ = os.Remove(filepath.Join(pc.dir, name))
+			continue
+		}
+		pieceCID, err := cid.Decode(strings.TrimSuffix(name, pieceFileExt))
+		if err != nil {
+			log.Warnf("ignoring unrecognized file %s in piece cache directory", name)
+			continue
+		}
+		pc.addEntry(pieceCID, uint64(fi.Size()))
+	}
+	pc.evict()
+	return nil
+}
+
+// must be called with lk held
+func (pc *PieceCache) addEntry(pieceCID cid.Cid, size uint64) {
+	pc.entries[pieceCID] = pc.lru.PushFront(&entry{pieceCID: pieceCID, size: size})
+	pc.usedBytes += size
+}
+
+// must be called with lk held
+func (pc *PieceCache) removeElement(elem *list.Element) {
+	e := pc.lru.Remove(elem).(*entry)
+	delete(pc.entries, e.pieceCID)
+	pc.usedBytes -= e.size
+	if err := os.Remove(pc.piecePath(e.pieceCID)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("failed to remove cached piece %s: %s", e.pieceCID, err)
+	}
+}
+
+// evict removes least recently used pieces that are not pinned until the cache
+// is within budget. Files that are still open for reading remain readable until
+// they are closed.
+// must be called with lk held
+func (pc *PieceCache) evict() {
+	elem := pc.lru.Back()
+	for pc.usedBytes > pc.maxBytes && elem != nil {
+		prev := elem.Prev()
+		if pc.pins[elem.Value.(*entry).pieceCID] == 0 {
+			pc.removeElement(elem)
+		}
+		elem = prev
+	}
+}
+
+func (pc *PieceCache) piecePath(pieceCID cid.Cid) string {
+	return filepath.Join(pc.dir, pieceCID.String()+pieceFileExt)
+}
+
+// commit moves a completely written temp file into the cache
+func (pc *PieceCache) commit(pieceCID cid.Cid, tmpPath string, size uint64) error {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+	delete(pc.inProgress, pieceCID)
+
+	if err := os.Rename(tmpPath, pc.piecePath(pieceCID)); err != nil {
+		_ = os.Remove(tmpPath)
+		return xerrors.Errorf("moving piece into cache: %w", err)
+	}
+
+	pc.addEntry(pieceCID, size)
+	pc.evict()
+	return nil
+}
+
+// abort discards a partially written temp file
+func (pc *PieceCache) abort(pieceCID cid.Cid, tmpPath string) {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+	delete(pc.inProgress, pieceCID)
+	_ = os.Remove(tmpPath)
+}
+
+type teeReader struct {
+	pc       *PieceCache
+	pieceCID cid.Cid
+	src      io.ReadCloser
+	tmp      *os.File
+	written  uint64
+	writeErr error
+	eof      bool
+}
+
+func (tr *teeReader) Read(p []byte) (int, error) {
+	n, err := tr.src.Read(p)
+	if n > 0 && tr.writeErr == nil {
+		var wn int
+		wn, tr.writeErr = tr.tmp.Write(p[:n])
+		tr.written += uint64(wn)
+		if tr.writeErr == nil && tr.written > tr.pc.maxBytes {
+			tr.writeErr = xerrors.New("piece is larger than the piece cache")
+		}
+	}
+	if err == io.EOF {
+		tr.eof = true
+	}
+	return n, err
+}
+
+func (tr *teeReader) Close() error {
+	tmpPath := tr.tmp.Name()
+	closeTmpErr := tr.tmp.Close()
+
+	if !tr.eof || tr.writeErr != nil || closeTmpErr != nil {
+		tr.pc.abort(tr.pieceCID, tmpPath)
+	} else if err := tr.pc.commit(tr.pieceCID, tmpPath, tr.written); err != nil {
+		log.Warnf("failed to cache piece %s: %s", tr.pieceCID, err)
+	}
+
+	return tr.src.Close()
+}
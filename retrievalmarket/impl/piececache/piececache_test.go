@@ -0,0 +1,141 @@
+package piececache_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/piececache"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "piececache_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func readThrough(t *testing.T, reader io.ReadCloser) []byte {
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	return data
+}
+
+func TestPieceCache(t *testing.T) {
+	pieceCids := tut.GenerateCids(3)
+	data := [][]byte{tut.RandomBytes(100), tut.RandomBytes(100), tut.RandomBytes(100)}
+
+	t.Run("caches a piece once it is fully read", func(t *testing.T) {
+		pc, err := piececache.NewPieceCache(tempDir(t), 1000)
+		require.NoError(t, err)
+
+		_, ok := pc.Get(pieceCids[0])
+		require.False(t, ok)
+
+		reader := pc.TeeReader(pieceCids[0], 100, ioutil.NopCloser(bytes.NewReader(data[0])))
+		require.Equal(t, data[0], readThrough(t, reader))
+		require.True(t, pc.Has(pieceCids[0]))
+		require.Equal(t, uint64(100), pc.Size())
+
+		cached, ok := pc.Get(pieceCids[0])
+		require.True(t, ok)
+		require.Equal(t, data[0], readThrough(t, cached))
+	})
+
+	t.Run("does not cache a partially read piece", func(t *testing.T) {
+		pc, err := piececache.NewPieceCache(tempDir(t), 1000)
+		require.NoError(t, err)
+
+		reader := pc.TeeReader(pieceCids[0], 100, ioutil.NopCloser(bytes.NewReader(data[0])))
+		buf := make([]byte, 10)
+		_, err = reader.Read(buf)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.False(t, pc.Has(pieceCids[0]))
+		require.Equal(t, uint64(0), pc.Size())
+	})
+
+	t.Run("does not cache a piece larger than the budget", func(t *testing.T) {
+		pc, err := piececache.NewPieceCache(tempDir(t), 50)
+		require.NoError(t, err)
+
+		src := ioutil.NopCloser(bytes.NewReader(data[0]))
+		require.Equal(t, src, pc.TeeReader(pieceCids[0], 100, src))
+
+		// size underreported
+		reader := pc.TeeReader(pieceCids[0], 10, ioutil.NopCloser(bytes.NewReader(data[0])))
+		require.Equal(t, data[0], readThrough(t, reader))
+		require.False(t, pc.Has(pieceCids[0]))
+	})
+
+	t.Run("evicts least recently used pieces", func(t *testing.T) {
+		pc, err := piececache.NewPieceCache(tempDir(t), 200)
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			readThrough(t, pc.TeeReader(pieceCids[i], 100, ioutil.NopCloser(bytes.NewReader(data[i]))))
+		}
+
+		// use the first piece so the second is least recently used
+		cached, ok := pc.Get(pieceCids[0])
+		require.True(t, ok)
+		readThrough(t, cached)
+
+		readThrough(t, pc.TeeReader(pieceCids[2], 100, ioutil.NopCloser(bytes.NewReader(data[2]))))
+		require.True(t, pc.Has(pieceCids[0]))
+		require.False(t, pc.Has(pieceCids[1]))
+		require.True(t, pc.Has(pieceCids[2]))
+		require.Equal(t, uint64(200), pc.Size())
+	})
+
+	t.Run("does not evict pinned pieces", func(t *testing.T) {
+		pc, err := piececache.NewPieceCache(tempDir(t), 200)
+		require.NoError(t, err)
+
+		require.False(t, pc.Pin(pieceCids[0]))
+		for i := 0; i < 2; i++ {
+			readThrough(t, pc.TeeReader(pieceCids[i], 100, ioutil.NopCloser(bytes.NewReader(data[i]))))
+		}
+		require.True(t, pc.Pin(pieceCids[0]))
+
+		// the least recently used piece is pinned, so the next one goes
+		readThrough(t, pc.TeeReader(pieceCids[2], 100, ioutil.NopCloser(bytes.NewReader(data[2]))))
+		require.True(t, pc.Has(pieceCids[0]))
+		require.False(t, pc.Has(pieceCids[1]))
+		require.True(t, pc.Has(pieceCids[2]))
+
+		// a new piece is not kept while every other piece is pinned
+		require.True(t, pc.Pin(pieceCids[2]))
+		readThrough(t, pc.TeeReader(pieceCids[1], 100, ioutil.NopCloser(bytes.NewReader(data[1]))))
+		require.False(t, pc.Has(pieceCids[1]))
+
+		pc.Unpin(pieceCids[0])
+		readThrough(t, pc.TeeReader(pieceCids[1], 100, ioutil.NopCloser(bytes.NewReader(data[1]))))
+		require.False(t, pc.Has(pieceCids[0]))
+		require.True(t, pc.Has(pieceCids[1]))
+		require.Equal(t, uint64(200), pc.Size())
+	})
+
+	t.Run("reloads cached pieces on restart", func(t *testing.T) {
+		dir := tempDir(t)
+		pc, err := piececache.NewPieceCache(dir, 1000)
+		require.NoError(t, err)
+		readThrough(t, pc.TeeReader(pieceCids[0], 100, ioutil.NopCloser(bytes.NewReader(data[0]))))
+
+		pc, err = piececache.NewPieceCache(dir, 1000)
+		require.NoError(t, err)
+		require.True(t, pc.Has(pieceCids[0]))
+		require.Equal(t, uint64(100), pc.Size())
+
+		pc.Remove(pieceCids[0])
+		pc, err = piececache.NewPieceCache(dir, 1000)
+		require.NoError(t, err)
+		require.False(t, pc.Has(pieceCids[0]))
+	})
+}
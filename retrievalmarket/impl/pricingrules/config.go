@@ -0,0 +1,247 @@
+package pricingrules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+// Format is the encoding of a rules file
+type Format string
+
+const (
+	// FormatJSON is a rules file encoded as JSON
+	FormatJSON Format = "json"
+	// FormatTOML is a rules file encoded as TOML
+	FormatTOML Format = "toml"
+)
+
+// Config is the content of a rules file
+type Config struct {
+	// TimeZone is the IANA name of the time zone that time windows are in.
+	// It defaults to UTC.
+	TimeZone string
+	Rules    []RuleConfig
+}
+
+// RuleConfig is a single pricing rule. A rule applies to a retrieval when all
+// of its match conditions hold, and sets the terms it specifies.
+type RuleConfig struct {
+	// Name identifies the rule in errors and logs
+	Name  string
+	Match MatchConfig
+	Set   TermsConfig
+}
+
+// MatchConfig is the conditions under which a rule applies. Conditions that
+// are left empty always hold.
+type MatchConfig struct {
+	// Clients are the peer IDs of the clients the rule applies to
+	Clients []string
+	// PieceCIDs are the pieces the rule applies to
+	PieceCIDs []string
+	// MinPieceSize and MaxPieceSize bound the unpadded size of the piece
+	MinPieceSize uint64
+	MaxPieceSize uint64
+	// Verified matches on whether there is a verified deal for the payload
+	Verified *bool
+	// Unsealed matches on whether there is an unsealed copy of the payload
+	Unsealed *bool
+	// Times are the time windows the rule applies in. The rule applies if
+	// any one of them holds.
+	Times []TimeWindowConfig
+}
+
+// TimeWindowConfig is a daily window of time
+type TimeWindowConfig struct {
+	// Days are the days of the week the window is open, by their three letter
+	// names ("mon", "tue", ...). The window is open every day if it is empty.
+	Days []string
+	// Start and End are the times of day the window opens and closes, as
+	// "15:04". A window that ends before it starts runs over midnight, and
+	// its days are the days it opens on.
+	Start string
+	End   string
+}
+
+// TermsConfig is the terms a rule sets. Terms that are left empty are not
+// changed by the rule.
+type TermsConfig struct {
+	// PricePerByte and UnsealPrice are amounts of attoFIL
+	PricePerByte            *string
+	UnsealPrice             *string
+	PaymentInterval         *uint64
+	PaymentIntervalIncrease *uint64
+}
+
+// Parse decodes a rules file and validates it
+func Parse(data []byte, format Format) (*RuleSet, error) {
+	var cfg Config
+	switch format {
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return nil, xerrors.Errorf("decoding JSON pricing rules: %w", err)
+		}
+	case FormatTOML:
+		md, err := toml.Decode(string(data), &cfg)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding TOML pricing rules: %w", err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, xerrors.Errorf("unknown field %s in pricing rules", undecoded[0])
+		}
+	default:
+		return nil, xerrors.Errorf("unknown pricing rules format %q", format)
+	}
+	return Compile(cfg)
+}
+
+// Compile validates a rules configuration and returns the rule set it
+// describes
+func Compile(cfg Config) (*RuleSet, error) {
+	location := time.UTC
+	if cfg.TimeZone != "" {
+		var err error
+		location, err = time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, xerrors.Errorf("loading time zone %s: %w", cfg.TimeZone, err)
+		}
+	}
+
+	rs := &RuleSet{location: location}
+	for i, rc := range cfg.Rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		r, err := compileRule(name, rc)
+		if err != nil {
+			return nil, xerrors.Errorf("pricing rule %s: %w", name, err)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return rs, nil
+}
+
+func compileRule(name string, rc RuleConfig) (rule, error) {
+	r := rule{
+		name:         name,
+		minPieceSize: abi.UnpaddedPieceSize(rc.Match.MinPieceSize),
+		maxPieceSize: abi.UnpaddedPieceSize(rc.Match.MaxPieceSize),
+		verified:     rc.Match.Verified,
+		unsealed:     rc.Match.Unsealed,
+	}
+	if r.maxPieceSize != 0 && r.maxPieceSize < r.minPieceSize {
+		return rule{}, xerrors.Errorf("maximum piece size %d is less than the minimum %d", r.maxPieceSize, r.minPieceSize)
+	}
+
+	if len(rc.Match.Clients) > 0 {
+		r.clients = make(map[peer.ID]struct{}, len(rc.Match.Clients))
+		for _, s := range rc.Match.Clients {
+			p, err := peer.Decode(s)
+			if err != nil {
+				return rule{}, xerrors.Errorf("invalid client peer ID %s: %w", s, err)
+			}
+			r.clients[p] = struct{}{}
+		}
+	}
+
+	if len(rc.Match.PieceCIDs) > 0 {
+		r.pieceCIDs = make(map[cid.Cid]struct{}, len(rc.Match.PieceCIDs))
+		for _, s := range rc.Match.PieceCIDs {
+			c, err := cid.Decode(s)
+			if err != nil {
+				return rule{}, xerrors.Errorf("invalid piece CID %s: %w", s, err)
+			}
+			r.pieceCIDs[c] = struct{}{}
+		}
+	}
+
+	for _, twc := range rc.Match.Times {
+		tw, err := compileTimeWindow(twc)
+		if err != nil {
+			return rule{}, err
+		}
+		r.times = append(r.times, tw)
+	}
+
+	var err error
+	if r.pricePerByte, err = parseAmount("price per byte", rc.Set.PricePerByte); err != nil {
+		return rule{}, err
+	}
+	if r.unsealPrice, err = parseAmount("unseal price", rc.Set.UnsealPrice); err != nil {
+		return rule{}, err
+	}
+	if rc.Set.PaymentInterval != nil && *rc.Set.PaymentInterval == 0 {
+		return rule{}, xerrors.New("payment interval must be greater than zero")
+	}
+	r.paymentInterval = rc.Set.PaymentInterval
+	r.paymentIntervalIncrease = rc.Set.PaymentIntervalIncrease
+	return r, nil
+}
+
+func parseAmount(what string, s *string) (*abi.TokenAmount, error) {
+	if s == nil {
+		return nil, nil
+	}
+	amount, err := big.FromString(*s)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid %s %q: %w", what, *s, err)
+	}
+	if amount.LessThan(big.Zero()) {
+		return nil, xerrors.Errorf("%s %s is negative", what, *s)
+	}
+	return &amount, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func compileTimeWindow(twc TimeWindowConfig) (timeWindow, error) {
+	var tw timeWindow
+	for _, d := range twc.Days {
+		day, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return timeWindow{}, xerrors.Errorf("unknown day of the week %q", d)
+		}
+		tw.days |= 1 << day
+	}
+	var err error
+	if tw.start, err = parseTimeOfDay(twc.Start); err != nil {
+		return timeWindow{}, err
+	}
+	if tw.end, err = parseTimeOfDay(twc.End); err != nil {
+		return timeWindow{}, err
+	}
+	if tw.start == tw.end {
+		return timeWindow{}, xerrors.Errorf("time window starts and ends at %s", twc.Start)
+	}
+	return tw, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,317 @@
+/*
+Package pricingrules prices retrieval deals from a declarative set of rules.
+
+Rules are loaded from a JSON or TOML file. Each rule matches on the pricing
+input of a retrieval (the client, the piece, whether there's a verified deal or
+an unsealed copy) and on the time of day, and sets some of the terms of the
+ask. Pricing starts from the provider's current ask, and every rule that
+matches applies in the order they're written, so later rules override the
+terms earlier ones set. The engine then adjusts the ask the same way the
+default pricing function does: unsealing is free when there's an unsealed
+copy, when only part of a piece needs to be unsealed the unseal price is
+charged in proportion, and transfer is free for verified deals unless the
+engine is told otherwise.
+
+An Engine can watch its rules file and reload it when it changes. A file that
+fails validation is not loaded, and the engine keeps pricing with the rules it
+had.
+
+Example rules file:
+
+	TimeZone = "Europe/Berlin"
+
+	[[Rules]]
+	Name = "free unsealing of small pieces"
+	  [Rules.Match]
+	  MaxPieceSize = 1048576
+	  [Rules.Set]
+	  UnsealPrice = "0"
+
+	[[Rules]]
+	Name = "off-peak"
+	  [[Rules.Match.Times]]
+	  Start = "22:00"
+	  End = "06:00"
+	  [Rules.Set]
+	  PricePerByte = "1"
+*/
+package pricingrules
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+var log = logging.Logger("pricingrules")
+
+// DefaultReloadInterval is how often the rules file is checked for changes by
+// default
+const DefaultReloadInterval = 30 * time.Second
+
+// RuleSet is a validated set of pricing rules
+type RuleSet struct {
+	location *time.Location
+	rules    []rule
+}
+
+type rule struct {
+	name string
+
+	clients      map[peer.ID]struct{}
+	pieceCIDs    map[cid.Cid]struct{}
+	minPieceSize abi.UnpaddedPieceSize
+	maxPieceSize abi.UnpaddedPieceSize
+	verified     *bool
+	unsealed     *bool
+	times        []timeWindow
+
+	pricePerByte            *abi.TokenAmount
+	unsealPrice             *abi.TokenAmount
+	paymentInterval         *uint64
+	paymentIntervalIncrease *uint64
+}
+
+type timeWindow struct {
+	// days is a bit set of weekdays, or zero for every day
+	days       uint8
+	start, end time.Duration
+}
+
+// Price returns the ask for a retrieval at the given time, with the terms the
+// matching rules set
+func (rs *RuleSet) Price(input retrievalmarket.PricingInput, now time.Time) retrievalmarket.Ask {
+	ask := input.CurrentAsk
+	now = now.In(rs.location)
+	for _, r := range rs.rules {
+		if !r.matches(input, now) {
+			continue
+		}
+		if r.pricePerByte != nil {
+			ask.PricePerByte = *r.pricePerByte
+		}
+		if r.unsealPrice != nil {
+			ask.UnsealPrice = *r.unsealPrice
+		}
+		if r.paymentInterval != nil {
+			ask.PaymentInterval = *r.paymentInterval
+		}
+		if r.paymentIntervalIncrease != nil {
+			ask.PaymentIntervalIncrease = *r.paymentIntervalIncrease
+		}
+	}
+	return ask
+}
+
+func (r rule) matches(input retrievalmarket.PricingInput, now time.Time) bool {
+	if r.clients != nil {
+		if _, ok := r.clients[input.Client]; !ok {
+			return false
+		}
+	}
+	if r.pieceCIDs != nil {
+		if _, ok := r.pieceCIDs[input.PieceCID]; !ok {
+			return false
+		}
+	}
+	if input.PieceSize < r.minPieceSize || (r.maxPieceSize != 0 && input.PieceSize > r.maxPieceSize) {
+		return false
+	}
+	if r.verified != nil && *r.verified != input.VerifiedDeal {
+		return false
+	}
+	if r.unsealed != nil && *r.unsealed != input.Unsealed {
+		return false
+	}
+	if len(r.times) == 0 {
+		return true
+	}
+	for _, tw := range r.times {
+		if tw.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tw timeWindow) contains(now time.Time) bool {
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	day := now.Weekday()
+	if tw.start < tw.end {
+		return tw.openOn(day) && sinceMidnight >= tw.start && sinceMidnight < tw.end
+	}
+	// the window runs over midnight, so after midnight it belongs to the day
+	// before
+	if sinceMidnight >= tw.start {
+		return tw.openOn(day)
+	}
+	return sinceMidnight < tw.end && tw.openOn((day+6)%7)
+}
+
+func (tw timeWindow) openOn(day time.Weekday) bool {
+	return tw.days == 0 || tw.days&(1<<day) != 0
+}
+
+// Load reads a rules file and validates it. The format is chosen by the file
+// extension: files ending in .toml are TOML, and all others are JSON.
+func Load(path string) (*RuleSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("reading pricing rules: %w", err)
+	}
+	return Parse(data, formatForPath(path))
+}
+
+func formatForPath(path string) Format {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// Option configures an Engine
+type Option func(*Engine)
+
+// ReloadInterval sets how often the engine checks its rules file for changes
+func ReloadInterval(interval time.Duration) Option {
+	return func(e *Engine) {
+		e.reloadInterval = interval
+	}
+}
+
+// Clock sets the function the engine uses to get the current time when
+// matching time windows
+func Clock(now func() time.Time) Option {
+	return func(e *Engine) {
+		e.now = now
+	}
+}
+
+// VerifiedDealsFreeTransfer sets whether transfer is free for verified deals,
+// whatever the rules say. It is by default.
+func VerifiedDealsFreeTransfer(free bool) Option {
+	return func(e *Engine) {
+		e.verifiedDealsFreeTransfer = free
+	}
+}
+
+// Engine prices retrieval deals with the rules in a file, reloading them when
+// the file changes
+type Engine struct {
+	path                      string
+	reloadInterval            time.Duration
+	now                       func() time.Time
+	verifiedDealsFreeTransfer bool
+
+	lk      sync.RWMutex
+	rules   *RuleSet
+	modTime time.Time
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewEngine loads the rules file at the given path and returns an engine that
+// prices with it. It fails if the file is invalid.
+func NewEngine(path string, options ...Option) (*Engine, error) {
+	e := &Engine{
+		path:                      path,
+		reloadInterval:            DefaultReloadInterval,
+		now:                       time.Now,
+		verifiedDealsFreeTransfer: true,
+	}
+	for _, option := range options {
+		option(e)
+	}
+	if _, err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Price returns the ask for a retrieval according to the current rules. It
+// can be passed to the provider as its RetrievalPricingFunc.
+func (e *Engine) Price(ctx context.Context, input retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+	e.lk.RLock()
+	rules := e.rules
+	e.lk.RUnlock()
+	return input.AdjustAsk(rules.Price(input, e.now()), e.verifiedDealsFreeTransfer), nil
+}
+
+// Reload loads the rules file again if it has changed since it was last
+// loaded, and reports whether it did. If the file is invalid the engine keeps
+// its current rules and the error is returned.
+func (e *Engine) Reload() (bool, error) {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false, xerrors.Errorf("reading pricing rules: %w", err)
+	}
+
+	e.lk.RLock()
+	unchanged := e.rules != nil && info.ModTime().Equal(e.modTime)
+	e.lk.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	rules, err := Load(e.path)
+	if err != nil {
+		return false, err
+	}
+
+	e.lk.Lock()
+	e.rules = rules
+	e.modTime = info.ModTime()
+	e.lk.Unlock()
+	return true, nil
+}
+
+// Start checks the rules file for changes regularly until Stop is called
+func (e *Engine) Start(ctx context.Context) {
+	e.stop = make(chan struct{})
+	e.stopped = make(chan struct{})
+	go func() {
+		defer close(e.stopped)
+		ticker := time.NewTicker(e.reloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				reloaded, err := e.Reload()
+				if err != nil {
+					log.Errorf("reloading pricing rules from %s, keeping current rules: %s", e.path, err)
+				} else if reloaded {
+					log.Infof("reloaded pricing rules from %s", e.path)
+				}
+			case <-e.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops checking the rules file for changes
+func (e *Engine) Stop() {
+	if e.stop == nil {
+		return
+	}
+	close(e.stop)
+	<-e.stopped
+	e.stop = nil
+}
@@ -0,0 +1,332 @@
+package pricingrules_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/pricingrules"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+var currentAsk = retrievalmarket.Ask{
+	PricePerByte:            abi.NewTokenAmount(10),
+	UnsealPrice:             abi.NewTokenAmount(1000),
+	PaymentInterval:         1000,
+	PaymentIntervalIncrease: 100,
+}
+
+func TestRuleSetPrice(t *testing.T) {
+	client := tut.GeneratePeers(1)[0]
+	pieceCID := tut.GenerateCids(1)[0]
+	rules := `{
+		"TimeZone": "UTC",
+		"Rules": [
+			{
+				"Name": "unsealed",
+				"Match": {"Unsealed": true},
+				"Set": {"UnsealPrice": "0"}
+			},
+			{
+				"Name": "friend",
+				"Match": {"Clients": ["` + client.String() + `"]},
+				"Set": {"PricePerByte": "1", "PaymentInterval": 5000}
+			},
+			{
+				"Name": "big pieces",
+				"Match": {"PieceCIDs": ["` + pieceCID.String() + `"], "MinPieceSize": 1000},
+				"Set": {"PricePerByte": "2"}
+			},
+			{
+				"Name": "weekend nights",
+				"Match": {"Verified": true, "Times": [{"Days": ["Fri", "sat"], "Start": "22:00", "End": "06:00"}]},
+				"Set": {"PaymentIntervalIncrease": 0}
+			}
+		]
+	}`
+	rs, err := pricingrules.Parse([]byte(rules), pricingrules.FormatJSON)
+	require.NoError(t, err)
+
+	// a Wednesday afternoon
+	wednesday := time.Date(2021, 3, 3, 15, 0, 0, 0, time.UTC)
+	// a Saturday, early in the morning
+	saturday := time.Date(2021, 3, 6, 2, 0, 0, 0, time.UTC)
+	// a Sunday, early in the morning
+	sunday := time.Date(2021, 3, 7, 2, 0, 0, 0, time.UTC)
+
+	testCases := map[string]struct {
+		input    retrievalmarket.PricingInput
+		now      time.Time
+		expected retrievalmarket.Ask
+	}{
+		"no rules match": {
+			input:    retrievalmarket.PricingInput{},
+			now:      wednesday,
+			expected: currentAsk,
+		},
+		"one rule matches": {
+			input: retrievalmarket.PricingInput{Unsealed: true},
+			now:   wednesday,
+			expected: retrievalmarket.Ask{
+				PricePerByte:            abi.NewTokenAmount(10),
+				UnsealPrice:             abi.NewTokenAmount(0),
+				PaymentInterval:         1000,
+				PaymentIntervalIncrease: 100,
+			},
+		},
+		"later rules override earlier ones": {
+			input: retrievalmarket.PricingInput{Client: client, PieceCID: pieceCID, PieceSize: 2000},
+			now:   wednesday,
+			expected: retrievalmarket.Ask{
+				PricePerByte:            abi.NewTokenAmount(2),
+				UnsealPrice:             abi.NewTokenAmount(1000),
+				PaymentInterval:         5000,
+				PaymentIntervalIncrease: 100,
+			},
+		},
+		"piece too small": {
+			input:    retrievalmarket.PricingInput{PieceCID: pieceCID, PieceSize: 500},
+			now:      wednesday,
+			expected: currentAsk,
+		},
+		"time window over midnight": {
+			input: retrievalmarket.PricingInput{VerifiedDeal: true},
+			now:   saturday,
+			expected: retrievalmarket.Ask{
+				PricePerByte:            abi.NewTokenAmount(10),
+				UnsealPrice:             abi.NewTokenAmount(1000),
+				PaymentInterval:         1000,
+				PaymentIntervalIncrease: 0,
+			},
+		},
+		"time window closed": {
+			input:    retrievalmarket.PricingInput{VerifiedDeal: true},
+			now:      sunday.Add(5 * time.Hour),
+			expected: currentAsk,
+		},
+		"time window belongs to the day it opens": {
+			input: retrievalmarket.PricingInput{VerifiedDeal: true},
+			now:   sunday,
+			expected: retrievalmarket.Ask{
+				PricePerByte:            abi.NewTokenAmount(10),
+				UnsealPrice:             abi.NewTokenAmount(1000),
+				PaymentInterval:         1000,
+				PaymentIntervalIncrease: 0,
+			},
+		},
+	}
+	for name, data := range testCases {
+		t.Run(name, func(t *testing.T) {
+			data.input.CurrentAsk = currentAsk
+			require.Equal(t, data.expected, rs.Price(data.input, data.now))
+		})
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	rules := `
+TimeZone = "UTC"
+
+[[Rules]]
+Name = "verified"
+  [Rules.Match]
+  Verified = true
+  [Rules.Set]
+  PricePerByte = "0"
+  PaymentInterval = 2000
+`
+	rs, err := pricingrules.Parse([]byte(rules), pricingrules.FormatTOML)
+	require.NoError(t, err)
+	ask := rs.Price(retrievalmarket.PricingInput{VerifiedDeal: true, CurrentAsk: currentAsk}, time.Now())
+	require.Equal(t, abi.NewTokenAmount(0), ask.PricePerByte)
+	require.Equal(t, uint64(2000), ask.PaymentInterval)
+}
+
+func TestParseValidation(t *testing.T) {
+	testCases := map[string]struct {
+		rules  string
+		format pricingrules.Format
+		err    string
+	}{
+		"malformed": {
+			rules: `{"Rules": [`,
+			err:   "decoding JSON pricing rules",
+		},
+		"unknown JSON field": {
+			rules: `{"Rules": [{"Match": {"Client": ["x"]}}]}`,
+			err:   "unknown field",
+		},
+		"unknown TOML field": {
+			rules:  "[[Rules]]\nPrice = \"1\"\n",
+			format: pricingrules.FormatTOML,
+			err:    "unknown field",
+		},
+		"unknown time zone": {
+			rules: `{"TimeZone": "Nowhere/Atlantis"}`,
+			err:   "loading time zone",
+		},
+		"invalid client": {
+			rules: `{"Rules": [{"Name": "bad client", "Match": {"Clients": ["nope"]}}]}`,
+			err:   "pricing rule bad client: invalid client peer ID",
+		},
+		"invalid piece CID": {
+			rules: `{"Rules": [{"Match": {"PieceCIDs": ["nope"]}}]}`,
+			err:   "pricing rule #1: invalid piece CID",
+		},
+		"piece sizes out of order": {
+			rules: `{"Rules": [{"Match": {"MinPieceSize": 10, "MaxPieceSize": 5}}]}`,
+			err:   "maximum piece size 5 is less than the minimum 10",
+		},
+		"invalid day": {
+			rules: `{"Rules": [{"Match": {"Times": [{"Days": ["someday"], "Start": "01:00", "End": "02:00"}]}}]}`,
+			err:   "unknown day of the week",
+		},
+		"invalid time": {
+			rules: `{"Rules": [{"Match": {"Times": [{"Start": "25:00", "End": "02:00"}]}}]}`,
+			err:   "invalid time of day",
+		},
+		"empty time window": {
+			rules: `{"Rules": [{"Match": {"Times": [{"Start": "02:00", "End": "02:00"}]}}]}`,
+			err:   "time window starts and ends at 02:00",
+		},
+		"invalid price": {
+			rules: `{"Rules": [{"Set": {"PricePerByte": "lots"}}]}`,
+			err:   "invalid price per byte",
+		},
+		"negative price": {
+			rules: `{"Rules": [{"Set": {"UnsealPrice": "-1"}}]}`,
+			err:   "unseal price -1 is negative",
+		},
+		"zero payment interval": {
+			rules: `{"Rules": [{"Set": {"PaymentInterval": 0}}]}`,
+			err:   "payment interval must be greater than zero",
+		},
+	}
+	for name, data := range testCases {
+		t.Run(name, func(t *testing.T) {
+			format := data.format
+			if format == "" {
+				format = pricingrules.FormatJSON
+			}
+			_, err := pricingrules.Parse([]byte(data.rules), format)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), data.err)
+		})
+	}
+}
+
+func TestEnginePrice(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "pricingrules")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"Rules": [{"Set": {"PricePerByte": "2"}}]}`), 0644))
+
+	testCases := map[string]struct {
+		input                     retrievalmarket.PricingInput
+		verifiedDealsFreeTransfer bool
+		expectedPricePerByte      abi.TokenAmount
+		expectedUnsealPrice       abi.TokenAmount
+	}{
+		"rules apply": {
+			expectedPricePerByte: abi.NewTokenAmount(2),
+			expectedUnsealPrice:  abi.NewTokenAmount(1000),
+		},
+		"partial unseal": {
+			input:                retrievalmarket.PricingInput{PieceSize: 100, UnsealSize: 25},
+			expectedPricePerByte: abi.NewTokenAmount(2),
+			expectedUnsealPrice:  abi.NewTokenAmount(250),
+		},
+		"unsealed copy": {
+			input:                retrievalmarket.PricingInput{Unsealed: true},
+			expectedPricePerByte: abi.NewTokenAmount(2),
+			expectedUnsealPrice:  abi.NewTokenAmount(0),
+		},
+		"verified deal with free transfer": {
+			input:                     retrievalmarket.PricingInput{VerifiedDeal: true},
+			verifiedDealsFreeTransfer: true,
+			expectedPricePerByte:      abi.NewTokenAmount(0),
+			expectedUnsealPrice:       abi.NewTokenAmount(1000),
+		},
+		"verified deal without free transfer": {
+			input:                retrievalmarket.PricingInput{VerifiedDeal: true},
+			expectedPricePerByte: abi.NewTokenAmount(2),
+			expectedUnsealPrice:  abi.NewTokenAmount(1000),
+		},
+	}
+	for name, data := range testCases {
+		t.Run(name, func(t *testing.T) {
+			e, err := pricingrules.NewEngine(path, pricingrules.VerifiedDealsFreeTransfer(data.verifiedDealsFreeTransfer))
+			require.NoError(t, err)
+			data.input.CurrentAsk = currentAsk
+			ask, err := e.Price(ctx, data.input)
+			require.NoError(t, err)
+			require.Equal(t, data.expectedPricePerByte, ask.PricePerByte)
+			require.Equal(t, data.expectedUnsealPrice, ask.UnsealPrice)
+		})
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "pricingrules")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+
+	modTime := time.Now()
+	writeRules := func(rules string) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(rules), 0644))
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	price := func(e *pricingrules.Engine) abi.TokenAmount {
+		ask, err := e.Price(ctx, retrievalmarket.PricingInput{CurrentAsk: currentAsk})
+		require.NoError(t, err)
+		return ask.PricePerByte
+	}
+
+	_, err = pricingrules.NewEngine(path)
+	require.Error(t, err)
+
+	writeRules(`{"Rules": [{"Set": {"PricePerByte": "1"}}]}`)
+	e, err := pricingrules.NewEngine(path)
+	require.NoError(t, err)
+	require.Equal(t, abi.NewTokenAmount(1), price(e))
+
+	reloaded, err := e.Reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	writeRules(`{"Rules": [{"Set": {"PricePerByte": "2"}}]}`)
+	reloaded, err = e.Reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Equal(t, abi.NewTokenAmount(2), price(e))
+
+	// invalid rules are not loaded
+	writeRules(`{"Rules": [{"Set": {"PricePerByte": "free"}}]}`)
+	_, err = e.Reload()
+	require.Error(t, err)
+	require.Equal(t, abi.NewTokenAmount(2), price(e))
+
+	// the engine reloads in the background once started
+	writeRules(`{"Rules": [{"Set": {"PricePerByte": "3"}}]}`)
+	e, err = pricingrules.NewEngine(path, pricingrules.ReloadInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	e.Start(ctx)
+	defer e.Stop()
+	writeRules(`{"Rules": [{"Set": {"PricePerByte": "4"}}]}`)
+	require.Eventually(t, func() bool {
+		return price(e).Equals(abi.NewTokenAmount(4))
+	}, time.Second, 10*time.Millisecond)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/hannahhoward/go-pubsub"
@@ -24,12 +26,17 @@ import (
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/askstore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dealscheduler"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dtutils"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/pieceblockstore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/piececache"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/providerstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/requestvalidation"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/vouchermanager"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
 )
 
 // RetrievalProviderOption is a function that configures a retrieval provider
@@ -60,6 +67,19 @@ type Provider struct {
 	askStore             retrievalmarket.AskStore
 	disableNewDeals      bool
 	retrievalPricingFunc RetrievalPricingFunc
+	pieceCache           *piececache.PieceCache
+	pinnedPiecesLk       sync.Mutex
+	pinnedPieces         map[retrievalmarket.ProviderDealIdentifier]cid.Cid
+	scheduler            *dealscheduler.Scheduler
+	bandwidthLimiter     *bandwidth.Limiter
+	transfersLk          sync.Mutex
+	transfers            map[retrievalmarket.ProviderDealIdentifier]context.CancelFunc
+	voucherManager       *vouchermanager.Manager
+
+	// when set, deals are served directly from the unsealed piece data
+	serveFromUnsealedPiece bool
+	pieceBlockstoresLk     sync.Mutex
+	pieceBlockstores       map[multistore.StoreID]*pieceblockstore.Blockstore
 }
 
 type internalProviderEvent struct {
@@ -96,6 +116,55 @@ func DisableNewDeals() RetrievalProviderOption {
 	}
 }
 
+// UnsealedPieceCache sets a cache of unsealed pieces, so that frequently retrieved
+// pieces are served from the cache instead of being unsealed for every deal.
+// Pieces in the cache are priced as unsealed, and stay in the cache until the
+// deals that were accepted for them end.
+func UnsealedPieceCache(cache *piececache.PieceCache) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.pieceCache = cache
+	}
+}
+
+// ServeFromUnsealedPiece causes deals to be served directly from the unsealed
+// piece data as it is unsealed, instead of first loading the whole piece into
+// a multistore. Blocks are read from the piece at the locations recorded in
+// the piece store. Selector retrievals are not partially unsealed when serving
+// from the unsealed piece.
+func ServeFromUnsealedPiece() RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.serveFromUnsealedPiece = true
+	}
+}
+
+// DealSchedulerLimits limits the number of deals the provider unseals and
+// sends data for at once, and the number of deals it serves for each client.
+// Deals over the limits wait in the DealStatusQueued state until there is
+// capacity. By default there are no limits.
+func DealSchedulerLimits(limits dealscheduler.Limits) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.scheduler.SetLimits(limits)
+	}
+}
+
+// BandwidthLimiter limits the rate at which the provider sends deal data.
+// Deals paying at least the ask's PriorityPricePerByte are sent with the
+// limiter's priority limits, and all other deals with its standard limits.
+func BandwidthLimiter(limiter *bandwidth.Limiter) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.bandwidthLimiter = limiter
+	}
+}
+
+// VoucherManager has the provider hand each payment voucher it saves to the
+// given manager, which redeems them on chain. The caller is responsible for
+// starting and stopping the manager.
+func VoucherManager(manager *vouchermanager.Manager) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.voucherManager = manager
+	}
+}
+
 // NewProvider returns a new retrieval Provider
 func NewProvider(minerAddress address.Address,
 	node retrievalmarket.RetrievalProviderNode,
@@ -122,7 +191,11 @@ func NewProvider(minerAddress address.Address,
 		subscribers:          pubsub.New(providerDispatcher),
 		readySub:             pubsub.New(shared.ReadyDispatcher),
 		retrievalPricingFunc: retrievalPricingFunc,
+		pieceBlockstores:     make(map[multistore.StoreID]*pieceblockstore.Blockstore),
+		transfers:            make(map[retrievalmarket.ProviderDealIdentifier]context.CancelFunc),
+		pinnedPieces:         make(map[retrievalmarket.ProviderDealIdentifier]cid.Cid),
 	}
+	p.scheduler = dealscheduler.NewScheduler(dealscheduler.Limits{}, p.startQueuedDeal)
 
 	err := shared.MoveKey(ds, "retrieval-ask", "retrieval-ask/latest")
 	if err != nil {
@@ -218,6 +291,8 @@ func (p *Provider) Start(ctx context.Context) error {
 		err := p.migrateStateMachines(ctx)
 		if err != nil {
 			log.Errorf("Migrating retrieval provider state machines: %s", err.Error())
+		} else if err = p.restoreQueue(); err != nil {
+			log.Errorf("Restoring retrieval provider deal queue: %s", err.Error())
 		}
 		err = p.readySub.Publish(err)
 		if err != nil {
@@ -235,6 +310,12 @@ func (p *Provider) OnReady(ready shared.ReadyFunc) {
 func (p *Provider) notifySubscribers(eventName fsm.EventName, state fsm.StateType) {
 	evt := eventName.(retrievalmarket.ProviderEvent)
 	ds := state.(retrievalmarket.ProviderDealState)
+	p.updateScheduler(evt, ds)
+	switch ds.Status {
+	case retrievalmarket.DealStatusErrored, retrievalmarket.DealStatusCompleted, retrievalmarket.DealStatusCancelled:
+		p.endTransfer(ds.Identifier())
+		p.unpinPiece(ds.Identifier())
+	}
 	_ = p.subscribers.Publish(internalProviderEvent{evt, ds})
 }
 
@@ -269,6 +350,192 @@ func (p *Provider) ListDeals() map[retrievalmarket.ProviderDealIdentifier]retrie
 	return dealMap
 }
 
+// GetDeal returns the state of a single retrieval deal
+func (p *Provider) GetDeal(dealID retrievalmarket.ProviderDealIdentifier) (retrievalmarket.ProviderDealState, error) {
+	has, err := p.stateMachines.Has(dealID)
+	if err != nil {
+		return retrievalmarket.ProviderDealState{}, err
+	}
+	if !has {
+		return retrievalmarket.ProviderDealState{}, xerrors.Errorf("getting deal %s: %w", dealID, retrievalmarket.ErrNotFound)
+	}
+	var deal retrievalmarket.ProviderDealState
+	err = p.stateMachines.Get(dealID).Get(&deal)
+	return deal, err
+}
+
+// FilterDeals returns the retrieval deals that match the filter, ordered by
+// the time they were received
+func (p *Provider) FilterDeals(filter retrievalmarket.ProviderDealFilter) ([]retrievalmarket.ProviderDealState, error) {
+	var deals []retrievalmarket.ProviderDealState
+	err := p.stateMachines.List(&deals)
+	if err != nil {
+		return nil, err
+	}
+
+	matching := make([]retrievalmarket.ProviderDealState, 0, len(deals))
+	for _, deal := range deals {
+		if filter.Matches(deal) {
+			matching = append(matching, deal)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].CreatedAt != matching[j].CreatedAt {
+			return matching[i].CreatedAt < matching[j].CreatedAt
+		}
+		return matching[i].Identifier().String() < matching[j].Identifier().String()
+	})
+
+	if filter.Offset >= len(matching) {
+		return []retrievalmarket.ProviderDealState{}, nil
+	}
+	matching = matching[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(matching) {
+		matching = matching[:filter.Limit]
+	}
+	return matching, nil
+}
+
+// CancelDeal stops a retrieval deal from the provider's side. The client is
+// sent a deal response with the reason, then the deal is cancelled as if the
+// client had cancelled it: its data transfer is closed and the reason is
+// recorded in the deal's message.
+func (p *Provider) CancelDeal(dealID retrievalmarket.ProviderDealIdentifier, reason string) error {
+	deal, err := p.GetDeal(dealID)
+	if err != nil {
+		return err
+	}
+	switch deal.Status {
+	case retrievalmarket.DealStatusCompleted, retrievalmarket.DealStatusErrored, retrievalmarket.DealStatusCancelled:
+		return xerrors.Errorf("deal %s has already finished with status %s", dealID, retrievalmarket.DealStatuses[deal.Status])
+	}
+	p.revalidator.CancelChannel(deal, reason)
+	return p.stateMachines.Send(dealID, retrievalmarket.ProviderEventProviderCancelled, reason)
+}
+
+// QueueStats returns metrics for the queue of deals waiting to be served
+func (p *Provider) QueueStats() retrievalmarket.ProviderQueueStats {
+	return p.scheduler.Stats()
+}
+
+// restoreQueue queues the deals that were waiting in the queue when the
+// provider last stopped, in the order they were created, since the scheduler
+// only keeps its queue in memory
+func (p *Provider) restoreQueue() error {
+	var deals []retrievalmarket.ProviderDealState
+	if err := p.stateMachines.List(&deals); err != nil {
+		return err
+	}
+	queued := make([]retrievalmarket.ProviderDealState, 0, len(deals))
+	for _, deal := range deals {
+		if deal.Status == retrievalmarket.DealStatusQueued {
+			queued = append(queued, deal)
+		}
+	}
+	sort.SliceStable(queued, func(i, j int) bool {
+		return queued[i].CreatedAt < queued[j].CreatedAt
+	})
+	for _, deal := range queued {
+		p.scheduler.Enqueue(deal.Identifier())
+	}
+	return nil
+}
+
+// startQueuedDeal moves a deal on from the queue to unsealing. The event is
+// sent asynchronously because the scheduler is updated from the state machine
+// notifier.
+func (p *Provider) startQueuedDeal(dealID retrievalmarket.ProviderDealIdentifier) error {
+	go func() {
+		err := p.stateMachines.Send(dealID, retrievalmarket.ProviderEventDequeued)
+		if err != nil {
+			log.Errorf("starting queued deal %s: %s", dealID, err)
+			p.scheduler.Finished(dealID)
+		}
+	}()
+	return nil
+}
+
+// transferContext returns a context for sending a deal's data that is
+// cancelled when the deal ends. A restarted transfer replaces the context of
+// the one before it.
+func (p *Provider) transferContext(dealID retrievalmarket.ProviderDealIdentifier) context.Context {
+	p.transfersLk.Lock()
+	defer p.transfersLk.Unlock()
+
+	if cancel, ok := p.transfers[dealID]; ok {
+		cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.transfers[dealID] = cancel
+	return ctx
+}
+
+// endTransfer cancels the context of a deal's transfer
+func (p *Provider) endTransfer(dealID retrievalmarket.ProviderDealIdentifier) {
+	p.transfersLk.Lock()
+	defer p.transfersLk.Unlock()
+
+	if cancel, ok := p.transfers[dealID]; ok {
+		cancel()
+		delete(p.transfers, dealID)
+	}
+}
+
+// pinPiece keeps the piece a deal will be served from in the piece cache until
+// the deal ends, since the deal may have been priced as unsealed because the
+// piece was cached. If the piece has already left the cache and there is no
+// unsealed copy, the deal is priced again, and an error is returned if it no
+// longer pays for unsealing.
+func (p *Provider) pinPiece(ctx context.Context, dealID retrievalmarket.ProviderDealIdentifier, deal retrievalmarket.ProviderDealState) error {
+	if p.pieceCache == nil || deal.PieceInfo == nil {
+		return nil
+	}
+	pieceCID := deal.PieceInfo.PieceCID
+	if p.pieceCache.Pin(pieceCID) {
+		p.pinnedPiecesLk.Lock()
+		p.pinnedPieces[dealID] = pieceCID
+		p.pinnedPiecesLk.Unlock()
+		return nil
+	}
+
+	isUnsealed := pieceInUnsealedSector(ctx, p.node, *deal.PieceInfo)
+	pve := &providerValidationEnvironment{p}
+	ask, err := pve.GetAsk(ctx, deal.PayloadCID, deal.PieceCID, deal.Selector, *deal.PieceInfo, isUnsealed, deal.Receiver)
+	if err != nil {
+		return xerrors.Errorf("pricing retrieval again: %w", err)
+	}
+	if !ask.UnsealPrice.Nil() && deal.UnsealPrice.LessThan(ask.UnsealPrice) {
+		return xerrors.Errorf("piece %s is no longer unsealed: unsealing costs %s", pieceCID, ask.UnsealPrice)
+	}
+	return nil
+}
+
+// unpinPiece releases the pin pinPiece took for a deal, if any
+func (p *Provider) unpinPiece(dealID retrievalmarket.ProviderDealIdentifier) {
+	p.pinnedPiecesLk.Lock()
+	pieceCID, ok := p.pinnedPieces[dealID]
+	delete(p.pinnedPieces, dealID)
+	p.pinnedPiecesLk.Unlock()
+
+	if ok {
+		p.pieceCache.Unpin(pieceCID)
+	}
+}
+
+// updateScheduler releases the scheduler capacity held by a deal as it
+// finishes unsealing and when it ends
+func (p *Provider) updateScheduler(evt retrievalmarket.ProviderEvent, ds retrievalmarket.ProviderDealState) {
+	dealID := ds.Identifier()
+	switch ds.Status {
+	case retrievalmarket.DealStatusErrored, retrievalmarket.DealStatusCompleted, retrievalmarket.DealStatusCancelled:
+		p.scheduler.Finished(dealID)
+	default:
+		if evt == retrievalmarket.ProviderEventUnsealComplete || evt == retrievalmarket.ProviderEventUnsealError {
+			p.scheduler.UnsealFinished(dealID)
+		}
+	}
+}
+
 /*
 HandleQueryStream is called by the network implementation whenever a new message is received on the query protocol
 
@@ -277,8 +544,12 @@ A Provider handling a retrieval `Query` does the following:
 1. Get the node's chain head in order to get its miner worker address.
 
 2. Look in its piece store to determine if it can serve the given payload CID.
+If the query includes a selector, it also uses the piece store's block index to
+check that the selected blocks are in the piece and to find their expected size.
 
 3. Combine these results with its existing parameters for retrieval deals to construct a `retrievalmarket.QueryResponse` struct.
+If the terms are outside the price and payment interval limits set in the query, the response
+status is `QueryResponseTermsUnacceptable`.
 
 4. Writes this response to the `Query` stream.
 
@@ -332,7 +603,7 @@ func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 	if query.PieceCID != nil {
 		pieceCID = *query.PieceCID
 	}
-	pieceInfo, isUnsealed, err := getPieceInfoFromCid(ctx, p.node, p.pieceStore, query.PayloadCID, pieceCID)
+	pieceInfo, isUnsealed, err := p.getPieceInfoFromCid(ctx, query.PayloadCID, pieceCID)
 	if err != nil {
 		log.Errorf("Retrieval query: getPieceInfoFromCid: %s", err)
 		if !xerrors.Is(err, retrievalmarket.ErrNotFound) {
@@ -366,6 +637,17 @@ func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 		Unsealed:   isUnsealed,
 		Client:     stream.RemotePeer(),
 	}
+
+	// if the client asked about a selection of the payload, check that the
+	// piece holds it and price just that selection
+	if query.SelectorSpecified() {
+		answer.SelectorFound, answer.ExpectedPayloadSize = p.querySelection(ctx, query.PayloadCID, query.Selector, pieceInfo)
+		input.PieceSize = pieceInfo.Deals[0].Length.Unpadded()
+		if unsealSize, ok := p.partialUnsealSize(ctx, query.PayloadCID, query.Selector, pieceInfo); ok {
+			input.UnsealSize = unsealSize
+		}
+	}
+
 	ask, err := p.GetDynamicAsk(ctx, input, storageDeals)
 	if err != nil {
 		log.Errorf("Retrieval query: GetAsk: %s", err)
@@ -379,6 +661,12 @@ func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 	answer.MaxPaymentInterval = ask.PaymentInterval
 	answer.MaxPaymentIntervalIncrease = ask.PaymentIntervalIncrease
 	answer.UnsealPrice = ask.UnsealPrice
+
+	// tell the client up front if our terms are outside its limits
+	if err := query.CheckTerms(ask.PricePerByte, ask.PaymentInterval, ask.PaymentIntervalIncrease); err != nil {
+		answer.Status = retrievalmarket.QueryResponseTermsUnacceptable
+		answer.Message = err.Error()
+	}
 	sendResp(answer)
 }
 
@@ -398,6 +686,10 @@ func (p *Provider) GetDynamicAsk(ctx context.Context, input retrievalmarket.Pric
 
 	dp.PayloadCID = input.PayloadCID
 	dp.PieceCID = input.PieceCID
+	if dp.PieceSize == 0 {
+		dp.PieceSize = input.PieceSize
+	}
+	dp.UnsealSize = input.UnsealSize
 	dp.Unsealed = input.Unsealed
 	dp.Client = input.Client
 	dp.CurrentAsk = *currAsk
@@ -428,18 +720,6 @@ var ProviderFSMParameterSpec = fsm.Parameters{
 // DefaultPricingFunc is the default pricing policy that will be used to price retrieval deals.
 var DefaultPricingFunc = func(VerifiedDealsFreeTransfer bool) func(ctx context.Context, pricingInput retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
 	return func(ctx context.Context, pricingInput retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
-		ask := pricingInput.CurrentAsk
-
-		// don't charge for Unsealing if we have an Unsealed copy.
-		if pricingInput.Unsealed {
-			ask.UnsealPrice = big.Zero()
-		}
-
-		// don't charge for data transfer for verified deals if it's been configured to do so.
-		if pricingInput.VerifiedDeal && VerifiedDealsFreeTransfer {
-			ask.PricePerByte = big.Zero()
-		}
-
-		return ask, nil
+		return pricingInput.AdjustAsk(pricingInput.CurrentAsk, VerifiedDealsFreeTransfer), nil
 	}
 }
@@ -1,27 +1,37 @@
 package retrievalimpl
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	"github.com/libp2p/go-libp2p-core/peer"
+	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/xerrors"
 
+	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-commp-utils/pieceio/cario"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-multistore"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockunsealer"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dtutils"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/pieceblockstore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/providerstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/requestvalidation"
 	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
 )
 
 var _ requestvalidation.ValidationEnvironment = new(providerValidationEnvironment)
@@ -30,7 +40,7 @@ type providerValidationEnvironment struct {
 	p *Provider
 }
 
-func (pve *providerValidationEnvironment) GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid,
+func (pve *providerValidationEnvironment) GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid, selector *cbg.Deferred,
 	piece piecestore.PieceInfo, isUnsealed bool, client peer.ID) (retrievalmarket.Ask, error) {
 
 	storageDeals, err := storageDealsForPiece(pieceCid != nil, payloadCid, piece, pve.p.pieceStore)
@@ -46,6 +56,13 @@ func (pve *providerValidationEnvironment) GetAsk(ctx context.Context, payloadCid
 		Unsealed:   isUnsealed,
 		Client:     client,
 	}
+	if len(piece.Deals) > 0 {
+		input.PieceSize = piece.Deals[0].Length.Unpadded()
+	}
+	// selector retrievals may only need part of the piece to be unsealed
+	if unsealSize, ok := pve.p.partialUnsealSize(ctx, payloadCid, selector, piece); ok {
+		input.UnsealSize = unsealSize
+	}
 
 	return pve.p.GetDynamicAsk(ctx, input, storageDeals)
 }
@@ -56,7 +73,7 @@ func (pve *providerValidationEnvironment) GetPiece(c cid.Cid, pieceCID *cid.Cid)
 		inPieceCid = *pieceCID
 	}
 
-	return getPieceInfoFromCid(context.TODO(), pve.p.node, pve.p.pieceStore, c, inPieceCid)
+	return pve.p.getPieceInfoFromCid(context.TODO(), c, inPieceCid)
 }
 
 // CheckDealParams verifies the given deal params are acceptable
@@ -86,8 +103,17 @@ func (pve *providerValidationEnvironment) RunDealDecisioningLogic(ctx context.Co
 
 // StateMachines returns the FSM Group to begin tracking with
 func (pve *providerValidationEnvironment) BeginTracking(pds retrievalmarket.ProviderDealState) error {
+	if err := pve.p.pinPiece(context.TODO(), pds.Identifier(), pds); err != nil {
+		return err
+	}
+	pve.p.newPieceBlockstore(pds)
+
 	err := pve.p.stateMachines.Begin(pds.Identifier(), &pds)
 	if err != nil {
+		pve.p.unpinPiece(pds.Identifier())
+		if _, err := pve.p.closePieceBlockstore(pds.StoreID); err != nil {
+			log.Warnf("failed to close unsealed piece blockstore for store %d: %s", pds.StoreID, err)
+		}
 		return err
 	}
 
@@ -98,13 +124,23 @@ func (pve *providerValidationEnvironment) BeginTracking(pds retrievalmarket.Prov
 	return pve.p.stateMachines.Send(pds.Identifier(), retrievalmarket.ProviderEventOpen)
 }
 
-// NextStoreID allocates a store for this deal
+// NextStoreID allocates a store for this deal. Deals served from the unsealed
+// piece don't load the piece into a store, so for them the ID only keys the
+// deal's piece blockstore, and no store is created unless the deal falls back
+// to one after a restart.
 func (pve *providerValidationEnvironment) NextStoreID() (multistore.StoreID, error) {
 	storeID := pve.p.multiStore.Next()
+	if pve.p.serveFromUnsealedPiece {
+		return storeID, nil
+	}
 	_, err := pve.p.multiStore.Get(storeID)
 	return storeID, err
 }
 
+func (pve *providerValidationEnvironment) WouldQueue(client peer.ID) bool {
+	return pve.p.scheduler.WouldQueue(client)
+}
+
 type providerRevalidatorEnvironment struct {
 	p *Provider
 }
@@ -123,6 +159,17 @@ func (pre *providerRevalidatorEnvironment) Get(dealID retrievalmarket.ProviderDe
 	return deal, err
 }
 
+func (pre *providerRevalidatorEnvironment) RecordVoucher(paymentChannel address.Address, voucher *paych.SignedVoucher) error {
+	if pre.p.voucherManager == nil {
+		return nil
+	}
+	return pre.p.voucherManager.AddVoucher(paymentChannel, voucher)
+}
+
+func (pre *providerRevalidatorEnvironment) WouldQueue(client peer.ID) bool {
+	return pre.p.scheduler.WouldQueue(client)
+}
+
 var _ providerstates.ProviderDealEnvironment = new(providerDealEnvironment)
 
 type providerDealEnvironment struct {
@@ -135,6 +182,12 @@ func (pde *providerDealEnvironment) Node() retrievalmarket.RetrievalProviderNode
 }
 
 func (pde *providerDealEnvironment) ReadIntoBlockstore(storeID multistore.StoreID, pieceData io.ReadCloser) error {
+	// When serving directly from the unsealed piece, blocks are read from the
+	// piece data as the transfer requests them
+	if bs := pde.p.pieceBlockstore(storeID); bs != nil {
+		return bs.Load(pieceData)
+	}
+
 	// Get the the destination multistore
 	store, loadErr := pde.p.multiStore.Get(storeID)
 	if loadErr != nil {
@@ -176,6 +229,52 @@ func (pde *providerDealEnvironment) ReadIntoBlockstore(storeID multistore.StoreI
 	return nil
 }
 
+func (pde *providerDealEnvironment) UnsealSelected(ctx context.Context, deal retrievalmarket.ProviderDealState) (bool, error) {
+	if deal.PieceInfo == nil {
+		return false, nil
+	}
+	if _, ok := pde.p.partialUnsealSize(ctx, deal.PayloadCID, deal.Selector, *deal.PieceInfo); !ok {
+		return false, nil
+	}
+
+	sel, err := retrievalmarket.DecodeNode(deal.Selector)
+	if err != nil {
+		return false, xerrors.Errorf("failed to decode selector: %w", err)
+	}
+	store, err := pde.p.multiStore.Get(deal.StoreID)
+	if err != nil {
+		return false, xerrors.Errorf("failed to get multistore %d: %w", deal.StoreID, err)
+	}
+
+	// the deal's unseal price only covers the selected blocks, so if they
+	// can't be unsealed the deal fails rather than unsealing the whole piece
+	unsealer := blockunsealer.NewUnsealer(ctx, pde.p.node, pde.p.pieceStore, *deal.PieceInfo)
+	err = unsealer.UnsealSelected(ctx, deal.PayloadCID, sel, store.Bstore)
+	if err != nil {
+		return false, xerrors.Errorf("failed to unseal selected blocks of piece %s: %w", deal.PieceInfo.PieceCID, err)
+	}
+	return true, nil
+}
+
+func (pde *providerDealEnvironment) GetCachedPiece(pieceCID cid.Cid) (io.ReadCloser, bool) {
+	if pde.p.pieceCache == nil {
+		return nil, false
+	}
+	return pde.p.pieceCache.Get(pieceCID)
+}
+
+func (pde *providerDealEnvironment) CachePiece(pieceInfo piecestore.PieceInfo, pieceData io.ReadCloser) io.ReadCloser {
+	if pde.p.pieceCache == nil || len(pieceInfo.Deals) == 0 {
+		return pieceData
+	}
+	pieceSize := uint64(pieceInfo.Deals[0].Length.Unpadded())
+	return pde.p.pieceCache.TeeReader(pieceInfo.PieceCID, pieceSize, pieceData)
+}
+
+func (pde *providerDealEnvironment) QueueDeal(deal retrievalmarket.ProviderDealState) {
+	pde.p.scheduler.Enqueue(deal.Identifier())
+}
+
 func (pde *providerDealEnvironment) TrackTransfer(deal retrievalmarket.ProviderDealState) error {
 	pde.p.revalidator.TrackChannel(deal)
 	return nil
@@ -186,6 +285,23 @@ func (pde *providerDealEnvironment) UntrackTransfer(deal retrievalmarket.Provide
 	return nil
 }
 
+func (pde *providerDealEnvironment) WaitForCancelResponse(ctx context.Context, deal retrievalmarket.ProviderDealState) {
+	delivered := pde.p.revalidator.CancelResponseDelivered(deal)
+	if delivered == nil {
+		return
+	}
+
+	// the response is only sent when the transfer next asks for revalidation,
+	// so don't hold up the cancellation for long if it doesn't
+	ctx, cancel := context.WithTimeout(ctx, shared.CloseDataTransferTimeout)
+	defer cancel()
+	select {
+	case <-delivered:
+	case <-ctx.Done():
+		log.Warnf("failed to tell client the provider cancelled deal %s within timeout %s", deal.Identifier(), shared.CloseDataTransferTimeout)
+	}
+}
+
 func (pde *providerDealEnvironment) ResumeDataTransfer(ctx context.Context, chid datatransfer.ChannelID) error {
 	return pde.p.dataTransfer.ResumeDataTransferChannel(ctx, chid)
 }
@@ -205,10 +321,132 @@ func (pde *providerDealEnvironment) CloseDataTransfer(ctx context.Context, chid
 	return err
 }
 
+// DeleteStore deletes the deal's store, or closes its piece blockstore if the
+// deal was served from the unsealed piece, in which case there is no store
 func (pde *providerDealEnvironment) DeleteStore(storeID multistore.StoreID) error {
+	closed, err := pde.p.closePieceBlockstore(storeID)
+	if err != nil {
+		log.Warnf("failed to close unsealed piece blockstore for store %d: %s", storeID, err)
+	}
+	if closed {
+		return nil
+	}
 	return pde.p.multiStore.Delete(storeID)
 }
 
+var allSelectorBytes []byte
+
+func init() {
+	buf := new(bytes.Buffer)
+	_ = dagcbor.Encoder(shared.AllSelector(), buf)
+	allSelectorBytes = buf.Bytes()
+}
+
+// maxSelectionBlocks is the most blocks a selection is walked through to
+// measure it when pricing a retrieval. A larger selection is only estimated.
+const maxSelectionBlocks = 1024
+
+// partialUnsealSize returns the estimated number of bytes of the piece that
+// must be unsealed to serve a retrieval of the payload with the given
+// selector. It returns false if the whole piece must be unsealed, because the
+// retrieval is for the whole DAG or the payload's location in the piece is unknown.
+// Partial unsealing is not used when serving directly from unsealed pieces.
+func (p *Provider) partialUnsealSize(ctx context.Context, payloadCID cid.Cid, selector *cbg.Deferred, pieceInfo piecestore.PieceInfo) (abi.UnpaddedPieceSize, bool) {
+	if p.serveFromUnsealedPiece {
+		return 0, false
+	}
+	if selector == nil || bytes.Equal(selector.Raw, cbg.CborNull) || bytes.Equal(selector.Raw, allSelectorBytes) {
+		return 0, false
+	}
+	sel, err := retrievalmarket.DecodeNode(selector)
+	if err != nil {
+		return 0, false
+	}
+	unsealer := blockunsealer.NewUnsealer(ctx, p.node, p.pieceStore, pieceInfo)
+	return unsealer.EstimateUnsealSize(ctx, payloadCID, sel, maxSelectionBlocks)
+}
+
+// querySelection checks whether the piece holds the blocks a query's selector
+// reaches under the payload and returns their expected total size. When a
+// sector has an unsealed copy of the piece, the selection is walked to find
+// its exact size. Otherwise the blocks can't be read without unsealing, and if
+// the selection reaches more than maxSelectionBlocks blocks it is too costly
+// to walk for a query, so the status is unknown and the size is estimated
+// from the payload's location in the piece.
+func (p *Provider) querySelection(ctx context.Context, payloadCID cid.Cid, selector *cbg.Deferred, pieceInfo piecestore.PieceInfo) (retrievalmarket.SelectorStatus, uint64) {
+	sel, err := retrievalmarket.DecodeNode(selector)
+	if err != nil {
+		log.Warnf("Retrieval query: decoding selector: %s", err)
+		return retrievalmarket.SelectorUnavailable, 0
+	}
+
+	unsealer := blockunsealer.NewUnsealer(ctx, p.node, p.pieceStore, pieceInfo)
+	size, err := unsealer.SelectedSize(ctx, payloadCID, sel, maxSelectionBlocks)
+	if err == nil {
+		return retrievalmarket.SelectorAvailable, size
+	}
+	if xerrors.Is(err, blockunsealer.ErrNoBlockLocation) {
+		return retrievalmarket.SelectorUnavailable, 0
+	}
+	if !xerrors.Is(err, blockunsealer.ErrNoUnsealedCopy) && !xerrors.Is(err, blockunsealer.ErrSelectionTooLarge) {
+		log.Warnf("Retrieval query: measuring selection: %s", err)
+	}
+
+	estimate, _ := blockunsealer.RangeFromRoot(p.pieceStore, pieceInfo, payloadCID)
+	return retrievalmarket.SelectorUnknown, uint64(estimate)
+}
+
+// newPieceBlockstore sets up the blockstore serving the unsealed piece for a
+// deal, if the provider is configured to serve directly from unsealed pieces.
+// Blocks behind the piece data already read are unsealed on their own.
+func (p *Provider) newPieceBlockstore(deal retrievalmarket.ProviderDealState) {
+	if !p.serveFromUnsealedPiece || deal.PieceInfo == nil {
+		return
+	}
+	pieceInfo := *deal.PieceInfo
+	bs := pieceblockstore.NewBlockstore(p.pieceStore, pieceInfo.PieceCID, func(c cid.Cid) (blocks.Block, error) {
+		ctx := context.TODO()
+		return blockunsealer.NewUnsealer(ctx, p.node, p.pieceStore, pieceInfo).ReadBlock(ctx, c)
+	})
+
+	p.pieceBlockstoresLk.Lock()
+	p.pieceBlockstores[deal.StoreID] = bs
+	p.pieceBlockstoresLk.Unlock()
+}
+
+// pieceBlockstore returns the blockstore serving the unsealed piece for the
+// given store. It returns nil if the deal is served from its multistore,
+// including deals accepted before the provider restarted.
+func (p *Provider) pieceBlockstore(storeID multistore.StoreID) *pieceblockstore.Blockstore {
+	p.pieceBlockstoresLk.Lock()
+	defer p.pieceBlockstoresLk.Unlock()
+	return p.pieceBlockstores[storeID]
+}
+
+// closePieceBlockstore closes the blockstore serving the unsealed piece for
+// the given store. It returns false if there is none, because the deal is
+// served from its multistore.
+func (p *Provider) closePieceBlockstore(storeID multistore.StoreID) (bool, error) {
+	p.pieceBlockstoresLk.Lock()
+	bs, ok := p.pieceBlockstores[storeID]
+	delete(p.pieceBlockstores, storeID)
+	p.pieceBlockstoresLk.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, bs.Close()
+}
+
+// pieceIsUnsealed returns true if the piece can be served without unsealing,
+// either because it is in the piece cache or it is in an unsealed sector
+func (p *Provider) pieceIsUnsealed(ctx context.Context, pieceInfo piecestore.PieceInfo) bool {
+	if p.pieceCache != nil && p.pieceCache.Has(pieceInfo.PieceCID) {
+		return true
+	}
+	return pieceInUnsealedSector(ctx, p.node, pieceInfo)
+}
+
 func pieceInUnsealedSector(ctx context.Context, n retrievalmarket.RetrievalProviderNode, pieceInfo piecestore.PieceInfo) bool {
 	for _, di := range pieceInfo.Deals {
 		isUnsealed, err := n.IsUnsealed(ctx, di.SectorID, di.Offset.Unpadded(), di.Length.Unpadded())
@@ -279,8 +517,8 @@ func getAllDealsContainingPayload(pieceStore piecestore.PieceStore, payloadCID c
 	return dealsIds, nil
 }
 
-func getPieceInfoFromCid(ctx context.Context, n retrievalmarket.RetrievalProviderNode, pieceStore piecestore.PieceStore, payloadCID, pieceCID cid.Cid) (piecestore.PieceInfo, bool, error) {
-	cidInfo, err := pieceStore.GetCIDInfo(payloadCID)
+func (p *Provider) getPieceInfoFromCid(ctx context.Context, payloadCID, pieceCID cid.Cid) (piecestore.PieceInfo, bool, error) {
+	cidInfo, err := p.pieceStore.GetCIDInfo(payloadCID)
 	if err != nil {
 		return piecestore.PieceInfoUndefined, false, xerrors.Errorf("get cid info: %w", err)
 	}
@@ -288,7 +526,7 @@ func getPieceInfoFromCid(ctx context.Context, n retrievalmarket.RetrievalProvide
 	var sealedPieceInfo *piecestore.PieceInfo
 
 	for _, pieceBlockLocation := range cidInfo.PieceBlockLocations {
-		pieceInfo, err := pieceStore.GetPieceInfo(pieceBlockLocation.PieceCID)
+		pieceInfo, err := p.pieceStore.GetPieceInfo(pieceBlockLocation.PieceCID)
 		if err != nil {
 			lastErr = err
 			continue
@@ -296,13 +534,13 @@ func getPieceInfoFromCid(ctx context.Context, n retrievalmarket.RetrievalProvide
 
 		// if client wants to retrieve the payload from a specific piece, just return that piece.
 		if pieceCID.Defined() && pieceInfo.PieceCID.Equals(pieceCID) {
-			return pieceInfo, pieceInUnsealedSector(ctx, n, pieceInfo), nil
+			return pieceInfo, p.pieceIsUnsealed(ctx, pieceInfo), nil
 		}
 
 		// if client dosen't have a preference for a particular piece, prefer a piece
 		// for which an unsealed sector exists.
 		if pieceCID.Equals(cid.Undef) {
-			if pieceInUnsealedSector(ctx, n, pieceInfo) {
+			if p.pieceIsUnsealed(ctx, pieceInfo) {
 				return pieceInfo, true, nil
 			}
 
@@ -325,6 +563,8 @@ func getPieceInfoFromCid(ctx context.Context, n retrievalmarket.RetrievalProvide
 }
 
 var _ dtutils.StoreGetter = &providerStoreGetter{}
+var _ dtutils.BlockstoreGetter = &providerStoreGetter{}
+var _ dtutils.TransferThrottler = &providerStoreGetter{}
 
 type providerStoreGetter struct {
 	p *Provider
@@ -339,3 +579,36 @@ func (psg *providerStoreGetter) Get(otherPeer peer.ID, dealID retrievalmarket.De
 	}
 	return psg.p.multiStore.Get(deal.StoreID)
 }
+
+func (psg *providerStoreGetter) GetBlockstore(otherPeer peer.ID, dealID retrievalmarket.DealID) (blockstore.Blockstore, error) {
+	if !psg.p.serveFromUnsealedPiece {
+		return nil, nil
+	}
+	var deal retrievalmarket.ProviderDealState
+	provDealID := retrievalmarket.ProviderDealIdentifier{Receiver: otherPeer, DealID: dealID}
+	err := psg.p.stateMachines.Get(provDealID).Get(&deal)
+	if err != nil {
+		return nil, err
+	}
+	if bs := psg.p.pieceBlockstore(deal.StoreID); bs != nil {
+		return bs, nil
+	}
+	return nil, nil
+}
+
+func (psg *providerStoreGetter) Throttle(otherPeer peer.ID, dealID retrievalmarket.DealID) (*bandwidth.Transfer, error) {
+	if psg.p.bandwidthLimiter == nil {
+		return nil, nil
+	}
+	var deal retrievalmarket.ProviderDealState
+	provDealID := retrievalmarket.ProviderDealIdentifier{Receiver: otherPeer, DealID: dealID}
+	err := psg.p.stateMachines.Get(provDealID).Get(&deal)
+	if err != nil {
+		return nil, err
+	}
+	priority := false
+	if ask := psg.p.GetAsk(); ask != nil {
+		priority = ask.IsPriority(deal.PricePerByte)
+	}
+	return psg.p.bandwidthLimiter.NewTransfer(psg.p.transferContext(provDealID), otherPeer, priority), nil
+}
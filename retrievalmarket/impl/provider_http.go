@@ -0,0 +1,420 @@
+package retrievalimpl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-commp-utils/pieceio/cario"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/blockunsealer"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+// HTTPRetrieval is a retrieval requested over HTTP, as presented to a
+// CredentialValidator
+type HTTPRetrieval struct {
+	PayloadCID cid.Cid
+	PieceCID   cid.Cid
+	// Selector is the selector the client asked for, applied at the end of
+	// the path
+	Selector ipld.Node
+	// Ask is the price of the retrieval
+	Ask retrievalmarket.Ask
+	// Credential is the bearer token the client presented
+	Credential string
+}
+
+// CredentialValidator checks that the credential an HTTP client presented
+// pays for a retrieval. It returns an error if the retrieval should not be
+// served.
+type CredentialValidator func(ctx context.Context, retrieval HTTPRetrieval) error
+
+// HTTPGatewayOption configures an HTTPGateway
+type HTTPGatewayOption func(*HTTPGateway)
+
+// CredentialValidatorOpt lets the gateway serve content that has a price to
+// clients that present a pre-paid credential, checked by the given validator
+func CredentialValidatorOpt(validator CredentialValidator) HTTPGatewayOption {
+	return func(g *HTTPGateway) {
+		g.validateCredential = validator
+	}
+}
+
+/*
+HTTPGateway serves retrievals from a provider to plain HTTP clients.
+
+A request for `GET /ipfs/<payloadCID>[/<path>]` is answered with a CAR stream
+of the blocks under the payload CID. The optional path is a sequence of IPLD
+field names and list indexes to follow from the payload root, and the optional
+`selector` query parameter is a DAG-JSON selector applied at the end of the
+path. Without either, the whole DAG is sent. The `piece` query parameter
+retrieves the payload from a specific piece.
+
+The gateway finds, prices and unseals content the same way the provider does
+for graphsync retrievals, and runs the provider's deal decider on each request.
+Requests wait in the provider's deal queue like other deals, each client
+address counting as one client, and the response is sent within the provider's
+bandwidth limits.
+Content whose price is zero is served to anyone. Content with a price is only
+served to clients that present a credential in an `Authorization: Bearer`
+header that the gateway's CredentialValidator accepts.
+*/
+type HTTPGateway struct {
+	p                  *Provider
+	validateCredential CredentialValidator
+	lastDealID         uint64
+}
+
+var _ http.Handler = new(HTTPGateway)
+
+// NewHTTPGateway returns an HTTP handler serving retrievals from the given
+// provider, which must have been created with NewProvider
+func NewHTTPGateway(provider retrievalmarket.RetrievalProvider, options ...HTTPGatewayOption) (*HTTPGateway, error) {
+	p, ok := provider.(*Provider)
+	if !ok {
+		return nil, xerrors.Errorf("unsupported retrieval provider type %T", provider)
+	}
+	g := &HTTPGateway{p: p}
+	for _, option := range options {
+		option(g)
+	}
+	return g, nil
+}
+
+// httpError is an error with the HTTP status it should be reported with
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func httpErrorf(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, err: xerrors.Errorf(format, args...)}
+}
+
+// httpDeal is a retrieval being served over HTTP
+type httpDeal struct {
+	id       retrievalmarket.ProviderDealIdentifier
+	bs       blockstore.Blockstore
+	root     cid.Cid
+	sel      ipld.Node
+	priority bool
+	// cleanup releases the deal's scheduler slots and store
+	cleanup func()
+}
+
+// ServeHTTP serves a single retrieval
+func (g *HTTPGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	deal, err := g.prepare(r)
+	if deal != nil {
+		defer deal.cleanup()
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		var he *httpError
+		if errors.As(err, &he) {
+			status = he.status
+		}
+		// the error may describe the provider's internals, so the client
+		// only gets the status
+		log.Warnf("http retrieval %s: %s", r.URL.Path, err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var out io.Writer = w
+	if g.p.bandwidthLimiter != nil {
+		out = g.p.bandwidthLimiter.NewTransfer(r.Context(), deal.id.Receiver, deal.priority).Writer(w)
+	}
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	sc := car.NewSelectiveCar(r.Context(), deal.bs, []car.Dag{{Root: deal.root, Selector: deal.sel}})
+	if err := sc.Write(out); err != nil {
+		// the status has been sent, so all we can do is cut the stream short
+		log.Warnf("http retrieval %s: writing CAR: %s", r.URL.Path, err)
+	}
+}
+
+// prepare checks a request may be served, waits for the deal's turn in the
+// provider's queue and unseals its data. If a deal is returned, its cleanup
+// function must be called once the data has been sent.
+func (g *HTTPGateway) prepare(r *http.Request) (*httpDeal, error) {
+	ctx := r.Context()
+	if g.p.disableNewDeals {
+		return nil, httpErrorf(http.StatusServiceUnavailable, "provider is not accepting new retrievals")
+	}
+
+	root, sel, err := parseRetrievalPath(r)
+	if err != nil {
+		return nil, &httpError{status: http.StatusBadRequest, err: err}
+	}
+	selBuf := new(bytes.Buffer)
+	if err := dagcbor.Encoder(sel, selBuf); err != nil {
+		return nil, &httpError{status: http.StatusBadRequest, err: xerrors.Errorf("encoding selector: %w", err)}
+	}
+	encodedSel := &cbg.Deferred{Raw: selBuf.Bytes()}
+
+	var pieceCID *cid.Cid
+	if s := r.URL.Query().Get("piece"); s != "" {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return nil, httpErrorf(http.StatusBadRequest, "invalid piece CID %s: %w", s, err)
+		}
+		pieceCID = &c
+	}
+
+	// find the piece and price the retrieval
+	pve := &providerValidationEnvironment{g.p}
+	pieceInfo, isUnsealed, err := pve.GetPiece(root, pieceCID)
+	if err != nil {
+		return nil, httpErrorf(http.StatusNotFound, "payload %s not found: %w", root, err)
+	}
+	ask, err := pve.GetAsk(ctx, root, pieceCID, encodedSel, pieceInfo, isUnsealed, "")
+	if err != nil {
+		return nil, xerrors.Errorf("pricing retrieval: %w", err)
+	}
+
+	// run the deal decider as it would be for a graphsync retrieval
+	deal := retrievalmarket.ProviderDealState{
+		DealProposal: retrievalmarket.DealProposal{
+			PayloadCID: root,
+			Params: retrievalmarket.Params{
+				Selector:                encodedSel,
+				PieceCID:                pieceCID,
+				PricePerByte:            ask.PricePerByte,
+				PaymentInterval:         ask.PaymentInterval,
+				PaymentIntervalIncrease: ask.PaymentIntervalIncrease,
+				UnsealPrice:             ask.UnsealPrice,
+			},
+		},
+		PieceInfo: &pieceInfo,
+	}
+	if err := g.checkPayment(r, root, pieceInfo.PieceCID, sel, ask, deal.Params); err != nil {
+		return nil, err
+	}
+	accepted, reason, err := pve.RunDealDecisioningLogic(ctx, deal)
+	if err != nil {
+		return nil, xerrors.Errorf("running deal decider: %w", err)
+	}
+	if !accepted {
+		return nil, httpErrorf(http.StatusForbidden, "retrieval rejected: %s", reason)
+	}
+
+	// wait for capacity, as graphsync retrievals do
+	hd := &httpDeal{
+		id:   g.newDealID(r),
+		root: root,
+		sel:  sel,
+	}
+	if storedAsk := g.p.GetAsk(); storedAsk != nil {
+		hd.priority = storedAsk.IsPriority(ask.PricePerByte)
+	}
+	// keep a cached piece for the retrieval it was priced for
+	if err := g.p.pinPiece(ctx, hd.id, deal); err != nil {
+		return nil, httpErrorf(http.StatusConflict, "%w", err)
+	}
+	if err := g.p.scheduler.Acquire(ctx, hd.id); err != nil {
+		g.p.unpinPiece(hd.id)
+		return nil, httpErrorf(http.StatusServiceUnavailable, "waiting for capacity: %w", err)
+	}
+
+	// unseal the data into a temporary store
+	storeID := g.p.multiStore.Next()
+	store, err := g.p.multiStore.Get(storeID)
+	if err != nil {
+		g.p.scheduler.Finished(hd.id)
+		g.p.unpinPiece(hd.id)
+		return nil, xerrors.Errorf("creating store: %w", err)
+	}
+	hd.bs = store.Bstore
+	hd.cleanup = func() {
+		g.p.scheduler.Finished(hd.id)
+		g.p.unpinPiece(hd.id)
+		if err := g.p.multiStore.Delete(storeID); err != nil {
+			log.Warnf("http retrieval: deleting store %d: %s", storeID, err)
+		}
+	}
+	err = g.unseal(ctx, root, sel, encodedSel, pieceInfo, store.Bstore)
+	g.p.scheduler.UnsealFinished(hd.id)
+	if err != nil {
+		return hd, xerrors.Errorf("unsealing piece %s: %w", pieceInfo.PieceCID, err)
+	}
+	return hd, nil
+}
+
+// newDealID returns the scheduler identifier for an HTTP retrieval. The
+// client's address stands in for its peer ID, so that the per client limit
+// applies to HTTP clients too.
+func (g *HTTPGateway) newDealID(r *http.Request) retrievalmarket.ProviderDealIdentifier {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return retrievalmarket.ProviderDealIdentifier{
+		Receiver: peer.ID(fmt.Sprintf("http:%s", host)),
+		DealID:   retrievalmarket.DealID(atomic.AddUint64(&g.lastDealID, 1)),
+	}
+}
+
+// checkPayment returns an error unless the retrieval is free or the client
+// presented a credential that pays for it
+func (g *HTTPGateway) checkPayment(r *http.Request, root cid.Cid, pieceCID cid.Cid, sel ipld.Node, ask retrievalmarket.Ask, params retrievalmarket.Params) error {
+	if params.IsFree() {
+		return nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if g.validateCredential == nil || !strings.HasPrefix(auth, "Bearer ") {
+		return httpErrorf(http.StatusPaymentRequired, "retrieval costs %s per byte plus %s to unseal", ask.PricePerByte, ask.UnsealPrice)
+	}
+	credential := strings.TrimPrefix(auth, "Bearer ")
+	err := g.validateCredential(r.Context(), HTTPRetrieval{
+		PayloadCID: root,
+		PieceCID:   pieceCID,
+		Selector:   sel,
+		Ask:        ask,
+		Credential: credential,
+	})
+	if err != nil {
+		return httpErrorf(http.StatusForbidden, "credential rejected: %w", err)
+	}
+	return nil
+}
+
+// unseal reads the data for a retrieval into the given blockstore, unsealing
+// only the selected blocks where it can
+func (g *HTTPGateway) unseal(ctx context.Context, root cid.Cid, sel ipld.Node, encodedSel *cbg.Deferred, pieceInfo piecestore.PieceInfo, bs blockstore.Blockstore) error {
+	if _, ok := g.p.partialUnsealSize(ctx, root, encodedSel, pieceInfo); ok {
+		// the retrieval was only priced for the selected blocks
+		unsealer := blockunsealer.NewUnsealer(ctx, g.p.node, g.p.pieceStore, pieceInfo)
+		if err := unsealer.UnsealSelected(ctx, root, sel, bs); err != nil {
+			return xerrors.Errorf("failed to unseal selected blocks of piece %s: %w", pieceInfo.PieceCID, err)
+		}
+		return nil
+	}
+
+	pde := &providerDealEnvironment{g.p}
+	reader, ok := pde.GetCachedPiece(pieceInfo.PieceCID)
+	if !ok {
+		var err error
+		reader, err = g.unsealPiece(ctx, pieceInfo)
+		if err != nil {
+			return err
+		}
+		reader = pde.CachePiece(pieceInfo, reader)
+	}
+	_, err := cario.NewCarIO().LoadCar(bs, reader)
+	// the CAR ends before the padding at the end of the piece, so drain the
+	// reader, both for the unsealing subsystem and so the piece gets cached
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, reader)
+	}
+	closeErr := reader.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// unsealPiece returns the data of the piece from the first of its sectors that
+// can be unsealed, preferring sectors that are already unsealed
+func (g *HTTPGateway) unsealPiece(ctx context.Context, pieceInfo piecestore.PieceInfo) (io.ReadCloser, error) {
+	deals := make([]piecestore.DealInfo, 0, len(pieceInfo.Deals))
+	for _, di := range pieceInfo.Deals {
+		isUnsealed, err := g.p.node.IsUnsealed(ctx, di.SectorID, di.Offset.Unpadded(), di.Length.Unpadded())
+		if err == nil && isUnsealed {
+			deals = append([]piecestore.DealInfo{di}, deals...)
+		} else {
+			deals = append(deals, di)
+		}
+	}
+
+	lastErr := xerrors.New("no sectors found to unseal from")
+	for _, di := range deals {
+		reader, err := g.p.node.UnsealSector(ctx, di.SectorID, di.Offset.Unpadded(), di.Length.Unpadded())
+		if err == nil {
+			return reader, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// parseRetrievalPath reads the payload CID and the selector to send from a
+// request for /ipfs/<payloadCID>[/<path>][?selector=<DAG-JSON selector>]
+func parseRetrievalPath(r *http.Request) (cid.Cid, ipld.Node, error) {
+	if !strings.HasPrefix(r.URL.Path, "/ipfs/") {
+		return cid.Undef, nil, xerrors.Errorf("path must start with /ipfs/")
+	}
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/ipfs/"), "/"), "/")
+	root, err := cid.Decode(segments[0])
+	if err != nil {
+		return cid.Undef, nil, xerrors.Errorf("invalid payload CID %s: %w", segments[0], err)
+	}
+
+	sel := shared.AllSelector()
+	if s := r.URL.Query().Get("selector"); s != "" {
+		nb := basicnode.Prototype.Any.NewBuilder()
+		if err := dagjson.Decoder(nb, strings.NewReader(s)); err != nil {
+			return cid.Undef, nil, xerrors.Errorf("decoding selector: %w", err)
+		}
+		sel = nb.Build()
+	}
+	if _, err := selector.ParseSelector(sel); err != nil {
+		return cid.Undef, nil, xerrors.Errorf("invalid selector: %w", err)
+	}
+
+	// wrap the selector so that it is applied at the end of the path
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	for i := len(segments) - 1; i > 0; i-- {
+		if segments[i] == "" {
+			return cid.Undef, nil, xerrors.Errorf("empty path segment in %s", r.URL.Path)
+		}
+		next := sel
+		field := segments[i]
+		sel = ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert(field, explicitSelector{next})
+		}).Node()
+	}
+	return root, sel, nil
+}
+
+// explicitSelector adapts an already built selector node for use with the
+// selector builder
+type explicitSelector struct {
+	node ipld.Node
+}
+
+func (s explicitSelector) Node() ipld.Node {
+	return s.node
+}
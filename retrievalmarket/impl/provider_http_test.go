@@ -0,0 +1,215 @@
+package retrievalimpl_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-car"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-multistore"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	spect "github.com/filecoin-project/specs-actors/support/testing"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	retrievalimpl "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dealscheduler"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestHTTPGateway(t *testing.T) {
+	ctx := context.Background()
+	tree := tut.NewTestIPLDTree()
+	payloadCID := tree.RootNodeLnk.(cidlink.Link).Cid
+	var carData bytes.Buffer
+	require.NoError(t, tree.DumpToCar(&carData))
+
+	pieceCID := tut.GenerateCids(1)[0]
+	deal := piecestore.DealInfo{
+		DealID:   abi.DealID(10),
+		SectorID: abi.SectorNumber(20),
+		Offset:   abi.PaddedPieceSize(0),
+		Length:   abi.PaddedPieceSize(1 << 20),
+	}
+
+	setupProvider := func(t *testing.T, ask retrievalmarket.Ask, providerOptions []retrievalimpl.RetrievalProviderOption, options ...retrievalimpl.HTTPGatewayOption) (*httptest.Server, retrievalmarket.RetrievalProvider) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.StubUnseal(deal.SectorID, deal.Offset.Unpadded(), deal.Length.Unpadded(), carData.Bytes())
+		pieceStore := tut.NewTestPieceStore()
+		pieceStore.StubCID(payloadCID, piecestore.CIDInfo{
+			PieceBlockLocations: []piecestore.PieceBlockLocation{{PieceCID: pieceCID}},
+		})
+		pieceStore.StubPiece(pieceCID, piecestore.PieceInfo{PieceCID: pieceCID, Deals: []piecestore.DealInfo{deal}})
+
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		multiStore, err := multistore.NewMultiDstore(ds)
+		require.NoError(t, err)
+		priceFunc := func(ctx context.Context, input retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+			return ask, nil
+		}
+		providerOptions = append([]retrievalimpl.RetrievalProviderOption{
+			retrievalimpl.DealDeciderOpt(func(ctx context.Context, state retrievalmarket.ProviderDealState) (bool, string, error) {
+				if state.PricePerByte.GreaterThan(abi.NewTokenAmount(100)) {
+					return false, "too expensive", nil
+				}
+				return true, "", nil
+			}),
+		}, providerOptions...)
+		provider, err := retrievalimpl.NewProvider(spect.NewIDAddr(t, 2344), node,
+			tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{}), pieceStore, multiStore,
+			tut.NewTestDataTransfer(), ds, priceFunc, providerOptions...)
+		require.NoError(t, err)
+		tut.StartAndWaitForReady(ctx, t, provider)
+
+		gateway, err := retrievalimpl.NewHTTPGateway(provider, options...)
+		require.NoError(t, err)
+		server := httptest.NewServer(gateway)
+		t.Cleanup(server.Close)
+		return server, provider
+	}
+
+	setup := func(t *testing.T, ask retrievalmarket.Ask, options ...retrievalimpl.HTTPGatewayOption) *httptest.Server {
+		server, _ := setupProvider(t, ask, nil, options...)
+		return server
+	}
+
+	get := func(t *testing.T, target string, credential string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		require.NoError(t, err)
+		if credential != "" {
+			req.Header.Set("Authorization", "Bearer "+credential)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	readCar := func(t *testing.T, body io.Reader) []cid.Cid {
+		cr, err := car.NewCarReader(body)
+		require.NoError(t, err)
+		require.Equal(t, []cid.Cid{payloadCID}, cr.Header.Roots)
+		var received []cid.Cid
+		for {
+			blk, err := cr.Next()
+			if err == io.EOF {
+				return received
+			}
+			require.NoError(t, err)
+			received = append(received, blk.Cid())
+		}
+	}
+
+	free := retrievalmarket.Ask{PricePerByte: big.Zero(), UnsealPrice: big.Zero()}
+	priced := retrievalmarket.Ask{PricePerByte: abi.NewTokenAmount(1), UnsealPrice: big.Zero()}
+
+	t.Run("serves free content as a CAR", func(t *testing.T) {
+		server := setup(t, free)
+		resp := get(t, server.URL+"/ipfs/"+payloadCID.String(), "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/vnd.ipld.car", resp.Header.Get("Content-Type"))
+		require.ElementsMatch(t, []cid.Cid{
+			payloadCID,
+			tree.LeafAlphaBlock.Cid(),
+			tree.MiddleMapBlock.Cid(),
+			tree.MiddleListBlock.Cid(),
+			tree.LeafBetaBlock.Cid(),
+		}, readCar(t, resp.Body))
+	})
+
+	t.Run("follows a path", func(t *testing.T) {
+		server := setup(t, free)
+		resp := get(t, server.URL+"/ipfs/"+payloadCID.String()+"/linkedMap/nested", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.ElementsMatch(t, []cid.Cid{
+			payloadCID,
+			tree.MiddleMapBlock.Cid(),
+			tree.LeafAlphaBlock.Cid(),
+		}, readCar(t, resp.Body))
+	})
+
+	t.Run("applies a selector", func(t *testing.T) {
+		server := setup(t, free)
+		// match the root node without following any links
+		sel := url.QueryEscape(`{".":{}}`)
+		resp := get(t, server.URL+"/ipfs/"+payloadCID.String()+"?selector="+sel, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, []cid.Cid{payloadCID}, readCar(t, resp.Body))
+	})
+
+	t.Run("rejects bad requests", func(t *testing.T) {
+		server := setup(t, free)
+		resp := get(t, server.URL+"/ipfs/notacid", "")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp = get(t, server.URL+"/ipfs/"+payloadCID.String()+"?selector=nope", "")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp = get(t, server.URL+"/ipfs/"+tut.GenerateCids(1)[0].String(), "")
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("requires a credential for priced content", func(t *testing.T) {
+		server := setup(t, priced, retrievalimpl.CredentialValidatorOpt(func(ctx context.Context, retrieval retrievalimpl.HTTPRetrieval) error {
+			return nil
+		}))
+		resp := get(t, server.URL+"/ipfs/"+payloadCID.String(), "")
+		require.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	})
+
+	t.Run("serves priced content to clients with a valid credential", func(t *testing.T) {
+		var validated []retrievalimpl.HTTPRetrieval
+		server := setup(t, priced, retrievalimpl.CredentialValidatorOpt(func(ctx context.Context, retrieval retrievalimpl.HTTPRetrieval) error {
+			validated = append(validated, retrieval)
+			if retrieval.Credential != "prepaid" {
+				return errors.New("unknown credential")
+			}
+			return nil
+		}))
+
+		resp := get(t, server.URL+"/ipfs/"+payloadCID.String(), "stolen")
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp = get(t, server.URL+"/ipfs/"+payloadCID.String(), "prepaid")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, readCar(t, resp.Body), 5)
+
+		require.Len(t, validated, 2)
+		require.Equal(t, payloadCID, validated[1].PayloadCID)
+		require.Equal(t, pieceCID, validated[1].PieceCID)
+		require.Equal(t, priced, validated[1].Ask)
+	})
+
+	t.Run("runs the deal decider", func(t *testing.T) {
+		expensive := retrievalmarket.Ask{PricePerByte: abi.NewTokenAmount(1000), UnsealPrice: big.Zero()}
+		server := setup(t, expensive, retrievalimpl.CredentialValidatorOpt(func(ctx context.Context, retrieval retrievalimpl.HTTPRetrieval) error {
+			return nil
+		}))
+		resp := get(t, server.URL+"/ipfs/"+payloadCID.String(), "prepaid")
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+	t.Run("takes a slot in the deal queue while serving", func(t *testing.T) {
+		server, provider := setupProvider(t, free, []retrievalimpl.RetrievalProviderOption{
+			retrievalimpl.DealSchedulerLimits(dealscheduler.Limits{MaxConcurrentTransfers: 1}),
+		})
+		for i := 0; i < 2; i++ {
+			resp := get(t, server.URL+"/ipfs/"+payloadCID.String(), "")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Len(t, readCar(t, resp.Body), 5)
+		}
+		stats := provider.(*retrievalimpl.Provider).QueueStats()
+		require.Equal(t, uint64(2), stats.TotalStarted)
+		require.Equal(t, 0, stats.Active)
+	})
+}
@@ -13,10 +13,13 @@ import (
 	"github.com/ipfs/go-datastore/namespace"
 	dss "github.com/ipfs/go-datastore/sync"
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -35,6 +38,7 @@ import (
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared"
 	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/blockrecorder"
 )
 
 func TestDynamicPricing(t *testing.T) {
@@ -607,6 +611,33 @@ func TestDynamicPricing(t *testing.T) {
 	}
 }
 
+func TestDefaultPricingFuncUnsealSize(t *testing.T) {
+	ctx := context.Background()
+	currentAsk := retrievalmarket.Ask{
+		PricePerByte: abi.NewTokenAmount(1),
+		UnsealPrice:  abi.NewTokenAmount(1000),
+	}
+	pricingFunc := retrievalimpl.DefaultPricingFunc(false)
+
+	t.Run("charges the full unseal price for the whole piece", func(t *testing.T) {
+		ask, err := pricingFunc(ctx, retrievalmarket.PricingInput{PieceSize: 1024, CurrentAsk: currentAsk})
+		require.NoError(t, err)
+		require.Equal(t, currentAsk.UnsealPrice, ask.UnsealPrice)
+	})
+
+	t.Run("scales the unseal price to the part of the piece unsealed", func(t *testing.T) {
+		ask, err := pricingFunc(ctx, retrievalmarket.PricingInput{PieceSize: 1024, UnsealSize: 256, CurrentAsk: currentAsk})
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(250), ask.UnsealPrice)
+	})
+
+	t.Run("does not charge to unseal an unsealed piece", func(t *testing.T) {
+		ask, err := pricingFunc(ctx, retrievalmarket.PricingInput{PieceSize: 1024, UnsealSize: 256, Unsealed: true, CurrentAsk: currentAsk})
+		require.NoError(t, err)
+		require.True(t, ask.UnsealPrice.IsZero())
+	})
+}
+
 func TestHandleQueryStream(t *testing.T) {
 	ctx := context.Background()
 
@@ -753,6 +784,77 @@ func TestHandleQueryStream(t *testing.T) {
 			expectedUnsealPrice:             expectedUnsealDiscount,
 		},
 
+		{name: "When the price is above the client's maximum",
+			expFunc: func(t *testing.T, pieceStore *tut.TestPieceStore) {
+				loadPieceCIDS(t, pieceStore, payloadCID, expectedPieceCID)
+			},
+			query: retrievalmarket.Query{
+				PayloadCID: payloadCID,
+				QueryParams: retrievalmarket.QueryParams{
+					PieceCID:        &expectedPieceCID,
+					MaxPricePerByte: abi.NewTokenAmount(1000),
+				},
+			},
+			expResp: retrievalmarket.QueryResponse{
+				Status:        retrievalmarket.QueryResponseTermsUnacceptable,
+				PieceCIDFound: retrievalmarket.QueryItemAvailable,
+				Size:          expectedSize,
+				Message:       "price per byte 4321 is more than the maximum 1000",
+			},
+			expectedPricePerByte:            expectedPricePerByte,
+			expectedPaymentInterval:         expectedPaymentInterval,
+			expectedPaymentIntervalIncrease: expectedPaymentIntervalIncrease,
+			expectedUnsealPrice:             expectedUnsealPrice,
+		},
+
+		{name: "When the payment interval is below the client's minimum",
+			expFunc: func(t *testing.T, pieceStore *tut.TestPieceStore) {
+				loadPieceCIDS(t, pieceStore, payloadCID, expectedPieceCID)
+			},
+			query: retrievalmarket.Query{
+				PayloadCID: payloadCID,
+				QueryParams: retrievalmarket.QueryParams{
+					PieceCID:           &expectedPieceCID,
+					MaxPricePerByte:    abi.NewTokenAmount(5000),
+					MinPaymentInterval: expectedPaymentInterval + 1,
+				},
+			},
+			expResp: retrievalmarket.QueryResponse{
+				Status:        retrievalmarket.QueryResponseTermsUnacceptable,
+				PieceCIDFound: retrievalmarket.QueryItemAvailable,
+				Size:          expectedSize,
+				Message:       "payment interval 4567 is less than the minimum 4568",
+			},
+			expectedPricePerByte:            expectedPricePerByte,
+			expectedPaymentInterval:         expectedPaymentInterval,
+			expectedPaymentIntervalIncrease: expectedPaymentIntervalIncrease,
+			expectedUnsealPrice:             expectedUnsealPrice,
+		},
+
+		{name: "When the terms are within the client's limits",
+			expFunc: func(t *testing.T, pieceStore *tut.TestPieceStore) {
+				loadPieceCIDS(t, pieceStore, payloadCID, expectedPieceCID)
+			},
+			query: retrievalmarket.Query{
+				PayloadCID: payloadCID,
+				QueryParams: retrievalmarket.QueryParams{
+					PieceCID:                   &expectedPieceCID,
+					MaxPricePerByte:            expectedPricePerByte,
+					MinPaymentInterval:         expectedPaymentInterval,
+					MinPaymentIntervalIncrease: expectedPaymentIntervalIncrease,
+				},
+			},
+			expResp: retrievalmarket.QueryResponse{
+				Status:        retrievalmarket.QueryResponseAvailable,
+				PieceCIDFound: retrievalmarket.QueryItemAvailable,
+				Size:          expectedSize,
+			},
+			expectedPricePerByte:            expectedPricePerByte,
+			expectedPaymentInterval:         expectedPaymentInterval,
+			expectedPaymentIntervalIncrease: expectedPaymentIntervalIncrease,
+			expectedUnsealPrice:             expectedUnsealPrice,
+		},
+
 		{name: "When PieceCID is provided and both PieceCID and PayloadCID are found",
 			expFunc: func(t *testing.T, pieceStore *tut.TestPieceStore) {
 				loadPieceCIDS(t, pieceStore, payloadCID, expectedPieceCID)
@@ -897,6 +999,148 @@ func TestHandleQueryStream(t *testing.T) {
 
 }
 
+func TestHandleQueryStreamWithSelector(t *testing.T) {
+	ctx := context.Background()
+	tree := tut.NewTestIPLDTree()
+	payloadCID := tree.RootBlock.Cid()
+
+	carBuf := new(bytes.Buffer)
+	locationsBuf := new(bytes.Buffer)
+	require.NoError(t, tree.DumpToCar(carBuf, blockrecorder.RecordEachBlockTo(locationsBuf)))
+	metadata, err := blockrecorder.ReadBlockMetadata(locationsBuf)
+	require.NoError(t, err)
+	carData := carBuf.Bytes()
+
+	pieceCID := tut.GenerateCids(1)[0]
+	deal := piecestore.DealInfo{
+		DealID:   abi.DealID(10),
+		SectorID: abi.SectorNumber(1),
+		Offset:   abi.PaddedPieceSize(1024),
+		Length:   abi.PaddedPieceSize(1024),
+	}
+	pieceInfo := piecestore.PieceInfo{PieceCID: pieceCID, Deals: []piecestore.DealInfo{deal}}
+	locations := make(map[cid.Cid]piecestore.BlockLocation)
+	for _, md := range metadata {
+		locations[md.CID] = piecestore.BlockLocation{RelOffset: md.Offset, BlockSize: md.Size}
+	}
+
+	// the piece store records the location of each block in the piece, except
+	// those in missing
+	newPieceStore := func(missing ...cid.Cid) *tut.TestPieceStore {
+		pieceStore := tut.NewTestPieceStore()
+		pieceStore.StubPiece(pieceCID, pieceInfo)
+		for c, loc := range locations {
+			pieceBlockLocation := piecestore.PieceBlockLocation{BlockLocation: loc, PieceCID: pieceCID}
+			for _, m := range missing {
+				if m.Equals(c) {
+					pieceBlockLocation.PieceCID = tut.GenerateCids(1)[0]
+				}
+			}
+			pieceStore.StubCID(c, piecestore.CIDInfo{
+				CID:                 c,
+				PieceBlockLocations: []piecestore.PieceBlockLocation{pieceBlockLocation},
+			})
+		}
+		return pieceStore
+	}
+
+	// the node has an unsealed copy of the piece if unsealed is true
+	newNode := func(unsealed bool) *testnodes.TestRetrievalProviderNode {
+		node := testnodes.NewTestRetrievalProviderNode()
+		if unsealed {
+			node.MarkUnsealed(ctx, deal.SectorID, deal.Offset.Unpadded(), deal.Length.Unpadded())
+		}
+		for _, loc := range locations {
+			node.StubUnseal(deal.SectorID, deal.Offset.Unpadded()+abi.UnpaddedPieceSize(loc.RelOffset),
+				abi.UnpaddedPieceSize(loc.BlockSize), carData[loc.RelOffset:loc.RelOffset+loc.BlockSize])
+		}
+		return node
+	}
+
+	expectedPricePerByte := abi.NewTokenAmount(2)
+	expectedUnsealPrice := abi.NewTokenAmount(100)
+	query := func(t *testing.T, node *testnodes.TestRetrievalProviderNode, pieceStore piecestore.PieceStore, q retrievalmarket.Query) retrievalmarket.QueryResponse {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		multiStore, err := multistore.NewMultiDstore(ds)
+		require.NoError(t, err)
+		dt := tut.NewTestDataTransfer()
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+		priceFunc := func(ctx context.Context, dealPricingParams retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+			return retrievalmarket.Ask{
+				PricePerByte: expectedPricePerByte,
+				UnsealPrice:  expectedUnsealPrice,
+			}, nil
+		}
+		p, err := retrievalimpl.NewProvider(address.TestAddress2, node, net, pieceStore, multiStore, dt, ds, priceFunc)
+		require.NoError(t, err)
+		tut.StartAndWaitForReady(ctx, t, p)
+
+		qRead, qWrite := tut.QueryReadWriter()
+		qrRead, qrWrite := tut.QueryResponseReadWriter()
+		qs := tut.NewTestRetrievalQueryStream(tut.TestQueryStreamParams{
+			PeerID:     peer.ID("somepeer"),
+			Reader:     qRead,
+			Writer:     qWrite,
+			RespReader: qrRead,
+			RespWriter: qrWrite,
+		})
+		require.NoError(t, qs.WriteQuery(q))
+		net.ReceiveQueryStream(qs)
+
+		resp, err := qs.ReadQueryResponse()
+		require.NoError(t, err)
+		require.Equal(t, retrievalmarket.QueryResponseAvailable, resp.Status)
+		return resp
+	}
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("linkedMap", ssb.Matcher())
+	}).Node()
+	selQuery, err := retrievalmarket.NewQueryV1WithSelector(payloadCID, nil, sel)
+	require.NoError(t, err)
+
+	t.Run("measures the selection of an unsealed piece", func(t *testing.T) {
+		resp := query(t, newNode(true), newPieceStore(), selQuery)
+		require.Equal(t, retrievalmarket.SelectorAvailable, resp.SelectorFound)
+		expectedSize := locations[tree.RootBlock.Cid()].BlockSize + locations[tree.MiddleMapBlock.Cid()].BlockSize
+		require.Equal(t, expectedSize, resp.ExpectedPayloadSize)
+		require.Equal(t, uint64(deal.Length.Unpadded()), resp.Size)
+		expectedPrice := big.Add(big.Mul(expectedPricePerByte, abi.NewTokenAmount(int64(expectedSize))), expectedUnsealPrice)
+		require.Equal(t, expectedPrice, resp.PayloadRetrievalPrice())
+	})
+
+	t.Run("reports a selected block missing from the piece", func(t *testing.T) {
+		resp := query(t, newNode(true), newPieceStore(tree.MiddleMapBlock.Cid()), selQuery)
+		require.Equal(t, retrievalmarket.SelectorUnavailable, resp.SelectorFound)
+		require.Zero(t, resp.ExpectedPayloadSize)
+	})
+
+	t.Run("estimates the selection of a sealed piece without unsealing", func(t *testing.T) {
+		node := newNode(false)
+		node.ExpectPricingParams(pieceCID, []abi.DealID{deal.DealID})
+		resp := query(t, node, newPieceStore(), selQuery)
+		require.Equal(t, retrievalmarket.SelectorUnknown, resp.SelectorFound)
+		expectedSize := uint64(deal.Length.Unpadded()) - locations[payloadCID].RelOffset
+		require.Equal(t, expectedSize, resp.ExpectedPayloadSize)
+		node.VerifyExpectations(t)
+	})
+
+	t.Run("rejects an invalid selector", func(t *testing.T) {
+		q := retrievalmarket.Query{
+			PayloadCID:  payloadCID,
+			QueryParams: retrievalmarket.QueryParams{Selector: &cbg.Deferred{Raw: []byte{0x80}}},
+		}
+		resp := query(t, newNode(true), newPieceStore(), q)
+		require.Equal(t, retrievalmarket.SelectorUnavailable, resp.SelectorFound)
+	})
+
+	t.Run("leaves responses without a selector unchanged", func(t *testing.T) {
+		resp := query(t, newNode(true), newPieceStore(), retrievalmarket.NewQueryV0(payloadCID))
+		require.Zero(t, resp.ExpectedPayloadSize)
+	})
+}
+
 func TestProvider_Construct(t *testing.T) {
 	ds := datastore.NewMapDatastore()
 	multiStore, err := multistore.NewMultiDstore(ds)
@@ -1196,3 +1440,204 @@ func TestProviderMigrations(t *testing.T) {
 		require.Equal(t, expectedDeal, deal)
 	}
 }
+
+func TestProviderDealManagement(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	multiStore, err := multistore.NewMultiDstore(ds)
+	require.NoError(t, err)
+	providerDs := namespace.Wrap(ds, datastore.NewKey("/retrievals/provider"))
+
+	selfPeer := tut.GeneratePeers(1)[0]
+	clients := tut.GeneratePeers(2)
+	statuses := []retrievalmarket.DealStatus{
+		retrievalmarket.DealStatusCompleted,
+		retrievalmarket.DealStatusFundsNeeded,
+		retrievalmarket.DealStatusOngoing,
+	}
+	dealIDs := make([]retrievalmarket.ProviderDealIdentifier, len(statuses))
+	for i, status := range statuses {
+		storeID := multiStore.Next()
+		_, err := multiStore.Get(storeID)
+		require.NoError(t, err)
+		receiver := clients[i%2]
+		dealIDs[i] = retrievalmarket.ProviderDealIdentifier{Receiver: receiver, DealID: retrievalmarket.DealID(i)}
+		deal := migrations.ProviderDealState0{
+			DealProposal0: migrations.DealProposal0{
+				PayloadCID: tut.GenerateCids(1)[0],
+				ID:         retrievalmarket.DealID(i),
+				Params0: migrations.Params0{
+					PricePerByte: abi.NewTokenAmount(1),
+					UnsealPrice:  big.Zero(),
+				},
+			},
+			StoreID: storeID,
+			ChannelID: datatransfer.ChannelID{
+				Responder: selfPeer,
+				Initiator: receiver,
+				ID:        datatransfer.TransferID(i),
+			},
+			Status:        status,
+			Receiver:      receiver,
+			FundsReceived: big.Zero(),
+		}
+		buf := new(bytes.Buffer)
+		require.NoError(t, deal.MarshalCBOR(buf))
+		require.NoError(t, providerDs.Put(datastore.NewKey(fmt.Sprint(deal.ID)), buf.Bytes()))
+	}
+
+	priceFunc := func(ctx context.Context, dealPricingParams retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+		return retrievalmarket.Ask{}, nil
+	}
+	provider, err := retrievalimpl.NewProvider(
+		spect.NewIDAddr(t, 2344),
+		testnodes.NewTestRetrievalProviderNode(),
+		tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{}),
+		tut.NewTestPieceStore(),
+		multiStore,
+		tut.NewTestDataTransfer(),
+		providerDs,
+		priceFunc,
+	)
+	require.NoError(t, err)
+	tut.StartAndWaitForReady(ctx, t, provider)
+
+	t.Run("get deal", func(t *testing.T) {
+		deal, err := provider.GetDeal(dealIDs[1])
+		require.NoError(t, err)
+		require.Equal(t, retrievalmarket.DealStatusFundsNeeded, deal.Status)
+
+		_, err = provider.GetDeal(retrievalmarket.ProviderDealIdentifier{Receiver: clients[0], DealID: 100})
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+	})
+
+	t.Run("filter deals", func(t *testing.T) {
+		identifiers := func(deals []retrievalmarket.ProviderDealState) []retrievalmarket.ProviderDealIdentifier {
+			ids := make([]retrievalmarket.ProviderDealIdentifier, 0, len(deals))
+			for _, deal := range deals {
+				ids = append(ids, deal.Identifier())
+			}
+			return ids
+		}
+
+		deals, err := provider.FilterDeals(retrievalmarket.ProviderDealFilter{})
+		require.NoError(t, err)
+		require.Len(t, deals, 3)
+
+		deals, err = provider.FilterDeals(retrievalmarket.ProviderDealFilter{
+			Statuses: []retrievalmarket.DealStatus{retrievalmarket.DealStatusFundsNeeded, retrievalmarket.DealStatusOngoing},
+		})
+		require.NoError(t, err)
+		require.ElementsMatch(t, dealIDs[1:], identifiers(deals))
+
+		deals, err = provider.FilterDeals(retrievalmarket.ProviderDealFilter{Client: clients[0]})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []retrievalmarket.ProviderDealIdentifier{dealIDs[0], dealIDs[2]}, identifiers(deals))
+
+		all, err := provider.FilterDeals(retrievalmarket.ProviderDealFilter{})
+		require.NoError(t, err)
+		deals, err = provider.FilterDeals(retrievalmarket.ProviderDealFilter{Offset: 1, Limit: 1})
+		require.NoError(t, err)
+		require.Equal(t, all[1:2], deals)
+
+		deals, err = provider.FilterDeals(retrievalmarket.ProviderDealFilter{Offset: 3})
+		require.NoError(t, err)
+		require.Empty(t, deals)
+	})
+
+	t.Run("cancel deal", func(t *testing.T) {
+		err := provider.CancelDeal(dealIDs[0], "too late")
+		require.Error(t, err)
+
+		cancelled := make(chan retrievalmarket.ProviderDealState, 1)
+		unsubscribe := provider.SubscribeToEvents(func(event retrievalmarket.ProviderEvent, state retrievalmarket.ProviderDealState) {
+			if state.Status == retrievalmarket.DealStatusCancelled {
+				cancelled <- state
+			}
+		})
+		defer unsubscribe()
+
+		require.NoError(t, provider.CancelDeal(dealIDs[1], "abusive client"))
+		select {
+		case <-ctx.Done():
+			t.Fatal("deal was not cancelled")
+		case deal := <-cancelled:
+			require.Equal(t, dealIDs[1], deal.Identifier())
+			require.Equal(t, "Provider cancelled retrieval: abusive client", deal.Message)
+		}
+	})
+}
+
+func TestProviderRestoresQueuedDeals(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	multiStore, err := multistore.NewMultiDstore(ds)
+	require.NoError(t, err)
+	providerDs := namespace.Wrap(ds, datastore.NewKey("/retrievals/provider"))
+
+	selfPeer := tut.GeneratePeers(1)[0]
+	client := tut.GeneratePeers(1)[0]
+	storeID := multiStore.Next()
+	_, err = multiStore.Get(storeID)
+	require.NoError(t, err)
+	deal := migrations.ProviderDealState0{
+		DealProposal0: migrations.DealProposal0{
+			PayloadCID: tut.GenerateCids(1)[0],
+			ID:         retrievalmarket.DealID(1),
+			Params0: migrations.Params0{
+				PricePerByte: abi.NewTokenAmount(1),
+				UnsealPrice:  big.Zero(),
+			},
+		},
+		StoreID: storeID,
+		ChannelID: datatransfer.ChannelID{
+			Responder: selfPeer,
+			Initiator: client,
+			ID:        datatransfer.TransferID(1),
+		},
+		PieceInfo:     &piecemigrations.PieceInfo0{PieceCID: tut.GenerateCids(1)[0]},
+		Status:        retrievalmarket.DealStatusQueued,
+		Receiver:      client,
+		FundsReceived: big.Zero(),
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, deal.MarshalCBOR(buf))
+	require.NoError(t, providerDs.Put(datastore.NewKey(fmt.Sprint(deal.ID)), buf.Bytes()))
+
+	priceFunc := func(ctx context.Context, dealPricingParams retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+		return retrievalmarket.Ask{}, nil
+	}
+	provider, err := retrievalimpl.NewProvider(
+		spect.NewIDAddr(t, 2344),
+		testnodes.NewTestRetrievalProviderNode(),
+		tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{}),
+		tut.NewTestPieceStore(),
+		multiStore,
+		tut.NewTestDataTransfer(),
+		providerDs,
+		priceFunc,
+	)
+	require.NoError(t, err)
+
+	// the deal was waiting in the queue when the provider stopped, so it is
+	// started once the provider starts again
+	dequeued := make(chan retrievalmarket.ProviderDealState, 1)
+	unsubscribe := provider.SubscribeToEvents(func(event retrievalmarket.ProviderEvent, state retrievalmarket.ProviderDealState) {
+		if event == retrievalmarket.ProviderEventDequeued {
+			dequeued <- state
+		}
+	})
+	defer unsubscribe()
+	tut.StartAndWaitForReady(ctx, t, provider)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("queued deal was not started")
+	case state := <-dequeued:
+		require.Equal(t, retrievalmarket.ProviderDealIdentifier{Receiver: client, DealID: deal.ID}, state.Identifier())
+	}
+}
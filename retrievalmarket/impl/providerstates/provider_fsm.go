@@ -1,6 +1,8 @@
 package providerstates
 
 import (
+	"fmt"
+
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
@@ -31,12 +33,16 @@ var ProviderEvents = fsm.Events{
 	// accepting
 	fsm.Event(rm.ProviderEventDealAccepted).
 		From(rm.DealStatusFundsNeededUnseal).ToNoChange().
-		From(rm.DealStatusNew).To(rm.DealStatusUnsealing).
+		From(rm.DealStatusNew).To(rm.DealStatusQueued).
 		Action(func(deal *rm.ProviderDealState, channelID datatransfer.ChannelID) error {
 			deal.ChannelID = &channelID
 			return nil
 		}),
 
+	// waiting for capacity
+	fsm.Event(rm.ProviderEventDequeued).
+		From(rm.DealStatusQueued).To(rm.DealStatusUnsealing),
+
 	//unsealing
 	fsm.Event(rm.ProviderEventUnsealError).
 		From(rm.DealStatusUnsealing).To(rm.DealStatusFailing).
@@ -79,7 +85,7 @@ var ProviderEvents = fsm.Events{
 	fsm.Event(rm.ProviderEventPaymentReceived).
 		From(rm.DealStatusFundsNeeded).To(rm.DealStatusOngoing).
 		From(rm.DealStatusFundsNeededLastPayment).To(rm.DealStatusFinalizing).
-		From(rm.DealStatusFundsNeededUnseal).To(rm.DealStatusUnsealing).
+		From(rm.DealStatusFundsNeededUnseal).To(rm.DealStatusQueued).
 		FromMany(rm.DealStatusBlocksComplete, rm.DealStatusOngoing, rm.DealStatusFinalizing).ToJustRecord().
 		Action(func(deal *rm.ProviderDealState, fundsReceived abi.TokenAmount) error {
 			deal.FundsReceived = big.Add(deal.FundsReceived, fundsReceived)
@@ -102,6 +108,8 @@ var ProviderEvents = fsm.Events{
 
 	// data transfer errors
 	fsm.Event(rm.ProviderEventDataTransferError).
+		// the transfer ends with an error once a cancelled client is told why
+		From(rm.DealStatusCancelling).ToJustRecord().
 		FromAny().To(rm.DealStatusErrored).
 		Action(recordError),
 
@@ -121,11 +129,24 @@ var ProviderEvents = fsm.Events{
 			return nil
 		},
 	),
+
+	fsm.Event(rm.ProviderEventProviderCancelled).
+		From(rm.DealStatusFailing).ToJustRecord().
+		From(rm.DealStatusCancelling).ToJustRecord().
+		FromAny().To(rm.DealStatusCancelling).Action(
+		func(deal *rm.ProviderDealState, reason string) error {
+			if deal.Status != rm.DealStatusFailing && deal.Status != rm.DealStatusCancelling {
+				deal.Message = fmt.Sprintf("Provider cancelled retrieval: %s", reason)
+			}
+			return nil
+		},
+	),
 }
 
 // ProviderStateEntryFuncs are the handlers for different states in a retrieval provider
 var ProviderStateEntryFuncs = fsm.StateEntryFuncs{
 	rm.DealStatusFundsNeededUnseal: TrackTransfer,
+	rm.DealStatusQueued:            QueueDeal,
 	rm.DealStatusUnsealing:         UnsealData,
 	rm.DealStatusUnsealed:          UnpauseDeal,
 	rm.DealStatusFailing:           CancelDeal,
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 
+	"github.com/ipfs/go-cid"
 	"golang.org/x/xerrors"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -22,8 +23,25 @@ type ProviderDealEnvironment interface {
 	// Node returns the node interface for this deal
 	Node() rm.RetrievalProviderNode
 	ReadIntoBlockstore(storeID multistore.StoreID, pieceData io.ReadCloser) error
+	// UnsealSelected unseals only the blocks reached by the deal's selector into
+	// the deal's blockstore. It returns false if the whole piece must be unsealed
+	// instead, and an error if the deal was priced for a partial unseal that
+	// fails.
+	UnsealSelected(ctx context.Context, deal rm.ProviderDealState) (bool, error)
+	// GetCachedPiece returns a reader for the unsealed data of the given piece,
+	// if the piece is held in the piece cache
+	GetCachedPiece(pieceCID cid.Cid) (io.ReadCloser, bool)
+	// CachePiece wraps a reader for unsealed piece data, so that the piece is
+	// added to the piece cache as it is read
+	CachePiece(pieceInfo piecestore.PieceInfo, pieceData io.ReadCloser) io.ReadCloser
+	// QueueDeal adds the deal to the queue of deals waiting for capacity to
+	// unseal and send data
+	QueueDeal(deal rm.ProviderDealState)
 	TrackTransfer(deal rm.ProviderDealState) error
 	UntrackTransfer(deal rm.ProviderDealState) error
+	// WaitForCancelResponse waits for the response telling the client that the
+	// provider has cancelled the deal to be sent, if the provider cancelled it
+	WaitForCancelResponse(ctx context.Context, deal rm.ProviderDealState)
 	DeleteStore(storeID multistore.StoreID) error
 	ResumeDataTransfer(context.Context, datatransfer.ChannelID) error
 	CloseDataTransfer(context.Context, datatransfer.ChannelID) error
@@ -57,13 +75,33 @@ func firstSuccessfulUnseal(ctx context.Context, node rm.RetrievalProviderNode, p
 	return nil, lastErr
 }
 
+// QueueDeal waits for the provider to have capacity to unseal and send the deal's data
+func QueueDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) error {
+	environment.QueueDeal(deal)
+	return nil
+}
+
 // UnsealData unseals the piece containing data for retrieval as needed
 func UnsealData(ctx fsm.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) error {
-	reader, err := firstSuccessfulUnseal(ctx.Context(), environment.Node(), *deal.PieceInfo)
-	if err != nil {
-		return ctx.Trigger(rm.ProviderEventUnsealError, err)
+	// serve the piece from the piece cache if it's there, otherwise unseal it
+	reader, ok := environment.GetCachedPiece(deal.PieceInfo.PieceCID)
+	if !ok {
+		// for selector retrievals, try to unseal just the parts of the piece needed
+		unsealed, err := environment.UnsealSelected(ctx.Context(), deal)
+		if err != nil {
+			return ctx.Trigger(rm.ProviderEventUnsealError, err)
+		}
+		if unsealed {
+			return ctx.Trigger(rm.ProviderEventUnsealComplete)
+		}
+
+		reader, err = firstSuccessfulUnseal(ctx.Context(), environment.Node(), *deal.PieceInfo)
+		if err != nil {
+			return ctx.Trigger(rm.ProviderEventUnsealError, err)
+		}
+		reader = environment.CachePiece(*deal.PieceInfo, reader)
 	}
-	err = environment.ReadIntoBlockstore(deal.StoreID, reader)
+	err := environment.ReadIntoBlockstore(deal.StoreID, reader)
 	if err != nil {
 		return ctx.Trigger(rm.ProviderEventUnsealError, err)
 	}
@@ -96,6 +134,10 @@ func UnpauseDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal rm.P
 
 // CancelDeal clears a deal that went wrong for an unknown reason
 func CancelDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) error {
+	// if the provider cancelled the deal, give the client a chance to hear why
+	// before the transfer is closed
+	environment.WaitForCancelResponse(ctx.Context(), deal)
+
 	// Read next response (or fail)
 	err := environment.UntrackTransfer(deal)
 	if err != nil {
@@ -1,11 +1,15 @@
 package providerstates_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
+	"github.com/ipfs/go-cid"
 	"github.com/stretchr/testify/require"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -94,6 +98,52 @@ func TestUnsealData(t *testing.T) {
 		require.Equal(t, dealState.Status, rm.DealStatusUnsealed)
 	})
 
+	t.Run("serves from the piece cache if the piece is cached", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		dealState := makeDeals()
+		setupEnv := func(fe *rmtesting.TestProviderDealEnvironment) {
+			fe.CachedPieces = map[cid.Cid]io.ReadCloser{
+				pieceCid: ioutil.NopCloser(bytes.NewReader(data)),
+			}
+		}
+		runUnsealData(t, node, setupEnv, dealState)
+		require.Equal(t, dealState.Status, rm.DealStatusUnsealed)
+	})
+
+	t.Run("caches the piece after unsealing", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		node.ExpectUnseal(sectorID, offset.Unpadded(), length.Unpadded(), data)
+		dealState := makeDeals()
+		var env *rmtesting.TestProviderDealEnvironment
+		setupEnv := func(fe *rmtesting.TestProviderDealEnvironment) {
+			env = fe
+		}
+		runUnsealData(t, node, setupEnv, dealState)
+		require.Equal(t, dealState.Status, rm.DealStatusUnsealed)
+		require.Equal(t, []cid.Cid{pieceCid}, env.PiecesCached)
+	})
+
+	t.Run("unseals only the selected blocks when possible", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		dealState := makeDeals()
+		setupEnv := func(fe *rmtesting.TestProviderDealEnvironment) {
+			fe.UnsealSelectedResult = true
+		}
+		runUnsealData(t, node, setupEnv, dealState)
+		require.Equal(t, dealState.Status, rm.DealStatusUnsealed)
+	})
+
+	t.Run("UnsealSelected error", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		dealState := makeDeals()
+		setupEnv := func(fe *rmtesting.TestProviderDealEnvironment) {
+			fe.UnsealSelectedError = errors.New("Something went wrong")
+		}
+		runUnsealData(t, node, setupEnv, dealState)
+		require.Equal(t, dealState.Status, rm.DealStatusFailing)
+		require.Equal(t, dealState.Message, "Something went wrong")
+	})
+
 	t.Run("use a non-unsealed sector if there is no unsealed sector", func(t *testing.T) {
 		node := testnodes.NewTestRetrievalProviderNode()
 		node.ExpectUnseal(sectorID, offset.Unpadded(), length.Unpadded(), data)
@@ -138,6 +188,23 @@ func TestUnsealData(t *testing.T) {
 	})
 }
 
+func TestQueueDeal(t *testing.T) {
+	ctx := context.Background()
+	eventMachine, err := fsm.NewEventProcessor(rm.ProviderDealState{}, "Status", providerstates.ProviderEvents)
+	require.NoError(t, err)
+
+	node := testnodes.NewTestRetrievalProviderNode()
+	environment := rmtesting.NewTestProviderDealEnvironment(node)
+	fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+	dealState := makeDealState(rm.DealStatusQueued)
+	err = providerstates.QueueDeal(fsmCtx, environment, *dealState)
+	require.NoError(t, err)
+	fsmCtx.ReplayEvents(t, dealState)
+	require.Equal(t, rm.DealStatusQueued, dealState.Status)
+	require.Len(t, environment.QueuedDeals, 1)
+	require.Equal(t, dealState.Identifier(), environment.QueuedDeals[0].Identifier())
+}
+
 func TestUnpauseDeal(t *testing.T) {
 	ctx := context.Background()
 	eventMachine, err := fsm.NewEventProcessor(rm.ProviderDealState{}, "Status", providerstates.ProviderEvents)
@@ -10,6 +10,7 @@ import (
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	peer "github.com/libp2p/go-libp2p-core/peer"
+	cbg "github.com/whyrusleeping/cbor-gen"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-multistore"
@@ -34,7 +35,7 @@ func init() {
 
 // ValidationEnvironment contains the dependencies needed to validate deals
 type ValidationEnvironment interface {
-	GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid, piece piecestore.PieceInfo, isUnsealed bool, client peer.ID) (retrievalmarket.Ask, error)
+	GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid, selector *cbg.Deferred, piece piecestore.PieceInfo, isUnsealed bool, client peer.ID) (retrievalmarket.Ask, error)
 
 	GetPiece(c cid.Cid, pieceCID *cid.Cid) (piecestore.PieceInfo, bool, error)
 	// CheckDealParams verifies the given deal params are acceptable
@@ -45,6 +46,9 @@ type ValidationEnvironment interface {
 	BeginTracking(pds retrievalmarket.ProviderDealState) error
 	// NextStoreID allocates a store for this deal
 	NextStoreID() (multistore.StoreID, error)
+	// WouldQueue returns true if a deal for the given client would wait in the
+	// queue for the provider to have capacity to serve it
+	WouldQueue(client peer.ID) bool
 }
 
 // ProviderRequestValidator validates incoming requests for the Retrieval Provider
@@ -129,6 +133,7 @@ func (rv *ProviderRequestValidator) validatePull(isRestart bool, receiver peer.I
 		Receiver:        receiver,
 		LegacyProtocol:  legacyProtocol,
 		CurrentInterval: proposal.PaymentInterval,
+		CreatedAt:       time.Now().Unix(),
 	}
 
 	// Decide whether to accept the deal
@@ -143,6 +148,12 @@ func (rv *ProviderRequestValidator) validatePull(isRestart bool, receiver peer.I
 		response.PaymentOwed = pds.UnsealPrice
 	}
 
+	// let the client know if the deal has to wait for capacity. Clients using
+	// the legacy protocol don't know about queued deals.
+	if status == retrievalmarket.DealStatusAccepted && !legacyProtocol && rv.env.WouldQueue(receiver) {
+		response.Status = retrievalmarket.DealStatusQueued
+	}
+
 	if err != nil {
 		response.Message = err.Error()
 		return &response, err
@@ -170,7 +181,7 @@ func (rv *ProviderRequestValidator) acceptDeal(deal *retrievalmarket.ProviderDea
 	ctx, cancel := context.WithTimeout(context.TODO(), askTimeout)
 	defer cancel()
 
-	ask, err := rv.env.GetAsk(ctx, deal.PayloadCID, deal.PieceCID, pieceInfo, isUnsealed, deal.Receiver)
+	ask, err := rv.env.GetAsk(ctx, deal.PayloadCID, deal.PieceCID, deal.Selector, pieceInfo, isUnsealed, deal.Receiver)
 	if err != nil {
 		return retrievalmarket.DealStatusErrored, err
 	}
@@ -11,6 +11,7 @@ import (
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-multistore"
@@ -182,6 +183,34 @@ func TestValidatePull(t *testing.T) {
 				ID:     proposal.ID,
 			},
 		},
+		"success, queued": {
+			fve: fakeValidationEnvironment{
+				RunDealDecisioningLogicAccepted: true,
+				wouldQueue:                      true,
+			},
+			baseCid:       proposal.PayloadCID,
+			selector:      shared.AllSelector(),
+			voucher:       &proposal,
+			expectedError: datatransfer.ErrPause,
+			expectedVoucherResult: &retrievalmarket.DealResponse{
+				Status: retrievalmarket.DealStatusQueued,
+				ID:     proposal.ID,
+			},
+		},
+		"success, legacyProposal, queued": {
+			fve: fakeValidationEnvironment{
+				RunDealDecisioningLogicAccepted: true,
+				wouldQueue:                      true,
+			},
+			baseCid:       proposal.PayloadCID,
+			selector:      shared.AllSelector(),
+			voucher:       &legacyProposal,
+			expectedError: datatransfer.ErrPause,
+			expectedVoucherResult: &migrations.DealResponse0{
+				Status: retrievalmarket.DealStatusAccepted,
+				ID:     proposal.ID,
+			},
+		},
 		"success, legacyProposal": {
 			fve: fakeValidationEnvironment{
 				RunDealDecisioningLogicAccepted: true,
@@ -233,11 +262,12 @@ type fakeValidationEnvironment struct {
 	BeginTrackingError                error
 	NextStoreIDValue                  multistore.StoreID
 	NextStoreIDError                  error
+	wouldQueue                        bool
 
 	Ask retrievalmarket.Ask
 }
 
-func (fve *fakeValidationEnvironment) GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid,
+func (fve *fakeValidationEnvironment) GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid, selector *cbg.Deferred,
 	piece piecestore.PieceInfo, isUnsealed bool, client peer.ID) (retrievalmarket.Ask, error) {
 	return fve.Ask, nil
 }
@@ -261,6 +291,10 @@ func (fve *fakeValidationEnvironment) BeginTracking(pds retrievalmarket.Provider
 	return fve.BeginTrackingError
 }
 
+func (fve *fakeValidationEnvironment) WouldQueue(client peer.ID) bool {
+	return fve.wouldQueue
+}
+
 func (fve *fakeValidationEnvironment) NextStoreID() (multistore.StoreID, error) {
 	return fve.NextStoreIDValue, fve.NextStoreIDError
 }
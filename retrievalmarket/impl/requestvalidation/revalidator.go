@@ -6,10 +6,13 @@ import (
 	"sync"
 
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
 
+	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -24,6 +27,10 @@ type RevalidatorEnvironment interface {
 	Node() rm.RetrievalProviderNode
 	SendEvent(dealID rm.ProviderDealIdentifier, evt rm.ProviderEvent, args ...interface{}) error
 	Get(dealID rm.ProviderDealIdentifier) (rm.ProviderDealState, error)
+	RecordVoucher(paymentChannel address.Address, voucher *paych.SignedVoucher) error
+	// WouldQueue returns true if a deal for the given client would wait in the
+	// queue for the provider to have capacity to serve it
+	WouldQueue(client peer.ID) bool
 }
 
 type channelData struct {
@@ -34,6 +41,12 @@ type channelData struct {
 	pricePerByte   abi.TokenAmount
 	reload         bool
 	legacyProtocol bool
+
+	// cancelResponse is sent to the client in answer to the next revalidation
+	// after the provider cancels the deal
+	cancelResponse  *rm.DealResponse
+	cancelOnce      sync.Once
+	cancelDelivered chan struct{}
 }
 
 // ProviderRevalidator defines data transfer revalidation logic in the context of
@@ -82,6 +95,66 @@ func (pr *ProviderRevalidator) UntrackChannel(deal rm.ProviderDealState) {
 	delete(pr.trackedChannels, *deal.ChannelID)
 }
 
+// ErrProviderCancelled is returned to the data transfer with the response that
+// tells the client the provider has cancelled the deal
+var ErrProviderCancelled = errors.New("provider cancelled retrieval")
+
+// CancelChannel tells the client that the provider has cancelled the deal with
+// the given reason. The response is sent in answer to the next revalidation of
+// the deal's channel, which then ends the transfer. The returned channel is
+// closed once the response has been handed to the data transfer, and is nil
+// if the deal's channel is not tracked.
+func (pr *ProviderRevalidator) CancelChannel(deal rm.ProviderDealState, reason string) <-chan struct{} {
+	if deal.ChannelID == nil {
+		return nil
+	}
+
+	pr.trackedChannelsLk.Lock()
+	defer pr.trackedChannelsLk.Unlock()
+	channel, ok := pr.trackedChannels[*deal.ChannelID]
+	if !ok {
+		return nil
+	}
+	if channel.cancelResponse == nil {
+		channel.cancelResponse = &rm.DealResponse{
+			ID:      deal.ID,
+			Status:  rm.DealStatusCancelled,
+			Message: reason,
+		}
+		channel.cancelDelivered = make(chan struct{})
+	}
+	return channel.cancelDelivered
+}
+
+// CancelResponseDelivered returns the channel that is closed once the
+// cancellation for the deal's channel has been handed to the data transfer,
+// or nil if the provider has not cancelled the deal
+func (pr *ProviderRevalidator) CancelResponseDelivered(deal rm.ProviderDealState) <-chan struct{} {
+	if deal.ChannelID == nil {
+		return nil
+	}
+
+	pr.trackedChannelsLk.RLock()
+	defer pr.trackedChannelsLk.RUnlock()
+	channel, ok := pr.trackedChannels[*deal.ChannelID]
+	if !ok {
+		return nil
+	}
+	return channel.cancelDelivered
+}
+
+// cancelled returns the response cancelling the channel's deal, if the
+// provider has cancelled it
+func cancelled(channel *channelData) (datatransfer.VoucherResult, bool) {
+	if channel.cancelResponse == nil {
+		return nil, false
+	}
+	channel.cancelOnce.Do(func() {
+		close(channel.cancelDelivered)
+	})
+	return finalResponse(channel.cancelResponse, channel.legacyProtocol), true
+}
+
 func (pr *ProviderRevalidator) loadDealState(channel *channelData) error {
 	if !channel.reload {
 		return nil
@@ -114,6 +187,9 @@ func (pr *ProviderRevalidator) Revalidate(channelID datatransfer.ChannelID, vouc
 	if !ok {
 		return nil, nil
 	}
+	if response, ok := cancelled(channel); ok {
+		return response, ErrProviderCancelled
+	}
 
 	// read payment, or fail
 	payment, ok := voucher.(*rm.DealPayment)
@@ -148,12 +224,21 @@ func (pr *ProviderRevalidator) processPayment(dealID rm.ProviderDealIdentifier,
 		return errorDealResponse(dealID, err), err
 	}
 
+	// A free deal has no payment channel, so there is no voucher to save
+	if deal.IsFree() {
+		log.Warnf("provider: ignoring payment voucher for free deal %s", dealID)
+		return nil, nil
+	}
+
 	// Save voucher
 	received, err := pr.env.Node().SavePaymentVoucher(context.TODO(), payment.PaymentChannel, payment.PaymentVoucher, nil, big.Zero(), tok)
 	if err != nil {
 		_ = pr.env.SendEvent(dealID, rm.ProviderEventSaveVoucherFailed, err)
 		return errorDealResponse(dealID, err), err
 	}
+	if err := pr.env.RecordVoucher(payment.PaymentChannel, payment.PaymentVoucher); err != nil {
+		log.Warnf("provider: recording voucher for redemption: %s", err)
+	}
 
 	totalPaid := big.Add(deal.FundsReceived, received)
 
@@ -185,8 +270,16 @@ func (pr *ProviderRevalidator) processPayment(dealID rm.ProviderDealIdentifier,
 	}
 
 	// We shouldn't resume the data transfer if we haven't finished unsealing/reading the unsealed data into the
-	// local block-store.
-	if deal.Status == rm.DealStatusUnsealing || deal.Status == rm.DealStatusFundsNeededUnseal {
+	// local block-store, or are still waiting in the queue to unseal it.
+	if deal.Status == rm.DealStatusFundsNeededUnseal && !deal.LegacyProtocol && pr.env.WouldQueue(dealID.Receiver) {
+		// paying for unsealing moves the deal to the queue, so let the client
+		// know it has to wait for capacity
+		return &rm.DealResponse{
+			ID:     deal.ID,
+			Status: rm.DealStatusQueued,
+		}, nil
+	}
+	if deal.Status == rm.DealStatusUnsealing || deal.Status == rm.DealStatusFundsNeededUnseal || deal.Status == rm.DealStatusQueued {
 		return nil, nil
 	}
 
@@ -242,6 +335,9 @@ func (pr *ProviderRevalidator) OnPullDataSent(chid datatransfer.ChannelID, addit
 	if !ok {
 		return false, nil, nil
 	}
+	if response, ok := cancelled(channel); ok {
+		return true, response, ErrProviderCancelled
+	}
 
 	err := pr.loadDealState(channel)
 	if err != nil {
@@ -293,6 +389,9 @@ func (pr *ProviderRevalidator) OnComplete(chid datatransfer.ChannelID) (bool, da
 	if !ok {
 		return false, nil, nil
 	}
+	if response, ok := cancelled(channel); ok {
+		return true, response, ErrProviderCancelled
+	}
 
 	err := pr.loadDealState(channel)
 	if err != nil {
@@ -5,12 +5,14 @@ import (
 	"math/rand"
 	"testing"
 
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -324,6 +326,12 @@ func TestRevalidate(t *testing.T) {
 	}
 	lastPaymentDeal := deal
 	lastPaymentDeal.Status = rm.DealStatusFundsNeededLastPayment
+	unsealDeal := deal
+	unsealDeal.Status = rm.DealStatusFundsNeededUnseal
+	freeDeal := deal
+	freeDeal.Status = rm.DealStatusOngoing
+	freeDeal.PricePerByte = big.Zero()
+	freeDeal.UnsealPrice = big.Zero()
 	testCases := map[string]struct {
 		configureTestNode func(tn *testnodes.TestRetrievalProviderNode)
 		noSend            bool
@@ -336,6 +344,7 @@ func TestRevalidate(t *testing.T) {
 		voucher           datatransfer.Voucher
 		expectedResult    datatransfer.VoucherResult
 		expectedError     error
+		wouldQueue        bool
 	}{
 		"not tracked": {
 			deal:      deal,
@@ -453,7 +462,33 @@ func TestRevalidate(t *testing.T) {
 			expectedArgs:  []interface{}{defaultPaymentPerInterval},
 			expectedError: datatransfer.ErrResume,
 		},
-
+		"it waits to unseal": {
+			deal:          unsealDeal,
+			channelID:     channelID,
+			voucher:       payment,
+			expectedID:    deal.Identifier(),
+			expectedEvent: rm.ProviderEventPaymentReceived,
+			expectedArgs:  []interface{}{defaultPaymentPerInterval},
+		},
+		"it tells the client the deal is queued": {
+			deal:          unsealDeal,
+			channelID:     channelID,
+			voucher:       payment,
+			wouldQueue:    true,
+			expectedID:    deal.Identifier(),
+			expectedEvent: rm.ProviderEventPaymentReceived,
+			expectedArgs:  []interface{}{defaultPaymentPerInterval},
+			expectedResult: &rm.DealResponse{
+				ID:     deal.ID,
+				Status: rm.DealStatusQueued,
+			},
+		},
+		"ignores payment for a free deal": {
+			deal:      freeDeal,
+			channelID: channelID,
+			voucher:   payment,
+			noSend:    true,
+		},
 		"it completes": {
 			deal:          lastPaymentDeal,
 			channelID:     channelID,
@@ -501,6 +536,7 @@ func TestRevalidate(t *testing.T) {
 				node:         tn,
 				returnedDeal: data.deal,
 				getError:     data.getError,
+				wouldQueue:   data.wouldQueue,
 			}
 			revalidator := requestvalidation.NewProviderRevalidator(fre)
 			revalidator.TrackChannel(data.deal)
@@ -521,10 +557,55 @@ func TestRevalidate(t *testing.T) {
 			} else {
 				require.Len(t, fre.sentEvents, 0)
 			}
+			// saved vouchers are recorded for redemption
+			if !data.noSend && (data.expectedEvent == rm.ProviderEventPaymentReceived || data.expectedEvent == rm.ProviderEventPartialPaymentReceived) {
+				require.Len(t, fre.recorded, 1)
+			} else {
+				require.Empty(t, fre.recorded)
+			}
 		})
 	}
 }
 
+func TestCancelChannel(t *testing.T) {
+	deal := *makeDealState(rm.DealStatusOngoing)
+	fre := &fakeRevalidatorEnvironment{
+		node:         testnodes.NewTestRetrievalProviderNode(),
+		returnedDeal: deal,
+	}
+	revalidator := requestvalidation.NewProviderRevalidator(fre)
+
+	// a deal whose channel isn't tracked can't be told anything
+	require.Nil(t, revalidator.CancelChannel(deal, "shutting down"))
+	require.Nil(t, revalidator.CancelResponseDelivered(deal))
+
+	revalidator.TrackChannel(deal)
+	require.Nil(t, revalidator.CancelResponseDelivered(deal))
+	delivered := revalidator.CancelChannel(deal, "shutting down")
+	require.NotNil(t, delivered)
+	require.Equal(t, delivered, revalidator.CancelResponseDelivered(deal))
+
+	handled, voucherResult, err := revalidator.OnPullDataSent(*deal.ChannelID, 500)
+	require.True(t, handled)
+	require.Equal(t, &rm.DealResponse{
+		ID:      deal.ID,
+		Status:  rm.DealStatusCancelled,
+		Message: "shutting down",
+	}, voucherResult)
+	require.Equal(t, requestvalidation.ErrProviderCancelled, err)
+	require.Empty(t, fre.sentEvents)
+	select {
+	case <-delivered:
+	default:
+		t.Fatal("cancel response should be delivered")
+	}
+
+	// the client keeps being told the deal is cancelled
+	voucherResult, err = revalidator.Revalidate(*deal.ChannelID, &rm.DealPayment{})
+	require.Equal(t, rm.DealStatusCancelled, voucherResult.(*rm.DealResponse).Status)
+	require.Equal(t, requestvalidation.ErrProviderCancelled, err)
+}
+
 type eventSent struct {
 	ID    rm.ProviderDealIdentifier
 	Event rm.ProviderEvent
@@ -536,6 +617,8 @@ type fakeRevalidatorEnvironment struct {
 	sendEventError error
 	returnedDeal   rm.ProviderDealState
 	getError       error
+	recorded       []*paych.SignedVoucher
+	wouldQueue     bool
 }
 
 func (fre *fakeRevalidatorEnvironment) Node() rm.RetrievalProviderNode {
@@ -551,6 +634,15 @@ func (fre *fakeRevalidatorEnvironment) Get(dealID rm.ProviderDealIdentifier) (rm
 	return fre.returnedDeal, fre.getError
 }
 
+func (fre *fakeRevalidatorEnvironment) WouldQueue(client peer.ID) bool {
+	return fre.wouldQueue
+}
+
+func (fre *fakeRevalidatorEnvironment) RecordVoucher(paymentChannel address.Address, voucher *paych.SignedVoucher) error {
+	fre.recorded = append(fre.recorded, voucher)
+	return nil
+}
+
 var dealID = retrievalmarket.DealID(10)
 var defaultCurrentInterval = uint64(3000)
 var defaultPaymentInterval = uint64(1000)
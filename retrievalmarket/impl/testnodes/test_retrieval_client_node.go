@@ -13,6 +13,7 @@ import (
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
 	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -41,6 +42,12 @@ type TestRetrievalClientNode struct {
 	allocateLaneRecorder              func(address.Address)
 	createPaymentVoucherRecorder      func(voucher *paych.SignedVoucher)
 	getCreatePaymentChannelRecorder   func(address.Address, address.Address, abi.TokenAmount)
+	chainHeadEpoch                    abi.ChainEpoch
+	settlingAt                        map[address.Address]abi.ChainEpoch
+	settled                           []address.Address
+	collected                         []address.Address
+	messagesPending                   bool
+	messageExitCode                   exitcode.ExitCode
 }
 
 // TestRetrievalClientNodeParams are parameters for initializing a TestRetrievalClientNode
@@ -86,6 +93,7 @@ func NewTestRetrievalClientNode(params TestRetrievalClientNodeParams) *TestRetri
 		knownAddreses:                   map[retrievalmarket.RetrievalPeer][]ma.Multiaddr{},
 		expectedKnownAddresses:          map[retrievalmarket.RetrievalPeer]struct{}{},
 		receivedKnownAddresses:          map[retrievalmarket.RetrievalPeer]struct{}{},
+		settlingAt:                      map[address.Address]abi.ChainEpoch{},
 	}
 }
 
@@ -130,7 +138,58 @@ func (trcn *TestRetrievalClientNode) CreatePaymentVoucher(ctx context.Context, p
 
 // GetChainHead returns a mock value for the chain head
 func (trcn *TestRetrievalClientNode) GetChainHead(ctx context.Context) (shared.TipSetToken, abi.ChainEpoch, error) {
-	return shared.TipSetToken{}, 0, nil
+	return shared.TipSetToken{}, trcn.chainHeadEpoch, nil
+}
+
+// SetChainHeadEpoch sets the epoch of the mock chain head
+func (trcn *TestRetrievalClientNode) SetChainHeadEpoch(epoch abi.ChainEpoch) {
+	trcn.chainHeadEpoch = epoch
+}
+
+// SettlePaymentChannel records that a payment channel was settled
+func (trcn *TestRetrievalClientNode) SettlePaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error) {
+	trcn.settled = append(trcn.settled, paymentChannel)
+	return shared_testutil.GenerateCids(1)[0], nil
+}
+
+// StubPaymentChannelSettlingAt sets the epoch at which a payment channel
+// settles
+func (trcn *TestRetrievalClientNode) StubPaymentChannelSettlingAt(paymentChannel address.Address, settlingAt abi.ChainEpoch) {
+	trcn.settlingAt[paymentChannel] = settlingAt
+}
+
+// GetPaymentChannelSettlingAt returns the stubbed settling epoch of a payment
+// channel
+func (trcn *TestRetrievalClientNode) GetPaymentChannelSettlingAt(ctx context.Context, paymentChannel address.Address, tok shared.TipSetToken) (abi.ChainEpoch, error) {
+	return trcn.settlingAt[paymentChannel], nil
+}
+
+// CollectPaymentChannel records that a payment channel was collected
+func (trcn *TestRetrievalClientNode) CollectPaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error) {
+	trcn.collected = append(trcn.collected, paymentChannel)
+	return shared_testutil.GenerateCids(1)[0], nil
+}
+
+// SearchMessage returns the stubbed result of a message
+func (trcn *TestRetrievalClientNode) SearchMessage(ctx context.Context, msg cid.Cid) (bool, exitcode.ExitCode, error) {
+	return !trcn.messagesPending, trcn.messageExitCode, nil
+}
+
+// StubMessageResult sets whether messages are still pending, and the exit
+// code they are executed with otherwise
+func (trcn *TestRetrievalClientNode) StubMessageResult(pending bool, code exitcode.ExitCode) {
+	trcn.messagesPending = pending
+	trcn.messageExitCode = code
+}
+
+// SettledPaymentChannels returns the payment channels that were settled
+func (trcn *TestRetrievalClientNode) SettledPaymentChannels() []address.Address {
+	return trcn.settled
+}
+
+// CollectedPaymentChannels returns the payment channels that were collected
+func (trcn *TestRetrievalClientNode) CollectedPaymentChannels() []address.Address {
+	return trcn.collected
 }
 
 // WaitForPaymentChannelReady simulates waiting for a payment channel to finish adding funds
@@ -0,0 +1,72 @@
+package vouchermanager
+
+import (
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
+)
+
+//go:generate cbor-gen-for --map-encoding LaneVouchers ChannelVouchers
+
+// LaneVouchers is the bookkeeping for the vouchers received on one lane of a
+// payment channel
+type LaneVouchers struct {
+	PaymentChannel address.Address
+	Lane           uint64
+
+	// BestVoucher is the voucher for the highest amount received on the lane
+	BestVoucher *paych.SignedVoucher
+
+	// Redeemed is the amount of the last voucher confirmed on chain
+	Redeemed abi.TokenAmount
+
+	// RedeemMessage is the message submitting the voucher for Redeeming,
+	// while it waits to be confirmed on chain
+	RedeemMessage *cid.Cid
+	Redeeming     abi.TokenAmount
+
+	// Lost is set if the lane's deadline passed before its best voucher
+	// could be redeemed
+	Lost bool
+}
+
+// ChannelVouchers is the bookkeeping for a payment channel the provider has
+// received vouchers on
+type ChannelVouchers struct {
+	PaymentChannel address.Address
+
+	// SettlingAt is the epoch at which the channel settles, or zero if no one
+	// has started settling it
+	SettlingAt abi.ChainEpoch
+
+	// CollectMessage is the message that collects the channel's funds, once
+	// it has settled, and Collected is set once the message is confirmed
+	CollectMessage *cid.Cid
+	Collected      bool
+}
+
+// ChannelEarnings is what the provider has earned on one payment channel. The
+// total received is the sum of the other amounts.
+type ChannelEarnings struct {
+	PaymentChannel address.Address
+
+	// Received is the total of the best vouchers received on each lane
+	Received abi.TokenAmount
+	// Pending is the amount received that has not been confirmed on chain
+	Pending abi.TokenAmount
+	// Redeemed is the amount confirmed on chain that has not been collected
+	Redeemed abi.TokenAmount
+	// Collected is the amount paid out when the channel was collected
+	Collected abi.TokenAmount
+	// Lost is the amount of vouchers whose deadline passed before they could
+	// be redeemed
+	Lost abi.TokenAmount
+}
+
+// Earnings is what the provider has earned across all payment channels
+type Earnings struct {
+	ChannelEarnings
+	Channels []ChannelEarnings
+}
@@ -0,0 +1,458 @@
+/*
+Package vouchermanager redeems the payment vouchers a retrieval provider
+receives.
+
+The provider only saves vouchers with its node, and a voucher is worthless
+once its payment channel settles or the voucher expires. The manager tracks
+the best voucher on each lane of each channel and, on a regular check,
+submits it on chain when the policy says to: once the unredeemed amount
+reaches a threshold, or when the lane's deadline is close. Once a channel has
+settled, the manager collects its funds. Vouchers are only counted as redeemed,
+and channels as collected, once their messages are confirmed on chain, and
+failed messages are sent again on a later check. All bookkeeping is persisted, so that
+the manager can report what the provider has earned.
+*/
+package vouchermanager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-statestore"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
+
+	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("vouchermanager")
+
+// DefaultCheckInterval is how often vouchers are checked by default
+const DefaultCheckInterval = 10 * time.Minute
+
+// DefaultRedeemBeforeDeadline is how many epochs before a lane's deadline
+// its voucher is redeemed by default (about twelve hours)
+const DefaultRedeemBeforeDeadline = abi.ChainEpoch(1440)
+
+// Policy decides when vouchers are submitted on chain
+type Policy struct {
+	// MinRedeemAmount is how much a lane's best voucher must exceed the
+	// amount already redeemed on the lane before it is submitted. If it is
+	// zero, vouchers are only submitted as their deadline approaches.
+	MinRedeemAmount abi.TokenAmount
+
+	// RedeemBeforeDeadline is how many epochs before a lane's deadline its best
+	// voucher is submitted. A lane's deadline is the earlier of the epoch its
+	// channel settles and the epoch its best voucher expires.
+	RedeemBeforeDeadline abi.ChainEpoch
+}
+
+// DefaultPolicy redeems vouchers only as their deadline approaches, so
+// that each lane is submitted once
+var DefaultPolicy = Policy{
+	MinRedeemAmount:      big.Zero(),
+	RedeemBeforeDeadline: DefaultRedeemBeforeDeadline,
+}
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// CheckInterval sets how often the manager checks whether vouchers should be
+// redeemed and channels collected
+func CheckInterval(interval time.Duration) Option {
+	return func(m *Manager) {
+		m.checkInterval = interval
+	}
+}
+
+// Manager tracks and redeems the payment vouchers received by a retrieval
+// provider
+type Manager struct {
+	node          rm.RetrievalProviderVoucherNode
+	lanes         *statestore.StateStore
+	channels      *statestore.StateStore
+	checkInterval time.Duration
+
+	// checkLk makes sure only one check runs at a time, while lk guards the
+	// bookkeeping and is not held during calls to the node
+	checkLk sync.Mutex
+	lk      sync.Mutex
+	policy  Policy
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewManager returns a voucher manager that persists its bookkeeping to the
+// given datastore and redeems vouchers with the given node according to the
+// policy
+func NewManager(ds datastore.Batching, node rm.RetrievalProviderVoucherNode, policy Policy, options ...Option) *Manager {
+	m := &Manager{
+		node:          node,
+		lanes:         statestore.New(namespace.Wrap(ds, datastore.NewKey("/lanes"))),
+		channels:      statestore.New(namespace.Wrap(ds, datastore.NewKey("/channels"))),
+		checkInterval: DefaultCheckInterval,
+		policy:        normalizePolicy(policy),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// SetPolicy changes the policy for redeeming vouchers
+func (m *Manager) SetPolicy(policy Policy) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.policy = normalizePolicy(policy)
+}
+
+// Start checks vouchers regularly until Stop is called
+func (m *Manager) Start(ctx context.Context) {
+	m.stop = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go func() {
+		defer close(m.stopped)
+		ticker := time.NewTicker(m.checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.Check(ctx); err != nil {
+					log.Errorf("checking payment vouchers: %s", err)
+				}
+			case <-m.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops checking vouchers
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.stopped
+	m.stop = nil
+}
+
+// AddVoucher records a voucher the provider has received, keeping it if it
+// is the best voucher on its lane
+func (m *Manager) AddVoucher(paymentChannel address.Address, voucher *paych.SignedVoucher) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	has, err := m.channels.Has(paymentChannel)
+	if err != nil {
+		return err
+	}
+	if !has {
+		err := m.channels.Begin(paymentChannel, &ChannelVouchers{PaymentChannel: paymentChannel})
+		if err != nil {
+			return xerrors.Errorf("recording payment channel %s: %w", paymentChannel, err)
+		}
+	}
+
+	key := laneKey(paymentChannel, voucher.Lane)
+	has, err = m.lanes.Has(key)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return m.lanes.Begin(key, &LaneVouchers{
+			PaymentChannel: paymentChannel,
+			Lane:           voucher.Lane,
+			BestVoucher:    voucher,
+			Redeemed:       big.Zero(),
+			Redeeming:      big.Zero(),
+		})
+	}
+	return m.lanes.Get(key).Mutate(func(lane *LaneVouchers) error {
+		if lane.BestVoucher == nil || voucher.Amount.GreaterThan(lane.BestVoucher.Amount) {
+			lane.BestVoucher = voucher
+		}
+		return nil
+	})
+}
+
+// Check redeems the vouchers and collects the channels the policy says are
+// due at the current chain head. Messages sent by earlier checks are only
+// counted once they are confirmed on chain.
+func (m *Manager) Check(ctx context.Context) error {
+	m.checkLk.Lock()
+	defer m.checkLk.Unlock()
+
+	m.lk.Lock()
+	policy := m.policy
+	var channels []ChannelVouchers
+	err := m.channels.List(&channels)
+	if err != nil {
+		m.lk.Unlock()
+		return xerrors.Errorf("listing payment channels: %w", err)
+	}
+	lanes, err := m.lanesByChannel()
+	m.lk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tok, epoch, err := m.node.GetChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	for _, channel := range channels {
+		if channel.Collected {
+			continue
+		}
+		if err := m.checkChannel(ctx, policy, tok, epoch, channel, lanes[channel.PaymentChannel]); err != nil {
+			log.Errorf("checking payment channel %s: %s", channel.PaymentChannel, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) checkChannel(ctx context.Context, policy Policy, tok shared.TipSetToken, epoch abi.ChainEpoch, channel ChannelVouchers, lanes []LaneVouchers) error {
+	if channel.CollectMessage != nil {
+		return m.checkCollected(ctx, channel)
+	}
+
+	settlingAt, err := m.node.GetPaymentChannelSettlingAt(ctx, channel.PaymentChannel, tok)
+	if err != nil {
+		return xerrors.Errorf("getting settlement epoch: %w", err)
+	}
+	if settlingAt != channel.SettlingAt {
+		err := m.mutateChannel(channel.PaymentChannel, func(c *ChannelVouchers) error {
+			c.SettlingAt = settlingAt
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	redeeming := false
+	for _, lane := range lanes {
+		pending, err := m.checkLane(ctx, policy, epoch, settlingAt, lane)
+		if err != nil {
+			log.Errorf("checking lane %d of payment channel %s: %s", lane.Lane, lane.PaymentChannel, err)
+		}
+		redeeming = redeeming || pending
+	}
+
+	// collecting pays out what has been redeemed, so it waits for vouchers
+	// still being redeemed
+	if settlingAt == 0 || epoch < settlingAt || redeeming {
+		return nil
+	}
+	msg, err := m.node.CollectPaymentChannel(ctx, channel.PaymentChannel)
+	if err != nil {
+		return xerrors.Errorf("collecting: %w", err)
+	}
+	log.Infof("collecting payment channel %s in message %s", channel.PaymentChannel, msg)
+	return m.mutateChannel(channel.PaymentChannel, func(c *ChannelVouchers) error {
+		c.CollectMessage = &msg
+		return nil
+	})
+}
+
+// checkCollected records the channel as collected once its collect message
+// is confirmed, or clears the message so that it is collected again if the
+// message failed
+func (m *Manager) checkCollected(ctx context.Context, channel ChannelVouchers) error {
+	found, code, err := m.node.SearchMessage(ctx, *channel.CollectMessage)
+	if err != nil {
+		return xerrors.Errorf("looking up collect message: %w", err)
+	}
+	if !found {
+		return nil
+	}
+	if code != exitcode.Ok {
+		log.Warnf("collect message %s for payment channel %s failed with exit code %d", *channel.CollectMessage, channel.PaymentChannel, code)
+	} else {
+		log.Infof("collected payment channel %s", channel.PaymentChannel)
+	}
+	return m.mutateChannel(channel.PaymentChannel, func(c *ChannelVouchers) error {
+		c.Collected = code == exitcode.Ok
+		if !c.Collected {
+			c.CollectMessage = nil
+		}
+		return nil
+	})
+}
+
+// checkLane submits the lane's best voucher if it is due, and returns whether
+// a voucher on the lane is waiting to be confirmed
+func (m *Manager) checkLane(ctx context.Context, policy Policy, epoch abi.ChainEpoch, settlingAt abi.ChainEpoch, lane LaneVouchers) (bool, error) {
+	key := laneKey(lane.PaymentChannel, lane.Lane)
+	if lane.RedeemMessage != nil {
+		found, code, err := m.node.SearchMessage(ctx, *lane.RedeemMessage)
+		if err != nil {
+			return true, xerrors.Errorf("looking up redeem message: %w", err)
+		}
+		if !found {
+			return true, nil
+		}
+		if code != exitcode.Ok {
+			log.Warnf("redeem message %s for lane %d of payment channel %s failed with exit code %d",
+				*lane.RedeemMessage, lane.Lane, lane.PaymentChannel, code)
+		} else {
+			lane.Redeemed = lane.Redeeming
+		}
+		err = m.mutateLane(key, func(l *LaneVouchers) error {
+			l.Redeemed = lane.Redeemed
+			l.RedeemMessage = nil
+			l.Redeeming = big.Zero()
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	voucher := lane.BestVoucher
+	if lane.Lost || voucher == nil || !voucher.Amount.GreaterThan(lane.Redeemed) {
+		return false, nil
+	}
+
+	deadline := settlingAt
+	if voucher.TimeLockMax > 0 && (deadline == 0 || voucher.TimeLockMax < deadline) {
+		deadline = voucher.TimeLockMax
+	}
+	if deadline > 0 && epoch >= deadline {
+		log.Warnf("lane %d of payment channel %s passed its deadline with %s unredeemed",
+			lane.Lane, lane.PaymentChannel, big.Sub(voucher.Amount, lane.Redeemed))
+		return false, m.mutateLane(key, func(l *LaneVouchers) error {
+			l.Lost = true
+			return nil
+		})
+	}
+	if epoch < voucher.TimeLockMin {
+		return false, nil
+	}
+
+	unredeemed := big.Sub(voucher.Amount, lane.Redeemed)
+	overThreshold := policy.MinRedeemAmount.GreaterThan(big.Zero()) && unredeemed.GreaterThanEqual(policy.MinRedeemAmount)
+	nearDeadline := deadline > 0 && deadline-epoch <= policy.RedeemBeforeDeadline
+	if !overThreshold && !nearDeadline {
+		return false, nil
+	}
+
+	msg, err := m.node.SubmitPaymentVoucher(ctx, lane.PaymentChannel, voucher)
+	if err != nil {
+		return false, xerrors.Errorf("submitting voucher: %w", err)
+	}
+	log.Infof("redeeming %s on lane %d of payment channel %s in message %s", unredeemed, lane.Lane, lane.PaymentChannel, msg)
+	return true, m.mutateLane(key, func(l *LaneVouchers) error {
+		l.RedeemMessage = &msg
+		l.Redeeming = voucher.Amount
+		return nil
+	})
+}
+
+func (m *Manager) mutateLane(key string, mutator func(*LaneVouchers) error) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.lanes.Get(key).Mutate(mutator)
+}
+
+func (m *Manager) mutateChannel(paymentChannel address.Address, mutator func(*ChannelVouchers) error) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.channels.Get(paymentChannel).Mutate(mutator)
+}
+
+// Earnings reports what the provider has earned on each payment channel
+func (m *Manager) Earnings() (Earnings, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var channels []ChannelVouchers
+	if err := m.channels.List(&channels); err != nil {
+		return Earnings{}, xerrors.Errorf("listing payment channels: %w", err)
+	}
+	lanes, err := m.lanesByChannel()
+	if err != nil {
+		return Earnings{}, err
+	}
+
+	earnings := Earnings{ChannelEarnings: zeroEarnings(address.Undef)}
+	for _, channel := range channels {
+		ce := zeroEarnings(channel.PaymentChannel)
+		for _, lane := range lanes[channel.PaymentChannel] {
+			if lane.BestVoucher == nil {
+				continue
+			}
+			unredeemed := big.Sub(lane.BestVoucher.Amount, lane.Redeemed)
+			ce.Received = big.Add(ce.Received, lane.BestVoucher.Amount)
+			if channel.Collected {
+				ce.Collected = big.Add(ce.Collected, lane.Redeemed)
+			} else {
+				ce.Redeemed = big.Add(ce.Redeemed, lane.Redeemed)
+			}
+			if lane.Lost || channel.Collected {
+				ce.Lost = big.Add(ce.Lost, unredeemed)
+			} else {
+				ce.Pending = big.Add(ce.Pending, unredeemed)
+			}
+		}
+		earnings.Channels = append(earnings.Channels, ce)
+		earnings.Received = big.Add(earnings.Received, ce.Received)
+		earnings.Pending = big.Add(earnings.Pending, ce.Pending)
+		earnings.Redeemed = big.Add(earnings.Redeemed, ce.Redeemed)
+		earnings.Collected = big.Add(earnings.Collected, ce.Collected)
+		earnings.Lost = big.Add(earnings.Lost, ce.Lost)
+	}
+	return earnings, nil
+}
+
+func (m *Manager) lanesByChannel() (map[address.Address][]LaneVouchers, error) {
+	var lanes []LaneVouchers
+	if err := m.lanes.List(&lanes); err != nil {
+		return nil, xerrors.Errorf("listing lanes: %w", err)
+	}
+	byChannel := make(map[address.Address][]LaneVouchers)
+	for _, lane := range lanes {
+		byChannel[lane.PaymentChannel] = append(byChannel[lane.PaymentChannel], lane)
+	}
+	return byChannel, nil
+}
+
+// normalizePolicy fills in a zero minimum redeem amount, so that a policy
+// that leaves it unset only redeems vouchers near their deadline
+func normalizePolicy(policy Policy) Policy {
+	if policy.MinRedeemAmount.Nil() {
+		policy.MinRedeemAmount = big.Zero()
+	}
+	return policy
+}
+
+func laneKey(paymentChannel address.Address, lane uint64) string {
+	return fmt.Sprintf("%s-%d", paymentChannel, lane)
+}
+
+func zeroEarnings(paymentChannel address.Address) ChannelEarnings {
+	return ChannelEarnings{
+		PaymentChannel: paymentChannel,
+		Received:       big.Zero(),
+		Pending:        big.Zero(),
+		Redeemed:       big.Zero(),
+		Collected:      big.Zero(),
+		Lost:           big.Zero(),
+	}
+}
@@ -0,0 +1,250 @@
+package vouchermanager_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
+	spect "github.com/filecoin-project/specs-actors/support/testing"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/vouchermanager"
+	"github.com/filecoin-project/go-fil-markets/shared"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+type fakeVoucherNode struct {
+	epoch      abi.ChainEpoch
+	settlingAt map[address.Address]abi.ChainEpoch
+	submitted  []*paych.SignedVoucher
+	collected  []address.Address
+
+	// messages are confirmed with their exit code unless unconfirmed is set
+	unconfirmed bool
+	exitCode    exitcode.ExitCode
+}
+
+func newFakeVoucherNode() *fakeVoucherNode {
+	return &fakeVoucherNode{settlingAt: make(map[address.Address]abi.ChainEpoch)}
+}
+
+func (n *fakeVoucherNode) SearchMessage(ctx context.Context, msg cid.Cid) (bool, exitcode.ExitCode, error) {
+	return !n.unconfirmed, n.exitCode, nil
+}
+
+func (n *fakeVoucherNode) GetChainHead(ctx context.Context) (shared.TipSetToken, abi.ChainEpoch, error) {
+	return []byte{}, n.epoch, nil
+}
+
+func (n *fakeVoucherNode) GetPaymentChannelSettlingAt(ctx context.Context, paymentChannel address.Address, tok shared.TipSetToken) (abi.ChainEpoch, error) {
+	return n.settlingAt[paymentChannel], nil
+}
+
+func (n *fakeVoucherNode) SubmitPaymentVoucher(ctx context.Context, paymentChannel address.Address, voucher *paych.SignedVoucher) (cid.Cid, error) {
+	n.submitted = append(n.submitted, voucher)
+	return tut.GenerateCids(1)[0], nil
+}
+
+func (n *fakeVoucherNode) CollectPaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error) {
+	n.collected = append(n.collected, paymentChannel)
+	return tut.GenerateCids(1)[0], nil
+}
+
+func voucher(paymentChannel address.Address, lane uint64, amount int64) *paych.SignedVoucher {
+	return &paych.SignedVoucher{
+		ChannelAddr: paymentChannel,
+		Lane:        lane,
+		Nonce:       uint64(amount),
+		Amount:      abi.NewTokenAmount(amount),
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	ch1 := spect.NewIDAddr(t, 100)
+	ch2 := spect.NewIDAddr(t, 101)
+
+	t.Run("keeps the best voucher on each lane", func(t *testing.T) {
+		node := newFakeVoucherNode()
+		m := vouchermanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()), node, vouchermanager.DefaultPolicy)
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 10)))
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 30)))
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 20)))
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 1, 5)))
+
+		earnings, err := m.Earnings()
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(35), earnings.Received)
+		require.Equal(t, abi.NewTokenAmount(35), earnings.Pending)
+		require.Len(t, earnings.Channels, 1)
+		require.Equal(t, ch1, earnings.Channels[0].PaymentChannel)
+
+		// nothing is due without a deadline or threshold
+		require.NoError(t, m.Check(ctx))
+		require.Empty(t, node.submitted)
+	})
+
+	t.Run("redeems vouchers over the threshold", func(t *testing.T) {
+		node := newFakeVoucherNode()
+		policy := vouchermanager.Policy{MinRedeemAmount: abi.NewTokenAmount(100)}
+		m := vouchermanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()), node, policy)
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 50)))
+		require.NoError(t, m.Check(ctx))
+		require.Empty(t, node.submitted)
+
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 120)))
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 1)
+		require.Equal(t, abi.NewTokenAmount(120), node.submitted[0].Amount)
+
+		// the threshold applies to the amount not yet redeemed, once the
+		// voucher submitted is confirmed
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 200)))
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 1)
+
+		earnings, err := m.Earnings()
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(200), earnings.Received)
+		require.Equal(t, abi.NewTokenAmount(120), earnings.Redeemed)
+		require.Equal(t, abi.NewTokenAmount(80), earnings.Pending)
+	})
+
+	t.Run("redeems before the deadline and collects once settled", func(t *testing.T) {
+		node := newFakeVoucherNode()
+		policy := vouchermanager.Policy{MinRedeemAmount: big.Zero(), RedeemBeforeDeadline: 10}
+		m := vouchermanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()), node, policy)
+
+		expiring := voucher(ch2, 0, 40)
+		expiring.TimeLockMax = 105
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 10)))
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 1, 20)))
+		require.NoError(t, m.AddVoucher(ch2, expiring))
+
+		// the voucher on the second channel expires soon
+		node.epoch = 100
+		require.NoError(t, m.Check(ctx))
+		require.Equal(t, []*paych.SignedVoucher{expiring}, node.submitted)
+
+		// the first channel starts settling
+		node.settlingAt[ch1] = 150
+		node.epoch = 130
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 1)
+		node.epoch = 140
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 3)
+		require.Empty(t, node.collected)
+
+		// a voucher arriving too late is lost
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 1, 25)))
+		node.epoch = 150
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 3)
+		require.Equal(t, []address.Address{ch1}, node.collected)
+
+		// collected channels are not checked again
+		node.epoch = 160
+		require.NoError(t, m.Check(ctx))
+		node.epoch = 170
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.collected, 1)
+
+		earnings, err := m.Earnings()
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(75), earnings.Received)
+		require.Equal(t, abi.NewTokenAmount(30), earnings.Collected)
+		require.Equal(t, abi.NewTokenAmount(40), earnings.Redeemed)
+		require.Equal(t, abi.NewTokenAmount(5), earnings.Lost)
+		require.Equal(t, big.Zero(), earnings.Pending)
+	})
+
+	t.Run("marks vouchers lost when their deadline passes", func(t *testing.T) {
+		node := newFakeVoucherNode()
+		m := vouchermanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()), node, vouchermanager.Policy{MinRedeemAmount: big.Zero()})
+		expired := voucher(ch1, 0, 40)
+		expired.TimeLockMax = 50
+		require.NoError(t, m.AddVoucher(ch1, expired))
+
+		node.epoch = 60
+		require.NoError(t, m.Check(ctx))
+		require.Empty(t, node.submitted)
+
+		earnings, err := m.Earnings()
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(40), earnings.Lost)
+	})
+
+	t.Run("persists its bookkeeping", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		node := newFakeVoucherNode()
+		policy := vouchermanager.Policy{MinRedeemAmount: abi.NewTokenAmount(10)}
+		m := vouchermanager.NewManager(ds, node, policy)
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 10)))
+		require.NoError(t, m.Check(ctx))
+		require.NoError(t, m.Check(ctx))
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 15)))
+		expected, err := m.Earnings()
+		require.NoError(t, err)
+
+		m = vouchermanager.NewManager(ds, node, policy)
+		earnings, err := m.Earnings()
+		require.NoError(t, err)
+		require.Equal(t, expected, earnings)
+		require.Equal(t, abi.NewTokenAmount(10), earnings.Redeemed)
+		require.Equal(t, abi.NewTokenAmount(5), earnings.Pending)
+
+		// the redeemed amount survives, so the lane isn't submitted again
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 1)
+	})
+
+	t.Run("waits for messages to be confirmed", func(t *testing.T) {
+		node := newFakeVoucherNode()
+		node.unconfirmed = true
+		m := vouchermanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()), node, vouchermanager.Policy{MinRedeemAmount: abi.NewTokenAmount(10)})
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 20)))
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 1)
+
+		// the voucher is not submitted again, nor counted as redeemed, while
+		// its message is pending
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 1)
+		earnings, err := m.Earnings()
+		require.NoError(t, err)
+		require.Equal(t, big.Zero(), earnings.Redeemed)
+		require.Equal(t, abi.NewTokenAmount(20), earnings.Pending)
+
+		// a failed message is sent again
+		node.unconfirmed = false
+		node.exitCode = exitcode.ErrInsufficientFunds
+		require.NoError(t, m.Check(ctx))
+		require.Len(t, node.submitted, 2)
+
+		node.exitCode = exitcode.Ok
+		require.NoError(t, m.Check(ctx))
+		earnings, err = m.Earnings()
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(20), earnings.Redeemed)
+		require.Equal(t, big.Zero(), earnings.Pending)
+	})
+
+	t.Run("accepts a policy without a minimum redeem amount", func(t *testing.T) {
+		node := newFakeVoucherNode()
+		m := vouchermanager.NewManager(dss.MutexWrap(datastore.NewMapDatastore()), node, vouchermanager.Policy{})
+		require.NoError(t, m.AddVoucher(ch1, voucher(ch1, 0, 20)))
+		require.NoError(t, m.Check(ctx))
+		m.SetPolicy(vouchermanager.Policy{RedeemBeforeDeadline: 10})
+		require.NoError(t, m.Check(ctx))
+		require.Empty(t, node.submitted)
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
 	"github.com/filecoin-project/go-multistore"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
@@ -365,6 +366,7 @@ func MigrateAsk0To1(oldAsk *Ask0) (*retrievalmarket.Ask, error) {
 		UnsealPrice:             oldAsk.UnsealPrice,
 		PaymentInterval:         oldAsk.PaymentInterval,
 		PaymentIntervalIncrease: oldAsk.PaymentIntervalIncrease,
+		PriorityPricePerByte:    big.Zero(),
 	}, nil
 }
 
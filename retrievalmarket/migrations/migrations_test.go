@@ -11,18 +11,22 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
+	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	versionedfsm "github.com/filecoin-project/go-ds-versioning/pkg/fsm"
 	"github.com/filecoin-project/go-multistore"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 	tutils "github.com/filecoin-project/specs-actors/v2/support/testing"
 
+	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/piecestore/migrations"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/providerstates"
+	"github.com/filecoin-project/go-fil-markets/shared"
 )
 
 func TestClientStateMigration(t *testing.T) {
@@ -255,6 +259,34 @@ func (e *mockClientEnv) CloseDataTransfer(_ context.Context, _ datatransfer.Chan
 	return nil
 }
 
+func (e *mockClientEnv) AllocateLane(_ context.Context, _ retrievalmarket.ClientDealState, _ address.Address) (uint64, error) {
+	return 0, nil
+}
+
+func (e *mockClientEnv) CreatePaymentVoucher(_ context.Context, _ retrievalmarket.ClientDealState, _ abi.TokenAmount, _ shared.TipSetToken) (*paych.SignedVoucher, error) {
+	return nil, nil
+}
+
+func (e *mockClientEnv) ReserveFunds(_ retrievalmarket.ClientDealState, _ abi.TokenAmount) error {
+	return nil
+}
+
+func (e *mockClientEnv) ReleaseFunds(_ retrievalmarket.ClientDealState, _ abi.TokenAmount) error {
+	return nil
+}
+
+func (e *mockClientEnv) CheckBudget(_ retrievalmarket.ClientDealState, _ abi.TokenAmount) error {
+	return nil
+}
+
+func (e *mockClientEnv) ReserveFunding(_ retrievalmarket.ClientDealState, _ abi.TokenAmount) error {
+	return nil
+}
+
+func (e *mockClientEnv) ReleaseFunding(_ retrievalmarket.ClientDealState, _ abi.TokenAmount) error {
+	return nil
+}
+
 type mockProviderEnv struct {
 }
 
@@ -270,6 +302,21 @@ func (te *mockProviderEnv) ReadIntoBlockstore(storeID multistore.StoreID, pieceD
 	return nil
 }
 
+func (te *mockProviderEnv) UnsealSelected(ctx context.Context, deal retrievalmarket.ProviderDealState) (bool, error) {
+	return false, nil
+}
+
+func (te *mockProviderEnv) GetCachedPiece(pieceCID cid.Cid) (io.ReadCloser, bool) {
+	return nil, false
+}
+
+func (te *mockProviderEnv) CachePiece(pieceInfo piecestore.PieceInfo, pieceData io.ReadCloser) io.ReadCloser {
+	return pieceData
+}
+
+func (te *mockProviderEnv) QueueDeal(deal retrievalmarket.ProviderDealState) {
+}
+
 func (te *mockProviderEnv) TrackTransfer(deal retrievalmarket.ProviderDealState) error {
 	return nil
 }
@@ -278,6 +325,9 @@ func (te *mockProviderEnv) UntrackTransfer(deal retrievalmarket.ProviderDealStat
 	return nil
 }
 
+func (te *mockProviderEnv) WaitForCancelResponse(ctx context.Context, deal retrievalmarket.ProviderDealState) {
+}
+
 func (te *mockProviderEnv) ResumeDataTransfer(_ context.Context, _ datatransfer.ChannelID) error {
 	return nil
 }
@@ -43,6 +43,7 @@ func NewFromLibp2pHost(h host.Host, options ...Option) RetrievalMarketNetwork {
 		host:        h,
 		retryStream: shared.NewRetryStream(h),
 		supportedProtocols: []protocol.ID{
+			retrievalmarket.QueryProtocolID110,
 			retrievalmarket.QueryProtocolID,
 			retrievalmarket.OldQueryProtocolID,
 		},
@@ -75,7 +76,7 @@ func (impl *libp2pRetrievalMarketNetwork) NewQueryStream(id peer.ID) (RetrievalQ
 	if s.Protocol() == retrievalmarket.OldQueryProtocolID {
 		return &oldQueryStream{p: id, rw: s, buffered: buffered}, nil
 	}
-	return &queryStream{p: id, rw: s, buffered: buffered}, nil
+	return &queryStream{p: id, rw: s, buffered: buffered, noTermLimits: s.Protocol() == retrievalmarket.QueryProtocolID}, nil
 }
 
 // SetDelegate sets a RetrievalReceiver to handle stream data
@@ -107,9 +108,9 @@ func (impl *libp2pRetrievalMarketNetwork) handleNewQueryStream(s network.Stream)
 	buffered := bufio.NewReaderSize(s, 16)
 	var qs RetrievalQueryStream
 	if s.Protocol() == retrievalmarket.OldQueryProtocolID {
-		qs = &oldQueryStream{remotePID, s, buffered}
+		qs = &oldQueryStream{p: remotePID, rw: s, buffered: buffered}
 	} else {
-		qs = &queryStream{remotePID, s, buffered}
+		qs = &queryStream{p: remotePID, rw: s, buffered: buffered, noTermLimits: s.Protocol() == retrievalmarket.QueryProtocolID}
 	}
 	impl.receiver.HandleQueryStream(qs)
 }
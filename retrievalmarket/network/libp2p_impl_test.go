@@ -10,6 +10,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/filecoin-project/go-state-types/abi"
+
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
@@ -168,6 +170,72 @@ func TestQueryStreamSendReceiveMultipleSuccessful(t *testing.T) {
 	assert.Equal(t, qr, resp)
 }
 
+func TestQueryStreamTermLimits(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := map[string]struct {
+		senderProtocols   []protocol.ID
+		receiverProtocols []protocol.ID
+		response          retrievalmarket.QueryResponseStatus
+		expectedStatus    retrievalmarket.QueryResponseStatus
+	}{
+		"both clients current version passes on the provider's check": {
+			response:       retrievalmarket.QueryResponseAvailable,
+			expectedStatus: retrievalmarket.QueryResponseAvailable,
+		},
+		"receiver without term limits is checked by the sender": {
+			receiverProtocols: []protocol.ID{retrievalmarket.QueryProtocolID},
+			response:          retrievalmarket.QueryResponseAvailable,
+			expectedStatus:    retrievalmarket.QueryResponseTermsUnacceptable,
+		},
+		"receiver only supporting old queries is checked by the sender": {
+			receiverProtocols: []protocol.ID{retrievalmarket.OldQueryProtocolID},
+			response:          retrievalmarket.QueryResponseAvailable,
+			expectedStatus:    retrievalmarket.QueryResponseTermsUnacceptable,
+		},
+		"sender without term limits receives unavailable": {
+			senderProtocols: []protocol.ID{retrievalmarket.QueryProtocolID},
+			response:        retrievalmarket.QueryResponseTermsUnacceptable,
+			expectedStatus:  retrievalmarket.QueryResponseUnavailable,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			td := shared_testutil.NewLibp2pTestData(ctx, t)
+			var fromOpts, toOpts []network.Option
+			if data.senderProtocols != nil {
+				fromOpts = append(fromOpts, network.SupportedProtocols(data.senderProtocols))
+			}
+			if data.receiverProtocols != nil {
+				toOpts = append(toOpts, network.SupportedProtocols(data.receiverProtocols))
+			}
+			fromNetwork := network.NewFromLibp2pHost(td.Host1, fromOpts...)
+			toNetwork := network.NewFromLibp2pHost(td.Host2, toOpts...)
+			require.NoError(t, td.Host1.Connect(ctx, peer.AddrInfo{ID: td.Host2.ID()}))
+
+			// host2 answers with a price above the query's limit
+			qr := shared_testutil.MakeTestQueryResponse()
+			qr.Status = data.response
+			qr.MinPricePerByte = abi.NewTokenAmount(10)
+			tr2 := &testReceiver{t: t, queryStreamHandler: func(s network.RetrievalQueryStream) {
+				_, err := s.ReadQuery()
+				require.NoError(t, err)
+				require.NoError(t, s.WriteQueryResponse(qr))
+			}}
+			require.NoError(t, toNetwork.SetDelegate(tr2))
+
+			qs, err := fromNetwork.NewQueryStream(td.Host2.ID())
+			require.NoError(t, err)
+			q := retrievalmarket.NewQueryV0(shared_testutil.GenerateCids(1)[0])
+			q.MaxPricePerByte = abi.NewTokenAmount(5)
+			require.NoError(t, qs.WriteQuery(q))
+			resp, err := qs.ReadQueryResponse()
+			require.NoError(t, err)
+			require.Equal(t, data.expectedStatus, resp.Status)
+		})
+	}
+}
+
 func TestLibp2pRetrievalMarketNetwork_StopHandlingRequests(t *testing.T) {
 	bgCtx := context.Background()
 	td := shared_testutil.NewLibp2pTestData(bgCtx, t)
@@ -16,6 +16,7 @@ type oldQueryStream struct {
 	p        peer.ID
 	rw       mux.MuxedStream
 	buffered *bufio.Reader
+	params   retrievalmarket.QueryParams
 }
 
 var _ RetrievalQueryStream = (*oldQueryStream)(nil)
@@ -37,6 +38,7 @@ func (qs *oldQueryStream) ReadQuery() (retrievalmarket.Query, error) {
 }
 
 func (qs *oldQueryStream) WriteQuery(newQ retrievalmarket.Query) error {
+	qs.params = newQ.QueryParams
 	q := migrations.Query0{
 		PayloadCID: newQ.PayloadCID,
 		QueryParams0: migrations.QueryParams0{
@@ -55,10 +57,13 @@ func (qs *oldQueryStream) ReadQueryResponse() (retrievalmarket.QueryResponse, er
 		return retrievalmarket.QueryResponseUndefined, err
 	}
 
-	return migrations.MigrateQueryResponse0To1(resp), nil
+	// the provider never saw a selector, so SelectorFound is left unknown
+	newResp := migrations.MigrateQueryResponse0To1(resp)
+	return applyTermLimits(qs.params, newResp), nil
 }
 
 func (qs *oldQueryStream) WriteQueryResponse(newQr retrievalmarket.QueryResponse) error {
+	newQr = withoutTermLimits(newQr)
 	qr := migrations.QueryResponse0{
 		Status:                     newQr.Status,
 		PieceCIDFound:              newQr.PieceCIDFound,
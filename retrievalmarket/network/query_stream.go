@@ -15,6 +15,11 @@ type queryStream struct {
 	p        peer.ID
 	rw       mux.MuxedStream
 	buffered *bufio.Reader
+
+	// noTermLimits is set when the stream's protocol version predates term
+	// limits, so the provider does not check them
+	noTermLimits bool
+	params       retrievalmarket.QueryParams
 }
 
 var _ RetrievalQueryStream = (*queryStream)(nil)
@@ -36,6 +41,7 @@ func (qs *queryStream) RemotePeer() peer.ID {
 }
 
 func (qs *queryStream) WriteQuery(q retrievalmarket.Query) error {
+	qs.params = q.QueryParams
 	return cborutil.WriteCborRPC(qs.rw, &q)
 }
 
@@ -47,13 +53,41 @@ func (qs *queryStream) ReadQueryResponse() (retrievalmarket.QueryResponse, error
 		return retrievalmarket.QueryResponseUndefined, err
 	}
 
+	if qs.noTermLimits {
+		resp = applyTermLimits(qs.params, resp)
+	}
 	return resp, nil
 }
 
 func (qs *queryStream) WriteQueryResponse(qr retrievalmarket.QueryResponse) error {
+	if qs.noTermLimits {
+		qr = withoutTermLimits(qr)
+	}
 	return cborutil.WriteCborRPC(qs.rw, &qr)
 }
 
 func (qs *queryStream) Close() error {
 	return qs.rw.Close()
 }
+
+// applyTermLimits checks a response from a provider that does not support term
+// limits against the limits in the query, as a provider that does would have
+func applyTermLimits(params retrievalmarket.QueryParams, resp retrievalmarket.QueryResponse) retrievalmarket.QueryResponse {
+	if resp.Status != retrievalmarket.QueryResponseAvailable {
+		return resp
+	}
+	if err := params.CheckTerms(resp.MinPricePerByte, resp.MaxPaymentInterval, resp.MaxPaymentIntervalIncrease); err != nil {
+		resp.Status = retrievalmarket.QueryResponseTermsUnacceptable
+		resp.Message = err.Error()
+	}
+	return resp
+}
+
+// withoutTermLimits converts a response for a client that does not support
+// term limits, which does not know the terms unacceptable status
+func withoutTermLimits(resp retrievalmarket.QueryResponse) retrievalmarket.QueryResponse {
+	if resp.Status == retrievalmarket.QueryResponseTermsUnacceptable {
+		resp.Status = retrievalmarket.QueryResponseUnavailable
+	}
+	return resp
+}
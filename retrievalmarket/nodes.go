@@ -9,6 +9,7 @@ import (
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/exitcode"
 	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -42,6 +43,25 @@ type RetrievalClientNode interface {
 
 	// GetKnownAddresses gets any on known multiaddrs for a given address, so we can add to the peer store
 	GetKnownAddresses(ctx context.Context, p RetrievalPeer, tok shared.TipSetToken) ([]ma.Multiaddr, error)
+
+	// SettlePaymentChannel starts settling a payment channel, after which no
+	// more vouchers can be made on it, and returns the cid of the message. Once
+	// a channel is settling, GetOrCreatePaymentChannel must create a new
+	// channel rather than return it.
+	SettlePaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error)
+
+	// GetPaymentChannelSettlingAt returns the epoch at which the payment channel
+	// settles, or zero if no one has started settling it
+	GetPaymentChannelSettlingAt(ctx context.Context, paymentChannel address.Address, tok shared.TipSetToken) (abi.ChainEpoch, error)
+
+	// CollectPaymentChannel collects the funds from a settled payment channel,
+	// returning what the provider has not redeemed to the client, and returns
+	// the cid of the message
+	CollectPaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error)
+
+	// SearchMessage looks up a message on chain without waiting for it, and
+	// returns whether it has been executed and, if so, its exit code
+	SearchMessage(ctx context.Context, msg cid.Cid) (bool, exitcode.ExitCode, error)
 }
 
 // RetrievalProviderNode are the node depedencies for a RetrevalProvider
@@ -50,6 +70,10 @@ type RetrievalProviderNode interface {
 
 	// returns the worker address associated with a miner
 	GetMinerWorkerAddress(ctx context.Context, miner address.Address, tok shared.TipSetToken) (address.Address, error)
+
+	// unseals the given range of a sector. The offset is always a multiple of
+	// 127 bytes and the length a valid unpadded piece size, so the range can be
+	// unsealed from the fr32 padded sector data.
 	UnsealSector(ctx context.Context, sectorID abi.SectorNumber, offset abi.UnpaddedPieceSize, length abi.UnpaddedPieceSize) (io.ReadCloser, error)
 	SavePaymentVoucher(ctx context.Context, paymentChannel address.Address, voucher *paych.SignedVoucher, proof []byte, expectedAmount abi.TokenAmount, tok shared.TipSetToken) (abi.TokenAmount, error)
 
@@ -57,3 +81,26 @@ type RetrievalProviderNode interface {
 
 	GetRetrievalPricingInput(ctx context.Context, pieceCID cid.Cid, storageDeals []abi.DealID) (PricingInput, error)
 }
+
+// RetrievalProviderVoucherNode is the node dependencies for redeeming the
+// payment vouchers a RetrievalProvider receives. It is optional: providers
+// whose node implements it can redeem vouchers automatically.
+type RetrievalProviderVoucherNode interface {
+	GetChainHead(ctx context.Context) (shared.TipSetToken, abi.ChainEpoch, error)
+
+	// GetPaymentChannelSettlingAt returns the epoch at which the payment channel
+	// settles, or zero if no one has started settling it
+	GetPaymentChannelSettlingAt(ctx context.Context, paymentChannel address.Address, tok shared.TipSetToken) (abi.ChainEpoch, error)
+
+	// SubmitPaymentVoucher submits a voucher to its payment channel on chain and
+	// returns the cid of the message
+	SubmitPaymentVoucher(ctx context.Context, paymentChannel address.Address, voucher *paych.SignedVoucher) (cid.Cid, error)
+
+	// CollectPaymentChannel collects the funds from a settled payment channel
+	// and returns the cid of the message
+	CollectPaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error)
+
+	// SearchMessage looks up a message on chain without waiting for it, and
+	// returns whether it has been executed and, if so, its exit code
+	SearchMessage(ctx context.Context, msg cid.Cid) (bool, exitcode.ExitCode, error)
+}
@@ -31,6 +31,20 @@ type RetrievalProvider interface {
 	SubscribeToEvents(subscriber ProviderSubscriber) Unsubscribe
 
 	ListDeals() map[ProviderDealIdentifier]ProviderDealState
+
+	// GetDeal returns the state of a single retrieval deal
+	GetDeal(dealID ProviderDealIdentifier) (ProviderDealState, error)
+
+	// FilterDeals returns the retrieval deals that match the filter, oldest
+	// first
+	FilterDeals(filter ProviderDealFilter) ([]ProviderDealState, error)
+
+	// CancelDeal stops a retrieval deal and closes its data transfer, recording
+	// the reason in the deal's message
+	CancelDeal(dealID ProviderDealIdentifier, reason string) error
+
+	// QueueStats returns metrics for the queue of deals waiting to be served
+	QueueStats() ProviderQueueStats
 }
 
 // AskStore is an interface which provides access to a persisted retrieval Ask
@@ -5,9 +5,12 @@ import (
 	"context"
 	"io"
 
+	"github.com/ipfs/go-cid"
+
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-multistore"
 
+	"github.com/filecoin-project/go-fil-markets/piecestore"
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	retrievalimpl "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl"
 )
@@ -18,10 +21,15 @@ type TestProviderDealEnvironment struct {
 	node                    rm.RetrievalProviderNode
 	ResumeDataTransferError error
 	ReadIntoBlockstoreError error
+	UnsealSelectedResult    bool
+	UnsealSelectedError     error
 	TrackTransferError      error
 	UntrackTransferError    error
 	CloseDataTransferError  error
 	DeleteStoreError        error
+	CachedPieces            map[cid.Cid]io.ReadCloser
+	PiecesCached            []cid.Cid
+	QueuedDeals             []rm.ProviderDealState
 }
 
 // NewTestProviderDealEnvironment returns a new TestProviderDealEnvironment instance
@@ -44,6 +52,32 @@ func (te *TestProviderDealEnvironment) ReadIntoBlockstore(storeID multistore.Sto
 	return te.ReadIntoBlockstoreError
 }
 
+// UnsealSelected returns UnsealSelectedResult and UnsealSelectedError
+func (te *TestProviderDealEnvironment) UnsealSelected(_ context.Context, _ rm.ProviderDealState) (bool, error) {
+	return te.UnsealSelectedResult, te.UnsealSelectedError
+}
+
+// GetCachedPiece returns the reader in CachedPieces for the given piece, if present
+func (te *TestProviderDealEnvironment) GetCachedPiece(pieceCID cid.Cid) (io.ReadCloser, bool) {
+	reader, ok := te.CachedPieces[pieceCID]
+	return reader, ok
+}
+
+// CachePiece records the piece in PiecesCached and returns the reader unchanged
+func (te *TestProviderDealEnvironment) CachePiece(pieceInfo piecestore.PieceInfo, pieceData io.ReadCloser) io.ReadCloser {
+	te.PiecesCached = append(te.PiecesCached, pieceInfo.PieceCID)
+	return pieceData
+}
+
+// QueueDeal records the deal in QueuedDeals
+func (te *TestProviderDealEnvironment) QueueDeal(deal rm.ProviderDealState) {
+	te.QueuedDeals = append(te.QueuedDeals, deal)
+}
+
+// WaitForCancelResponse does nothing
+func (te *TestProviderDealEnvironment) WaitForCancelResponse(_ context.Context, _ rm.ProviderDealState) {
+}
+
 func (te *TestProviderDealEnvironment) TrackTransfer(deal rm.ProviderDealState) error {
 	return te.TrackTransferError
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
@@ -25,6 +26,10 @@ import (
 
 //go:generate cbor-gen-for --map-encoding Query QueryResponse DealProposal DealResponse Params QueryParams DealPayment ClientDealState ProviderDealState PaymentInfo RetrievalPeer Ask
 
+// QueryProtocolID110 is the protocol for querying information about retrieval
+// deal parameters, where the provider checks the client's price limits
+const QueryProtocolID110 = protocol.ID("/fil/retrieval/qry/1.1.0")
+
 // QueryProtocolID is the protocol for querying information about retrieval
 // deal parameters
 const QueryProtocolID = protocol.ID("/fil/retrieval/qry/1.0.0")
@@ -87,6 +92,9 @@ type ProviderDealState struct {
 	Message         string
 	CurrentInterval uint64
 	LegacyProtocol  bool
+	// CreatedAt is the Unix time in seconds at which the provider received the
+	// deal. It is zero for deals received before it was recorded.
+	CreatedAt int64
 }
 
 func (deal *ProviderDealState) IntervalLowerBound() uint64 {
@@ -112,6 +120,71 @@ func (p ProviderDealIdentifier) String() string {
 	return fmt.Sprintf("%v/%v", p.Receiver, p.DealID)
 }
 
+// ProviderDealFilter selects deals from those known to a retrieval provider.
+// Conditions that are left empty match every deal.
+type ProviderDealFilter struct {
+	// Statuses are the statuses of the deals to select
+	Statuses []DealStatus
+	// Client is the peer the deals are with
+	Client peer.ID
+	// CreatedAfter and CreatedBefore bound the time the deals were received
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Offset is the number of matching deals to skip, and Limit is the most
+	// deals to return, or zero to return them all
+	Offset int
+	Limit  int
+}
+
+// Matches returns true if the deal meets all the filter's conditions
+func (f ProviderDealFilter) Matches(deal ProviderDealState) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, status := range f.Statuses {
+			if deal.Status == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Client != "" && deal.Receiver != f.Client {
+		return false
+	}
+	createdAt := time.Unix(deal.CreatedAt, 0)
+	if !f.CreatedAfter.IsZero() && !createdAt.After(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !createdAt.Before(f.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// ProviderQueueStats are metrics for the queue of deals waiting for a
+// provider to have capacity to serve them
+type ProviderQueueStats struct {
+	// Queued is the number of deals waiting in the queue
+	Queued int
+	// Unsealing is the number of started deals that are unsealing
+	Unsealing int
+	// Active is the number of deals that have started and not yet finished
+	Active int
+	// QueuedPerClient is the number of queued deals for each client
+	QueuedPerClient map[peer.ID]int
+	// ActivePerClient is the number of active deals for each client
+	ActivePerClient map[peer.ID]int
+	// LongestWait is how long the deal at the front of the queue has been waiting
+	LongestWait time.Duration
+	// TotalStarted is the number of deals that have been started from the queue
+	TotalStarted uint64
+	// TotalWaitTime is the total time started deals spent waiting in the queue
+	TotalWaitTime time.Duration
+}
+
 // RetrievalPeer is a provider address/peer.ID pair (everything needed to make
 // deals for with a miner)
 type RetrievalPeer struct {
@@ -134,10 +207,14 @@ const (
 
 	// QueryResponseError indicates something went wrong generating a query response
 	QueryResponseError
+
+	// QueryResponseTermsUnacceptable indicates a provider has the piece, but its
+	// terms for serving it are outside the limits the client set in its query
+	QueryResponseTermsUnacceptable
 )
 
-// QueryItemStatus (V1) indicates whether the requested part of a piece (payload or selector)
-// is available for retrieval
+// QueryItemStatus (V1) indicates whether the requested part of a piece is
+// available for retrieval
 type QueryItemStatus uint64
 
 const (
@@ -155,15 +232,58 @@ const (
 	QueryItemUnknown
 )
 
+// SelectorStatus (V1) indicates whether a provider holds the blocks a query's
+// selector reaches. Its zero value is unknown, so that a response from a
+// provider that does not check selectors is not taken to mean the selection
+// is available.
+type SelectorStatus uint64
+
+const (
+	// SelectorUnknown indicates the provider did not or could not check
+	// whether it holds the selection (for example, if the piece is sealed)
+	SelectorUnknown SelectorStatus = iota
+
+	// SelectorAvailable indicates the provider holds every block the selector
+	// reaches
+	SelectorAvailable
+
+	// SelectorUnavailable indicates a block the selector reaches is missing
+	// from the piece, or the selector is invalid
+	SelectorUnavailable
+)
+
 // QueryParams - V1 - indicate what specific information about a piece that a retrieval
 // client is interested in, as well as specific parameters the client is seeking
 // for the retrieval deal
 type QueryParams struct {
-	PieceCID *cid.Cid // optional, query if miner has this cid in this piece. some miners may not be able to respond.
-	//Selector                   ipld.Node // optional, query if miner has this cid in this piece. some miners may not be able to respond.
-	//MaxPricePerByte            abi.TokenAmount    // optional, tell miner uninterested if more expensive than this
-	//MinPaymentInterval         uint64    // optional, tell miner uninterested unless payment interval is greater than this
-	//MinPaymentIntervalIncrease uint64    // optional, tell miner uninterested unless payment interval increase is greater than this
+	PieceCID *cid.Cid      // optional, query if miner has this cid in this piece. some miners may not be able to respond.
+	Selector *cbg.Deferred // optional, query if miner has the blocks this selector reaches under the payload CID. some miners may not be able to respond.
+
+	MaxPricePerByte            abi.TokenAmount // optional, tell miner uninterested if more expensive than this
+	MinPaymentInterval         uint64          // optional, tell miner uninterested unless payment interval is greater than this
+	MinPaymentIntervalIncrease uint64          // optional, tell miner uninterested unless payment interval increase is greater than this
+}
+
+// SelectorSpecified returns whether the query asks about a selection of the
+// payload rather than the whole DAG
+func (qp QueryParams) SelectorSpecified() bool {
+	return qp.Selector != nil && !bytes.Equal(qp.Selector.Raw, cbg.CborNull)
+}
+
+// CheckTerms returns an error describing the first of the given deal terms
+// that is outside the query's limits, or nil if the client would accept them.
+// Limits that are not set are not checked.
+func (qp QueryParams) CheckTerms(pricePerByte abi.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64) error {
+	if !qp.MaxPricePerByte.Nil() && qp.MaxPricePerByte.GreaterThan(big.Zero()) && pricePerByte.GreaterThan(qp.MaxPricePerByte) {
+		return xerrors.Errorf("price per byte %s is more than the maximum %s", pricePerByte, qp.MaxPricePerByte)
+	}
+	if paymentInterval < qp.MinPaymentInterval {
+		return xerrors.Errorf("payment interval %d is less than the minimum %d", paymentInterval, qp.MinPaymentInterval)
+	}
+	if paymentIntervalIncrease < qp.MinPaymentIntervalIncrease {
+		return xerrors.Errorf("payment interval increase %d is less than the minimum %d", paymentIntervalIncrease, qp.MinPaymentIntervalIncrease)
+	}
+	return nil
 }
 
 // Query is a query to a given provider to determine information about a piece
@@ -191,14 +311,37 @@ func NewQueryV1(payloadCID cid.Cid, pieceCID *cid.Cid) Query {
 	}
 }
 
+// NewQueryV1WithSelector creates a V1 query asking about the blocks the given
+// selector reaches under the payload CID
+func NewQueryV1WithSelector(payloadCID cid.Cid, pieceCID *cid.Cid, sel ipld.Node) (Query, error) {
+	var buffer bytes.Buffer
+
+	if sel == nil {
+		return Query{}, xerrors.New("selector required for NewQueryV1WithSelector")
+	}
+
+	err := dagcbor.Encoder(sel, &buffer)
+	if err != nil {
+		return Query{}, xerrors.Errorf("error encoding selector: %w", err)
+	}
+
+	return Query{
+		PayloadCID: payloadCID,
+		QueryParams: QueryParams{
+			PieceCID: pieceCID,
+			Selector: &cbg.Deferred{Raw: buffer.Bytes()},
+		},
+	}, nil
+}
+
 // QueryResponse is a miners response to a given retrieval query
 type QueryResponse struct {
 	Status        QueryResponseStatus
 	PieceCIDFound QueryItemStatus // V1 - if a PieceCID was requested, the result
-	//SelectorFound   QueryItemStatus // V1 - if a Selector was requested, the result
+	SelectorFound SelectorStatus  // V1 - if a Selector was requested, the result
 
-	Size uint64 // Total size of piece in bytes
-	//ExpectedPayloadSize uint64 // V1 - optional, if PayloadCID + selector are specified and miner knows, can offer an expected size
+	Size                uint64 // Total size of piece in bytes
+	ExpectedPayloadSize uint64 // V1 - optional, if PayloadCID + selector are specified and miner knows, can offer an expected size
 
 	PaymentAddress             address.Address // address to send funds to -- may be different than miner addr
 	MinPricePerByte            abi.TokenAmount
@@ -217,10 +360,10 @@ func (qr QueryResponse) PieceRetrievalPrice() abi.TokenAmount {
 }
 
 // PayloadRetrievalPrice is the expected price to retrieve just the given payload
-// & selector (V1)
-//func (qr QueryResponse) PayloadRetrievalPrice() abi.TokenAmount {
-//	return types.BigMul(qr.MinPricePerByte, types.NewInt(qr.ExpectedPayloadSize))
-//}
+// & selector (ExpectedPayloadSize * MinPricePerByte + UnsealPrice) (V1)
+func (qr QueryResponse) PayloadRetrievalPrice() abi.TokenAmount {
+	return big.Add(big.Mul(qr.MinPricePerByte, abi.NewTokenAmount(int64(qr.ExpectedPayloadSize))), qr.UnsealPrice)
+}
 
 // IsTerminalError returns true if this status indicates processing of this deal
 // is complete with an error
@@ -256,6 +399,13 @@ func (p Params) SelectorSpecified() bool {
 	return p.Selector != nil && !bytes.Equal(p.Selector.Raw, cbg.CborNull)
 }
 
+// IsFree returns true if retrieving with these parameters costs nothing, in
+// which case no payment channel is needed
+func (p Params) IsFree() bool {
+	return (p.PricePerByte.Nil() || p.PricePerByte.IsZero()) &&
+		(p.UnsealPrice.Nil() || p.UnsealPrice.IsZero())
+}
+
 func (p Params) IntervalLowerBound(currentInterval uint64) uint64 {
 	intervalSize := p.PaymentInterval
 	var lowerBound uint64
@@ -373,6 +523,13 @@ var (
 
 	// ErrVerification means a retrieval contained a block response that did not verify
 	ErrVerification = errors.New("Error when verify data")
+
+	// ErrNoProviders means no provider could serve a retrieval
+	ErrNoProviders = errors.New("no providers available for retrieval")
+
+	// ErrBudgetExceeded means a payment would exceed one of the client's
+	// spending budgets
+	ErrBudgetExceeded = errors.New("retrieval spending budget exceeded")
 )
 
 type Ask struct {
@@ -380,6 +537,19 @@ type Ask struct {
 	UnsealPrice             abi.TokenAmount
 	PaymentInterval         uint64
 	PaymentIntervalIncrease uint64
+	// PriorityPricePerByte is the price per byte at or above which a deal's
+	// data is sent with the provider's priority bandwidth limits. A zero or
+	// unset price means there is no priority tier.
+	PriorityPricePerByte abi.TokenAmount
+}
+
+// IsPriority returns true if a deal at the given price per byte is in the
+// ask's priority tier
+func (a Ask) IsPriority(pricePerByte abi.TokenAmount) bool {
+	if a.PriorityPricePerByte.Nil() || a.PriorityPricePerByte.LessThanEqual(big.Zero()) || pricePerByte.Nil() {
+		return false
+	}
+	return pricePerByte.GreaterThanEqual(a.PriorityPricePerByte)
 }
 
 // ShortfallErorr is an error that indicates a short fall of funds
@@ -425,6 +595,10 @@ type PricingInput struct {
 	PieceCID cid.Cid
 	// PieceSize is the size of the Piece from which the payload will be retrieved.
 	PieceSize abi.UnpaddedPieceSize
+	// UnsealSize is the number of bytes of the Piece that need to be unsealed when only
+	// part of the Piece is needed to serve a selector retrieval. It is zero if the whole
+	// Piece would be unsealed.
+	UnsealSize abi.UnpaddedPieceSize
 	// Client is the peerID of the retrieval client.
 	Client peer.ID
 	// VerifiedDeal is true if there exists a verified storage deal for the PayloadCID.
@@ -434,3 +608,78 @@ type PricingInput struct {
 	// CurrentAsk is the current configured ask in the ask-store.
 	CurrentAsk Ask
 }
+
+// AdjustAsk applies the rules every pricing policy shares to an ask for this
+// input: unsealing is free when there's an unsealed copy, only the part of the
+// piece that needs to be unsealed is charged for, and if
+// verifiedDealsFreeTransfer is set, transfer is free for verified deals.
+func (input PricingInput) AdjustAsk(ask Ask, verifiedDealsFreeTransfer bool) Ask {
+	// don't charge for Unsealing if we have an Unsealed copy.
+	if input.Unsealed {
+		ask.UnsealPrice = big.Zero()
+	}
+
+	// only charge for the part of the piece that needs to be unsealed.
+	if input.UnsealSize > 0 && input.UnsealSize < input.PieceSize && !ask.UnsealPrice.Nil() {
+		ask.UnsealPrice = big.Div(big.Mul(ask.UnsealPrice, big.NewIntUnsigned(uint64(input.UnsealSize))),
+			big.NewIntUnsigned(uint64(input.PieceSize)))
+	}
+
+	// don't charge for data transfer for verified deals if it's been configured to do so.
+	if input.VerifiedDeal && verifiedDealsFreeTransfer {
+		ask.PricePerByte = big.Zero()
+	}
+	return ask
+}
+
+// FailoverParams are the parameters of a retrieval that fails over between
+// providers
+type FailoverParams struct {
+	// QueryParams are sent with the query to each provider, and limit the
+	// terms the client will accept
+	QueryParams
+	// StallTimeout is how long a deal may go without receiving any data
+	// before it is cancelled and the next provider is tried. Zero means deals
+	// are never treated as stalled.
+	StallTimeout time.Duration
+}
+
+// FailoverAttempt is a deal made during a retrieval with failover
+type FailoverAttempt struct {
+	Provider peer.ID
+	DealID   DealID
+	// PayloadCID is the root of the part of the DAG the deal retrieved
+	PayloadCID cid.Cid
+	// Err is why the deal failed, or empty if it succeeded
+	Err string
+}
+
+// FailoverResult is the outcome of a retrieval with failover
+type FailoverResult struct {
+	// StoreID is the store the payload was retrieved into
+	StoreID multistore.StoreID
+	// Provider is the provider that finished the retrieval
+	Provider peer.ID
+	// Attempts are the deals that were made, in order
+	Attempts []FailoverAttempt
+}
+
+// ExportFormat is the format a retrieved DAG is exported in
+type ExportFormat string
+
+const (
+	// ExportCAR writes the DAG to a CAR file
+	ExportCAR ExportFormat = "car"
+	// ExportUnixFS reconstructs the UnixFS file or directory the DAG encodes
+	ExportUnixFS ExportFormat = "unixfs"
+)
+
+// ExportParams are the parameters for exporting the DAG retrieved by a deal
+type ExportParams struct {
+	Format ExportFormat
+	// Path is where the CAR file, or the UnixFS file or directory, is
+	// written. It must not already exist.
+	Path string
+	// DeleteStore deletes the deal's store once the export has succeeded
+	DeleteStore bool
+}
@@ -136,7 +136,7 @@ func (t *QueryResponse) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{169}); err != nil {
+	if _, err := w.Write([]byte{171}); err != nil {
 		return err
 	}
 
@@ -174,6 +174,22 @@ func (t *QueryResponse) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// t.SelectorFound (retrievalmarket.SelectorStatus) (uint64)
+	if len("SelectorFound") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"SelectorFound\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("SelectorFound"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("SelectorFound")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.SelectorFound)); err != nil {
+		return err
+	}
+
 	// t.Size (uint64) (uint64)
 	if len("Size") > cbg.MaxLength {
 		return xerrors.Errorf("Value in field \"Size\" was too long")
@@ -190,6 +206,22 @@ func (t *QueryResponse) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// t.ExpectedPayloadSize (uint64) (uint64)
+	if len("ExpectedPayloadSize") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"ExpectedPayloadSize\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("ExpectedPayloadSize"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("ExpectedPayloadSize")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.ExpectedPayloadSize)); err != nil {
+		return err
+	}
+
 	// t.PaymentAddress (address.Address) (struct)
 	if len("PaymentAddress") > cbg.MaxLength {
 		return xerrors.Errorf("Value in field \"PaymentAddress\" was too long")
@@ -357,6 +389,21 @@ func (t *QueryResponse) UnmarshalCBOR(r io.Reader) error {
 				}
 				t.PieceCIDFound = QueryItemStatus(extra)
 
+			}
+			// t.SelectorFound (retrievalmarket.SelectorStatus) (uint64)
+		case "SelectorFound":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.SelectorFound = SelectorStatus(extra)
+
 			}
 			// t.Size (uint64) (uint64)
 		case "Size":
@@ -372,6 +419,21 @@ func (t *QueryResponse) UnmarshalCBOR(r io.Reader) error {
 				}
 				t.Size = uint64(extra)
 
+			}
+			// t.ExpectedPayloadSize (uint64) (uint64)
+		case "ExpectedPayloadSize":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.ExpectedPayloadSize = uint64(extra)
+
 			}
 			// t.PaymentAddress (address.Address) (struct)
 		case "PaymentAddress":
@@ -1017,7 +1079,7 @@ func (t *QueryParams) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{161}); err != nil {
+	if _, err := w.Write([]byte{165}); err != nil {
 		return err
 	}
 
@@ -1045,6 +1107,70 @@ func (t *QueryParams) MarshalCBOR(w io.Writer) error {
 		}
 	}
 
+	// t.Selector (typegen.Deferred) (struct)
+	if len("Selector") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Selector\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Selector"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Selector")); err != nil {
+		return err
+	}
+
+	if err := t.Selector.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.MaxPricePerByte (big.Int) (struct)
+	if len("MaxPricePerByte") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"MaxPricePerByte\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("MaxPricePerByte"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("MaxPricePerByte")); err != nil {
+		return err
+	}
+
+	if err := t.MaxPricePerByte.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.MinPaymentInterval (uint64) (uint64)
+	if len("MinPaymentInterval") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"MinPaymentInterval\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("MinPaymentInterval"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("MinPaymentInterval")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.MinPaymentInterval)); err != nil {
+		return err
+	}
+
+	// t.MinPaymentIntervalIncrease (uint64) (uint64)
+	if len("MinPaymentIntervalIncrease") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"MinPaymentIntervalIncrease\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("MinPaymentIntervalIncrease"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("MinPaymentIntervalIncrease")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.MinPaymentIntervalIncrease)); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -1104,6 +1230,57 @@ func (t *QueryParams) UnmarshalCBOR(r io.Reader) error {
 				}
 
 			}
+			// t.Selector (typegen.Deferred) (struct)
+		case "Selector":
+
+			{
+
+				t.Selector = new(cbg.Deferred)
+
+				if err := t.Selector.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("failed to read deferred field: %w", err)
+				}
+			}
+			// t.MaxPricePerByte (big.Int) (struct)
+		case "MaxPricePerByte":
+
+			{
+
+				if err := t.MaxPricePerByte.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.MaxPricePerByte: %w", err)
+				}
+
+			}
+			// t.MinPaymentInterval (uint64) (uint64)
+		case "MinPaymentInterval":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.MinPaymentInterval = uint64(extra)
+
+			}
+			// t.MinPaymentIntervalIncrease (uint64) (uint64)
+		case "MinPaymentIntervalIncrease":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.MinPaymentIntervalIncrease = uint64(extra)
+
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -1987,7 +2164,7 @@ func (t *ProviderDealState) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{171}); err != nil {
+	if _, err := w.Write([]byte{172}); err != nil {
 		return err
 	}
 
@@ -2182,6 +2359,28 @@ func (t *ProviderDealState) MarshalCBOR(w io.Writer) error {
 	if err := cbg.WriteBool(w, t.LegacyProtocol); err != nil {
 		return err
 	}
+
+	// t.CreatedAt (int64) (int64)
+	if len("CreatedAt") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"CreatedAt\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("CreatedAt"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("CreatedAt")); err != nil {
+		return err
+	}
+
+	if t.CreatedAt >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.CreatedAt)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.CreatedAt-1)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -2378,6 +2577,32 @@ func (t *ProviderDealState) UnmarshalCBOR(r io.Reader) error {
 			default:
 				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
 			}
+			// t.CreatedAt (int64) (int64)
+		case "CreatedAt":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.CreatedAt = int64(extraI)
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -2666,7 +2891,7 @@ func (t *Ask) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{164}); err != nil {
+	if _, err := w.Write([]byte{165}); err != nil {
 		return err
 	}
 
@@ -2736,6 +2961,22 @@ func (t *Ask) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// t.PriorityPricePerByte (big.Int) (struct)
+	if len("PriorityPricePerByte") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"PriorityPricePerByte\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("PriorityPricePerByte"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("PriorityPricePerByte")); err != nil {
+		return err
+	}
+
+	if err := t.PriorityPricePerByte.MarshalCBOR(w); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -2822,6 +3063,16 @@ func (t *Ask) UnmarshalCBOR(r io.Reader) error {
 				t.PaymentIntervalIncrease = uint64(extra)
 
 			}
+			// t.PriorityPricePerByte (big.Int) (struct)
+		case "PriorityPricePerByte":
+
+			{
+
+				if err := t.PriorityPricePerByte.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.PriorityPricePerByte: %w", err)
+				}
+
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
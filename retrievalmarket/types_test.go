@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
@@ -118,3 +119,92 @@ func TestParamsIntervalBounds(t *testing.T) {
 		})
 	}
 }
+
+func TestAskIsPriority(t *testing.T) {
+	ask := retrievalmarket.Ask{PricePerByte: abi.NewTokenAmount(1)}
+	require.False(t, ask.IsPriority(abi.NewTokenAmount(100)))
+
+	ask.PriorityPricePerByte = big.Zero()
+	require.False(t, ask.IsPriority(abi.NewTokenAmount(100)))
+
+	ask.PriorityPricePerByte = abi.NewTokenAmount(10)
+	require.False(t, ask.IsPriority(abi.NewTokenAmount(9)))
+	require.True(t, ask.IsPriority(abi.NewTokenAmount(10)))
+	require.True(t, ask.IsPriority(abi.NewTokenAmount(11)))
+}
+
+func TestQueryWithSelectorMarshalUnmarshal(t *testing.T) {
+	payloadCid := tut.GenerateCids(1)[0]
+	allSelector := shared.AllSelector()
+	query, err := retrievalmarket.NewQueryV1WithSelector(payloadCid, nil, allSelector)
+	require.NoError(t, err)
+	require.True(t, query.SelectorSpecified())
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, query.MarshalCBOR(buf))
+	unmarshalled := &retrievalmarket.Query{}
+	require.NoError(t, unmarshalled.UnmarshalCBOR(buf))
+	require.Equal(t, query, *unmarshalled)
+
+	sel, err := retrievalmarket.DecodeNode(unmarshalled.Selector)
+	require.NoError(t, err)
+	require.Equal(t, allSelector, sel)
+
+	require.False(t, retrievalmarket.NewQueryV0(payloadCid).SelectorSpecified())
+}
+
+func TestQueryResponsePayloadRetrievalPrice(t *testing.T) {
+	qr := retrievalmarket.QueryResponse{
+		Size:                1000,
+		ExpectedPayloadSize: 100,
+		MinPricePerByte:     abi.NewTokenAmount(2),
+		UnsealPrice:         abi.NewTokenAmount(50),
+	}
+	require.Equal(t, abi.NewTokenAmount(250), qr.PayloadRetrievalPrice())
+	require.Equal(t, abi.NewTokenAmount(2050), qr.PieceRetrievalPrice())
+}
+
+func TestQueryParamsCheckTerms(t *testing.T) {
+	price := abi.NewTokenAmount(10)
+
+	require.NoError(t, retrievalmarket.QueryParams{}.CheckTerms(price, 100, 10))
+
+	params := retrievalmarket.QueryParams{
+		MaxPricePerByte:            abi.NewTokenAmount(10),
+		MinPaymentInterval:         100,
+		MinPaymentIntervalIncrease: 10,
+	}
+	require.NoError(t, params.CheckTerms(price, 100, 10))
+	require.Error(t, params.CheckTerms(abi.NewTokenAmount(11), 100, 10))
+	require.Error(t, params.CheckTerms(price, 99, 10))
+	require.Error(t, params.CheckTerms(price, 100, 9))
+
+	// a zero maximum price is not a limit
+	params.MaxPricePerByte = big.Zero()
+	require.NoError(t, params.CheckTerms(abi.NewTokenAmount(1000), 100, 10))
+}
+
+func TestProviderDealFilterMatches(t *testing.T) {
+	clients := tut.GeneratePeers(2)
+	created := time.Unix(1600000000, 0)
+	deal := retrievalmarket.ProviderDealState{
+		Status:    retrievalmarket.DealStatusOngoing,
+		Receiver:  clients[0],
+		CreatedAt: created.Unix(),
+	}
+
+	require.True(t, retrievalmarket.ProviderDealFilter{}.Matches(deal))
+	require.True(t, retrievalmarket.ProviderDealFilter{
+		Statuses:      []retrievalmarket.DealStatus{retrievalmarket.DealStatusFundsNeeded, retrievalmarket.DealStatusOngoing},
+		Client:        clients[0],
+		CreatedAfter:  created.Add(-time.Minute),
+		CreatedBefore: created.Add(time.Minute),
+	}.Matches(deal))
+
+	require.False(t, retrievalmarket.ProviderDealFilter{
+		Statuses: []retrievalmarket.DealStatus{retrievalmarket.DealStatusCompleted},
+	}.Matches(deal))
+	require.False(t, retrievalmarket.ProviderDealFilter{Client: clients[1]}.Matches(deal))
+	require.False(t, retrievalmarket.ProviderDealFilter{CreatedAfter: created}.Matches(deal))
+	require.False(t, retrievalmarket.ProviderDealFilter{CreatedBefore: created}.Matches(deal))
+}
@@ -0,0 +1,291 @@
+/*
+Package bandwidth limits the rate at which transfers send or receive data.
+
+A Limiter applies limits to each deal, to each peer and to all transfers
+together. Each limit is a token bucket that refills at the limit's rate and
+holds at most one second of data. Priority transfers draw from their own
+per-deal and per-peer limits, so a paid priority tier is not slowed down by
+standard traffic, but all transfers together stay within the standard global
+limit.
+*/
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Limits are transfer rate limits in bytes per second. A limit of zero means
+// there is no limit.
+type Limits struct {
+	// PerDeal is the maximum rate of a single deal's transfer
+	PerDeal uint64
+	// PerPeer is the maximum combined rate of all transfers with one peer
+	PerPeer uint64
+	// Global is the maximum combined rate of all transfers
+	Global uint64
+}
+
+// pruneInterval is how often idle peer buckets are removed
+const pruneInterval = time.Minute
+
+// Limiter limits the rate of transfers
+type Limiter struct {
+	now func() time.Time
+
+	lk        sync.Mutex
+	standard  *class
+	priority  *class
+	lastPrune time.Time
+}
+
+// class is a set of limits and the buckets that enforce them
+type class struct {
+	limits Limits
+	global *bucket
+	peers  map[peer.ID]*bucket
+}
+
+// NewLimiter returns a limiter that applies the standard limits to standard
+// transfers and the priority limits to priority transfers
+func NewLimiter(standard Limits, priority Limits) *Limiter {
+	now := time.Now()
+	return &Limiter{
+		now:       time.Now,
+		standard:  newClass(standard, now),
+		priority:  newClass(priority, now),
+		lastPrune: now,
+	}
+}
+
+func newClass(limits Limits, now time.Time) *class {
+	return &class{
+		limits: limits,
+		global: newBucket(limits.Global, now),
+		peers:  make(map[peer.ID]*bucket),
+	}
+}
+
+// SetLimits changes the limits, including for transfers already in progress
+func (l *Limiter) SetLimits(standard Limits, priority Limits) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	now := l.now()
+	l.standard.setLimits(standard, now)
+	l.priority.setLimits(priority, now)
+}
+
+func (c *class) setLimits(limits Limits, now time.Time) {
+	c.limits = limits
+	c.global.setRate(limits.Global, now)
+	for _, b := range c.peers {
+		b.setRate(limits.PerPeer, now)
+	}
+}
+
+// NewTransfer returns a Transfer that limits the rate of a single deal's data
+// exchanged with the given peer. Reads and writes through the transfer's
+// loader, storer and writer stop waiting once the context is done.
+func (l *Limiter) NewTransfer(ctx context.Context, p peer.ID, priority bool) *Transfer {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	c := l.standard
+	if priority {
+		c = l.priority
+	}
+	return &Transfer{
+		ctx:     ctx,
+		limiter: l,
+		class:   c,
+		peer:    p,
+		deal:    newBucket(c.limits.PerDeal, l.now()),
+	}
+}
+
+// reserve takes n bytes from the buckets of the given transfer, returning how
+// long the transfer must wait before using them
+func (l *Limiter) reserve(t *Transfer, n uint64) time.Duration {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.standard.prune(now)
+		l.priority.prune(now)
+		l.lastPrune = now
+	}
+
+	peerBucket, ok := t.class.peers[t.peer]
+	if !ok {
+		peerBucket = newBucket(t.class.limits.PerPeer, now)
+		t.class.peers[t.peer] = peerBucket
+	}
+	t.deal.setRate(t.class.limits.PerDeal, now)
+
+	buckets := []*bucket{peerBucket, t.deal}
+	if t.class != l.standard {
+		// the standard global limit caps all transfers, including priority ones
+		buckets = append(buckets, l.standard.global)
+	}
+	delay := t.class.global.reserve(n, now)
+	for _, b := range buckets {
+		if d := b.reserve(n, now); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// prune removes peer buckets that have refilled, since a new bucket would
+// start in the same state
+func (c *class) prune(now time.Time) {
+	for p, b := range c.peers {
+		if b.isFull(now) {
+			delete(c.peers, p)
+		}
+	}
+}
+
+// Transfer limits the rate of a single deal's transfer
+type Transfer struct {
+	ctx     context.Context
+	limiter *Limiter
+	class   *class
+	peer    peer.ID
+	deal    *bucket
+}
+
+// Wait blocks until n more bytes can be transferred without exceeding the
+// limits, or the context is cancelled
+func (t *Transfer) Wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	delay := t.limiter.reserve(t, uint64(n))
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Loader wraps a loader so that reading the blocks it loads is limited to the
+// transfer's rate
+func (t *Transfer) Loader(loader ipld.Loader) ipld.Loader {
+	return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+		r, err := loader(lnk, lnkCtx)
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReader{r, t}, nil
+	}
+}
+
+// Writer wraps a writer so that writing to it is limited to the transfer's
+// rate
+func (t *Transfer) Writer(w io.Writer) io.Writer {
+	return &limitedWriter{w, t}
+}
+
+// Storer wraps a storer so that writing the blocks it stores is limited to
+// the transfer's rate
+func (t *Transfer) Storer(storer ipld.Storer) ipld.Storer {
+	return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+		w, committer, err := storer(lnkCtx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &limitedWriter{w, t}, committer, nil
+	}
+}
+
+type limitedReader struct {
+	r io.Reader
+	t *Transfer
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if waitErr := lr.t.Wait(lr.t.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	w io.Writer
+	t *Transfer
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if err := lw.t.Wait(lw.t.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return lw.w.Write(p)
+}
+
+// bucket is a token bucket holding up to one second of data at its rate.
+// Reservations larger than the bucket put it into debt, which delays later
+// reservations until the debt is repaid.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate uint64, now time.Time) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+func (b *bucket) setRate(rate uint64, now time.Time) {
+	if float64(rate) == b.rate {
+		return
+	}
+	b.refill(now)
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+func (b *bucket) reserve(n uint64, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *bucket) isFull(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.rate
+}
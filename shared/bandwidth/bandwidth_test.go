@@ -0,0 +1,159 @@
+package bandwidth_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
+)
+
+const rate = 1 << 20
+
+// timeTransfer returns how long it takes to transfer the given number of
+// bytes in chunks of 64KiB with each of the given transfers concurrently
+func timeTransfer(t *testing.T, size int, transfers ...*bandwidth.Transfer) time.Duration {
+	ctx := context.Background()
+	start := time.Now()
+	errs := make(chan error, len(transfers))
+	for _, tr := range transfers {
+		go func(tr *bandwidth.Transfer) {
+			for sent := 0; sent < size; sent += 64 << 10 {
+				if err := tr.Wait(ctx, 64<<10); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(tr)
+	}
+	for range transfers {
+		require.NoError(t, <-errs)
+	}
+	return time.Since(start)
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	peer1 := peer.ID("peer1")
+	peer2 := peer.ID("peer2")
+
+	t.Run("does not limit with no limits", func(t *testing.T) {
+		l := bandwidth.NewLimiter(bandwidth.Limits{}, bandwidth.Limits{})
+		elapsed := timeTransfer(t, 10*rate, l.NewTransfer(ctx, peer1, false))
+		require.Less(t, int64(elapsed), int64(100*time.Millisecond))
+	})
+
+	t.Run("limits each deal", func(t *testing.T) {
+		l := bandwidth.NewLimiter(bandwidth.Limits{PerDeal: rate}, bandwidth.Limits{})
+		// the first second of data is sent immediately
+		elapsed := timeTransfer(t, rate+rate/2, l.NewTransfer(ctx, peer1, false), l.NewTransfer(ctx, peer2, false))
+		require.GreaterOrEqual(t, int64(elapsed), int64(400*time.Millisecond))
+		require.Less(t, int64(elapsed), int64(900*time.Millisecond))
+	})
+
+	t.Run("limits each peer", func(t *testing.T) {
+		l := bandwidth.NewLimiter(bandwidth.Limits{PerPeer: rate}, bandwidth.Limits{})
+		elapsed := timeTransfer(t, rate, l.NewTransfer(ctx, peer1, false), l.NewTransfer(ctx, peer1, false))
+		require.GreaterOrEqual(t, int64(elapsed), int64(900*time.Millisecond))
+
+		l = bandwidth.NewLimiter(bandwidth.Limits{PerPeer: rate}, bandwidth.Limits{})
+		elapsed = timeTransfer(t, rate, l.NewTransfer(ctx, peer1, false), l.NewTransfer(ctx, peer2, false))
+		require.Less(t, int64(elapsed), int64(400*time.Millisecond))
+	})
+
+	t.Run("limits all transfers", func(t *testing.T) {
+		l := bandwidth.NewLimiter(bandwidth.Limits{Global: rate}, bandwidth.Limits{})
+		elapsed := timeTransfer(t, rate, l.NewTransfer(ctx, peer1, false), l.NewTransfer(ctx, peer2, false))
+		require.GreaterOrEqual(t, int64(elapsed), int64(900*time.Millisecond))
+	})
+
+	t.Run("priority transfers use their own limits", func(t *testing.T) {
+		l := bandwidth.NewLimiter(bandwidth.Limits{PerPeer: rate / 4}, bandwidth.Limits{PerPeer: 4 * rate})
+		elapsed := timeTransfer(t, 2*rate, l.NewTransfer(ctx, peer1, true))
+		require.Less(t, int64(elapsed), int64(400*time.Millisecond))
+
+		elapsed = timeTransfer(t, rate/2, l.NewTransfer(ctx, peer1, false))
+		require.GreaterOrEqual(t, int64(elapsed), int64(900*time.Millisecond))
+	})
+
+	t.Run("the standard global limit applies to priority transfers", func(t *testing.T) {
+		l := bandwidth.NewLimiter(bandwidth.Limits{Global: rate}, bandwidth.Limits{})
+		elapsed := timeTransfer(t, 2*rate, l.NewTransfer(ctx, peer1, true))
+		require.GreaterOrEqual(t, int64(elapsed), int64(900*time.Millisecond))
+	})
+
+	t.Run("changing limits applies to transfers in progress", func(t *testing.T) {
+		l := bandwidth.NewLimiter(bandwidth.Limits{PerDeal: rate / 4}, bandwidth.Limits{})
+		tr := l.NewTransfer(ctx, peer1, false)
+		l.SetLimits(bandwidth.Limits{}, bandwidth.Limits{})
+		elapsed := timeTransfer(t, 4*rate, tr)
+		require.Less(t, int64(elapsed), int64(100*time.Millisecond))
+	})
+
+	t.Run("wait returns when the context is cancelled", func(t *testing.T) {
+		l := bandwidth.NewLimiter(bandwidth.Limits{PerDeal: rate}, bandwidth.Limits{})
+		tr := l.NewTransfer(ctx, peer1, false)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		require.NoError(t, tr.Wait(ctx, rate))
+		require.Equal(t, context.DeadlineExceeded, tr.Wait(ctx, 10*rate))
+	})
+}
+
+func TestTransferLoaderAndStorer(t *testing.T) {
+	ctx := context.Background()
+	l := bandwidth.NewLimiter(bandwidth.Limits{PerDeal: rate}, bandwidth.Limits{})
+	data := bytes.Repeat([]byte{1}, rate+rate/2)
+
+	t.Run("loader", func(t *testing.T) {
+		tr := l.NewTransfer(ctx, peer.ID("peer1"), false)
+		loader := tr.Loader(func(ipld.Link, ipld.LinkContext) (io.Reader, error) {
+			return bytes.NewReader(data), nil
+		})
+		start := time.Now()
+		r, err := loader(nil, ipld.LinkContext{})
+		require.NoError(t, err)
+		read, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(400*time.Millisecond))
+	})
+
+	t.Run("loader stops when the transfer's context is done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		tr := l.NewTransfer(ctx, peer.ID("peer3"), false)
+		loader := tr.Loader(func(ipld.Link, ipld.LinkContext) (io.Reader, error) {
+			return bytes.NewReader(bytes.Repeat([]byte{1}, 10*rate)), nil
+		})
+		r, err := loader(nil, ipld.LinkContext{})
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(r)
+		require.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("storer", func(t *testing.T) {
+		tr := l.NewTransfer(ctx, peer.ID("peer2"), false)
+		buf := new(bytes.Buffer)
+		storer := tr.Storer(func(ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+			return buf, func(ipld.Link) error { return nil }, nil
+		})
+		start := time.Now()
+		w, _, err := storer(ipld.LinkContext{})
+		require.NoError(t, err)
+		_, err = w.Write(data[:rate])
+		require.NoError(t, err)
+		_, err = w.Write(data[rate:])
+		require.NoError(t, err)
+		require.Equal(t, data, buf.Bytes())
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(400*time.Millisecond))
+	})
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/stretchr/testify/require"
 
+	"github.com/filecoin-project/go-state-types/abi"
+
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -105,6 +107,21 @@ func (tps *TestPieceStore) AddPieceBlockLocations(pieceCID cid.Cid, blockLocatio
 	return tps.addPieceBlockLocationsError
 }
 
+// RemoveDealForPiece does nothing
+func (tps *TestPieceStore) RemoveDealForPiece(pieceCID cid.Cid, dealID abi.DealID) error {
+	return nil
+}
+
+// RemovePiece does nothing
+func (tps *TestPieceStore) RemovePiece(pieceCID cid.Cid) error {
+	return nil
+}
+
+// RemoveCIDInfo does nothing
+func (tps *TestPieceStore) RemoveCIDInfo(payloadCID cid.Cid) error {
+	return nil
+}
+
 // GetPieceInfo returns a piece info if it's been stubbed
 func (tps *TestPieceStore) GetPieceInfo(pieceCID cid.Cid) (piecestore.PieceInfo, error) {
 	if tps.getPieceInfoError != nil {
@@ -147,6 +164,14 @@ func (tps *TestPieceStore) ListPieceInfoKeys() ([]cid.Cid, error) {
 	panic("do not call me")
 }
 
+func (tps *TestPieceStore) ListPiecesInSector(sectorID abi.SectorNumber) ([]cid.Cid, error) {
+	panic("do not call me")
+}
+
+func (tps *TestPieceStore) ListDealsForPiece(pieceCID cid.Cid) ([]piecestore.DealInfo, error) {
+	panic("do not call me")
+}
+
 func (tps *TestPieceStore) Start(ctx context.Context) error {
 	return nil
 }
@@ -0,0 +1,269 @@
+/*
+Package announcer publishes the payloads a storage provider serves, so that
+third party indexers can learn what the provider stores.
+
+Once a deal has been handed off and its blocks have been recorded in the piece
+store, the provider announces the deal's piece CID and the payload CIDs in it.
+When the deal expires or is slashed, the provider withdraws the piece, unless
+another deal it has announced still has the same piece.
+
+Announcements are published as advertisements, each signed by the provider's
+worker key and numbered in sequence, so that an indexer can check them with
+VerifyAdvertisement and tell when it has missed one. Advertisements are passed
+to one or more sinks: PubSubSink publishes them as retrieval announcements on
+the discovery pubsub topic, and FeedSink appends them to a file that indexers
+can read over HTTP.
+*/
+package announcer
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-statestore"
+
+	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerutils"
+)
+
+var log = logging.Logger("storage-announcer")
+
+// MaxPayloadCIDsPerAdvertisement is the most payload CIDs an advertisement
+// carries. Pieces with more payloads are announced and withdrawn in several
+// advertisements.
+const MaxPayloadCIDsPerAdvertisement = 1000
+
+var seqKey = datastore.NewKey("/seq")
+
+// Sink is somewhere advertisements are published to
+type Sink interface {
+	Publish(ctx context.Context, ad *SignedAdvertisement) error
+}
+
+// Refresher is a sink whose announcements expire, which must be given the
+// announced deals again from time to time
+type Refresher interface {
+	Refresh(ctx context.Context, deals []AnnouncedDeal) error
+}
+
+// Announcer signs advertisements for a storage provider and publishes them to
+// its sinks
+type Announcer struct {
+	ds    datastore.Batching
+	deals *statestore.StateStore
+	spn   storagemarket.StorageProviderNode
+	actor address.Address
+	sinks []Sink
+
+	lk sync.Mutex
+}
+
+// NewAnnouncer returns an announcer for the given miner actor, that persists
+// the deals it has announced and its sequence number to the given datastore
+func NewAnnouncer(ds datastore.Batching, spn storagemarket.StorageProviderNode, actor address.Address, sinks ...Sink) *Announcer {
+	return &Announcer{
+		ds:    ds,
+		deals: statestore.New(namespace.Wrap(ds, datastore.NewKey("/deals"))),
+		spn:   spn,
+		actor: actor,
+		sinks: sinks,
+	}
+}
+
+// Announce advertises that the provider serves the payloads in the deal's
+// piece
+func (a *Announcer) Announce(ctx context.Context, dealID abi.DealID, pieceCID cid.Cid, payloadCIDs []cid.Cid) error {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	deal := &AnnouncedDeal{DealID: dealID, PieceCID: pieceCID, PayloadCIDs: payloadCIDs}
+	has, err := a.deals.Has(uint64(dealID))
+	if err != nil {
+		return err
+	}
+	if has {
+		err = a.deals.Get(uint64(dealID)).Mutate(func(d *AnnouncedDeal) error {
+			*d = *deal
+			return nil
+		})
+	} else {
+		err = a.deals.Begin(uint64(dealID), deal)
+	}
+	if err != nil {
+		return xerrors.Errorf("recording announced deal %d: %w", dealID, err)
+	}
+	return a.publishPayloads(ctx, false, pieceCID, payloadCIDs)
+}
+
+// Withdraw advertises that the provider no longer serves the payloads in the
+// deal's piece, listing the payloads the deal was announced with. Nothing is
+// published if another announced deal has the same piece, or if the deal was
+// never announced.
+func (a *Announcer) Withdraw(ctx context.Context, dealID abi.DealID) error {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	has, err := a.deals.Has(uint64(dealID))
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+	var deal AnnouncedDeal
+	if err := a.deals.Get(uint64(dealID)).Get(&deal); err != nil {
+		return err
+	}
+	if err := a.deals.Get(uint64(dealID)).End(); err != nil {
+		return xerrors.Errorf("removing announced deal %d: %w", dealID, err)
+	}
+
+	var deals []AnnouncedDeal
+	if err := a.deals.List(&deals); err != nil {
+		return xerrors.Errorf("listing announced deals: %w", err)
+	}
+	for _, other := range deals {
+		if other.PieceCID.Equals(deal.PieceCID) {
+			return nil
+		}
+	}
+	return a.publishPayloads(ctx, true, deal.PieceCID, deal.PayloadCIDs)
+}
+
+// Refresh gives the deals the provider has announced to the sinks that are
+// Refreshers. It should be called more often than their announcements expire.
+func (a *Announcer) Refresh(ctx context.Context) error {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	var deals []AnnouncedDeal
+	if err := a.deals.List(&deals); err != nil {
+		return xerrors.Errorf("listing announced deals: %w", err)
+	}
+	for _, sink := range a.sinks {
+		if r, ok := sink.(Refresher); ok {
+			if err := r.Refresh(ctx, deals); err != nil {
+				return xerrors.Errorf("refreshing announced deals: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Deals returns the deals the provider has announced and not withdrawn
+func (a *Announcer) Deals() ([]AnnouncedDeal, error) {
+	var deals []AnnouncedDeal
+	if err := a.deals.List(&deals); err != nil {
+		return nil, err
+	}
+	return deals, nil
+}
+
+// publishPayloads publishes advertisements for the payloads in a piece, with
+// at most MaxPayloadCIDsPerAdvertisement payloads in each
+func (a *Announcer) publishPayloads(ctx context.Context, withdraw bool, pieceCID cid.Cid, payloadCIDs []cid.Cid) error {
+	for len(payloadCIDs) > 0 {
+		n := len(payloadCIDs)
+		if n > MaxPayloadCIDsPerAdvertisement {
+			n = MaxPayloadCIDsPerAdvertisement
+		}
+		if err := a.publish(ctx, withdraw, pieceCID, payloadCIDs[:n]); err != nil {
+			return err
+		}
+		payloadCIDs = payloadCIDs[n:]
+	}
+	return nil
+}
+
+// publish signs an advertisement and passes it to the sinks. The sequence
+// number is only used up once a sink has published the advertisement, so that
+// a failure to publish does not leave a gap in the sequence.
+func (a *Announcer) publish(ctx context.Context, withdraw bool, pieceCID cid.Cid, payloadCIDs []cid.Cid) error {
+	seq, err := a.nextSeq()
+	if err != nil {
+		return xerrors.Errorf("getting advertisement sequence number: %w", err)
+	}
+	ad := &Advertisement{
+		Provider:    a.actor,
+		Seq:         seq,
+		Time:        time.Now().Unix(),
+		Withdraw:    withdraw,
+		PieceCID:    pieceCID,
+		PayloadCIDs: payloadCIDs,
+	}
+	tok, _, err := a.spn.GetChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+	sig, err := providerutils.SignMinerData(ctx, ad, a.actor, tok, a.spn.GetMinerWorkerAddress, a.spn.SignBytes)
+	if err != nil {
+		return xerrors.Errorf("signing advertisement: %w", err)
+	}
+	sad := &SignedAdvertisement{Advertisement: ad, Signature: sig}
+	var publishErr error
+	published := false
+	for _, sink := range a.sinks {
+		if err := sink.Publish(ctx, sad); err != nil {
+			if publishErr == nil {
+				publishErr = xerrors.Errorf("publishing advertisement %d: %w", seq, err)
+			}
+			continue
+		}
+		published = true
+	}
+	if published {
+		if err := a.setSeq(seq); err != nil {
+			return xerrors.Errorf("saving advertisement sequence number: %w", err)
+		}
+	}
+	return publishErr
+}
+
+// nextSeq returns the sequence number of the next advertisement
+func (a *Announcer) nextSeq() (uint64, error) {
+	data, err := a.ds.Get(seqKey)
+	switch err {
+	case nil:
+		return binary.BigEndian.Uint64(data) + 1, nil
+	case datastore.ErrNotFound:
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+// setSeq records the sequence number of the last published advertisement
+func (a *Announcer) setSeq(seq uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, seq)
+	return a.ds.Put(seqKey, buf)
+}
+
+// VerifyAdvertisement checks an advertisement was signed by the worker of the
+// provider that made it
+func VerifyAdvertisement(ctx context.Context, sad *SignedAdvertisement, tok shared.TipSetToken, workerLookup providerutils.WorkerLookupFunc, verifier providerutils.VerifyFunc) error {
+	if sad.Advertisement == nil || sad.Signature == nil {
+		return xerrors.New("advertisement is not signed")
+	}
+	worker, err := workerLookup(ctx, sad.Advertisement.Provider, tok)
+	if err != nil {
+		return xerrors.Errorf("looking up provider worker address: %w", err)
+	}
+	buf, err := cborutil.Dump(sad.Advertisement)
+	if err != nil {
+		return err
+	}
+	return providerutils.VerifySignature(ctx, *sad.Signature, worker, buf, tok, verifier)
+}
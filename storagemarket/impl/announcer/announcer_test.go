@@ -0,0 +1,194 @@
+package announcer_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/announcer"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/testnodes"
+)
+
+type fakeSink struct {
+	published []*announcer.SignedAdvertisement
+	refreshed []announcer.AnnouncedDeal
+	err       error
+}
+
+func (s *fakeSink) Publish(ctx context.Context, ad *announcer.SignedAdvertisement) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.published = append(s.published, ad)
+	return nil
+}
+
+func (s *fakeSink) Refresh(ctx context.Context, deals []announcer.AnnouncedDeal) error {
+	s.refreshed = deals
+	return nil
+}
+
+func newNode() *testnodes.FakeProviderNode {
+	return &testnodes.FakeProviderNode{
+		FakeCommonNode: testnodes.FakeCommonNode{
+			SMState: testnodes.NewStorageMarketState(),
+		},
+		MinerAddr: address.TestAddress,
+	}
+}
+
+func TestAnnouncer(t *testing.T) {
+	ctx := context.Background()
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	node := newNode()
+	actor := address.TestAddress2
+	sink := &fakeSink{}
+	a := announcer.NewAnnouncer(ds, node, actor, sink)
+
+	pieceCID := shared_testutil.GenerateCids(1)[0]
+	payloadCIDs := shared_testutil.GenerateCids(announcer.MaxPayloadCIDsPerAdvertisement + 1)
+
+	t.Run("announces payloads in signed, numbered advertisements", func(t *testing.T) {
+		require.NoError(t, a.Announce(ctx, abi.DealID(1), pieceCID, payloadCIDs))
+		require.Len(t, sink.published, 2)
+		var announced []cid.Cid
+		for i, sad := range sink.published {
+			require.Equal(t, uint64(i), sad.Advertisement.Seq)
+			require.Equal(t, actor, sad.Advertisement.Provider)
+			require.Equal(t, pieceCID, sad.Advertisement.PieceCID)
+			require.False(t, sad.Advertisement.Withdraw)
+			require.NoError(t, announcer.VerifyAdvertisement(ctx, sad, nil, node.GetMinerWorkerAddress, node.VerifySignature))
+			announced = append(announced, sad.Advertisement.PayloadCIDs...)
+		}
+		require.Equal(t, payloadCIDs, announced)
+	})
+
+	t.Run("only withdraws a piece once no deal has it", func(t *testing.T) {
+		require.NoError(t, a.Announce(ctx, abi.DealID(2), pieceCID, payloadCIDs[:1]))
+		sink.published = nil
+
+		require.NoError(t, a.Withdraw(ctx, abi.DealID(1)))
+		require.Empty(t, sink.published)
+
+		require.NoError(t, a.Withdraw(ctx, abi.DealID(2)))
+		require.Len(t, sink.published, 1)
+		ad := sink.published[0].Advertisement
+		require.True(t, ad.Withdraw)
+		require.Equal(t, pieceCID, ad.PieceCID)
+		require.Equal(t, payloadCIDs[:1], ad.PayloadCIDs)
+		require.Equal(t, uint64(3), ad.Seq)
+
+		deals, err := a.Deals()
+		require.NoError(t, err)
+		require.Empty(t, deals)
+
+		// withdrawing a deal that was never announced does nothing
+		require.NoError(t, a.Withdraw(ctx, abi.DealID(3)))
+		require.Len(t, sink.published, 1)
+	})
+
+	t.Run("sequence numbers persist across restarts", func(t *testing.T) {
+		sink.published = nil
+		a = announcer.NewAnnouncer(ds, node, actor, sink)
+		require.NoError(t, a.Announce(ctx, abi.DealID(4), pieceCID, payloadCIDs[:1]))
+		require.Len(t, sink.published, 1)
+		require.Equal(t, uint64(4), sink.published[0].Advertisement.Seq)
+	})
+
+	t.Run("bad signatures do not verify", func(t *testing.T) {
+		failing := newNode()
+		failing.VerifySignatureFails = true
+		err := announcer.VerifyAdvertisement(ctx, sink.published[0], nil, failing.GetMinerWorkerAddress, failing.VerifySignature)
+		require.Error(t, err)
+	})
+
+	t.Run("a failed publish does not use up a sequence number", func(t *testing.T) {
+		sink.published = nil
+		sink.err = errors.New("something went wrong")
+		require.Error(t, a.Announce(ctx, abi.DealID(5), pieceCID, payloadCIDs[:1]))
+		sink.err = nil
+		require.NoError(t, a.Announce(ctx, abi.DealID(5), pieceCID, payloadCIDs[:1]))
+		require.Len(t, sink.published, 1)
+		require.Equal(t, uint64(5), sink.published[0].Advertisement.Seq)
+	})
+
+	t.Run("refreshes sinks with the announced deals", func(t *testing.T) {
+		require.NoError(t, a.Refresh(ctx))
+		deals, err := a.Deals()
+		require.NoError(t, err)
+		require.Equal(t, deals, sink.refreshed)
+		require.Len(t, deals, 2)
+	})
+}
+
+func TestFeedSink(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "announcer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	node := newNode()
+	feed, err := announcer.NewFeedSink(filepath.Join(dir, "feed.ndjson"))
+	require.NoError(t, err)
+	defer feed.Close()
+	a := announcer.NewAnnouncer(dss.MutexWrap(datastore.NewMapDatastore()), node, address.TestAddress2, feed)
+
+	payloadCIDs := shared_testutil.GenerateCids(3)
+	for i, payloadCID := range payloadCIDs {
+		pieceCID := shared_testutil.GenerateCids(1)[0]
+		require.NoError(t, a.Announce(ctx, abi.DealID(i), pieceCID, []cid.Cid{payloadCID}))
+	}
+
+	server := httptest.NewServer(feed)
+	defer server.Close()
+
+	read := func(url string) []announcer.SignedAdvertisement {
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		var ads []announcer.SignedAdvertisement
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var sad announcer.SignedAdvertisement
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &sad))
+			ads = append(ads, sad)
+		}
+		require.NoError(t, scanner.Err())
+		return ads
+	}
+
+	ads := read(server.URL)
+	require.Len(t, ads, 3)
+	for i, sad := range ads {
+		require.Equal(t, []cid.Cid{payloadCIDs[i]}, sad.Advertisement.PayloadCIDs)
+		// advertisements read from the feed can still be verified
+		require.NoError(t, announcer.VerifyAdvertisement(ctx, &sad, nil, node.GetMinerWorkerAddress, node.VerifySignature))
+	}
+
+	ads = read(server.URL + "?since=0")
+	require.Len(t, ads, 2)
+	require.Equal(t, uint64(1), ads[0].Advertisement.Seq)
+
+	resp, err := http.Get(server.URL + "?since=nope")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,146 @@
+package announcer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// MaxFeedPageSize is the most advertisements a FeedSink returns in one response
+const MaxFeedPageSize = 1000
+
+// maxFeedLine is the longest line the feed reads back, which fits an
+// advertisement with MaxPayloadCIDsPerAdvertisement payload CIDs with room
+// to spare
+const maxFeedLine = 4 << 20
+
+/*
+FeedSink appends advertisements to a file, one JSON encoded advertisement per
+line, and serves the file to indexers over HTTP.
+
+A request for `GET` on the handler returns the advertisements in the order they
+were published, as newline delimited JSON. The optional `since` query parameter
+only returns advertisements with a higher sequence number, so an indexer can
+pass the sequence number of the last advertisement it read to get the next
+page. At most MaxFeedPageSize advertisements are returned per request.
+*/
+type FeedSink struct {
+	path string
+	file *os.File
+
+	lk sync.Mutex
+	// size is the length of the complete lines in the file, which is as much
+	// of it as readers may read
+	size int64
+}
+
+// NewFeedSink returns a sink that appends to the file at the given path,
+// creating it if it does not exist
+func NewFeedSink(path string) (*FeedSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, xerrors.Errorf("opening advertisement feed: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, xerrors.Errorf("reading advertisement feed: %w", err)
+	}
+	return &FeedSink{path: path, file: file, size: info.Size()}, nil
+}
+
+// Publish appends the advertisement to the feed
+func (s *FeedSink) Publish(ctx context.Context, ad *SignedAdvertisement) error {
+	line, err := json.Marshal(ad)
+	if err != nil {
+		return xerrors.Errorf("encoding advertisement: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return xerrors.Errorf("writing advertisement feed: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return xerrors.Errorf("writing advertisement feed: %w", err)
+	}
+	s.size += int64(len(line))
+	return nil
+}
+
+// Close closes the feed file
+func (s *FeedSink) Close() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.file.Close()
+}
+
+// ServeHTTP serves a page of the feed. The feed is read without holding the
+// lock, up to the end of the last advertisement published when the request
+// started, so that slow readers do not hold up publishing.
+func (s *FeedSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var since uint64
+	hasSince := false
+	if param := r.URL.Query().Get("since"); param != "" {
+		var err error
+		since, err = strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		hasSince = true
+	}
+
+	s.lk.Lock()
+	size := s.size
+	s.lk.Unlock()
+	file, err := os.Open(s.path)
+	if err != nil {
+		log.Errorf("opening advertisement feed %s: %s", s.path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	scanner := bufio.NewScanner(io.LimitReader(file, size))
+	scanner.Buffer(nil, maxFeedLine)
+	written := 0
+	for written < MaxFeedPageSize && scanner.Scan() {
+		var entry struct {
+			Advertisement struct {
+				Seq uint64
+			}
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warnf("skipping unreadable line in advertisement feed %s: %s", s.path, err)
+			continue
+		}
+		if hasSince && entry.Advertisement.Seq <= since {
+			continue
+		}
+		if _, err := w.Write(append(scanner.Bytes(), '\n')); err != nil {
+			return
+		}
+		written++
+	}
+	if err := scanner.Err(); err != nil {
+		// the status has been sent, so all we can do is cut the feed short
+		log.Errorf("reading advertisement feed %s: %s", s.path, err)
+	}
+}
+
+var _ Sink = &FeedSink{}
+var _ http.Handler = &FeedSink{}
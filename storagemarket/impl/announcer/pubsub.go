@@ -0,0 +1,59 @@
+package announcer
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	discoveryimpl "github.com/filecoin-project/go-fil-markets/discovery/impl"
+)
+
+/*
+PubSubSink publishes advertisements as retrieval announcements, on the topic
+and in the format that the discovery Gossip resolver reads, so that retrieval
+clients learn which provider serves a payload.
+
+Withdrawals are published as withdrawn announcements, which the Gossip
+resolver removes. Announcements also expire, in case a withdrawal is missed,
+so the sink is a Refresher, and Announcer.Refresh should be called more often
+than announcements expire to keep the provider's current deals announced.
+*/
+type PubSubSink struct {
+	announcer *discoveryimpl.Announcer
+}
+
+// NewPubSubSink returns a sink that publishes with the given discovery
+// announcer
+func NewPubSubSink(announcer *discoveryimpl.Announcer) *PubSubSink {
+	return &PubSubSink{announcer: announcer}
+}
+
+// Publish announces or withdraws the payloads in the advertisement
+func (s *PubSubSink) Publish(ctx context.Context, ad *SignedAdvertisement) error {
+	anns := announcements(ad.Advertisement.PieceCID, ad.Advertisement.PayloadCIDs)
+	if ad.Advertisement.Withdraw {
+		return s.announcer.Withdraw(ctx, anns)
+	}
+	return s.announcer.Announce(ctx, anns)
+}
+
+// Refresh announces the payloads in the given deals again
+func (s *PubSubSink) Refresh(ctx context.Context, deals []AnnouncedDeal) error {
+	var all []discovery.Announcement
+	for _, deal := range deals {
+		all = append(all, announcements(deal.PieceCID, deal.PayloadCIDs)...)
+	}
+	return s.announcer.Announce(ctx, all)
+}
+
+func announcements(pieceCID cid.Cid, payloadCIDs []cid.Cid) []discovery.Announcement {
+	out := make([]discovery.Announcement, 0, len(payloadCIDs))
+	for _, payloadCID := range payloadCIDs {
+		out = append(out, discovery.Announcement{PayloadCID: payloadCID, PieceCID: pieceCID})
+	}
+	return out
+}
+
+var _ Sink = &PubSubSink{}
+var _ Refresher = &PubSubSink{}
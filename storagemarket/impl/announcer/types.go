@@ -0,0 +1,39 @@
+package announcer
+
+import (
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+)
+
+//go:generate cbor-gen-for --map-encoding Advertisement SignedAdvertisement AnnouncedDeal
+
+// Advertisement tells indexers that a provider has started, or stopped,
+// serving payloads from a piece
+type Advertisement struct {
+	Provider address.Address
+	// Seq increases by one with each advertisement the provider publishes, so
+	// that indexers can order advertisements and tell if they missed one
+	Seq uint64
+	// Time is the Unix time in seconds at which the advertisement was made
+	Time int64
+	// Withdraw is set when the provider no longer serves the payloads
+	Withdraw    bool
+	PieceCID    cid.Cid
+	PayloadCIDs []cid.Cid
+}
+
+// SignedAdvertisement is an advertisement signed by the provider's worker key
+type SignedAdvertisement struct {
+	Advertisement *Advertisement
+	Signature     *crypto.Signature
+}
+
+// AnnouncedDeal is a deal whose payloads the provider has advertised
+type AnnouncedDeal struct {
+	DealID      abi.DealID
+	PieceCID    cid.Cid
+	PayloadCIDs []cid.Cid
+}
@@ -205,8 +205,8 @@ func (c *Client) GetLocalDeal(ctx context.Context, cid cid.Cid) (storagemarket.C
 //
 // The client creates a new `StorageAskStream` for the chosen peer ID,
 // and calls WriteAskRequest on it, which constructs a message and writes it to the Ask stream.
-// When it receives a response, it verifies the signature and returns the validated
-// StorageAsk if successful
+// When it receives a response, it verifies the ask has not expired and the signature
+// is valid, and returns the validated StorageAsk if successful
 func (c *Client) GetAsk(ctx context.Context, info storagemarket.StorageProviderInfo) (*storagemarket.StorageAsk, error) {
 	if len(info.Addrs) > 0 {
 		c.net.AddAddrs(info.PeerID, info.Addrs)
@@ -234,11 +234,15 @@ func (c *Client) GetAsk(ctx context.Context, info storagemarket.StorageProviderI
 		return nil, xerrors.Errorf("got back ask for wrong miner")
 	}
 
-	tok, _, err := c.node.GetChainHead(ctx)
+	tok, height, err := c.node.GetChainHead(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if out.Ask.Ask.Expiry <= height {
+		return nil, xerrors.Errorf("ask expired at epoch %d (current epoch %d)", out.Ask.Ask.Expiry, height)
+	}
+
 	isValid, err := c.node.VerifySignature(ctx, *out.Ask.Signature, info.Worker, origBytes, tok)
 	if err != nil {
 		return nil, err
@@ -404,11 +408,11 @@ func (c *Client) ProposeStorageDeal(ctx context.Context, params storagemarket.Pr
 
 	return &storagemarket.ProposeStorageDealResult{
 			ProposalCid: deal.ProposalCid,
-		}, c.discovery.AddPeer(params.Data.Root, retrievalmarket.RetrievalPeer{
+		}, c.discovery.AddPeerWithExpiry(params.Data.Root, retrievalmarket.RetrievalPeer{
 			Address:  dealProposal.Provider,
 			ID:       deal.Miner,
 			PieceCID: &commP,
-		})
+		}, params.EndEpoch)
 }
 
 func curTime() cbg.CborTime {
@@ -13,6 +13,7 @@ import (
 	"github.com/filecoin-project/go-multistore"
 	"github.com/filecoin-project/go-statemachine/fsm"
 
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/requestvalidation"
 )
@@ -124,7 +125,14 @@ type StoreConfigurableTransport interface {
 	UseStore(datatransfer.ChannelID, ipld.Loader, ipld.Storer) error
 }
 
-// TransportConfigurer configurers the graphsync transport to use a custom blockstore per deal
+// TransferThrottler returns the bandwidth limits for receiving a deal's data.
+// It returns a nil transfer if the deal's data should not be limited.
+type TransferThrottler interface {
+	Throttle(proposalCid cid.Cid) (*bandwidth.Transfer, error)
+}
+
+// TransportConfigurer configurers the graphsync transport to use a custom blockstore per deal.
+// If the store getter is also a TransferThrottler, blocks are stored at the rate it allows.
 func TransportConfigurer(storeGetter StoreGetter) datatransfer.TransportConfigurer {
 	return func(channelID datatransfer.ChannelID, voucher datatransfer.Voucher, transport datatransfer.Transport) {
 		storageVoucher, ok := voucher.(*requestvalidation.StorageDataTransferVoucher)
@@ -143,7 +151,18 @@ func TransportConfigurer(storeGetter StoreGetter) datatransfer.TransportConfigur
 		if store == nil {
 			return
 		}
-		err = gsTransport.UseStore(channelID, store.Loader, store.Storer)
+		storer := store.Storer
+		if throttler, ok := storeGetter.(TransferThrottler); ok {
+			transfer, err := throttler.Throttle(storageVoucher.Proposal)
+			if err != nil {
+				log.Errorf("attempting to configure bandwidth limits: %s", err)
+				return
+			}
+			if transfer != nil {
+				storer = transfer.Storer(storer)
+			}
+		}
+		err = gsTransport.UseStore(channelID, store.Loader, storer)
 		if err != nil {
 			log.Errorf("attempting to configure data store: %s", err)
 		}
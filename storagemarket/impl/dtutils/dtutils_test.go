@@ -1,8 +1,10 @@
 package dtutils_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
 	"testing"
 
 	"github.com/ipfs/go-cid"
@@ -14,6 +16,7 @@ import (
 	"github.com/filecoin-project/go-multistore"
 	"github.com/filecoin-project/go-statemachine/fsm"
 
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/dtutils"
@@ -304,6 +307,46 @@ func TestTransportConfigurer(t *testing.T) {
 	}
 }
 
+func TestTransportConfigurerThrottle(t *testing.T) {
+	proposalCID := shared_testutil.GenerateCids(1)[0]
+	channelID := shared_testutil.MakeTestChannelID()
+	voucher := &requestvalidation.StorageDataTransferVoucher{Proposal: proposalCID}
+	buf := new(bytes.Buffer)
+	store := &multistore.Store{
+		Storer: func(ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+			return buf, func(ipld.Link) error { return nil }, nil
+		},
+	}
+
+	t.Run("wraps the storer with the deal's limits", func(t *testing.T) {
+		limiter := bandwidth.NewLimiter(bandwidth.Limits{PerDeal: 1 << 20}, bandwidth.Limits{})
+		storeGetter := &fakeThrottlingStoreGetter{
+			fakeStoreGetter:  fakeStoreGetter{returnedStore: store},
+			returnedTransfer: limiter.NewTransfer(context.Background(), channelID.Initiator, false),
+		}
+		transport := &fakeGsTransport{Transport: &fakeTransport{}}
+		dtutils.TransportConfigurer(storeGetter)(channelID, voucher, transport)
+		require.Equal(t, proposalCID, storeGetter.lastThrottled)
+		require.True(t, transport.called)
+		w, _, err := transport.lastStorer(ipld.LinkContext{})
+		require.NoError(t, err)
+		_, err = w.Write([]byte("block data"))
+		require.NoError(t, err)
+		require.Equal(t, "block data", buf.String())
+	})
+
+	t.Run("does not configure the store if the throttler errors", func(t *testing.T) {
+		storeGetter := &fakeThrottlingStoreGetter{
+			fakeStoreGetter: fakeStoreGetter{returnedStore: store},
+			throttleErr:     errors.New("something went wrong"),
+		}
+		transport := &fakeGsTransport{Transport: &fakeTransport{}}
+		dtutils.TransportConfigurer(storeGetter)(channelID, voucher, transport)
+		require.Equal(t, proposalCID, storeGetter.lastThrottled)
+		require.False(t, transport.called)
+	})
+}
+
 type fakeDealGroup struct {
 	returnedErr error
 	called      bool
@@ -333,6 +376,18 @@ func (fsg *fakeStoreGetter) Get(proposalCid cid.Cid) (*multistore.Store, error)
 	return fsg.returnedStore, fsg.returnedErr
 }
 
+type fakeThrottlingStoreGetter struct {
+	fakeStoreGetter
+	returnedTransfer *bandwidth.Transfer
+	throttleErr      error
+	lastThrottled    cid.Cid
+}
+
+func (ftsg *fakeThrottlingStoreGetter) Throttle(proposalCid cid.Cid) (*bandwidth.Transfer, error) {
+	ftsg.lastThrottled = proposalCid
+	return ftsg.returnedTransfer, ftsg.throttleErr
+}
+
 type fakeTransport struct{}
 
 func (ft *fakeTransport) OpenChannel(ctx context.Context, dataSender peer.ID, channelID datatransfer.ChannelID, root ipld.Link, stor ipld.Node, doNotSend []cid.Cid, msg datatransfer.Message) error {
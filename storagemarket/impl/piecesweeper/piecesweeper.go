@@ -0,0 +1,163 @@
+/*
+Package piecesweeper removes deals that are no longer on chain from a storage
+provider's piece store.
+
+The provider removes a deal from the piece store when it sees the deal expire
+or get slashed. Deals that ended before the provider did this, or while it was
+not running, stay in the piece store, and retrieval queries keep answering that
+their data is available. The sweeper finds these deals among the provider's
+local deals, either because the provider has seen them end or because their end
+epoch has passed, and removes them. The piece store removes a piece, and the
+locations of the blocks in it, along with its last deal.
+*/
+package piecesweeper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+var log = logging.Logger("piecesweeper")
+
+// DefaultSweepInterval is how often the piece store is swept by default
+const DefaultSweepInterval = time.Hour
+
+// Option configures a Sweeper
+type Option func(*Sweeper)
+
+// SweepInterval sets how often the sweeper sweeps the piece store
+func SweepInterval(interval time.Duration) Option {
+	return func(s *Sweeper) {
+		s.sweepInterval = interval
+	}
+}
+
+// Sweeper removes ended deals from a piece store
+type Sweeper struct {
+	pieceStore    piecestore.PieceStore
+	provider      storagemarket.StorageProvider
+	node          storagemarket.StorageProviderNode
+	sweepInterval time.Duration
+
+	lk sync.Mutex
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewSweeper returns a sweeper for the piece store of the given provider
+func NewSweeper(pieceStore piecestore.PieceStore, provider storagemarket.StorageProvider, node storagemarket.StorageProviderNode, options ...Option) *Sweeper {
+	s := &Sweeper{
+		pieceStore:    pieceStore,
+		provider:      provider,
+		node:          node,
+		sweepInterval: DefaultSweepInterval,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Start sweeps the piece store straight away, then regularly until Stop is
+// called
+func (s *Sweeper) Start(ctx context.Context) {
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(s.sweepInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.Sweep(ctx); err != nil {
+				log.Errorf("sweeping piece store: %s", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sweeping the piece store
+func (s *Sweeper) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.stopped
+	s.stop = nil
+}
+
+// Sweep removes the provider's ended deals from the piece store. Only deals
+// that have ended are removed, so pieces added while the sweep runs are kept.
+func (s *Sweeper) Sweep(ctx context.Context) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	_, epoch, err := s.node.GetChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+	deals, err := s.provider.ListLocalDeals()
+	if err != nil {
+		return xerrors.Errorf("listing deals: %w", err)
+	}
+
+	// a deal ID can belong to more than one local deal, if a proposal was
+	// retried, so a deal only counts as ended if none of them is live
+	ended := make(map[abi.DealID]struct{})
+	live := make(map[abi.DealID]struct{})
+	for _, deal := range deals {
+		if deal.DealID == 0 {
+			continue
+		}
+		if deal.State == storagemarket.StorageDealExpired || deal.State == storagemarket.StorageDealSlashed || deal.Proposal.EndEpoch < epoch {
+			ended[deal.DealID] = struct{}{}
+		} else {
+			live[deal.DealID] = struct{}{}
+		}
+	}
+	for dealID := range live {
+		delete(ended, dealID)
+	}
+
+	pieceCIDs, err := s.pieceStore.ListPieceInfoKeys()
+	if err != nil {
+		return xerrors.Errorf("listing pieces: %w", err)
+	}
+	removed := 0
+	for _, pieceCID := range pieceCIDs {
+		pi, err := s.pieceStore.GetPieceInfo(pieceCID)
+		if err != nil {
+			return xerrors.Errorf("getting piece %s: %w", pieceCID, err)
+		}
+		for _, di := range pi.Deals {
+			if _, ok := ended[di.DealID]; !ok {
+				continue
+			}
+			if err := s.pieceStore.RemoveDealForPiece(pieceCID, di.DealID); err != nil {
+				return xerrors.Errorf("removing deal %d from piece %s: %w", di.DealID, pieceCID, err)
+			}
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		log.Infof("swept piece store: removed %d ended deals", removed)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package piecesweeper_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin/market"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	piecestoreimpl "github.com/filecoin-project/go-fil-markets/piecestore/impl"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/piecesweeper"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/testnodes"
+)
+
+type fakeProvider struct {
+	storagemarket.StorageProvider
+	deals []storagemarket.MinerDeal
+}
+
+func (p *fakeProvider) ListLocalDeals() ([]storagemarket.MinerDeal, error) {
+	return p.deals, nil
+}
+
+func minerDeal(dealID abi.DealID, state storagemarket.StorageDealStatus, endEpoch abi.ChainEpoch) storagemarket.MinerDeal {
+	return storagemarket.MinerDeal{
+		ClientDealProposal: market.ClientDealProposal{
+			Proposal: market.DealProposal{EndEpoch: endEpoch},
+		},
+		DealID: dealID,
+		State:  state,
+	}
+}
+
+func TestSweep(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ps, err := piecestoreimpl.NewPieceStore(datastore.NewMapDatastore())
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+
+	pieceCIDs := shared_testutil.GenerateCids(4)
+	payloadCIDs := shared_testutil.GenerateCids(4)
+	addPiece := func(pieceCID cid.Cid, payloadCID cid.Cid, dealIDs ...abi.DealID) {
+		require.NoError(t, ps.AddPieceBlockLocations(pieceCID, map[cid.Cid]piecestore.BlockLocation{payloadCID: {}}))
+		for _, dealID := range dealIDs {
+			require.NoError(t, ps.AddDealForPiece(pieceCID, piecestore.DealInfo{DealID: dealID}))
+		}
+	}
+	// a piece whose only deal has expired
+	addPiece(pieceCIDs[0], payloadCIDs[0], 1)
+	// a piece with a slashed deal and a live one
+	addPiece(pieceCIDs[1], payloadCIDs[1], 2, 3)
+	// a piece whose deal is past its end epoch, though the provider has not
+	// seen it expire
+	addPiece(pieceCIDs[2], payloadCIDs[2], 4)
+	// block locations in a piece that is being handed off, whose deal has
+	// not been added yet
+	require.NoError(t, ps.AddPieceBlockLocations(pieceCIDs[3], map[cid.Cid]piecestore.BlockLocation{payloadCIDs[3]: {}}))
+
+	node := &testnodes.FakeProviderNode{
+		FakeCommonNode: testnodes.FakeCommonNode{
+			SMState: testnodes.NewStorageMarketState(),
+		},
+	}
+	node.SMState.Epoch = 100
+	provider := &fakeProvider{deals: []storagemarket.MinerDeal{
+		minerDeal(1, storagemarket.StorageDealExpired, 50),
+		minerDeal(2, storagemarket.StorageDealSlashed, 200),
+		minerDeal(3, storagemarket.StorageDealActive, 200),
+		minerDeal(4, storagemarket.StorageDealActive, 99),
+	}}
+
+	sweeper := piecesweeper.NewSweeper(ps, provider, node)
+	require.NoError(t, sweeper.Sweep(ctx))
+
+	pieces, err := ps.ListPieceInfoKeys()
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{pieceCIDs[1]}, pieces)
+	pi, err := ps.GetPieceInfo(pieceCIDs[1])
+	require.NoError(t, err)
+	require.Equal(t, []piecestore.DealInfo{{DealID: 3}}, pi.Deals)
+
+	payloads, err := ps.ListCidInfoKeys()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []cid.Cid{payloadCIDs[1], payloadCIDs[3]}, payloads)
+
+	// sweeping again finds nothing to remove
+	require.NoError(t, sweeper.Sweep(ctx))
+	pieces, err = ps.ListPieceInfoKeys()
+	require.NoError(t, err)
+	require.Len(t, pieces, 1)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
@@ -28,12 +29,15 @@ import (
 	"github.com/filecoin-project/go-fil-markets/filestore"
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/announcer"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/connmanager"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/dtutils"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerstates"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerutils"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/requestvalidation"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/storedask"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/migrations"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
 )
@@ -62,6 +66,11 @@ type Provider struct {
 	dataTransfer              datatransfer.Manager
 	universalRetrievalEnabled bool
 	customDealDeciderFunc     DealDeciderFunc
+	bandwidthLimiter          *bandwidth.Limiter
+	transfersLk               sync.Mutex
+	transfers                 map[cid.Cid]context.CancelFunc
+	announcer                 *announcer.Announcer
+	askMaintainer             *storedask.AskMaintainer
 	pubSub                    *pubsub.PubSub
 	readyMgr                  *shared.ReadyManager
 
@@ -98,6 +107,30 @@ func CustomDealDecisionLogic(decider DealDeciderFunc) StorageProviderOption {
 	}
 }
 
+// BandwidthLimiter limits the rate at which the provider receives deal data,
+// using the limiter's standard limits
+func BandwidthLimiter(limiter *bandwidth.Limiter) StorageProviderOption {
+	return func(p *Provider) {
+		p.bandwidthLimiter = limiter
+	}
+}
+
+// Announcer makes the provider advertise the payloads in each deal once it has
+// been handed off, and withdraw them when the deal expires or is slashed
+func Announcer(a *announcer.Announcer) StorageProviderOption {
+	return func(p *Provider) {
+		p.announcer = a
+	}
+}
+
+// AskMaintainer makes the provider run the given ask maintainer while it is
+// started, so that its ask is renewed before it expires
+func AskMaintainer(m *storedask.AskMaintainer) StorageProviderOption {
+	return func(p *Provider) {
+		p.askMaintainer = m
+	}
+}
+
 // NewProvider returns a new storage provider
 func NewProvider(net network.StorageMarketNetwork,
 	ds datastore.Batching,
@@ -126,6 +159,7 @@ func NewProvider(net network.StorageMarketNetwork,
 		dataTransfer: dataTransfer,
 		pubSub:       pubsub.New(providerDispatcher),
 		readyMgr:     shared.NewReadyManager(),
+		transfers:    make(map[cid.Cid]context.CancelFunc),
 	}
 	storageMigrations, err := migrations.ProviderMigrations.Build()
 	if err != nil {
@@ -167,6 +201,11 @@ func (p *Provider) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if p.askMaintainer != nil {
+		// the maintainer runs until Stop, so it is not tied to the context
+		// the provider is started with
+		p.askMaintainer.Start(context.Background())
+	}
 	go func() {
 		err := p.start(ctx)
 		if err != nil {
@@ -273,6 +312,9 @@ func (p *Provider) receiveDeal(s network.StorageDealStream) error {
 // Stop terminates processing of deals on a StorageProvider
 func (p *Provider) Stop() error {
 	p.readyMgr.Stop()
+	if p.askMaintainer != nil {
+		p.askMaintainer.Stop()
+	}
 	p.unsubDataTransfer()
 	err := p.deals.Stop(context.TODO())
 	if err != nil {
@@ -567,6 +609,60 @@ func (p *Provider) dispatch(eventName fsm.EventName, deal fsm.StateType) {
 	if err := p.pubSub.Publish(pubSubEvt); err != nil {
 		log.Errorf("failed to publish event %d", evt)
 	}
+
+	if evt == storagemarket.ProviderEventDealExpired || evt == storagemarket.ProviderEventDealSlashed {
+		p.dealEnded(realDeal)
+	}
+
+	switch {
+	case evt == storagemarket.ProviderEventDataTransferCompleted,
+		evt == storagemarket.ProviderEventDataTransferFailed,
+		evt == storagemarket.ProviderEventDataTransferCancelled,
+		evt == storagemarket.ProviderEventDataTransferRestartFailed,
+		realDeal.State == storagemarket.StorageDealFailing,
+		realDeal.State == storagemarket.StorageDealError:
+		p.endTransfer(realDeal.ProposalCid)
+	}
+}
+
+// transferContext returns a context for receiving a deal's data that is
+// cancelled when the transfer ends. A restarted transfer replaces the context
+// of the one before it.
+func (p *Provider) transferContext(proposalCid cid.Cid) context.Context {
+	p.transfersLk.Lock()
+	defer p.transfersLk.Unlock()
+
+	if cancel, ok := p.transfers[proposalCid]; ok {
+		cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.transfers[proposalCid] = cancel
+	return ctx
+}
+
+// endTransfer cancels the context of a deal's transfer
+func (p *Provider) endTransfer(proposalCid cid.Cid) {
+	p.transfersLk.Lock()
+	defer p.transfersLk.Unlock()
+
+	if cancel, ok := p.transfers[proposalCid]; ok {
+		cancel()
+		delete(p.transfers, proposalCid)
+	}
+}
+
+// dealEnded removes a deal that is no longer on chain from the piece store, so
+// that the provider stops offering its data for retrieval, and withdraws the
+// deal's advertisement
+func (p *Provider) dealEnded(deal storagemarket.MinerDeal) {
+	if err := p.pieceStore.RemoveDealForPiece(deal.Proposal.PieceCID, deal.DealID); err != nil {
+		log.Errorf("removing deal %d from piece store: %s", deal.DealID, err)
+	}
+	if p.announcer != nil {
+		if err := p.announcer.Withdraw(context.TODO(), deal.DealID); err != nil {
+			log.Errorf("withdrawing advertisement for deal %d: %s", deal.DealID, err)
+		}
+	}
 }
 
 func (p *Provider) start(ctx context.Context) error {
@@ -15,7 +15,9 @@ import (
 
 	"github.com/filecoin-project/go-fil-markets/filestore"
 	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/shared/bandwidth"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/dtutils"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerstates"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerutils"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
@@ -108,6 +110,13 @@ func (p *providerDealEnvironment) RunCustomDecisionLogic(ctx context.Context, de
 	return p.p.customDealDeciderFunc(ctx, deal)
 }
 
+func (p *providerDealEnvironment) AnnouncePiece(ctx context.Context, deal storagemarket.MinerDeal, payloadCids []cid.Cid) error {
+	if p.p.announcer == nil {
+		return nil
+	}
+	return p.p.announcer.Announce(ctx, deal.DealID, deal.Proposal.PieceCID, payloadCids)
+}
+
 func (p *providerDealEnvironment) TagPeer(id peer.ID, s string) {
 	p.p.net.TagPeer(id, s)
 }
@@ -118,6 +127,9 @@ func (p *providerDealEnvironment) UntagPeer(id peer.ID, s string) {
 
 var _ providerstates.ProviderDealEnvironment = &providerDealEnvironment{}
 
+var _ dtutils.StoreGetter = &providerStoreGetter{}
+var _ dtutils.TransferThrottler = &providerStoreGetter{}
+
 type providerStoreGetter struct {
 	p *Provider
 }
@@ -140,6 +152,18 @@ func (psg *providerStoreGetter) Get(proposalCid cid.Cid) (*multistore.Store, err
 	return psg.p.multiStore.Get(*deal.StoreID)
 }
 
+func (psg *providerStoreGetter) Throttle(proposalCid cid.Cid) (*bandwidth.Transfer, error) {
+	if psg.p.bandwidthLimiter == nil {
+		return nil, nil
+	}
+	var deal storagemarket.MinerDeal
+	err := psg.p.deals.Get(proposalCid).Get(&deal)
+	if err != nil {
+		return nil, err
+	}
+	return psg.p.bandwidthLimiter.NewTransfer(psg.p.transferContext(proposalCid), deal.Client, false), nil
+}
+
 type providerPushDeals struct {
 	p *Provider
 }
@@ -25,6 +25,7 @@ import (
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	storageimpl "github.com/filecoin-project/go-fil-markets/storagemarket/impl"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/storedask"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/migrations"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/testharness/dependencies"
@@ -43,6 +44,37 @@ func TestConfigure(t *testing.T) {
 	assert.True(t, p.UniversalRetrievalEnabled())
 }
 
+func TestProvider_AskMaintainer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	deps := dependencies.NewDependenciesWithTestData(t, ctx, shared_testutil.NewLibp2pTestData(ctx, t), testnodes.NewStorageMarketState(), "",
+		noOpDelay, noOpDelay)
+
+	maintainer := storedask.NewAskMaintainer(deps.StoredAsk, storedask.CheckInterval(10*time.Millisecond))
+	provider, err := storageimpl.NewProvider(
+		network.NewFromLibp2pHost(deps.TestData.Host2, network.RetryParameters(0, 0, 0, 0)),
+		namespace.Wrap(deps.TestData.Ds1, datastore.NewKey("/deals/provider")),
+		deps.Fs,
+		deps.TestData.MultiStore2,
+		deps.PieceStore,
+		deps.DTProvider,
+		deps.ProviderNode,
+		deps.ProviderAddr,
+		deps.StoredAsk,
+		storageimpl.AskMaintainer(maintainer),
+	)
+	require.NoError(t, err)
+
+	// the ask is renewed once its expiry is close
+	seqNo := deps.StoredAsk.GetAsk().Ask.SeqNo
+	deps.ProviderNode.SMState.Epoch = deps.StoredAsk.GetAsk().Ask.Expiry
+	shared_testutil.StartAndWaitForReady(ctx, t, provider)
+	require.Eventually(t, func() bool {
+		return deps.StoredAsk.GetAsk().Ask.SeqNo == seqNo+1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, provider.Stop())
+}
+
 func TestProvider_Migrations(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
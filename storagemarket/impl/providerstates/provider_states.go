@@ -47,6 +47,7 @@ type ProviderDealEnvironment interface {
 	FileStore() filestore.FileStore
 	PieceStore() piecestore.PieceStore
 	RunCustomDecisionLogic(context.Context, storagemarket.MinerDeal) (bool, string, error)
+	AnnouncePiece(ctx context.Context, deal storagemarket.MinerDeal, payloadCids []cid.Cid) error
 	network.PeerTagger
 }
 
@@ -351,7 +352,7 @@ func HandoffDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal stor
 		}
 	}
 
-	if err := recordPiece(environment, deal, packingInfo.SectorNumber, packingInfo.Offset, packingInfo.Size); err != nil {
+	if err := recordPiece(ctx.Context(), environment, deal, packingInfo.SectorNumber, packingInfo.Offset, packingInfo.Size); err != nil {
 		err = xerrors.Errorf("failed to register deal data for piece %s for retrieval: %w", deal.Ref.PieceCid, err)
 		log.Error(err.Error())
 		_ = ctx.Trigger(storagemarket.ProviderEventPieceStoreErrored, err)
@@ -379,7 +380,7 @@ func handoffDeal(ctx context.Context, environment ProviderDealEnvironment, deal
 	)
 }
 
-func recordPiece(environment ProviderDealEnvironment, deal storagemarket.MinerDeal, sectorID abi.SectorNumber, offset, length abi.PaddedPieceSize) error {
+func recordPiece(ctx context.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal, sectorID abi.SectorNumber, offset, length abi.PaddedPieceSize) error {
 
 	var blockLocations map[cid.Cid]piecestore.BlockLocation
 	if deal.MetadataPath != filestore.Path("") {
@@ -394,10 +395,8 @@ func recordPiece(environment ProviderDealEnvironment, deal storagemarket.MinerDe
 		}
 	}
 
-	if err := environment.PieceStore().AddPieceBlockLocations(deal.Proposal.PieceCID, blockLocations); err != nil {
-		return xerrors.Errorf("failed to add piece block locations: %s", err)
-	}
-
+	// add the deal before the block locations, so that removing the piece's
+	// last other deal in the meantime can't remove the locations with it
 	err := environment.PieceStore().AddDealForPiece(deal.Proposal.PieceCID, piecestore.DealInfo{
 		DealID:   deal.DealID,
 		SectorID: sectorID,
@@ -408,6 +407,18 @@ func recordPiece(environment ProviderDealEnvironment, deal storagemarket.MinerDe
 		return xerrors.Errorf("failed to add deal for piece: %s", err)
 	}
 
+	if err := environment.PieceStore().AddPieceBlockLocations(deal.Proposal.PieceCID, blockLocations); err != nil {
+		return xerrors.Errorf("failed to add piece block locations: %s", err)
+	}
+
+	payloadCids := make([]cid.Cid, 0, len(blockLocations))
+	for payloadCid := range blockLocations {
+		payloadCids = append(payloadCids, payloadCid)
+	}
+	if err := environment.AnnouncePiece(ctx, deal, payloadCids); err != nil {
+		log.Warnf("announcing piece %s: %s", deal.Proposal.PieceCID, err)
+	}
+
 	return nil
 }
 
@@ -609,6 +609,7 @@ func TestHandoffDeal(t *testing.T) {
 				require.Len(t, env.node.OnDealCompleteCalls, 1)
 				require.True(t, env.node.OnDealCompleteCalls[0].FastRetrieval)
 				require.True(t, deal.AvailableForRetrieval)
+				require.Equal(t, []cid.Cid{deal.Ref.Root}, env.announcedPayloads)
 			},
 		},
 		"succeed, assemble piece on demand": {
@@ -1439,6 +1440,7 @@ type fakeEnvironment struct {
 	expectedTags                map[string]struct{}
 	receivedTags                map[string]struct{}
 	peerTagger                  *tut.TestPeerTagger
+	announcedPayloads           []cid.Cid
 
 	restartDataTransferCalls []restartDataTransferCall
 	restartDataTransferError error
@@ -1500,6 +1502,11 @@ func (fe *fakeEnvironment) RunCustomDecisionLogic(context.Context, storagemarket
 	return !fe.rejectDeal, fe.rejectReason, fe.decisionError
 }
 
+func (fe *fakeEnvironment) AnnouncePiece(_ context.Context, _ storagemarket.MinerDeal, payloadCids []cid.Cid) error {
+	fe.announcedPayloads = append(fe.announcedPayloads, payloadCids...)
+	return nil
+}
+
 func (fe *fakeEnvironment) TagPeer(id peer.ID, s string) {
 	fe.peerTagger.TagPeer(id, s)
 }
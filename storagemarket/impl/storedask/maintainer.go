@@ -0,0 +1,101 @@
+package storedask
+
+import (
+	"context"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// DefaultCheckInterval is the default frequency with which the ask maintainer
+// checks whether the ask needs to be renewed
+const DefaultCheckInterval = time.Minute
+
+// DefaultRenewBefore is the default number of epochs before the ask expires
+// that the ask maintainer will renew it (one day)
+const DefaultRenewBefore abi.ChainEpoch = 2880
+
+// AskMaintainer periodically renews a StoredAsk in the background, so that
+// the ask never expires and is always signed by the miner's current worker key
+type AskMaintainer struct {
+	storedAsk     *StoredAsk
+	checkInterval time.Duration
+	renewBefore   abi.ChainEpoch
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// AskMaintainerOption allows custom configuration of an AskMaintainer
+type AskMaintainerOption func(m *AskMaintainer)
+
+// CheckInterval sets how often the ask maintainer checks the ask for renewal
+func CheckInterval(interval time.Duration) AskMaintainerOption {
+	return func(m *AskMaintainer) {
+		m.checkInterval = interval
+	}
+}
+
+// RenewBefore sets how many epochs before expiry the ask maintainer renews the ask
+func RenewBefore(epochs abi.ChainEpoch) AskMaintainerOption {
+	return func(m *AskMaintainer) {
+		m.renewBefore = epochs
+	}
+}
+
+// NewAskMaintainer returns a new AskMaintainer for the given StoredAsk
+func NewAskMaintainer(storedAsk *StoredAsk, options ...AskMaintainerOption) *AskMaintainer {
+	m := &AskMaintainer{
+		storedAsk:     storedAsk,
+		checkInterval: DefaultCheckInterval,
+		renewBefore:   DefaultRenewBefore,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Start checks the ask immediately, then begins checking it periodically
+// until Stop is called or the context is cancelled
+func (m *AskMaintainer) Start(ctx context.Context) {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run(ctx)
+}
+
+// Stop halts ask maintenance and waits for the background routine to exit
+func (m *AskMaintainer) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+func (m *AskMaintainer) run(ctx context.Context) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		m.checkAsk(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *AskMaintainer) checkAsk(ctx context.Context) {
+	_, err := m.storedAsk.RenewAsk(ctx, m.renewBefore)
+	if err != nil {
+		log.Errorf("failed to renew storage ask: %s", err)
+	}
+}
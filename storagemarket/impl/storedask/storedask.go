@@ -17,6 +17,7 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/crypto"
 
+	"github.com/filecoin-project/go-fil-markets/shared"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerutils"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/migrations"
@@ -49,6 +50,9 @@ type StoredAsk struct {
 	dsKey datastore.Key
 	spn   storagemarket.StorageProviderNode
 	actor address.Address
+	// signer is the worker address that signed the current ask, or
+	// address.Undef if it is not known (ie the ask was loaded from disk)
+	signer address.Address
 }
 
 // NewStoredAsk returns a new instance of StoredAsk
@@ -63,7 +67,7 @@ func NewStoredAsk(ds datastore.Batching, dsKey datastore.Key, spn storagemarket.
 	}
 
 	askMigrations, err := versioned.BuilderList{
-		versioned.NewVersionedBuilder(migrations.GetMigrateSignedStorageAsk0To1(s.sign), versioning.VersionKey("1")),
+		versioned.NewVersionedBuilder(migrations.GetMigrateSignedStorageAsk0To1(s.signWithCurrentWorker), versioning.VersionKey("1")),
 	}.Build()
 
 	if err != nil {
@@ -112,7 +116,7 @@ func (s *StoredAsk) SetAsk(price abi.TokenAmount, verifiedPrice abi.TokenAmount,
 
 	ctx := context.TODO()
 
-	_, height, err := s.spn.GetChainHead(ctx)
+	tok, height, err := s.spn.GetChainHead(ctx)
 	if err != nil {
 		return err
 	}
@@ -131,24 +135,134 @@ func (s *StoredAsk) SetAsk(price abi.TokenAmount, verifiedPrice abi.TokenAmount,
 		option(ask)
 	}
 
-	sig, err := s.sign(ctx, ask)
+	worker, err := s.spn.GetMinerWorkerAddress(ctx, s.actor, tok)
 	if err != nil {
 		return err
 	}
-	return s.saveAsk(&storagemarket.SignedStorageAsk{
+
+	return s.signAndSave(ctx, ask, worker)
+}
+
+// RenewAsk re-signs the current ask with a new timestamp, expiry and sequence
+// number if it expires within renewBefore epochs of the current chain head, or
+// if the miner's worker address no longer matches the key that signed it.
+// The prices, piece size limits and duration of the ask are preserved.
+// It returns true if the ask was renewed.
+func (s *StoredAsk) RenewAsk(ctx context.Context, renewBefore abi.ChainEpoch) (bool, error) {
+	s.askLk.Lock()
+	defer s.askLk.Unlock()
+
+	if s.ask == nil {
+		return false, nil
+	}
+
+	tok, height, err := s.spn.GetChainHead(ctx)
+	if err != nil {
+		return false, xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	worker, err := s.spn.GetMinerWorkerAddress(ctx, s.actor, tok)
+	if err != nil {
+		return false, xerrors.Errorf("looking up miner worker address: %w", err)
+	}
+
+	signedByWorker, err := s.isSignedBy(ctx, worker, tok)
+	if err != nil {
+		return false, err
+	}
+
+	expiring := height+renewBefore >= s.ask.Ask.Expiry
+	if !expiring && signedByWorker {
+		return false, nil
+	}
+
+	duration := s.ask.Ask.Expiry - s.ask.Ask.Timestamp
+	if duration <= 0 {
+		duration = DefaultDuration
+	}
+
+	ask := *s.ask.Ask
+	ask.Timestamp = height
+	ask.Expiry = height + duration
+	ask.SeqNo = s.ask.Ask.SeqNo + 1
+
+	if err := s.signAndSave(ctx, &ask, worker); err != nil {
+		return false, err
+	}
+
+	log.Infow("renewed storage ask", "seqno", ask.SeqNo, "expiry", ask.Expiry, "worker", worker, "expiring", expiring, "workerChanged", !signedByWorker)
+	return true, nil
+}
+
+// isSignedBy checks if the current ask was signed by the given worker address.
+// must be called with askLk held
+func (s *StoredAsk) isSignedBy(ctx context.Context, worker address.Address, tok shared.TipSetToken) (bool, error) {
+	if s.signer != address.Undef {
+		return s.signer == worker, nil
+	}
+
+	if s.ask.Signature == nil {
+		return false, nil
+	}
+
+	// the signer is not known for an ask that was loaded from disk, so verify
+	// the signature against the worker address
+	msg, err := cborutil.Dump(s.ask.Ask)
+	if err != nil {
+		return false, xerrors.Errorf("serializing ask: %w", err)
+	}
+
+	valid, err := s.spn.VerifySignature(ctx, *s.ask.Signature, worker, msg, tok)
+	if err != nil {
+		return false, xerrors.Errorf("verifying ask signature: %w", err)
+	}
+	if valid {
+		s.signer = worker
+	}
+	return valid, nil
+}
+
+// signAndSave signs the ask with the given worker address and persists it.
+// must be called with askLk held
+func (s *StoredAsk) signAndSave(ctx context.Context, ask *storagemarket.StorageAsk, worker address.Address) error {
+	sig, err := s.sign(ctx, ask, worker)
+	if err != nil {
+		return err
+	}
+
+	err = s.saveAsk(&storagemarket.SignedStorageAsk{
 		Ask:       ask,
 		Signature: sig,
 	})
+	if err != nil {
+		return err
+	}
 
+	s.signer = worker
+	return nil
 }
 
-func (s *StoredAsk) sign(ctx context.Context, ask *storagemarket.StorageAsk) (*crypto.Signature, error) {
+// signWithCurrentWorker signs the ask with the miner's worker address at the
+// current chain head, for migrating asks
+func (s *StoredAsk) signWithCurrentWorker(ctx context.Context, ask *storagemarket.StorageAsk) (*crypto.Signature, error) {
 	tok, _, err := s.spn.GetChainHead(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return providerutils.SignMinerData(ctx, ask, s.actor, tok, s.spn.GetMinerWorkerAddress, s.spn.SignBytes)
+	worker, err := s.spn.GetMinerWorkerAddress(ctx, s.actor, tok)
+	if err != nil {
+		return nil, err
+	}
+	return s.sign(ctx, ask, worker)
+}
+
+// sign signs the ask with the given worker address
+func (s *StoredAsk) sign(ctx context.Context, ask *storagemarket.StorageAsk, worker address.Address) (*crypto.Signature, error) {
+	workerLookup := func(context.Context, address.Address, shared.TipSetToken) (address.Address, error) {
+		return worker, nil
+	}
+	return providerutils.SignMinerData(ctx, ask, s.actor, nil, workerLookup, s.spn.SignBytes)
 }
 
 // GetAsk returns the current signed storage ask, or nil if one does not exist.
@@ -190,6 +304,7 @@ func (s *StoredAsk) loadAsk() error {
 	}
 
 	s.ask = &ssa
+	s.signer = address.Undef
 	return nil
 }
 
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-datastore"
 	dss "github.com/ipfs/go-datastore/sync"
@@ -134,6 +135,114 @@ func TestPieceSizeLimits(t *testing.T) {
 	require.EqualValues(t, newMax, ask.Ask.MaxPieceSize)
 }
 
+func TestRenewAsk(t *testing.T) {
+	ctx := context.Background()
+	actor := address.TestAddress2
+	testPrice := abi.NewTokenAmount(1000000000)
+	testVerifiedPrice := abi.NewTokenAmount(100000000)
+	testDuration := abi.ChainEpoch(200)
+	renewBefore := abi.ChainEpoch(50)
+
+	setup := func(t *testing.T) (*testnodes.FakeProviderNode, *storedask.StoredAsk) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		spn := &testnodes.FakeProviderNode{
+			FakeCommonNode: testnodes.FakeCommonNode{
+				SMState: testnodes.NewStorageMarketState(),
+			},
+			MinerAddr: address.TestAddress,
+		}
+		storedAsk, err := storedask.NewStoredAsk(ds, datastore.NewKey("latest-ask"), spn, actor)
+		require.NoError(t, err)
+		require.NoError(t, storedAsk.SetAsk(testPrice, testVerifiedPrice, testDuration, storagemarket.MinPieceSize(1024)))
+		return spn, storedAsk
+	}
+
+	t.Run("does not renew a valid ask", func(t *testing.T) {
+		spn, storedAsk := setup(t)
+		spn.SMState.Epoch = 100
+		before := storedAsk.GetAsk()
+		renewed, err := storedAsk.RenewAsk(ctx, renewBefore)
+		require.NoError(t, err)
+		require.False(t, renewed)
+		require.Equal(t, before, storedAsk.GetAsk())
+	})
+
+	t.Run("renews an ask close to expiry", func(t *testing.T) {
+		spn, storedAsk := setup(t)
+		before := storedAsk.GetAsk()
+		spn.SMState.Epoch = 160
+		renewed, err := storedAsk.RenewAsk(ctx, renewBefore)
+		require.NoError(t, err)
+		require.True(t, renewed)
+		ask := storedAsk.GetAsk()
+		require.Equal(t, before.Ask.SeqNo+1, ask.Ask.SeqNo)
+		require.Equal(t, abi.ChainEpoch(160), ask.Ask.Timestamp)
+		require.Equal(t, abi.ChainEpoch(160)+testDuration, ask.Ask.Expiry)
+		require.Equal(t, testPrice, ask.Ask.Price)
+		require.Equal(t, testVerifiedPrice, ask.Ask.VerifiedPrice)
+		require.Equal(t, abi.PaddedPieceSize(1024), ask.Ask.MinPieceSize)
+	})
+
+	t.Run("renews an ask when the worker changes", func(t *testing.T) {
+		spn, storedAsk := setup(t)
+		before := storedAsk.GetAsk()
+		spn.MinerAddr = address.TestAddress2
+		renewed, err := storedAsk.RenewAsk(ctx, renewBefore)
+		require.NoError(t, err)
+		require.True(t, renewed)
+		require.Equal(t, before.Ask.SeqNo+1, storedAsk.GetAsk().Ask.SeqNo)
+
+		// does not renew again once signed with the new worker
+		renewed, err = storedAsk.RenewAsk(ctx, renewBefore)
+		require.NoError(t, err)
+		require.False(t, renewed)
+	})
+
+	t.Run("verifies signature of an ask loaded from disk", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		spn := &testnodes.FakeProviderNode{
+			FakeCommonNode: testnodes.FakeCommonNode{
+				SMState: testnodes.NewStorageMarketState(),
+			},
+		}
+		_, err := storedask.NewStoredAsk(ds, datastore.NewKey("latest-ask"), spn, actor)
+		require.NoError(t, err)
+
+		storedAsk, err := storedask.NewStoredAsk(ds, datastore.NewKey("latest-ask"), spn, actor)
+		require.NoError(t, err)
+		renewed, err := storedAsk.RenewAsk(ctx, renewBefore)
+		require.NoError(t, err)
+		require.False(t, renewed)
+
+		spn.VerifySignatureFails = true
+		storedAsk, err = storedask.NewStoredAsk(ds, datastore.NewKey("latest-ask"), spn, actor)
+		require.NoError(t, err)
+		renewed, err = storedAsk.RenewAsk(ctx, renewBefore)
+		require.NoError(t, err)
+		require.True(t, renewed)
+	})
+
+	t.Run("node errors", func(t *testing.T) {
+		spn, storedAsk := setup(t)
+		spn.SMState.Epoch = 160
+		spn.MinerWorkerError = errors.New("something went wrong")
+		_, err := storedAsk.RenewAsk(ctx, renewBefore)
+		require.Error(t, err)
+	})
+
+	t.Run("maintainer renews in background", func(t *testing.T) {
+		spn, storedAsk := setup(t)
+		seqNo := storedAsk.GetAsk().Ask.SeqNo
+		spn.MinerAddr = address.TestAddress2
+		maintainer := storedask.NewAskMaintainer(storedAsk, storedask.CheckInterval(10*time.Millisecond), storedask.RenewBefore(renewBefore))
+		maintainer.Start(ctx)
+		defer maintainer.Stop()
+		require.Eventually(t, func() bool {
+			return storedAsk.GetAsk().Ask.SeqNo == seqNo+1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
 func TestMigrations(t *testing.T) {
 	ctx := context.Background()
 	ds := dss.MutexWrap(datastore.NewMapDatastore())